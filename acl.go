@@ -0,0 +1,229 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Rule represents the users and roles allowed to read a page or path prefix.
+type Rule struct {
+	users map[string]bool
+	roles map[string]bool
+}
+
+func newRule(users, roles []string) Rule {
+	r := Rule{make(map[string]bool), make(map[string]bool)}
+	for _, u := range users {
+		r.users[u] = true
+	}
+	for _, role := range roles {
+		r.roles[role] = true
+	}
+	return r
+}
+
+func (r Rule) allows(username string, roles []string) bool {
+	if r.users[username] {
+		return true
+	}
+	for _, role := range roles {
+		if r.roles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL represents access control rules for pages, keyed by url or url prefix.
+// Built-in rules, set by the server, are checked first, and can't be lifted or relaxed by administrators.
+// Rules set by administrators are persisted as JSON to a file in the data directory, and survive restarts;
+// built-in rules are not.
+type ACL struct {
+	sync.RWMutex
+	builtin map[string]Rule   // prefix => rule set by the server
+	rules   map[string]Rule   // prefix => rule set by administrators
+	saved   map[string]SetACL // prefix => rule set by administrators, persisted
+	path    string            // where saved rules are persisted; "" if they are not
+}
+
+func newACL() *ACL {
+	return &ACL{builtin: make(map[string]Rule), rules: make(map[string]Rule), saved: make(map[string]SetACL)}
+}
+
+// set declares a built-in rule: the users and roles allowed to read pages at or below prefix.
+// If both users and roles are empty, the rule is removed.
+func (acl *ACL) set(prefix string, users, roles []string) {
+	acl.Lock()
+	defer acl.Unlock()
+	if len(users) == 0 && len(roles) == 0 {
+		delete(acl.builtin, prefix)
+		return
+	}
+	acl.builtin[prefix] = newRule(users, roles)
+}
+
+// setLocked sets a rule on behalf of an administrator; if both users and roles are empty, the rule is removed.
+// Must be called under lock.
+func (acl *ACL) setLocked(prefix string, users, roles []string) {
+	if len(users) == 0 && len(roles) == 0 {
+		delete(acl.rules, prefix)
+		return
+	}
+	acl.rules[prefix] = newRule(users, roles)
+}
+
+// open loads the rules persisted at path, and persists rules put from now on there.
+func (acl *ACL) open(path string) error {
+	acl.Lock()
+	acl.path = path
+	acl.Unlock()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var rules []SetACL
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	return acl.load(rules)
+}
+
+// put sets a rule on behalf of an administrator, like setLocked, and persists it.
+func (acl *ACL) put(q SetACL) error {
+	acl.Lock()
+	defer acl.Unlock()
+	old, existed := acl.rules[q.Route]
+	oldSaved, wasSaved := acl.saved[q.Route]
+	acl.setLocked(q.Route, q.Users, q.Roles)
+	if len(q.Users) == 0 && len(q.Roles) == 0 {
+		delete(acl.saved, q.Route)
+	} else {
+		acl.saved[q.Route] = q
+	}
+	if err := acl.save(); err != nil {
+		if existed {
+			acl.rules[q.Route] = old
+		} else {
+			delete(acl.rules, q.Route)
+		}
+		if wasSaved {
+			acl.saved[q.Route] = oldSaved
+		} else {
+			delete(acl.saved, q.Route)
+		}
+		return err
+	}
+	return nil
+}
+
+// load replaces the rules set by administrators with rules, e.g. those of a peer, and persists them.
+func (acl *ACL) load(rules []SetACL) error {
+	acl.Lock()
+	defer acl.Unlock()
+	acl.rules = make(map[string]Rule)
+	acl.saved = make(map[string]SetACL)
+	for _, q := range rules {
+		if len(q.Users) == 0 && len(q.Roles) == 0 {
+			continue
+		}
+		acl.setLocked(q.Route, q.Users, q.Roles)
+		acl.saved[q.Route] = q
+	}
+	return acl.save()
+}
+
+// get returns the rule an administrator set for prefix; it has no users or roles if there is none.
+func (acl *ACL) get(prefix string) SetACL {
+	acl.RLock()
+	defer acl.RUnlock()
+	if q, ok := acl.saved[prefix]; ok {
+		return q
+	}
+	return SetACL{Route: prefix}
+}
+
+// list returns the rules set by administrators, by prefix.
+func (acl *ACL) list() []SetACL {
+	acl.RLock()
+	defer acl.RUnlock()
+	return acl.listLocked()
+}
+
+func (acl *ACL) listLocked() []SetACL {
+	rules := make([]SetACL, 0, len(acl.saved))
+	for _, q := range acl.saved {
+		rules = append(rules, q)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Route < rules[j].Route })
+	return rules
+}
+
+// save persists the rules set by administrators. Must be called under lock.
+func (acl *ACL) save() error {
+	if acl.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(acl.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(acl.path, data)
+}
+
+// matchRule returns the rule for the longest prefix matching url, if any.
+func matchRule(rules map[string]Rule, url string) (Rule, bool) {
+	var (
+		rule  Rule
+		found bool
+		n     = -1
+	)
+	for prefix, r := range rules {
+		if len(prefix) > n && isPathPrefix(prefix, url) {
+			rule, found, n = r, true, len(prefix)
+		}
+	}
+	return rule, found
+}
+
+// allows reports whether the given user may read the page at url: the built-in rule matching url, if any,
+// and the administrators' rule matching it, if any, must both allow it.
+func (acl *ACL) allows(url, username string, roles []string) bool {
+	acl.RLock()
+	defer acl.RUnlock()
+	if rule, ok := matchRule(acl.builtin, url); ok && !rule.allows(username, roles) {
+		return false
+	}
+	if rule, ok := matchRule(acl.rules, url); ok {
+		return rule.allows(username, roles)
+	}
+	return true
+}
+
+// isPathPrefix reports whether url is prefix, or is nested under prefix.
+func isPathPrefix(prefix, url string) bool {
+	if !strings.HasPrefix(url, prefix) {
+		return false
+	}
+	return len(url) == len(prefix) || strings.HasSuffix(prefix, "/") || url[len(prefix)] == '/'
+}
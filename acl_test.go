@@ -0,0 +1,145 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestACLAllows(t *testing.T) {
+	acl := newACL()
+	acl.set("/ops", []string{"alice"}, []string{"sre"})
+	acl.set("/ops/public", nil, []string{"staff"})
+	for _, c := range []struct {
+		url   string
+		user  string
+		roles []string
+		want  bool
+	}{
+		{"/home", "bob", nil, true},
+		{"/ops", "alice", nil, true},
+		{"/ops/db", "bob", []string{"sre"}, true},
+		{"/ops/db", "bob", []string{"staff"}, false},
+		{"/opsx", "bob", nil, true}, // not under /ops
+		{"/ops/public/x", "bob", []string{"staff"}, true},
+		{"/ops/public/x", "alice", nil, false}, // longest prefix wins
+	} {
+		if got := acl.allows(c.url, c.user, c.roles); got != c.want {
+			t.Errorf("allows(%q, %q, %v) = %v, want %v", c.url, c.user, c.roles, got, c.want)
+		}
+	}
+}
+
+func TestACLPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	acl := newACL()
+	acl.set(systemPrefix, nil, []string{systemRole}) // built-in: not persisted
+	if err := acl.open(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []SetACL{{"/ops", nil, []string{"sre"}}, {"/hr", []string{"carol"}, nil}, {"/tmp", []string{"dave"}, nil}} {
+		if err := acl.put(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := acl.put(SetACL{Route: "/tmp"}); err != nil { // lifted
+		t.Fatal(err)
+	}
+
+	restarted := newACL()
+	if err := restarted.open(path); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.allows("/ops/db", "bob", nil) || restarted.allows("/hr", "bob", nil) {
+		t.Error("restrictions lost on restart")
+	}
+	if !restarted.allows("/ops/db", "bob", []string{"sre"}) || !restarted.allows("/hr", "carol", nil) {
+		t.Error("allowed readers lost on restart")
+	}
+	if !restarted.allows("/tmp", "bob", nil) {
+		t.Error("lifted restriction restored on restart")
+	}
+	if rules := restarted.list(); len(rules) != 2 || rules[0].Route != "/hr" || rules[1].Route != "/ops" {
+		t.Errorf("persisted rules: got %+v, want /hr and /ops only", rules)
+	}
+}
+
+func TestACLLoadReplaces(t *testing.T) {
+	acl := newACL()
+	acl.set(systemPrefix, nil, []string{systemRole})
+	acl.put(SetACL{"/stale", nil, []string{"x"}})
+	if err := acl.load([]SetACL{{"/ops", nil, []string{"sre"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.allows("/stale", "bob", nil) {
+		t.Error("rule missing from the peer's rules survived")
+	}
+	if acl.allows("/ops", "bob", nil) {
+		t.Error("peer's rule not applied")
+	}
+	if acl.allows(systemPrefix+"/x", "bob", nil) {
+		t.Error("built-in rule dropped")
+	}
+}
+
+func TestACLBuiltinSurvivesAdmins(t *testing.T) {
+	acl := newACL()
+	acl.set(draftPrefix, nil, []string{draftRole})
+	if err := acl.put(SetACL{draftPrefix, []string{"bob"}, nil}); err != nil {
+		t.Fatal(err)
+	}
+	if acl.allows(draftPrefix+"/x", "bob", nil) {
+		t.Error("administrator's rule relaxed a built-in rule")
+	}
+	if err := acl.put(SetACL{Route: draftPrefix}); err != nil { // cleared
+		t.Fatal(err)
+	}
+	if acl.allows(draftPrefix+"/x", "bob", nil) {
+		t.Error("clearing an administrator's rule lifted a built-in rule")
+	}
+	if err := acl.load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if acl.allows(draftPrefix+"/x", "bob", nil) {
+		t.Error("loading rules lifted a built-in rule")
+	}
+	if !acl.allows(draftPrefix+"/x", "bob", []string{draftRole}) {
+		t.Error("editor denied")
+	}
+}
+
+func TestACLReplicated(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	data, _ := json.Marshal(SetACL{"/ops", nil, []string{"sre"}})
+	if err := b.replicate(Replica{"peer", aclMarker, "/ops", data}); err != nil {
+		t.Fatal(err)
+	}
+	if b.site.acl.allows("/ops", "bob", nil) {
+		t.Error("replicated rule not applied")
+	}
+}
+
+func TestACLSocketPatches(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	b.site.acl.set("/ops", []string{"alice"}, nil)
+	socketPatches(t, b, newRequestLimiter(RateLimits{}), "/ops", "/ops/db", "/home", systemPrefix+"/x")
+	for route, want := range map[string]bool{"/ops": false, "/ops/db": false, "/home": true, systemPrefix + "/x": false} {
+		if got := b.site.at(route) != nil; got != want {
+			t.Errorf("%s: patched %v, want %v", route, got, want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// adminEvery is how often the admin page is refreshed.
+	adminEvery = 5 * time.Second
+	// adminPagesShown is the number of most-watched pages listed on the admin page.
+	adminPagesShown = 25
+)
+
+// ClientInfo represents a connected client, for administration.
+type ClientInfo struct {
+	ID     string   `json:"id"`
+	Addr   string   `json:"addr"`
+	User   string   `json:"user"`
+	Routes []string `json:"routes"`
+	Queued int      `json:"queued"` // messages waiting to be sent
+}
+
+// Subscribers represents the number of clients watching a page.
+type Subscribers struct {
+	Route   string `json:"route"`
+	Clients int    `json:"clients"`
+}
+
+// AdminStatus represents the server's status, for administration.
+type AdminStatus struct {
+	Time       time.Time      `json:"time"`
+	Pages      int            `json:"pages"`
+	PatchRate  float64        `json:"patch_rate"` // patches per second, over the last refresh interval
+	AOFFile    string         `json:"aof_file,omitempty"`
+	AOFBytes   int64          `json:"aof_bytes"`
+	Clients    []ClientInfo   `json:"clients"`
+	Watched    []Subscribers  `json:"watched"` // most-watched first
+	Peers      []PeerStatus   `json:"peers,omitempty"`
+	Dropped    int64          `json:"dropped_clients"`
+	AuthFailed int64          `json:"auth_failures"`
+	License    *LicenseStatus `json:"license,omitempty"`
+}
+
+// call runs f in the broker loop, and waits for it to return.
+func (b *Broker) call(f func()) {
+	done := make(chan struct{})
+	b.calls <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+// census lists the clients watching pages, and the number of clients watching each page.
+func (b *Broker) census() ([]ClientInfo, []Subscribers) {
+	clients, watched := []ClientInfo{}, []Subscribers{}
+	b.call(func() {
+		seen := make(map[*Client]bool)
+		for route, cs := range b.clients {
+			watched = append(watched, Subscribers{route, cs.len()})
+			cs.each(func(c *Client) {
+				if seen[c] {
+					return
+				}
+				seen[c] = true
+				clients = append(clients, ClientInfo{c.id, c.addr, c.username, append([]string(nil), c.routes...), c.queue.len()})
+			})
+		}
+	})
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	sort.Slice(watched, func(i, j int) bool {
+		if watched[i].Clients != watched[j].Clients {
+			return watched[i].Clients > watched[j].Clients
+		}
+		return watched[i].Route < watched[j].Route
+	})
+	return clients, watched
+}
+
+// kick disconnects a client; returns false if no client watching pages has the given id.
+func (b *Broker) kick(id string) bool {
+	var found *Client
+	b.call(func() {
+		for _, cs := range b.clients {
+			cs.each(func(c *Client) {
+				if c.id == id {
+					found = c
+				}
+			})
+			if found != nil {
+				return
+			}
+		}
+	})
+	if found == nil {
+		return false
+	}
+	// Closing the connection ends the client's listener, which unsubscribes the client as usual.
+	found.conn.Close()
+	echo(Log{"t": "client_kick", "client": id, "addr": found.addr})
+	return true
+}
+
+// Admin tracks the server's status for the admin page and API.
+type Admin struct {
+	sync.Mutex
+	broker  *Broker
+	patches int64     // patches applied, as of the last refresh
+	at      time.Time // time of the last refresh
+	rate    float64   // patches per second, as of the last refresh
+}
+
+func newAdmin(broker *Broker) *Admin {
+	return &Admin{sync.Mutex{}, broker, atomic.LoadInt64(&stats.patches), clock.Now(), 0}
+}
+
+// refresh recomputes the patch rate, and republishes the admin page.
+func (a *Admin) refresh() {
+	now := clock.Now()
+	patches := atomic.LoadInt64(&stats.patches)
+	a.Lock()
+	if dt := now.Sub(a.at).Seconds(); dt > 0 {
+		a.rate = float64(patches-a.patches) / dt
+	}
+	a.patches, a.at = patches, now
+	a.Unlock()
+	a.publish(a.status())
+}
+
+// run refreshes the admin page periodically.
+func (a *Admin) run() {
+	a.refresh()
+	t := clock.NewTicker(adminEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C():
+		case <-a.broker.quit:
+			return
+		}
+		a.refresh()
+	}
+}
+
+func (a *Admin) status() AdminStatus {
+	a.Lock()
+	rate := a.rate
+	a.Unlock()
+	clients, watched := a.broker.census()
+	s := AdminStatus{
+		Time:       clock.Now(),
+		Pages:      len(a.broker.site.urls()),
+		PatchRate:  rate,
+		AOFBytes:   atomic.LoadInt64(&stats.aofBytes),
+		Clients:    clients,
+		Watched:    watched,
+		Dropped:    atomic.LoadInt64(&stats.droppedClients),
+		AuthFailed: atomic.LoadInt64(&stats.authFailures),
+		License:    licensing.status(),
+	}
+	if aof != nil {
+		s.AOFFile, s.AOFBytes = aof.status()
+	}
+	if cluster != nil {
+		s.Peers = cluster.status()
+	}
+	return s
+}
+
+func (a *Admin) publish(s AdminStatus) {
+	var clients strings.Builder
+	clients.WriteString("| ID | Address | User | Pages | Queued |\n")
+	clients.WriteString("|---|---|---|---|---|\n")
+	for _, c := range s.Clients {
+		fmt.Fprintf(&clients, "| %s | %s | %s | %s | %d |\n", c.ID, c.Addr, c.User, strings.Join(c.Routes, ", "), c.Queued)
+	}
+	var watched strings.Builder
+	watched.WriteString("| Page | Clients |\n")
+	watched.WriteString("|---|---|\n")
+	for i, w := range s.Watched {
+		if i == adminPagesShown {
+			break
+		}
+		fmt.Fprintf(&watched, "| %s | %d |\n", w.Route, w.Clients)
+	}
+	peers := "Not clustered."
+	if len(s.Peers) > 0 {
+		var sb strings.Builder
+		sb.WriteString("| Peer | Queued | Sent | Error |\n")
+		sb.WriteString("|---|---|---|---|\n")
+		for _, p := range s.Peers {
+			fmt.Fprintf(&sb, "| %s | %d | %d | %s |\n", p.URL, p.Queued, p.Sent, strings.ReplaceAll(p.Error, "|", "\\|"))
+		}
+		peers = sb.String()
+	}
+	stat := func(box, title, value string) map[string]interface{} {
+		return map[string]interface{}{"view": "small_stat", "box": box, "title": title, "value": value}
+	}
+	table := func(box, title, content string) map[string]interface{} {
+		return map[string]interface{}{"view": "markdown", "box": box, "title": title, "content": content}
+	}
+	data, err := json.Marshal(OpsD{D: []OpD{
+		{K: "clients_count", D: stat("1 1 2 1", "Clients", fmt.Sprintf("%d", len(s.Clients)))},
+		{K: "pages_count", D: stat("3 1 2 1", "Pages", fmt.Sprintf("%d", s.Pages))},
+		{K: "patch_rate", D: stat("5 1 2 1", "Patches/s", fmt.Sprintf("%.1f", s.PatchRate))},
+		{K: "aof_size", D: stat("7 1 2 1", "AOF bytes", fmt.Sprintf("%d", s.AOFBytes))},
+		{K: "dropped", D: stat("9 1 2 1", "Dropped clients", fmt.Sprintf("%d", s.Dropped))},
+		{K: "updated", D: stat("11 1 2 1", "Updated", s.Time.Format("15:04:05"))},
+		{K: "clients", D: table("1 2 8 6", "Clients", clients.String())},
+		{K: "watched", D: table("9 2 4 6", "Most watched pages", watched.String())},
+		{K: "peers", D: table("1 8 12 3", "Peers", peers)},
+	}})
+	if err != nil {
+		echo(Log{"t": "admin_publish", "error": err.Error()})
+		return
+	}
+	b := a.broker
+	b.pubMux.Lock()
+	defer b.pubMux.Unlock()
+	seq := nextSeq()
+	if err := b.site.patch(adminURL, data, seq); err != nil {
+		echo(Log{"t": "admin_publish", "error": err.Error()})
+		return
+	}
+	b.publish <- Pub{adminURL, data, context.Background(), seq}
+}
+
+// AdminHandler serves the administration API for administrators:
+// GET reports the server's status, DELETE ?client= disconnects a client, and DELETE ?page= removes a page.
+type AdminHandler struct {
+	admin *Admin
+	auth  *Auth
+}
+
+func newAdminHandler(admin *Admin, auth *Auth) *AdminHandler {
+	return &AdminHandler{admin, auth}
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, ok := h.auth.trusted(r)
+	if !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(h.admin.status())
+	case http.MethodDelete:
+		q := r.URL.Query()
+		if id := q.Get("client"); id != "" {
+			if !h.admin.broker.kick(id) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			}
+			return
+		}
+		if url := q.Get("page"); url != "" {
+			if h.admin.broker.site.peek(url) == nil {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			h.admin.broker.deleteIf(withWriter(withRemote(r.Context(), getRemoteAddr(r)), username, "admin"), url, nil)
+			echo(Log{"t": "admin_delete_page", "route": url})
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,431 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Usage tracking privacy levels.
+const (
+	AnalyticsOff        = "off"        // don't track usage
+	AnalyticsCounts     = "counts"     // count views and publishes only
+	AnalyticsAnonymous  = "anonymous"  // also count distinct viewers and publishers, identified by salted hashes
+	AnalyticsIdentified = "identified" // also record who viewed and published, by username
+)
+
+const (
+	analyticsSaveEvery     = time.Minute
+	defaultAnalyticsDays   = 90
+	analyticsDayFormat     = "2006-01-02"
+	defaultAnalyticsWindow = 30 // days reported unless specified
+)
+
+// AnalyticsConf represents usage tracking settings.
+type AnalyticsConf struct {
+	Privacy   string // AnalyticsOff (default), AnalyticsCounts, AnalyticsAnonymous or AnalyticsIdentified
+	Retention int    // days of usage kept; 0 = 90
+}
+
+func (c AnalyticsConf) validate() error {
+	switch c.Privacy {
+	case "", AnalyticsOff, AnalyticsCounts, AnalyticsAnonymous, AnalyticsIdentified:
+	default:
+		return fmt.Errorf("unknown analytics privacy level %q: want %s, %s, %s or %s", c.Privacy, AnalyticsOff, AnalyticsCounts, AnalyticsAnonymous, AnalyticsIdentified)
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("analytics retention must not be negative")
+	}
+	return nil
+}
+
+// enabled reports whether usage is tracked.
+func (c AnalyticsConf) enabled() bool {
+	return c.Privacy != "" && c.Privacy != AnalyticsOff
+}
+
+// DayUsage represents a route's usage on a day (UTC).
+type DayUsage struct {
+	Views      int             `json:"views"`
+	Viewers    map[string]bool `json:"viewers,omitempty"` // viewer IDs, as per privacy level
+	Publishes  int             `json:"publishes"`
+	Publishers map[string]bool `json:"publishers,omitempty"` // publisher IDs, as per privacy level
+}
+
+// RouteUsage represents a route's usage over time.
+type RouteUsage struct {
+	Days          map[string]*DayUsage `json:"days"` // day => usage
+	LastViewed    *time.Time           `json:"last_viewed,omitempty"`
+	LastPublished *time.Time           `json:"last_published,omitempty"`
+}
+
+// Analytics tracks page views and publisher activity per route, persisted as JSON to a file in the data directory.
+type Analytics struct {
+	sync.Mutex
+	path    string
+	conf    AnalyticsConf
+	salt    string                 // for hashing IDs at the anonymous privacy level
+	routes  map[string]*RouteUsage // route => usage
+	dirty   bool                   // changed since last saved
+	trimmed string                 // day usage was last trimmed to retention
+}
+
+var analytics *Analytics // nil unless tracking usage
+
+// analyticsFile represents the persisted state of Analytics.
+type analyticsFile struct {
+	Salt   string                 `json:"salt"`
+	Routes map[string]*RouteUsage `json:"routes"`
+}
+
+func newAnalytics(path string, conf AnalyticsConf) *Analytics {
+	if conf.Retention == 0 {
+		conf.Retention = defaultAnalyticsDays
+	}
+	a := &Analytics{path: path, conf: conf, routes: make(map[string]*RouteUsage)}
+	if err := a.load(); err != nil {
+		echo(Log{"t": "analytics_load", "path": path, "error": err.Error()})
+	}
+	if a.salt == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		a.salt = hex.EncodeToString(b)
+		a.dirty = true
+	}
+	return a
+}
+
+func (a *Analytics) load() error {
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var f analyticsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	if f.Routes != nil {
+		a.routes = f.Routes
+	}
+	a.salt = f.Salt
+	return nil
+}
+
+// save persists usage. Must be called under lock.
+func (a *Analytics) save() error {
+	data, err := json.Marshal(analyticsFile{a.salt, a.routes})
+	if err != nil {
+		return err
+	}
+	return writeFile(a.path, data)
+}
+
+// run periodically persists usage, discarding days past retention, until quit is closed.
+func (a *Analytics) run(quit <-chan struct{}) {
+	t := clock.NewTicker(analyticsSaveEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C():
+			a.flush()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// flush persists usage if changed.
+func (a *Analytics) flush() {
+	a.Lock()
+	defer a.Unlock()
+	a.trim()
+	if !a.dirty {
+		return
+	}
+	if err := a.save(); err != nil {
+		echo(Log{"t": "analytics_save", "path": a.path, "error": err.Error()})
+		return
+	}
+	a.dirty = false
+}
+
+// trim discards usage older than the retention period, once a day. Must be called under lock.
+func (a *Analytics) trim() {
+	today := clock.Now().UTC().Format(analyticsDayFormat)
+	if a.trimmed == today {
+		return
+	}
+	a.trimmed = today
+	oldest := clock.Now().UTC().AddDate(0, 0, 1-a.conf.Retention).Format(analyticsDayFormat)
+	for route, u := range a.routes {
+		for day := range u.Days {
+			if day < oldest {
+				delete(u.Days, day)
+				a.dirty = true
+			}
+		}
+		if len(u.Days) == 0 {
+			delete(a.routes, route)
+		}
+	}
+}
+
+// id returns how a viewer or publisher is recorded at the configured privacy level; "" if not recorded.
+func (a *Analytics) id(who string) string {
+	switch a.conf.Privacy {
+	case AnalyticsAnonymous:
+		h := sha256.Sum256([]byte(a.salt + who))
+		return hex.EncodeToString(h[:8])
+	case AnalyticsIdentified:
+		return who
+	}
+	return ""
+}
+
+// day returns a route's usage for today, creating it if necessary. Must be called under lock.
+func (a *Analytics) day(route string, now time.Time) (*RouteUsage, *DayUsage) {
+	u, ok := a.routes[route]
+	if !ok {
+		u = &RouteUsage{Days: make(map[string]*DayUsage)}
+		a.routes[route] = u
+	}
+	key := now.UTC().Format(analyticsDayFormat)
+	d, ok := u.Days[key]
+	if !ok {
+		d = &DayUsage{}
+		u.Days[key] = d
+	}
+	a.dirty = true
+	return u, d
+}
+
+// viewed records a view of a route by who (a username, or an address for anonymous users).
+func (a *Analytics) viewed(route, who string) {
+	if isPathPrefix(systemPrefix, route) {
+		return
+	}
+	now := clock.Now()
+	a.Lock()
+	defer a.Unlock()
+	u, d := a.day(route, now)
+	d.Views++
+	if id := a.id(who); id != "" {
+		if d.Viewers == nil {
+			d.Viewers = make(map[string]bool)
+		}
+		d.Viewers[id] = true
+	}
+	u.LastViewed = &now
+}
+
+// recordPublished counts a patch published on the broker's bus against its writer.
+// Patches replicated from peers are counted by the peer they were made on.
+func recordPublished(e Event) {
+	if analytics == nil || e.Change != changePatch {
+		return
+	}
+	w := writerFrom(e.Ctx)
+	if w.Via == viaPeer {
+		return
+	}
+	if w.By == "" {
+		w.By = w.Via
+	}
+	analytics.published(e.Route, w.By)
+}
+
+// published records a change to a route by who.
+func (a *Analytics) published(route, who string) {
+	if isPathPrefix(systemPrefix, route) {
+		return
+	}
+	now := clock.Now()
+	a.Lock()
+	defer a.Unlock()
+	u, d := a.day(route, now)
+	d.Publishes++
+	if id := a.id(who); id != "" {
+		if d.Publishers == nil {
+			d.Publishers = make(map[string]bool)
+		}
+		d.Publishers[id] = true
+	}
+	u.LastPublished = &now
+}
+
+// RouteReport represents a route's usage over a reporting period.
+type RouteReport struct {
+	Route          string      `json:"route"`
+	Exists         bool        `json:"exists"` // the route currently has a page
+	Views          int         `json:"views"`
+	Viewers        int         `json:"viewers"` // distinct; 0 at the counts privacy level
+	Publishes      int         `json:"publishes"`
+	Publishers     int         `json:"publishers"` // distinct; 0 at the counts privacy level
+	LastViewed     *time.Time  `json:"last_viewed,omitempty"`
+	LastPublished  *time.Time  `json:"last_published,omitempty"`
+	ViewerNames    []string    `json:"viewer_names,omitempty"`    // identified privacy level only
+	PublisherNames []string    `json:"publisher_names,omitempty"` // identified privacy level only
+	Daily          []DayReport `json:"daily,omitempty"`           // if requested
+}
+
+// DayReport represents a route's usage on a day.
+type DayReport struct {
+	Day        string `json:"day"`
+	Views      int    `json:"views"`
+	Viewers    int    `json:"viewers"`
+	Publishes  int    `json:"publishes"`
+	Publishers int    `json:"publishers"`
+}
+
+// UsageReport represents usage across routes, least viewed first.
+type UsageReport struct {
+	Since   string        `json:"since"` // first day reported
+	Privacy string        `json:"privacy"`
+	Routes  []RouteReport `json:"routes"`
+}
+
+// report summarizes usage of pages and routes at or below prefix over the last days, including existing pages
+// that were never viewed. If unused is set, only routes not viewed during the period are reported.
+func (a *Analytics) report(site *Site, prefix string, days int, unused, daily bool) UsageReport {
+	since := clock.Now().UTC().AddDate(0, 0, 1-days).Format(analyticsDayFormat)
+	exists := make(map[string]bool)
+	for _, url := range site.snapshotURLs() {
+		if isPathPrefix(prefix, url) {
+			exists[url] = true
+		}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	routes := make(map[string]bool)
+	for url := range exists {
+		routes[url] = true
+	}
+	for route := range a.routes {
+		if isPathPrefix(prefix, route) {
+			routes[route] = true
+		}
+	}
+
+	r := UsageReport{Since: since, Privacy: a.conf.Privacy, Routes: []RouteReport{}}
+	for route := range routes {
+		rr := RouteReport{Route: route, Exists: exists[route]}
+		if u, ok := a.routes[route]; ok {
+			rr.LastViewed, rr.LastPublished = u.LastViewed, u.LastPublished
+			viewers, publishers := make(map[string]bool), make(map[string]bool)
+			for day, d := range u.Days {
+				if day < since {
+					continue
+				}
+				rr.Views += d.Views
+				rr.Publishes += d.Publishes
+				for id := range d.Viewers {
+					viewers[id] = true
+				}
+				for id := range d.Publishers {
+					publishers[id] = true
+				}
+				if daily {
+					rr.Daily = append(rr.Daily, DayReport{day, d.Views, len(d.Viewers), d.Publishes, len(d.Publishers)})
+				}
+			}
+			rr.Viewers, rr.Publishers = len(viewers), len(publishers)
+			if a.conf.Privacy == AnalyticsIdentified {
+				rr.ViewerNames, rr.PublisherNames = sortedKeys(viewers), sortedKeys(publishers)
+			}
+			sort.Slice(rr.Daily, func(i, j int) bool { return rr.Daily[i].Day < rr.Daily[j].Day })
+		}
+		if unused && rr.Views > 0 {
+			continue
+		}
+		r.Routes = append(r.Routes, rr)
+	}
+	sort.Slice(r.Routes, func(i, j int) bool {
+		x, y := r.Routes[i], r.Routes[j]
+		if x.Views != y.Views {
+			return x.Views < y.Views
+		}
+		return x.Route < y.Route
+	})
+	return r
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// AnalyticsHandler reports usage to administrators:
+// GET /_admin/analytics?prefix=/foo&days=30&unused=1&daily=1.
+type AnalyticsHandler struct {
+	site *Site
+	auth *Auth
+}
+
+func newAnalyticsHandler(site *Site, auth *Auth) *AnalyticsHandler {
+	return &AnalyticsHandler{site, auth}
+}
+
+func (h *AnalyticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth.trusted(r); !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if analytics == nil {
+		http.Error(w, "usage tracking is off", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	if prefix == "" {
+		prefix = "/"
+	}
+	days := defaultAnalyticsWindow
+	if s := q.Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	unused, _ := strconv.ParseBool(q.Get("unused"))
+	daily, _ := strconv.ParseBool(q.Get("daily"))
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(analytics.report(h.site, prefix, days, unused, daily))
+}
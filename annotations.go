@@ -0,0 +1,277 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Annotation represents a label attached to a point or range in time (a deploy marker, an incident window, etc.),
+// on a page or on a specific card.
+type Annotation struct {
+	ID      string     `json:"id"`
+	Route   string     `json:"route"`
+	Card    string     `json:"card,omitempty"` // card name; empty if page-wide
+	Label   string     `json:"label,omitempty"`
+	Tags    []string   `json:"tags,omitempty"`
+	Start   time.Time  `json:"start"`
+	End     *time.Time `json:"end,omitempty"` // nil for point-in-time annotations
+	Author  string     `json:"author,omitempty"`
+	Created time.Time  `json:"created"`
+	Deleted bool       `json:"deleted,omitempty"` // set only when broadcasting deletions
+}
+
+// overlaps reports whether the annotation intersects [from, to]; zero times are unbounded.
+func (a *Annotation) overlaps(from, to time.Time) bool {
+	end := a.Start
+	if a.End != nil {
+		end = *a.End
+	}
+	return (from.IsZero() || !end.Before(from)) && (to.IsZero() || !a.Start.After(to))
+}
+
+// Annotations holds annotations for all pages, persisted as JSON to a file in the data directory.
+type Annotations struct {
+	sync.RWMutex
+	path  string                 // "" = not persisted
+	items map[string]*Annotation // id => annotation
+}
+
+func newAnnotations(path string) *Annotations {
+	a := &Annotations{path: path, items: make(map[string]*Annotation)}
+	if err := a.load(); err != nil {
+		echo(Log{"t": "annotations_load", "path": path, "error": err.Error()})
+	}
+	return a
+}
+
+func (a *Annotations) load() error {
+	if a.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var items []*Annotation
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	for _, x := range items {
+		a.items[x.ID] = x
+	}
+	return nil
+}
+
+// save persists annotations. Must be called under lock.
+func (a *Annotations) save() error {
+	if a.path == "" {
+		return nil
+	}
+	items := make([]*Annotation, 0, len(a.items))
+	for _, x := range a.items {
+		items = append(items, x)
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return writeFile(a.path, data)
+}
+
+func (a *Annotations) put(x *Annotation) error {
+	a.Lock()
+	defer a.Unlock()
+	a.items[x.ID] = x
+	return a.save()
+}
+
+func (a *Annotations) del(id string) (*Annotation, error) {
+	a.Lock()
+	defer a.Unlock()
+	x, ok := a.items[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(a.items, id)
+	return x, a.save()
+}
+
+// list returns the annotations for a route (and card, if not empty) overlapping [from, to], ordered by start time.
+func (a *Annotations) list(route, card string, from, to time.Time) []*Annotation {
+	a.RLock()
+	defer a.RUnlock()
+	items := make([]*Annotation, 0)
+	for _, x := range a.items {
+		if x.Route == route && (card == "" || x.Card == card) && x.overlaps(from, to) {
+			items = append(items, x)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Start.Before(items[j].Start) })
+	return items
+}
+
+// annotate records an annotation, and broadcasts it to the page's clients.
+func (b *Broker) annotate(x *Annotation) error {
+	if err := b.site.annotations.put(x); err != nil {
+		return err
+	}
+	b.broadcastAnnotations(x.Route, []*Annotation{x})
+	return nil
+}
+
+// unannotate deletes an annotation, and broadcasts its deletion to the page's clients.
+func (b *Broker) unannotate(id string) (bool, error) {
+	x, err := b.site.annotations.del(id)
+	if x == nil {
+		return false, err
+	}
+	b.broadcastAnnotations(x.Route, []*Annotation{{ID: x.ID, Route: x.Route, Card: x.Card, Deleted: true}})
+	return true, err
+}
+
+func (b *Broker) broadcastAnnotations(route string, xs []*Annotation) {
+	data, err := json.Marshal(OpsD{A: xs})
+	if err != nil {
+		echo(Log{"t": "annotations_marshal", "error": err.Error()})
+		return
+	}
+	b.broadcast(route, data)
+}
+
+// AnnotationHandler serves the annotations API:
+// GET lists annotations (?route=&card=&from=&to=, times in RFC 3339),
+// POST records an annotation, and DELETE removes one (?id=). Writes require an access key.
+type AnnotationHandler struct {
+	broker *Broker
+	auth   *Auth
+}
+
+func newAnnotationHandler(broker *Broker, auth *Auth) *AnnotationHandler {
+	return &AnnotationHandler{broker, auth}
+}
+
+func parseTimeParam(r *http.Request, k string) (time.Time, error) {
+	v := r.URL.Query().Get(k)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func (h *AnnotationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	viewer, ok := h.auth.identify(r)
+	if !ok && h.auth.oidcEnabled {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if !ok {
+		viewer.username = "default-user"
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		route := q.Get("route")
+		if !viewer.trusted && !h.broker.site.acl.allows(route, viewer.username, viewer.roles) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		from, err := parseTimeParam(r, "from")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: from: %v", http.StatusText(http.StatusBadRequest), err), http.StatusBadRequest)
+			return
+		}
+		to, err := parseTimeParam(r, "to")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: to: %v", http.StatusText(http.StatusBadRequest), err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(h.broker.site.annotations.list(route, q.Get("card"), from, to))
+	case http.MethodPost:
+		if !viewer.trusted {
+			stats.authFailed()
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		var x Annotation
+		if err := json.NewDecoder(r.Body).Decode(&x); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if err := validateAnnotation(&x); err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(http.StatusBadRequest), err), http.StatusBadRequest)
+			return
+		}
+		if x.ID == "" {
+			x.ID = uuid.New().String()
+		}
+		x.Author = viewer.username
+		x.Created = clock.Now()
+		x.Deleted = false
+		if err := h.broker.annotate(&x); err != nil {
+			echo(Log{"t": "annotation_put", "route": x.Route, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(&x)
+	case http.MethodDelete:
+		if !viewer.trusted {
+			stats.authFailed()
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		found, err := h.broker.unannotate(r.URL.Query().Get("id"))
+		if err != nil {
+			echo(Log{"t": "annotation_del", "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func validateAnnotation(x *Annotation) error {
+	if x.Route == "" {
+		return errors.New("want route")
+	}
+	if x.Start.IsZero() {
+		return errors.New("want start time")
+	}
+	if x.End != nil && x.End.Before(x.Start) {
+		return errors.New("end time precedes start time")
+	}
+	return nil
+}
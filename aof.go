@@ -0,0 +1,301 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AOF entry markers.
+const (
+	patchMarker   = "*" // patch existing page
+	compactMarker = "=" // compacted page; overwrite
+	deleteMarker  = "-" // delete page
+	commentMarker = "#" // comment; ignored on replay
+)
+
+// AOF durability policies.
+const (
+	fsyncAlways   = "always"   // sync after every entry
+	fsyncInterval = "interval" // sync every FsyncInterval
+	fsyncNever    = "never"    // leave syncing to the OS
+)
+
+const (
+	aofSegmentLayout = "20060102T150405.000000000" // segment file name timestamps; sortable
+	checkpointSuffix = "-checkpoint.aof"           // segments that start with a compacted copy of the site
+)
+
+// AOFConf represents append-only log settings.
+type AOFConf struct {
+	Dir           string        // write entries to rotated segments in this directory; if empty, to the standard logger's output
+	MaxBytes      int64         // start a new segment once the current one grows beyond this size; 0 = never
+	MaxAge        time.Duration // start a new segment once the current one is older than this; 0 = never
+	Fsync         string        // always, interval or never
+	FsyncInterval time.Duration // sync period for the interval policy
+	Archive       ArchiveConf   // object storage for segments superseded by checkpoints
+}
+
+func (c AOFConf) validate() error {
+	switch c.Fsync {
+	case "", fsyncAlways, fsyncInterval, fsyncNever:
+		return nil
+	}
+	return fmt.Errorf("unknown fsync policy %q: want always, interval or never", c.Fsync)
+}
+
+// AOF writes entries to rotated segment files in a directory.
+type AOF struct {
+	sync.Mutex
+	conf   AOFConf
+	file   *os.File
+	logger *log.Logger
+	size   int64     // bytes written to the current segment
+	opened time.Time // when the current segment was created
+	dirty  bool      // written to since the last sync
+	quit   chan struct{}
+}
+
+var aof *AOF // nil if entries are written to the standard logger's output
+
+// openAOF directs AOF entries to segment files as per conf. The last segment left behind by a previous run,
+// if any, is truncated to its last complete entry, and a new segment is started.
+func openAOF(conf AOFConf) (*AOF, error) {
+	if conf.Fsync == "" {
+		conf.Fsync = fsyncInterval
+	}
+	if conf.FsyncInterval <= 0 {
+		conf.FsyncInterval = time.Second
+	}
+	if err := os.MkdirAll(conf.Dir, 0700); err != nil {
+		return nil, err
+	}
+	segments, err := aofSegments(conf.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateAOF(conf.Dir); err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		if err := repairAOF(segments[len(segments)-1]); err != nil {
+			return nil, err
+		}
+	}
+	a := &AOF{conf: conf, quit: make(chan struct{})}
+	if err := a.rotate(); err != nil {
+		return nil, err
+	}
+	if conf.Fsync == fsyncInterval {
+		go a.syncEvery(conf.FsyncInterval)
+	}
+	return a, nil
+}
+
+// repairAOF truncates a segment to its last complete entry.
+func repairAOF(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return nil
+	}
+	// Scan backwards for the last newline.
+	const chunk = 64 * 1024
+	buf := make([]byte, chunk)
+	end := size
+	for end > 0 {
+		start := end - chunk
+		if start < 0 {
+			start = 0
+		}
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if end == size {
+		return nil
+	}
+	warn(Log{"t": "aof_repair", "file": path, "truncated": fmt.Sprint(size - end)})
+	return f.Truncate(end)
+}
+
+// rotate starts a new segment. Must be called under lock.
+func (a *AOF) rotate() error {
+	return a.rotateTo("site-" + clock.Now().UTC().Format(aofSegmentLayout) + ".aof")
+}
+
+func (a *AOF) rotateTo(name string) error {
+	now := clock.Now()
+	path := filepath.Join(a.conf.Dir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if a.file != nil {
+		a.file.Sync()
+		a.file.Close()
+	}
+	a.file, a.logger, a.size, a.opened, a.dirty = f, log.New(f, "", log.LstdFlags), 0, now, false
+	if err := writeAOFHeader(a.logger, aofFormat); err != nil {
+		return err
+	}
+	echo(Log{"t": "aof_segment", "file": path})
+	return nil
+}
+
+func (a *AOF) append(marker, url string, data []byte) {
+	a.Lock()
+	defer a.Unlock()
+	if (a.conf.MaxBytes > 0 && a.size >= a.conf.MaxBytes) || (a.conf.MaxAge > 0 && clock.Now().Sub(a.opened) >= a.conf.MaxAge) {
+		if err := a.rotate(); err != nil {
+			echo(Log{"t": "aof_rotate", "error": err.Error()})
+		}
+	}
+	n := len(aofTimeLayout) + len(marker) + len(url) + len(data) + 4 // separators, newline
+	if err := a.logger.Output(2, marker+" "+url+" "+string(data)); err != nil {
+		echo(Log{"t": "aof_append", "error": err.Error()})
+		return
+	}
+	a.size += int64(n)
+	if a.conf.Fsync == fsyncAlways {
+		if err := a.file.Sync(); err != nil {
+			echo(Log{"t": "aof_sync", "error": err.Error()})
+		}
+	} else {
+		a.dirty = true
+	}
+}
+
+// checkpoint starts a new segment, marked as a checkpoint, and has write fill it with a compacted copy of the site.
+// Page changes must be blocked until checkpoint returns.
+func (a *AOF) checkpoint(write func(*log.Logger)) error {
+	a.Lock()
+	defer a.Unlock()
+	if err := a.rotateTo("site-" + clock.Now().UTC().Format(aofSegmentLayout) + checkpointSuffix); err != nil {
+		return err
+	}
+	write(a.logger)
+	if fi, err := a.file.Stat(); err == nil {
+		a.size = fi.Size()
+	}
+	return a.file.Sync()
+}
+
+// superseded returns the segments that precede the latest checkpoint and were last written before t, oldest first.
+func (a *AOF) superseded(t time.Time) ([]string, error) {
+	segments, err := aofSegments(a.conf.Dir)
+	if err != nil {
+		return nil, err
+	}
+	last := -1
+	for i, s := range segments {
+		if strings.HasSuffix(s, checkpointSuffix) {
+			last = i
+		}
+	}
+	var old []string
+	if last < 0 {
+		return old, nil
+	}
+	for _, s := range segments[:last] {
+		if fi, err := os.Stat(s); err == nil && fi.ModTime().Before(t) {
+			old = append(old, s)
+		}
+	}
+	return old, nil
+}
+
+// status returns the current segment and its size.
+func (a *AOF) status() (string, int64) {
+	a.Lock()
+	defer a.Unlock()
+	return a.file.Name(), a.size
+}
+
+// sync flushes the current segment to disk.
+func (a *AOF) sync() {
+	a.Lock()
+	defer a.Unlock()
+	if err := a.file.Sync(); err != nil {
+		echo(Log{"t": "aof_sync", "error": err.Error()})
+	}
+	a.dirty = false
+}
+
+// close syncs and closes the current segment. Entries can no longer be appended.
+func (a *AOF) close() {
+	close(a.quit)
+	a.Lock()
+	defer a.Unlock()
+	if err := a.file.Sync(); err != nil {
+		echo(Log{"t": "aof_sync", "error": err.Error()})
+	}
+	if err := a.file.Close(); err != nil {
+		echo(Log{"t": "aof_close", "error": err.Error()})
+	}
+}
+
+func (a *AOF) syncEvery(d time.Duration) {
+	ticker := clock.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-a.quit:
+			return
+		}
+		a.Lock()
+		if a.dirty {
+			if err := a.file.Sync(); err != nil {
+				echo(Log{"t": "aof_sync", "error": err.Error()})
+			}
+			a.dirty = false
+		}
+		a.Unlock()
+	}
+}
+
+// appendAOF writes an entry to the append-only log: "date time marker url data". Unless configured to
+// write to segment files, the log shares the standard library logger's output with StdLogger messages.
+func appendAOF(marker, url string, data []byte) {
+	if aof != nil {
+		aof.append(marker, url, data)
+	} else {
+		log.Println(marker, url, string(data))
+	}
+	stats.aofWritten(len(marker) + len(url) + len(data) + 3) // separators, newline
+}
@@ -16,6 +16,7 @@ package wave
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 )
@@ -63,14 +64,22 @@ func newApp(broker *Broker, mode, route, addr string) *App {
 	}
 }
 
-func (app *App) forward(data []byte) {
-	if !app.send(data) {
+// forward sends data to the app, dropping the app if it is unreachable.
+// The request is abandoned if ctx is done first, e.g. when the client that triggered it disconnects.
+func (app *App) forward(ctx context.Context, data []byte) {
+	if !app.send(ctx, data) && ctx.Err() == nil {
 		app.broker.dropApp(app.route)
 	}
 }
 
-func (app *App) send(data []byte) bool {
-	resp, err := app.client.Post(app.addr, "text/plain; charset=utf-8", bytes.NewReader(data))
+func (app *App) send(ctx context.Context, data []byte) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, app.addr, bytes.NewReader(data))
+	if err != nil {
+		echo(Log{"t": "app", "route": app.route, "host": app.addr, "error": err.Error()})
+		return false
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := app.client.Do(req)
 	if err != nil {
 		echo(Log{"t": "app", "route": app.route, "host": app.addr, "error": err.Error()})
 		return false
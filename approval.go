@@ -0,0 +1,195 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// viaApproval identifies changes made by applying approved patches.
+const viaApproval = "approval"
+
+var errNotPending = errors.New("no such pending patch")
+
+// approvalsSaveError reports a failure to persist approvals; the change that needed saving was undone.
+type approvalsSaveError struct{ error }
+
+// PendingPatch represents a patch awaiting approval.
+type PendingPatch struct {
+	ID      string    `json:"id"`
+	Route   string    `json:"route"`
+	Data    string    `json:"data"`
+	By      string    `json:"by,omitempty"` // writer of the patch, on whose behalf it is applied once approved
+	Created time.Time `json:"created"`
+}
+
+// Approvals tracks route prefixes that require patches to be approved, and patches pending approval.
+// Pending patches are not applied or written to the AOF log until approved. Protected prefixes and
+// pending patches are persisted as JSON to a file in the data directory, and survive restarts.
+type Approvals struct {
+	sync.RWMutex
+	prefixes map[string]bool          // protected route prefixes
+	pending  map[string]*PendingPatch // id => patch
+	path     string                   // where approvals are persisted; "" if they are not
+}
+
+// approvalsFile represents persisted approvals.
+type approvalsFile struct {
+	Prefixes []string        `json:"prefixes"`
+	Pending  []*PendingPatch `json:"pending"`
+}
+
+func newApprovals() *Approvals {
+	return &Approvals{prefixes: make(map[string]bool), pending: make(map[string]*PendingPatch)}
+}
+
+// open loads the approvals persisted at path, and persists changes from now on there.
+func (a *Approvals) open(path string) error {
+	a.Lock()
+	defer a.Unlock()
+	a.path = path
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var f approvalsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	for _, prefix := range f.Prefixes {
+		a.prefixes[prefix] = true
+	}
+	for _, p := range f.Pending {
+		a.pending[p.ID] = p
+	}
+	return nil
+}
+
+// save persists approvals. Must be called under lock.
+func (a *Approvals) save() error {
+	if a.path == "" {
+		return nil
+	}
+	f := approvalsFile{make([]string, 0, len(a.prefixes)), a.sorted()}
+	for prefix := range a.prefixes {
+		f.Prefixes = append(f.Prefixes, prefix)
+	}
+	sort.Strings(f.Prefixes)
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return approvalsSaveError{err}
+	}
+	if err := writeFile(a.path, data); err != nil {
+		return approvalsSaveError{err}
+	}
+	return nil
+}
+
+// protect toggles whether patches to routes at or below prefix require approval.
+func (a *Approvals) protect(prefix string, required bool) error {
+	a.Lock()
+	defer a.Unlock()
+	was := a.prefixes[prefix]
+	if required {
+		a.prefixes[prefix] = true
+	} else {
+		delete(a.prefixes, prefix)
+	}
+	if err := a.save(); err != nil {
+		if was {
+			a.prefixes[prefix] = true
+		} else {
+			delete(a.prefixes, prefix)
+		}
+		return err
+	}
+	return nil
+}
+
+func (a *Approvals) requires(route string) bool {
+	a.RLock()
+	defer a.RUnlock()
+	for prefix := range a.prefixes {
+		if isPathPrefix(prefix, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue holds a patch written by by until it is approved, and returns its id.
+func (a *Approvals) enqueue(route string, data []byte, by string) (string, error) {
+	p := &PendingPatch{uuid.New().String(), route, string(data), by, clock.Now()}
+	if err := a.put(p); err != nil {
+		return "", err
+	}
+	return p.ID, nil
+}
+
+// put holds a patch.
+func (a *Approvals) put(p *PendingPatch) error {
+	a.Lock()
+	defer a.Unlock()
+	a.pending[p.ID] = p
+	if err := a.save(); err != nil {
+		delete(a.pending, p.ID)
+		return err
+	}
+	return nil
+}
+
+// take removes and returns a pending patch.
+func (a *Approvals) take(id string) (*PendingPatch, error) {
+	a.Lock()
+	defer a.Unlock()
+	p, ok := a.pending[id]
+	if !ok {
+		return nil, errNotPending
+	}
+	delete(a.pending, id)
+	if err := a.save(); err != nil {
+		a.pending[id] = p
+		return nil, err
+	}
+	return p, nil
+}
+
+// list returns pending patches, oldest first.
+func (a *Approvals) list() []*PendingPatch {
+	a.RLock()
+	defer a.RUnlock()
+	return a.sorted()
+}
+
+// sorted returns pending patches, oldest first. Must be called under lock.
+func (a *Approvals) sorted() []*PendingPatch {
+	ps := make([]*PendingPatch, 0, len(a.pending))
+	for _, p := range a.pending {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Created.Before(ps[j].Created) })
+	return ps
+}
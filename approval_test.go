@@ -0,0 +1,150 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+const testPatch = `{"d":[{"k":"status","d":{"view":"markdown","content":"up"}}]}`
+
+func TestApprovalsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "approvals.json")
+	a := newApprovals()
+	if err := a.open(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.protect("/ops", true); err != nil {
+		t.Fatal(err)
+	}
+	a.protect("/tmp", true)
+	a.protect("/tmp", false)
+	id, err := a.enqueue("/ops/db", []byte(testPatch), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newApprovals()
+	if err := restarted.open(path); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.requires("/ops/db") {
+		t.Error("protection lost on restart")
+	}
+	if restarted.requires("/tmp") {
+		t.Error("lifted protection restored on restart")
+	}
+	ps := restarted.list()
+	if len(ps) != 1 || ps[0].ID != id || ps[0].By != "alice" || ps[0].Data != testPatch {
+		t.Fatalf("pending patches after restart: got %+v, want %s by alice", ps, id)
+	}
+	if _, err := restarted.take(id); err != nil {
+		t.Fatal(err)
+	}
+	again := newApprovals()
+	again.open(path)
+	if len(again.list()) != 0 {
+		t.Error("taken patch restored on restart")
+	}
+}
+
+func TestApprove(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	b.approvals.protect("/ops", true)
+	ctx := withWriter(context.Background(), "alice", "http")
+
+	id, _, err := b.publishIf(ctx, "/ops", []byte(testPatch), -1)
+	if err != nil || id == "" {
+		t.Fatalf("publish to protected page: got %q, %v; want a pending patch", id, err)
+	}
+	if b.site.at("/ops") != nil {
+		t.Fatal("patch applied before approval")
+	}
+	if err := b.approve(id); err != nil {
+		t.Fatal(err)
+	}
+	page := b.site.at("/ops")
+	if page == nil {
+		t.Fatal("approved patch not applied")
+	}
+	if w := page.writers["status"]; w.By != "alice" || w.Via != viaApproval {
+		t.Errorf("writer of approved patch: got %+v, want alice via %s", w, viaApproval)
+	}
+	if err := b.approve(id); err != errNotPending {
+		t.Errorf("approving twice: got %v, want %v", err, errNotPending)
+	}
+	if err := b.reject("missing"); err != errNotPending {
+		t.Errorf("rejecting unknown patch: got %v, want %v", err, errNotPending)
+	}
+}
+
+func TestApproveInvalid(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	b.approvals.protect("/ops", true)
+	id, _, err := b.publishIf(context.Background(), "/ops", []byte(testPatch), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Validators added after the patch was queued reject it when approved.
+	defer func(v *Validators) { validators = v }(validators)
+	validators = newValidators([]CardValidator{{Check: func(route, card string, data map[string]interface{}) error {
+		return errors.New("frozen")
+	}}})
+	err = b.approve(id)
+	if _, ok := err.(*ValidationError); !ok {
+		t.Fatalf("approving invalid patch: got %v, want a validation error", err)
+	}
+	if b.site.at("/ops") != nil {
+		t.Error("invalid patch applied")
+	}
+	if ps := b.approvals.list(); len(ps) != 1 || ps[0].ID != id {
+		t.Error("patch that failed to apply is no longer pending")
+	}
+}
+
+func TestDeletePagesProtected(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	ctx := withWriter(context.Background(), "alice", "http")
+	for _, url := range []string{"/ops/db", "/ops/web"} {
+		if _, err := b.patchIf(ctx, url, []byte(testPatch), -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.approvals.protect("/ops/db", true)
+
+	if err := b.deletePages(ctx, "/ops", Progress{}); err != nil {
+		t.Fatal(err)
+	}
+	if b.site.at("/ops/web") != nil {
+		t.Error("unprotected page not deleted")
+	}
+	if b.site.at("/ops/db") == nil {
+		t.Fatal("protected page deleted without approval")
+	}
+	ps := b.approvals.list()
+	if len(ps) != 1 || ps[0].Route != "/ops/db" || ps[0].By != "alice" {
+		t.Fatalf("want the deletion pending approval, got %+v", ps)
+	}
+	if err := b.approve(ps[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if p := b.site.at("/ops/db"); p != nil && len(p.cards) > 0 {
+		t.Fatal("approved deletion not applied")
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	archiveIndex = "index.json" // name of the archive's index object
+	archiveEvery = 24 * time.Hour
+)
+
+// ArchiveConf represents object storage settings for archiving AOF segments.
+type ArchiveConf struct {
+	URL             string        // bucket URL, e.g. https://s3.us-east-1.amazonaws.com/bucket/prefix; disabled if empty
+	AccessKeyID     string        // if set, requests are signed using AWS Signature Version 4
+	SecretAccessKey string        // secret for AccessKeyID
+	Region          string        // signing region; defaults to us-east-1
+	Retention       time.Duration // keep segments on disk for this long after a checkpoint supersedes them
+}
+
+// ArchivedSegment represents an AOF segment in the archive.
+type ArchivedSegment struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Modified time.Time `json:"modified"` // last write to the segment
+	Archived time.Time `json:"archived"`
+}
+
+// ArchiveIndex lists the segments in an archive, oldest first.
+type ArchiveIndex struct {
+	Segments []ArchivedSegment `json:"segments"`
+}
+
+// Archive stores AOF segments in an S3-compatible object store.
+type Archive struct {
+	conf   ArchiveConf
+	client *http.Client
+}
+
+func newArchive(conf ArchiveConf) *Archive {
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	conf.URL = strings.TrimSuffix(conf.URL, "/")
+	return &Archive{conf, &http.Client{Timeout: 5 * time.Minute}}
+}
+
+func (a *Archive) put(name string, data []byte) error {
+	_, err := a.do(http.MethodPut, name, data)
+	return err
+}
+
+func (a *Archive) get(name string) ([]byte, error) {
+	return a.do(http.MethodGet, name, nil)
+}
+
+var errArchiveNotFound = fmt.Errorf("not found in archive")
+
+func (a *Archive) do(method, name string, data []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, a.conf.URL+"/"+name, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if a.conf.AccessKeyID != "" {
+		a.sign(req, data, clock.Now().UTC())
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errArchiveNotFound
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("%s %s: %s", method, name, resp.Status)
+	}
+	return body, nil
+}
+
+// sign signs a request using AWS Signature Version 4.
+func (a *Archive) sign(req *http.Request, payload []byte, now time.Time) {
+	date, stamp := now.Format("20060102"), now.Format("20060102T150405Z")
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + stamp + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + a.conf.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+a.conf.SecretAccessKey), date)
+	for _, s := range []string{a.conf.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+a.conf.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+func (a *Archive) index() (ArchiveIndex, error) {
+	var idx ArchiveIndex
+	b, err := a.get(archiveIndex)
+	if err == errArchiveNotFound {
+		return idx, nil
+	}
+	if err != nil {
+		return idx, err
+	}
+	return idx, json.Unmarshal(b, &idx)
+}
+
+// download fetches all archived segments into dir, verifying their checksums, for replay.
+func (a *Archive) download(dir string) error {
+	idx, err := a.index()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, s := range idx.Segments {
+		b, err := a.get(s.Name)
+		if err != nil {
+			return err
+		}
+		if sha256Hex(b) != s.SHA256 {
+			return fmt.Errorf("archived segment %s: checksum mismatch", s.Name)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, s.Name), b, 0600); err != nil {
+			return err
+		}
+	}
+	echo(Log{"t": "archive_download", "url": a.conf.URL, "segments": fmt.Sprint(len(idx.Segments))})
+	return nil
+}
+
+// checkpoint starts a new AOF segment beginning with a compacted copy of the site, superseding all earlier segments.
+func (b *Broker) checkpoint(p Progress) error {
+	b.pubMux.Lock()
+	defer b.pubMux.Unlock()
+	if err := aof.checkpoint(func(l *log.Logger) { b.writeCompacted(l, p) }); err != nil {
+		return err
+	}
+	return b.site.search.save()
+}
+
+// archiveAOF checkpoints the AOF, then moves segments that were superseded by a checkpoint more than
+// retention ago to the archive, updating the archive's index.
+func (b *Broker) archiveAOF(archive *Archive, retention time.Duration, p Progress) error {
+	if err := b.checkpoint(p); err != nil {
+		return err
+	}
+	segments, err := aof.superseded(clock.Now().Add(-retention))
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+	idx, err := archive.index()
+	if err != nil {
+		return err
+	}
+	for _, path := range segments {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(path)
+		if err := archive.put(name, data); err != nil {
+			return err
+		}
+		idx.Segments = append(idx.Segments, ArchivedSegment{name, int64(len(data)), sha256Hex(data), fi.ModTime(), clock.Now()})
+		j, err := json.Marshal(idx)
+		if err != nil {
+			return err
+		}
+		if err := archive.put(archiveIndex, j); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		echo(Log{"t": "aof_archive", "file": path, "url": archive.conf.URL})
+	}
+	return nil
+}
+
+// fetchArchive resolves an -init or -compact path: archive URLs are downloaded to a temporary directory under
+// dataDir, using the archive credentials in conf; local paths are returned as is. Call done once replayed.
+func fetchArchive(path string, conf ArchiveConf, dataDir string) (local string, done func(), err error) {
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		return path, func() {}, nil
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return "", nil, err
+	}
+	dir, err := ioutil.TempDir(dataDir, "archive-")
+	if err != nil {
+		return "", nil, err
+	}
+	conf.URL = path
+	if err := newArchive(conf).download(dir); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return dir, func() { os.RemoveAll(dir) }, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	immutableCacheControl  = "public, max-age=31536000, immutable"
+	revalidateCacheControl = "no-cache"
+)
+
+// hashedAssetRE matches file names carrying a content hash added by the UI build, e.g. "main.1a2b3c4d.chunk.js".
+var hashedAssetRE = regexp.MustCompile(`[.-][0-9a-f]{8,}\.[^/]+$`)
+
+// SPAFallback represents the history fallback for single-page apps: requests for paths without a file extension
+// are served the app's entry point (index.html), so that client-side routes survive a reload.
+type SPAFallback struct {
+	Disabled bool     // serve paths as-is; missing files are not found
+	Exclude  []string // path prefixes never rewritten, e.g. "/ws" or "/files"
+}
+
+// excludes reports whether the fallback does not apply to a path.
+func (f SPAFallback) excludes(p string) bool {
+	if f.Disabled || len(path.Ext(p)) > 0 {
+		return true
+	}
+	for _, prefix := range f.Exclude {
+		if prefix != "" && isPathPrefix(prefix, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// AssetServer serves web assets with caching headers: content-hashed assets are cached indefinitely,
+// and everything else, including index.html, is revalidated on every use against a content-based ETag.
+type AssetServer struct {
+	sync.Mutex
+	fs    http.FileSystem
+	files http.Handler
+	tags  map[string]assetTag // name => last computed tag
+}
+
+type assetTag struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func newAssetServer(fs http.FileSystem) *AssetServer {
+	return &AssetServer{fs: fs, files: http.FileServer(fs), tags: make(map[string]assetTag)}
+}
+
+func (s *AssetServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	if etag, name, ok := s.etag(name); ok {
+		w.Header().Set("ETag", etag)
+		if hashedAssetRE.MatchString(path.Base(name)) {
+			w.Header().Set("Cache-Control", immutableCacheControl)
+		} else {
+			w.Header().Set("Cache-Control", revalidateCacheControl)
+		}
+	}
+	s.files.ServeHTTP(w, r) // honors If-None-Match against the ETag
+}
+
+// etag returns the entity tag for a file, or a directory's index.html, along with the name of the file served.
+func (s *AssetServer) etag(name string) (string, string, bool) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return "", "", false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", "", false
+	}
+	if fi.IsDir() {
+		return s.etag(path.Join(name, "index.html"))
+	}
+
+	s.Lock()
+	tag, ok := s.tags[name]
+	s.Unlock()
+	if ok && tag.size == fi.Size() && tag.modTime.Equal(fi.ModTime()) {
+		return tag.etag, name, true
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		echo(Log{"t": "asset_hash", "name": name, "error": err.Error()})
+		return "", "", false
+	}
+	tag = assetTag{fi.Size(), fi.ModTime(), `"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`}
+	s.Lock()
+	s.tags[name] = tag
+	s.Unlock()
+	return tag.etag, name, true
+}
+
+// fallback serves prefix in place of paths the SPA fallback applies to.
+func fallback(prefix string, spa SPAFallback, h http.Handler) http.Handler {
+	// copy of http.StripPrefix
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if spa.excludes(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// rewrite
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = prefix
+		h.ServeHTTP(w, r2)
+	})
+}
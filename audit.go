@@ -0,0 +1,299 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Audited actions.
+const (
+	AuditPatch    = "patch"        // page changed
+	AuditReplace  = "replace"      // page replaced wholesale, e.g. by an import
+	AuditDelete   = "delete"       // page deleted
+	AuditUpload   = "upload"       // file uploaded
+	AuditRegister = "register_app" // app registered to serve a route
+	AuditCommand  = "command"      // command pushed to connected UIs
+)
+
+// AuditConf configures the audit log of write operations.
+type AuditConf struct {
+	Path   string // append audit events to this file, one JSON object per line; queryable at /_admin/audit
+	Syslog string // also send audit events to syslog: "local", or udp://host:port or tcp://host:port
+}
+
+func (c AuditConf) validate() error {
+	if c.Syslog == "" || c.Syslog == "local" {
+		return nil
+	}
+	u, err := url.Parse(c.Syslog)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return fmt.Errorf("invalid audit syslog address %q: want local, udp://host:port or tcp://host:port", c.Syslog)
+	}
+	return nil
+}
+
+func (c AuditConf) enabled() bool {
+	return c.Path != "" || c.Syslog != ""
+}
+
+// AuditEvent represents a write operation, as recorded in the audit log.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	By     string    `json:"by,omitempty"`     // access key ID or username; empty for changes made by the server itself
+	Via    string    `json:"via"`              // http, stream, socket, approval, system, etc.
+	Remote string    `json:"remote,omitempty"` // source IP address
+	Route  string    `json:"route"`            // page, or uploaded file
+	Size   int64     `json:"size"`             // payload size, in bytes
+}
+
+// AuditLog records write operations to an append-only file and/or syslog, for compliance.
+type AuditLog struct {
+	sync.Mutex
+	path   string
+	file   *os.File
+	syslog io.WriteCloser
+}
+
+var auditor *AuditLog // nil unless auditing is enabled
+
+func openAuditLog(conf AuditConf) (*AuditLog, error) {
+	a := &AuditLog{path: conf.Path}
+	if conf.Path != "" {
+		f, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	if conf.Syslog != "" {
+		w, err := dialSyslog(conf.Syslog)
+		if err != nil {
+			if a.file != nil {
+				a.file.Close()
+			}
+			return nil, fmt.Errorf("failed connecting to syslog: %v", err)
+		}
+		a.syslog = w
+	}
+	return a, nil
+}
+
+func (a *AuditLog) record(e AuditEvent) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		echo(Log{"t": "audit", "error": err.Error()})
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.file != nil {
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			echo(Log{"t": "audit", "path": a.path, "error": err.Error()})
+		}
+	}
+	if a.syslog != nil {
+		if _, err := a.syslog.Write(line); err != nil {
+			echo(Log{"t": "audit", "to": "syslog", "error": err.Error()})
+		}
+	}
+}
+
+// close stops recording; later events are discarded.
+func (a *AuditLog) close() {
+	a.Lock()
+	defer a.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	if a.syslog != nil {
+		a.syslog.Close()
+		a.syslog = nil
+	}
+}
+
+type remoteKey struct{}
+
+// withRemote returns a copy of ctx identifying the address the changes made under it came from.
+func withRemote(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, remoteKey{}, addr)
+}
+
+// remoteFrom returns the address identified by ctx, if any.
+func remoteFrom(ctx context.Context) string {
+	addr, _ := ctx.Value(remoteKey{}).(string)
+	return addr
+}
+
+// audit records a change made by the writer identified by ctx. Changes replicated from peers are recorded by the
+// peer they were made on.
+func audit(ctx context.Context, action, route string, size int) {
+	if auditor == nil {
+		return
+	}
+	w := writerFrom(ctx)
+	if w.Via == viaPeer {
+		return
+	}
+	auditor.record(AuditEvent{clock.Now().UTC(), action, w.By, w.Via, originOf(remoteFrom(ctx)), route, int64(size)})
+}
+
+// auditChange records a page change published on the broker's bus. Drafts are audited when their
+// publication is requested, with the requester's identity.
+func auditChange(e Event) {
+	switch e.Change {
+	case changePatch:
+		audit(e.Ctx, AuditPatch, e.Route, len(e.Data))
+	case changeReplace:
+		audit(e.Ctx, AuditReplace, e.Route, len(e.Data))
+	case changeDelete:
+		audit(e.Ctx, AuditDelete, e.Route, 0)
+	}
+}
+
+// auditRequest records an operation requested over HTTP, outside of page changes.
+func auditRequest(r *http.Request, action, route string, size int64) {
+	if auditor == nil {
+		return
+	}
+	username, _, _ := r.BasicAuth()
+	auditor.record(AuditEvent{clock.Now().UTC(), action, username, "http", originOf(getRemoteAddr(r)), route, size})
+}
+
+// AuditQuery filters audit events; zero fields match all events.
+type AuditQuery struct {
+	Since  time.Time
+	Until  time.Time
+	By     string
+	Action string
+	Prefix string // routes at or below this
+	Limit  int    // most recent events returned
+}
+
+func (q AuditQuery) matches(e *AuditEvent) bool {
+	return (q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until)) &&
+		(q.By == "" || e.By == q.By) &&
+		(q.Action == "" || e.Action == q.Action) &&
+		(q.Prefix == "" || isPathPrefix(q.Prefix, e.Route))
+}
+
+// AuditReport represents the audit events matching a query, oldest first.
+type AuditReport struct {
+	Events    []AuditEvent `json:"events"`
+	Truncated bool         `json:"truncated,omitempty"` // more events matched than the limit; the oldest were left out
+}
+
+// query scans the audit file for events matching q.
+func (a *AuditLog) query(q AuditQuery) (*AuditReport, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	report := &AuditReport{Events: []AuditEvent{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // torn write
+		}
+		if !q.matches(&e) {
+			continue
+		}
+		if len(report.Events) == q.Limit {
+			copy(report.Events, report.Events[1:])
+			report.Events = report.Events[:q.Limit-1]
+			report.Truncated = true
+		}
+		report.Events = append(report.Events, e)
+	}
+	return report, scanner.Err()
+}
+
+// AuditHandler answers audit log queries:
+// GET /_admin/audit?since=2021-01-01T00:00:00Z&until=..&by=key-id&action=patch&prefix=/sales&limit=100.
+// Requires an access key.
+type AuditHandler struct {
+	auth *Auth
+}
+
+func newAuditHandler(auth *Auth) *AuditHandler {
+	return &AuditHandler{auth}
+}
+
+func (h *AuditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth.trusted(r); !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if auditor == nil || auditor.path == "" {
+		http.Error(w, "audit log is not kept in a file", http.StatusNotFound)
+		return
+	}
+	p := r.URL.Query()
+	q := AuditQuery{By: p.Get("by"), Action: p.Get("action"), Prefix: p.Get("prefix"), Limit: defaultPageListLimit}
+	for _, t := range []struct {
+		name string
+		v    *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if s := p.Get(t.name); s != "" {
+			v, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: want RFC 3339 time", t.name), http.StatusBadRequest)
+				return
+			}
+			*t.v = v
+		}
+	}
+	if s := p.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if n > maxPageListLimit {
+			n = maxPageListLimit
+		}
+		q.Limit = n
+	}
+	report, err := auditor.query(q)
+	if err != nil {
+		echo(Log{"t": "audit_query", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package wave
+
+import (
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+// dialSyslog connects to the local syslog daemon, or to a remote one at udp://host:port or tcp://host:port.
+func dialSyslog(addr string) (io.WriteCloser, error) {
+	const priority = syslog.LOG_INFO | syslog.LOG_AUTH
+	if addr == "local" {
+		return syslog.New(priority, "waved")
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	return syslog.Dial(u.Scheme, u.Host, priority, "waved")
+}
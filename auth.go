@@ -0,0 +1,60 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+// Auth authenticates API callers, using either an OIDC session (browsers) or basic auth (access keys).
+type Auth struct {
+	users        map[string][]byte
+	oidcEnabled  bool
+	sessions     *OIDCSessions
+	oauth2Config oauth2.Config
+}
+
+func newAuth(users map[string][]byte, oidcEnabled bool, sessions *OIDCSessions, oauth2Config oauth2.Config) *Auth {
+	return &Auth{users, oidcEnabled, sessions, oauth2Config}
+}
+
+// trusted reports whether the request carries valid access key credentials.
+func (a *Auth) trusted(r *http.Request) (string, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash, ok := a.users[username]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
+	}
+	noteKey(r, username)
+	return username, true
+}
+
+// identify returns the caller's identity, using either the OIDC session or basic auth.
+func (a *Auth) identify(r *http.Request) (Viewer, bool) {
+	if a.oidcEnabled && hasValidSession(r, a.oauth2Config, a.sessions) {
+		username, _, roles, _, _ := getIdentity(r, a.sessions)
+		return Viewer{username: username, roles: roles}, true
+	}
+	if username, ok := a.trusted(r); ok {
+		return Viewer{username: username, trusted: true}, true
+	}
+	return Viewer{}, false
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Backpressure policies, applied when a client's outbound queue is full.
+const (
+	disconnectPolicy = "disconnect"  // drop the client
+	dropOldestPolicy = "drop-oldest" // discard the oldest queued message
+	collapsePolicy   = "collapse"    // discard the messages queued for the page, and queue the latest full page instead
+)
+
+const defaultQueueSize = 256
+
+// Backpressure represents how the broker handles clients that cannot keep up with broadcasts.
+type Backpressure struct {
+	QueueSize int           // max messages queued per client
+	Policy    string        // "disconnect", "drop-oldest" or "collapse"
+	MaxLag    time.Duration // disconnect clients whose queue stays full for longer than this; 0 = never
+}
+
+func (bp Backpressure) withDefaults() Backpressure {
+	if bp.QueueSize <= 0 {
+		bp.QueueSize = defaultQueueSize
+	}
+	if bp.Policy == "" {
+		bp.Policy = disconnectPolicy
+	}
+	return bp
+}
+
+func (bp Backpressure) validate() error {
+	switch bp.Policy {
+	case "", disconnectPolicy, dropOldestPolicy, collapsePolicy:
+		return nil
+	}
+	return fmt.Errorf("unknown backpressure policy: %q", bp.Policy)
+}
+
+// SendQueue holds the frames waiting to be written to a client: a ring buffer the broker pushes to,
+// and the client's flush loop drains. Frames are only ever discarded with the queue's lock held, so
+// the consumer never waits for frames that were taken away.
+type SendQueue struct {
+	mu     sync.Mutex
+	frames []*Frame      // ring buffer
+	head   int           // index of the oldest frame
+	n      int           // frames queued
+	closed bool          // no more frames will be queued
+	ready  chan struct{} // signaled when frames are queued; closed when the queue is closed
+}
+
+func newSendQueue(size int) *SendQueue {
+	return &SendQueue{frames: make([]*Frame, size), ready: make(chan struct{}, 1)}
+}
+
+func (q *SendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default: // already signaled
+	}
+}
+
+// push queues a frame; returns false if the queue is full or closed.
+func (q *SendQueue) push(f *Frame) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.n == len(q.frames) {
+		return false
+	}
+	q.frames[(q.head+q.n)%len(q.frames)] = f
+	q.n++
+	q.signal()
+	return true
+}
+
+// pushDroppingOldest queues a frame, discarding the oldest queued frame if the queue is full.
+// Returns the number of frames discarded, and false if the queue is closed.
+func (q *SendQueue) pushDroppingOldest(f *Frame) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, false
+	}
+	dropped := 0
+	if q.n == len(q.frames) {
+		q.frames[q.head] = nil
+		q.head = (q.head + 1) % len(q.frames)
+		q.n--
+		dropped++
+	}
+	q.frames[(q.head+q.n)%len(q.frames)] = f
+	q.n++
+	q.signal()
+	return dropped, true
+}
+
+// collapse discards the frames queued for route, and queues f instead. Returns the number of frames
+// discarded, and false if the queue is closed, or still full: frames queued for other routes are kept.
+func (q *SendQueue) collapse(route string, f *Frame) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, false
+	}
+	kept := 0
+	for i := 0; i < q.n; i++ {
+		x := q.frames[(q.head+i)%len(q.frames)]
+		if route == "" || x.route != route {
+			q.frames[(q.head+kept)%len(q.frames)] = x
+			kept++
+		}
+	}
+	for i := kept; i < q.n; i++ {
+		q.frames[(q.head+i)%len(q.frames)] = nil
+	}
+	dropped := q.n - kept
+	q.n = kept
+	if q.n == len(q.frames) {
+		return dropped, false
+	}
+	q.frames[(q.head+q.n)%len(q.frames)] = f
+	q.n++
+	q.signal()
+	return dropped, true
+}
+
+// drain appends all queued frames to xs, oldest first, and empties the queue. Returns false once the
+// queue is closed and empty.
+func (q *SendQueue) drain(xs []*Frame) ([]*Frame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n == 0 {
+		return xs, !q.closed
+	}
+	for ; q.n > 0; q.n-- {
+		xs = append(xs, q.frames[q.head])
+		q.frames[q.head] = nil
+		q.head = (q.head + 1) % len(q.frames)
+	}
+	q.head = 0
+	return xs, true
+}
+
+// len returns the number of frames queued.
+func (q *SendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}
+
+// cap returns the maximum number of frames that can be queued.
+func (q *SendQueue) cap() int {
+	return len(q.frames)
+}
+
+// close stops frames from being queued; frames already queued are still drained.
+func (q *SendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.ready)
+	}
+}
+
+// deliver queues a frame for a client, applying the backpressure policy if the client's queue is full.
+// Returns false if the client should be dropped. Must be called from the broker loop, or a fan-out
+// goroutine it waits for.
+func (b *Broker) deliver(client *Client, route string, page *Page, f *Frame) bool {
+	if client.sendFrame(f) {
+		if !client.behind.IsZero() && client.queue.len() < client.queue.cap()/2 {
+			client.behind = time.Time{} // caught up
+		}
+		return true
+	}
+
+	bp := b.backpressure
+	if bp.Policy == disconnectPolicy {
+		return false
+	}
+
+	now := clock.Now()
+	if client.behind.IsZero() {
+		client.behind = now
+	} else if bp.MaxLag > 0 && now.Sub(client.behind) > bp.MaxLag {
+		echo(Log{"t": "client_lag", "addr": client.addr, "error": "behind for " + now.Sub(client.behind).String()})
+		return false
+	}
+
+	switch bp.Policy {
+	case dropOldestPolicy:
+		n, ok := client.queue.pushDroppingOldest(f)
+		if ok {
+			b.taps.capture(client, "out", "", f.data)
+		}
+		stats.messageDropped(n)
+		return ok
+	case collapsePolicy:
+		if page != nil {
+			full := page.marshalFor(client.roles)
+			if full == nil {
+				return false
+			}
+			if selected, ok := client.selects(route, full); ok {
+				full = selected
+			} // else the client watches none of the page's cards any more: send it all, so that it drops them
+			f = newFrame(stamp(full, b.historyOf(route).mark()))
+			f.route = route
+			stats.queueCollapsed()
+		}
+		n, ok := client.queue.collapse(route, f)
+		if ok {
+			b.taps.capture(client, "out", "", f.data)
+		}
+		stats.messageDropped(n)
+		return ok
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSendQueue(t *testing.T) {
+	q := newSendQueue(3)
+	frames := make([]*Frame, 5)
+	for i := range frames {
+		frames[i] = newFrame([]byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < 3; i++ {
+		if !q.push(frames[i]) {
+			t.Fatalf("push %d: queue full too early", i)
+		}
+	}
+	if q.push(frames[3]) {
+		t.Fatal("push: want full queue to refuse frames")
+	}
+	if n, ok := q.pushDroppingOldest(frames[3]); n != 1 || !ok {
+		t.Fatalf("pushDroppingOldest: got %d, %v; want 1, true", n, ok)
+	}
+	xs, ok := q.drain(nil)
+	if got := frameData(xs); !ok || got != "1 2 3" {
+		t.Fatalf("drain: got %q, %v; want \"1 2 3\", true", got, ok)
+	}
+	q.push(frames[0])
+	q.push(frames[1])
+	if n, ok := q.collapse("", frames[4]); n != 0 || !ok {
+		t.Fatalf("collapse: got %d, %v; want 0, true", n, ok)
+	}
+	q.drain(xs[:0])
+	q.push(frames[4])
+	q.push(frames[0])
+	q.close()
+	if q.push(frames[1]) {
+		t.Fatal("push: want closed queue to refuse frames")
+	}
+	if xs, ok = q.drain(xs[:0]); !ok || frameData(xs) != "4 0" {
+		t.Fatalf("drain after close: got %q, %v; want \"4 0\", true", frameData(xs), ok)
+	}
+	if xs, ok = q.drain(xs[:0]); ok || len(xs) != 0 {
+		t.Fatalf("drain closed, empty queue: got %d frames, %v; want none, false", len(xs), ok)
+	}
+}
+
+func frameData(xs []*Frame) string {
+	s := make([]string, len(xs))
+	for i, f := range xs {
+		s[i] = string(f.data)
+	}
+	return strings.Join(s, " ")
+}
+
+// slowClient connects a client to b over a real websocket, and returns the client, the browser's end of the
+// connection, and a channel closed when the client's flush loop returns.
+func slowClient(t *testing.T, b *Broker) (*Client, *websocket.Conn, chan struct{}) {
+	t.Helper()
+	clients := make(chan *Client, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := newUpgrader(defaultFootprint.SocketBufferSize, false, nil).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		clients <- newClient(r.RemoteAddr, "default-user", "", nil, "", "", b, newRequestLimiter(RateLimits{}), conn, KeepAlive{}.withDefaults(), grammarVersion)
+	}))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := <-clients
+	done := make(chan struct{})
+	go func() {
+		c.flush()
+		close(done)
+	}()
+	return c, conn, done
+}
+
+// TestSlowReader floods a client that reads slowly while the broker discards queued frames, and checks that the
+// client's flush loop neither stalls nor loses the latest frame, and shuts down cleanly.
+func TestSlowReader(t *testing.T) {
+	for _, policy := range []string{dropOldestPolicy, collapsePolicy} {
+		t.Run(policy, func(t *testing.T) {
+			b := newTestBroker(t, Backpressure{QueueSize: 4, Policy: policy})
+			c, conn, done := slowClient(t, b)
+
+			const n = 2000
+			read := make(chan string, 1)
+			go func() {
+				last := ""
+				for {
+					_, msg, err := conn.ReadMessage()
+					if err != nil {
+						read <- last
+						return
+					}
+					lines := strings.Split(string(msg), "\n")
+					last = lines[len(lines)-1]
+					time.Sleep(100 * time.Microsecond)
+				}
+			}()
+			for i := 1; i <= n; i++ {
+				f := newFrame([]byte(strconv.Itoa(i)))
+				f.route = "/x"
+				if !b.deliver(c, "/x", nil, f) {
+					t.Fatalf("deliver %d: client dropped", i)
+				}
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for c.queue.len() > 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			c.quit()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("flush did not return after the queue was closed")
+			}
+			if last := <-read; last != strconv.Itoa(n) {
+				t.Fatalf("last message: got %q, want %d", last, n)
+			}
+		})
+	}
+}
+
+// TestCollapseKeepsOtherRoutes checks that collapsing a client's queue for one page keeps the messages
+// queued for the other pages it watches.
+func TestCollapseKeepsOtherRoutes(t *testing.T) {
+	b := newTestBroker(t, Backpressure{QueueSize: 3, Policy: collapsePolicy})
+	c := &Client{broker: b, queue: newSendQueue(b.backpressure.QueueSize)}
+	frame := func(route, data string) *Frame {
+		f := newFrame([]byte(data))
+		f.route = route
+		return f
+	}
+	for _, f := range []*Frame{frame("/a", "a1"), frame("/b", "b1"), frame("/a", "a2")} {
+		if !b.deliver(c, f.route, nil, f) {
+			t.Fatal("deliver: client dropped before its queue was full")
+		}
+	}
+	if !b.deliver(c, "/a", nil, frame("/a", "a3")) {
+		t.Fatal("deliver: client dropped while collapsing")
+	}
+	if xs, _ := c.queue.drain(nil); frameData(xs) != "b1 a3" {
+		t.Fatalf("queued: got %q, want \"b1 a3\"", frameData(xs))
+	}
+
+	for _, f := range []*Frame{frame("/b", "b2"), frame("/b", "b3"), frame("/b", "b4")} {
+		b.deliver(c, f.route, nil, f)
+	}
+	if b.deliver(c, "/a", nil, frame("/a", "a4")) {
+		t.Fatal("deliver: want client dropped when nothing queued for the page can be collapsed")
+	}
+	if xs, _ := c.queue.drain(nil); frameData(xs) != "b2 b3 b4" {
+		t.Fatalf("queued: got %q, want \"b2 b3 b4\"", frameData(xs))
+	}
+}
+
+func TestDisconnectPolicy(t *testing.T) {
+	b := newTestBroker(t, Backpressure{QueueSize: 2})
+	c := &Client{broker: b, queue: newSendQueue(b.backpressure.QueueSize)}
+	for i := 0; i < 2; i++ {
+		if !b.deliver(c, "/x", nil, newFrame([]byte("{}"))) {
+			t.Fatalf("deliver %d: client dropped before its queue was full", i)
+		}
+	}
+	if b.deliver(c, "/x", nil, newFrame([]byte("{}"))) {
+		t.Fatal("deliver: want client with a full queue dropped")
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const maxBatchTimeout = 30 * time.Second
+
+// PageData represents a page's contents, as returned in a batch.
+type PageData struct {
+	URL     string          `json:"url"`
+	Version int64           `json:"version"`
+	Data    json.RawMessage `json:"data"` // same as GET /<url>
+}
+
+// PageBatch represents the pages read in a batch.
+type PageBatch struct {
+	Pages   []PageData `json:"pages"`
+	Next    string     `json:"next,omitempty"`    // pass as ?from= to fetch the remaining pages
+	Partial bool       `json:"partial,omitempty"` // stopped at the deadline before all pages were marshaled
+}
+
+// BatchHandler reads many pages at once:
+// GET /_api/batch?url=/a&url=/b or ?prefix=/foo, optionally with &from=/foo/bar&limit=100&timeout=500ms.
+// Pages are returned in url order. If a timeout is given, the pages marshaled by then are returned, along with a
+// continuation token, instead of waiting for slow pages. Callers see only the pages they are allowed to read.
+type BatchHandler struct {
+	site *Site
+	auth *Auth
+}
+
+func newBatchHandler(site *Site, auth *Auth) *BatchHandler {
+	return &BatchHandler{site, auth}
+}
+
+func (h *BatchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	viewer, ok := h.auth.identify(r)
+	if !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultPageListLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if n > maxPageListLimit {
+			n = maxPageListLimit
+		}
+		limit = n
+	}
+	var deadline <-chan time.Time
+	if s := q.Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if d > maxBatchTimeout {
+			d = maxBatchTimeout
+		}
+		deadline = clock.After(d)
+	}
+
+	var urls []string
+	if list, ok := q["url"]; ok {
+		seen := make(map[string]bool)
+		for _, url := range list {
+			if !seen[url] {
+				seen[url] = true
+				urls = append(urls, url)
+			}
+		}
+		sort.Strings(urls)
+	} else {
+		prefix := q.Get("prefix")
+		if prefix == "" {
+			prefix = "/"
+		}
+		urls = h.site.urlsUnder(prefix)
+	}
+	urls = urls[sort.SearchStrings(urls, q.Get("from")):]
+
+	var readable []string
+	for _, url := range urls {
+		if viewer.trusted || h.site.acl.allows(url, viewer.username, viewer.roles) {
+			readable = append(readable, url)
+		}
+	}
+	batch := PageBatch{Pages: []PageData{}}
+	if len(readable) > limit {
+		batch.Next = readable[limit]
+		readable = readable[:limit]
+	}
+
+	// Marshal in the background, so that a slow page doesn't hold up the response past the deadline.
+	pages, stop := make(chan PageData), make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(pages)
+		for _, url := range readable {
+			d := PageData{URL: url}
+			if p := h.site.at(url); p != nil {
+				d.Version = h.site.version(url)
+				if viewer.trusted {
+					d.Data = p.marshal()
+				} else {
+					d.Data = p.marshalFor(viewer.roles)
+				}
+			}
+			select {
+			case pages <- d:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	done := 0
+read:
+	for done < len(readable) {
+		select {
+		case d := <-pages:
+			done++
+			if d.Data != nil { // skip pages deleted since listing
+				batch.Pages = append(batch.Pages, d)
+			}
+		case <-deadline:
+			batch.Next, batch.Partial = readable[done], true
+			break read
+		case <-r.Context().Done(): // client went away
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(batch)
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// BenchConf represents a fan-out benchmark run by RunBench.
+type BenchConf struct {
+	Address         string // base URL, e.g. http://localhost:10101
+	AccessKeyID     string // credentials for writes
+	AccessKeySecret string
+	Clients         int           // websocket clients watching the page
+	Patches         int           // patches published to the page
+	Size            int           // bytes of content per patch
+	Interval        time.Duration // time between patches; 0 = as fast as the server accepts them
+	Msgpack         bool          // receive MessagePack frames instead of JSON
+	Deflate         bool          // negotiate permessage-deflate compression
+	Timeout         time.Duration // maximum wait for all patches to be delivered
+}
+
+// BenchReport represents the outcome of a fan-out benchmark.
+type BenchReport struct {
+	Address    string  `json:"address"`
+	Clients    int     `json:"clients"`
+	Patches    int     `json:"patches"`
+	Expected   int     `json:"expected"`  // deliveries expected: clients × patches
+	Delivered  int     `json:"delivered"` // deliveries observed before the timeout
+	Elapsed    float64 `json:"elapsed_ms"`
+	Throughput float64 `json:"deliveries_per_second"`
+	P50        float64 `json:"p50_ms"` // latency from publishing a patch to its receipt by a client
+	P90        float64 `json:"p90_ms"`
+	P99        float64 `json:"p99_ms"`
+	Max        float64 `json:"max_ms"`
+}
+
+var benchMarker = []byte("wave-bench ")
+
+// RunBench connects many websocket clients to a page on a running server, publishes patches to
+// the page, and measures how long the server takes to deliver them to every client. The page is
+// created under a unique route, and dropped once the run completes.
+func RunBench(conf BenchConf) (BenchReport, error) {
+	conf.Address = strings.TrimSuffix(conf.Address, "/")
+	if conf.Clients <= 0 {
+		conf.Clients = 1000
+	}
+	if conf.Patches <= 0 {
+		conf.Patches = 100
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = time.Minute
+	}
+	c := &conformance{ConformanceConf{conf.Address, conf.AccessKeyID, conf.AccessKeySecret, conf.Timeout}, &http.Client{Timeout: conf.Timeout}, "/bench-" + uuid.New().String()[:8]}
+	defer c.cleanup()
+
+	padding := strings.Repeat("x", conf.Size)
+	content := func(i int) string { return string(benchMarker) + strconv.Itoa(i) + " " + padding }
+	if err := c.patch("page", `{"d":[{"k":"bench","d":{"view":"markdown","box":"1 1 2 2","title":"Bench","content":"`+content(0)+`"}}]}`); err != nil {
+		return BenchReport{}, err
+	}
+
+	sent := make([]int64, conf.Patches+1) // patch => unix nanoseconds when published
+	var (
+		latencies []time.Duration
+		last      int64 // unix nanoseconds when the last patch was delivered
+		mu        sync.Mutex
+		delivered int64
+		wg        sync.WaitGroup
+	)
+	var conns []*websocket.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	receive := func(conn *websocket.Conn) {
+		defer wg.Done()
+		var (
+			xs     []time.Duration
+			latest int64
+		)
+		defer func() {
+			mu.Lock()
+			latencies = append(latencies, xs...)
+			if latest > last {
+				last = latest
+			}
+			mu.Unlock()
+		}()
+		for got := 0; got < conf.Patches; {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			now := time.Now().UnixNano()
+			for { // a text frame may hold several messages
+				i := bytes.Index(b, benchMarker)
+				if i < 0 {
+					break
+				}
+				b = b[i+len(benchMarker):]
+				j := 0
+				for j < len(b) && b[j] >= '0' && b[j] <= '9' {
+					j++
+				}
+				if n, err := strconv.Atoi(string(b[:j])); err == nil && n > 0 && n <= conf.Patches {
+					xs = append(xs, time.Duration(now-atomic.LoadInt64(&sent[n])))
+					atomic.AddInt64(&delivered, 1)
+					latest = now
+					got++
+				}
+			}
+		}
+	}
+
+	dialer := *websocket.DefaultDialer
+	if conf.Msgpack {
+		dialer.Subprotocols = []string{msgpackProtocol}
+	}
+	dialer.EnableCompression = conf.Deflate
+	addr := "ws" + strings.TrimPrefix(conf.Address, "http") + "/_s"
+	route := c.url("page")
+	for i := 0; i < conf.Clients; i++ {
+		conn, _, err := dialer.Dial(addr, nil)
+		if err != nil {
+			return BenchReport{}, fmt.Errorf("client %d: %v", i, err)
+		}
+		conns = append(conns, conn)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("+ "+route+" ")); err != nil {
+			return BenchReport{}, fmt.Errorf("client %d: %v", i, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(conf.Timeout))
+		if _, _, err := conn.ReadMessage(); err != nil { // the page
+			return BenchReport{}, fmt.Errorf("client %d: %v", i, err)
+		}
+		conn.SetReadDeadline(time.Time{})
+		wg.Add(1)
+		go receive(conn)
+	}
+
+	start := time.Now()
+	for i := 1; i <= conf.Patches; i++ {
+		atomic.StoreInt64(&sent[i], time.Now().UnixNano())
+		if err := c.patch("page", `{"d":[{"k":"bench content","v":"`+content(i)+`"}]}`); err != nil {
+			return BenchReport{}, err
+		}
+		if conf.Interval > 0 {
+			time.Sleep(conf.Interval)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(conf.Timeout):
+		for _, conn := range conns { // unblock clients still waiting for patches
+			conn.Close()
+		}
+		<-done
+	}
+	elapsed := time.Duration(last - start.UnixNano())
+
+	r := BenchReport{
+		Address:   conf.Address,
+		Clients:   conf.Clients,
+		Patches:   conf.Patches,
+		Expected:  conf.Clients * conf.Patches,
+		Delivered: int(atomic.LoadInt64(&delivered)),
+		Elapsed:   millis(elapsed),
+	}
+	r.Throughput = float64(r.Delivered) / elapsed.Seconds()
+	if len(latencies) == 0 {
+		return r, errors.New("no patches delivered")
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	at := func(q float64) float64 { return millis(latencies[int(q*float64(len(latencies)-1))]) }
+	r.P50, r.P90, r.P99, r.Max = at(.5), at(.9), at(.99), at(1)
+	return r, nil
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
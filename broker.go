@@ -15,80 +15,149 @@
 package wave
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// MsgT represents message types.
-type MsgT int
-
-const (
-	badMsgT MsgT = iota
-	noopMsgT
-	patchMsgT
-	queryMsgT
-	watchMsgT
-)
-
-// Msg represents a message.
-type Msg struct {
-	t    MsgT
-	addr string
-	data []byte
-}
-
 var (
-	msgSep     = []byte{' '}
-	emptyJSON  = []byte("{}")
-	invalidMsg = Msg{t: badMsgT}
+	errVersionMismatch = errors.New("page version mismatch")
+
+	emptyJSON = []byte("{}")
 )
 
 // Pub represents a published message
 type Pub struct {
 	route string
 	data  []byte
+	ctx   context.Context // trace context
+	seq   int64           // sequence number
 }
 
 // Sub represents a subscription.
 type Sub struct {
 	route  string
 	client *Client
+	since  int64           // -1: subscribe only; 0: send page; > 0: send patches published after this sequence number
+	cards  map[string]bool // cards to watch; nil for the whole page
 }
 
 // Broker represents a message broker.
 type Broker struct {
-	site        *Site
-	clients     map[string]map[*Client]interface{} // route => clients
-	publish     chan Pub
-	subscribe   chan Sub
-	unsubscribe chan *Client
-	apps        map[string]*App // route => app
-	appsMux     sync.RWMutex    // mutex for tracking apps
+	site          *Site
+	clients       map[string]*ClientSet // route => clients
+	history       map[string]*History   // route => recently published messages
+	publish       chan Pub
+	subscribe     chan Sub
+	unsubscribe   chan *Client
+	ping          chan chan struct{} // liveness probes
+	sweep         chan chan int      // history garbage collection; replies with the number of histories dropped
+	running       int32              // set to 1 while the broker loop runs
+	apps          map[string]*App    // route => app
+	appsMux       sync.RWMutex       // mutex for tracking apps
+	primary       string             // websocket address of the primary server, if this server is a standby
+	primaryMux    sync.RWMutex       // mutex for tracking primary
+	pubMux        sync.RWMutex       // serializes page changes and publishing; see lock
+	approvals     *Approvals         // patches pending approval
+	pollers       *Pollers           // pollers bound to pages imported from dashboards
+	taps          *Taps              // websocket message captures
+	notifier      *Notifier          // page change notifications
+	jobs          *Jobs              // background administrative jobs
+	backpressure  Backpressure       // slow client handling
+	footprint     Footprint          // history retained per route
+	subscriptions *Subscriptions     // pages watched per user and origin
+	signals       chan []byte        // messages for every connected client, kept out of page history
+	webhooks      *Webhooks          // page change callbacks
+	calls         chan func()        // functions run by the broker loop, with access to broker-owned state
+	listeners     *Listeners         // in-process change listeners
+	schedule      *Schedule          // patches to be applied later
+	shards        int                // shards per ClientSet
+	bus           *Bus               // events for other subsystems
+	quit          chan struct{}      // closed when the server stops, ending background work
+	ordering      string             // how broadcasts to different pages are ordered
+	routeLocks    *RouteLocks        // serialize changes to each page under OrderPage
+	tasks         sync.WaitGroup     // background work started with spawn
+	halt          chan struct{}      // closed to end the broker loop, once background work has ended
+	loop          sync.WaitGroup     // the broker loop, if started
 }
 
-func newBroker(site *Site) *Broker {
-	return &Broker{
+func newBroker(site *Site, primary string, notifier *Notifier, webhooks *Webhooks, jobs *Jobs, schedule *Schedule, backpressure Backpressure, footprint Footprint, limits SubscriptionLimits, ordering string) *Broker {
+	b := &Broker{
 		site,
-		make(map[string]map[*Client]interface{}),
+		make(map[string]*ClientSet),
+		make(map[string]*History),
 		make(chan Pub, 1024),
 		make(chan Sub),
 		make(chan *Client),
+		make(chan chan struct{}),
+		make(chan chan int),
+		0,
 		make(map[string]*App),
 		sync.RWMutex{},
+		primary,
+		sync.RWMutex{},
+		sync.RWMutex{},
+		newApprovals(),
+		newPollers(),
+		newTaps(),
+		notifier,
+		jobs,
+		backpressure.withDefaults(),
+		footprint,
+		newSubscriptions(limits),
+		make(chan []byte),
+		webhooks,
+		make(chan func()),
+		newListeners(),
+		schedule,
+		fanoutShards(),
+		newBus(),
+		make(chan struct{}),
+		ordering,
+		&RouteLocks{},
+		sync.WaitGroup{},
+		make(chan struct{}),
+		sync.WaitGroup{},
 	}
+	b.wire()
+	return b
+}
+
+// setPrimary sets the address connecting clients should be redirected to; "" disables redirection.
+func (b *Broker) setPrimary(addr string) {
+	b.primaryMux.Lock()
+	b.primary = addr
+	b.primaryMux.Unlock()
+
+	echo(Log{"t": "primary_set", "address": addr})
+}
+
+func (b *Broker) getPrimary() string {
+	b.primaryMux.RLock()
+	defer b.primaryMux.RUnlock()
+	return b.primary
 }
 
 func (b *Broker) addApp(mode, route, addr string) {
 	s := newApp(b, mode, route, addr)
 
 	b.appsMux.Lock()
+	prev, replaced := b.apps[route]
 	b.apps[route] = s
 	b.appsMux.Unlock()
 
 	echo(Log{"t": "app_add", "route": route, "host": addr})
+	if replaced {
+		b.bus.publish(Event{Kind: appDisconnected, Route: route, Addr: prev.addr})
+	}
+	b.bus.publish(Event{Kind: appConnected, Route: route, Addr: addr})
 
 	// Force-reload all browsers listening to this app
 	b.reset(route) // TODO allow only in debug mode?
@@ -103,91 +172,541 @@ func (b *Broker) getApp(route string) *App {
 
 func (b *Broker) dropApp(route string) {
 	b.appsMux.Lock()
+	prev, ok := b.apps[route]
 	delete(b.apps, route)
 	b.appsMux.Unlock()
 
 	echo(Log{"t": "app_drop", "route": route})
+	if ok {
+		b.bus.publish(Event{Kind: appDisconnected, Route: route, Addr: prev.addr})
+	}
 
 	// Force-reload all browsers listening to this app
 	b.reset(route) // TODO allow only in debug mode?
 }
 
-func parseMsgT(s []byte) MsgT {
-	if len(s) == 1 {
-		switch s[0] {
-		case '*':
-			return patchMsgT
-		case '@':
-			return queryMsgT
-		case '+':
-			return watchMsgT
-		case '#':
-			return noopMsgT
+// patch broadcasts changes to clients and patches site data.
+// If the route requires approval, the patch is queued instead, and its pending ID is returned.
+func (b *Broker) patch(ctx context.Context, route string, data []byte) string {
+	id, _ := b.patchIf(ctx, route, data, -1)
+	return id
+}
+
+// patchIf is like patch, but fails with errVersionMismatch unless the page's current version is want
+// (0 if the page must not exist, -1 for any version).
+func (b *Broker) patchIf(ctx context.Context, route string, data []byte, want int64) (string, error) {
+	id, _, err := b.publishIf(ctx, route, data, want)
+	return id, err
+}
+
+// publishIf is like patchIf, but also returns the page's version once the patch is applied (0 if pending).
+func (b *Broker) publishIf(ctx context.Context, route string, data []byte, want int64) (string, int64, error) {
+	if err := ctx.Err(); err != nil {
+		stats.patchCanceled()
+		return "", 0, err
+	}
+	ops, err := parsePatch(data)
+	if err != nil {
+		echo(Log{"t": "broker_patch", "route": route, "error": err.Error()})
+		return "", 0, err
+	}
+	if b.approvals.requires(route) {
+		if revertFrom(ctx) != nil {
+			return "", 0, errRevertApproval
 		}
+		if want >= 0 && b.site.version(route) != want {
+			return "", 0, errVersionMismatch
+		}
+		if err := validators.check(b.site, route, ops); err != nil { // don't queue patches that can't be applied
+			return "", 0, err
+		}
+		id, err := b.approvals.enqueue(route, data, writerFrom(ctx).By)
+		if err != nil {
+			echo(Log{"t": "patch_pending", "route": route, "error": err.Error()})
+			return "", 0, err
+		}
+		echo(Log{"t": "patch_pending", "route": route, "id": id})
+		return id, 0, nil
 	}
-	return badMsgT
+	version, err := b.execIf(ctx, route, data, ops, want)
+	return "", version, err
 }
 
-func parseMsg(s []byte) Msg {
-	// protocol: t<sep>addr<sep>data
-	parts := bytes.SplitN(s, msgSep, 3)
-	if len(parts) == 3 {
-		t, addr, data := parts[0], parts[1], parts[2]
-		action := parseMsgT(t)
-		if action == badMsgT {
-			return invalidMsg
+// approve applies a pending patch on behalf of its writer. If the patch cannot be applied, it stays pending,
+// to be rejected, or approved again once whatever prevented it is resolved.
+func (b *Broker) approve(id string) error {
+	p, err := b.approvals.take(id)
+	if err != nil {
+		return err
+	}
+	data := []byte(p.Data)
+	ops, err := parsePatch(data)
+	if err == nil {
+		_, err = b.execIf(withWriter(context.Background(), p.By, viaApproval), p.Route, data, ops, -1)
+	}
+	if err != nil {
+		echo(Log{"t": "patch_approve", "route": p.Route, "id": id, "error": err.Error()})
+		if perr := b.approvals.put(p); perr != nil {
+			echo(Log{"t": "patch_approve", "route": p.Route, "id": id, "error": "patch lost: " + perr.Error()})
 		}
-		return Msg{action, string(addr), data}
+		return err
 	}
-	return invalidMsg
+	echo(Log{"t": "patch_approve", "route": p.Route, "id": id, "by": p.By})
+	return nil
 }
 
-// patch broadcasts changes to clients and patches site data.
-func (b *Broker) patch(route string, data []byte) {
-	b.publish <- Pub{route, data}
+// reject discards a pending patch.
+func (b *Broker) reject(id string) error {
+	p, err := b.approvals.take(id)
+	if err != nil {
+		return err
+	}
+	echo(Log{"t": "patch_reject", "route": p.Route, "id": id})
+	return nil
+}
+
+var errNoDraft = errors.New("no draft")
+
+// draftPatch returns a patch replacing a page with the contents of its draft.
+func draftPatch(d *PageD) OpsD {
+	names := make([]string, 0, len(d.C))
+	for k := range d.C {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	ops := OpsD{D: []OpD{{}}} // drop the page, then put each card
+	for _, k := range names {
+		ops.D = append(ops.D, OpD{K: k, D: d.C[k].D, B: d.C[k].B})
+	}
+	return ops
+}
+
+// pagePatch returns a patch replacing a page with a compacted copy, for recordings, which hold only patches.
+func pagePatch(data []byte) ([]byte, error) {
+	var page OpsD
+	if err := json.Unmarshal(data, &page); err != nil {
+		return nil, err
+	}
+	if page.P == nil {
+		return nil, errors.New("not a compacted page")
+	}
+	ops := draftPatch(page.P)
+	ops.T = page.T
+	return json.Marshal(ops)
+}
+
+// publishDraft replaces a page with its draft, and broadcasts the new page to clients. Publishing a draft is
+// subject to the same checks as patching the page: if the page requires approval, the replacement is queued
+// for approval instead, and its id returned.
+func (b *Broker) publishDraft(ctx context.Context, route string) (string, error) {
+	b.pubMux.Lock()
+	defer b.pubMux.Unlock()
+	draft := b.site.at(draftURL(route))
+	if draft == nil {
+		return "", errNoDraft
+	}
+	draft.RLock()
+	ops := draftPatch(draft.dump())
+	draft.RUnlock()
+	if err := licensing.canCreate(b.site, route); err != nil {
+		return "", err
+	}
+	if err := validators.check(b.site, route, ops); err != nil {
+		echo(Log{"t": "draft_publish", "route": route, "error": err.Error()})
+		return "", err
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return "", err
+	}
+	if b.approvals.requires(route) {
+		id, err := b.approvals.enqueue(route, patch, writerFrom(ctx).By)
+		if err != nil {
+			echo(Log{"t": "draft_publish", "route": route, "error": err.Error()})
+			return "", err
+		}
+		echo(Log{"t": "patch_pending", "route": route, "id": id})
+		return id, nil
+	}
+	seq := nextSeq()
+	page, ok := b.site.publish(route, seq)
+	if !ok {
+		return "", errNoDraft
+	}
+	data := page.marshal()
+	if data == nil {
+		return "", fmt.Errorf("draft of %s: failed marshaling page", route)
+	}
+	appendAOF(compactMarker, route, data)
+	if recorder != nil {
+		recorder.record(route, patch)
+	}
+	if cluster != nil {
+		cluster.forward(context.Background(), compactMarker, route, data)
+	}
+	b.publish <- Pub{route, data, ctx, seq}
+	b.bus.changed(ctx, changeDraft, route, data, OpsD{}, seq)
+	echo(Log{"t": "draft_publish", "route": route})
+	return "", nil
+}
+
+// replace overwrites a page with a compacted copy, and broadcasts the new page to clients.
+func (b *Broker) replace(ctx context.Context, route string, data []byte) error {
+	unlock := b.lock(route)
+	defer unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := licensing.canCreate(b.site, route); err != nil {
+		return err
+	}
+	seq := nextSeq()
+	if err := b.site.set(route, data, seq); err != nil {
+		return err
+	}
+	b.site.touch(route, clock.Now())
+	appendAOF(compactMarker, route, data)
+	if recorder != nil {
+		if patch, err := pagePatch(data); err == nil {
+			recorder.record(route, patch)
+		}
+	}
+	if cluster != nil {
+		cluster.forward(ctx, compactMarker, route, data)
+	}
+	b.publish <- Pub{route, data, ctx, seq}
+	b.bus.changed(ctx, changeReplace, route, data, OpsD{}, seq)
+	return nil
+}
+
+var dropPageJSON = []byte(`{"d":[{}]}`)
+
+// deletePage removes a page, and clears it on the clients viewing it.
+func (b *Broker) deletePage(route string) {
+	b.deletePageIf(route, nil)
+}
+
+// deletePageIf is like deletePage, but only deletes the page if it exists and cond, if not nil, holds.
+// cond is called under the page's lock, with page changes blocked, and reports whether the page was deleted.
+func (b *Broker) deletePageIf(route string, cond func(*Page) bool) bool {
+	return b.deleteIf(context.Background(), route, cond)
+}
+
+// deleteIf is like deletePageIf, but gives up without deleting the page if ctx is done before the delete starts.
+func (b *Broker) deleteIf(ctx context.Context, route string, cond func(*Page) bool) bool {
+	unlock := b.lock(route)
+	if ctx.Err() != nil {
+		unlock()
+		return false
+	}
+	if cond != nil {
+		p := b.site.at(route)
+		if p == nil {
+			unlock()
+			return false
+		}
+		p.RLock()
+		ok := cond(p)
+		p.RUnlock()
+		if !ok {
+			unlock()
+			return false
+		}
+	}
+	appendAOF(deleteMarker, route, emptyJSON)
+	if recorder != nil {
+		recorder.record(route, dropPageJSON)
+	}
+	if cluster != nil {
+		cluster.forward(ctx, deleteMarker, route, emptyJSON)
+	}
+	b.site.del(route)
+	seq := nextSeq()
+	b.publish <- Pub{route, dropPageJSON, context.Background(), seq}
+	b.bus.changed(ctx, changeDelete, route, nil, OpsD{}, seq)
+	unlock()
+	b.pollers.replace(b, route, "", nil)
+	return true
+}
+
+// deletePages removes all pages at or below prefix, on behalf of the writer identified by ctx, reporting progress.
+// Pages that require approval are dropped by a patch queued for approval, as single-page writes are.
+// Pages that could not be deleted are reported in the error; the rest are deleted regardless.
+func (b *Broker) deletePages(ctx context.Context, prefix string, p Progress) error {
+	urls := b.site.urlsUnder(prefix)
+	p.total(len(urls))
+	var msgs []string
+	for _, url := range urls {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if b.approvals.requires(url) {
+			if _, err := b.patchIf(ctx, url, dropPageJSON, -1); err != nil {
+				msgs = append(msgs, url+": "+err.Error())
+			}
+		} else {
+			b.deleteIf(ctx, url, nil) // false if already deleted
+		}
+		p.step(1)
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("failed deleting %d pages: %s", len(msgs), strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// apply broadcasts changes to clients and patches site data.
+func (b *Broker) apply(ctx context.Context, route string, data []byte) {
+	ops, err := parsePatch(data)
+	if err != nil {
+		echo(Log{"t": "broker_patch", "route": route, "error": err.Error()})
+		return
+	}
+	b.execIf(ctx, route, data, ops, -1)
+}
+
+// execIf applies parsed changes if the page's current version is want (0 if the page must not exist, -1 for any version),
+// and returns the page's new version.
+// If ctx is done while waiting for earlier changes to be published (e.g. the writer disconnected), the changes are
+// discarded and ctx's error is returned; once written to the AOF, changes are always applied in full.
+func (b *Broker) execIf(ctx context.Context, route string, data []byte, ops OpsD, want int64) (int64, error) {
+	unlock := b.lock(route)
+	defer unlock()
+
+	if err := ctx.Err(); err != nil {
+		stats.patchCanceled()
+		return 0, err
+	}
+	if err := licensing.canCreate(b.site, route); err != nil {
+		return 0, err
+	}
+
+	if want >= 0 {
+		if v := b.site.version(route); v != want {
+			return 0, errVersionMismatch
+		}
+	}
+	if writerFrom(ctx).Via != viaPeer { // already validated by the peer
+		if err := validators.check(b.site, route, ops); err != nil {
+			echo(Log{"t": "broker_patch", "route": route, "error": err.Error()})
+			return 0, err
+		}
+	}
+	if err := b.scheduleRevert(ctx, route, ops); err != nil {
+		echo(Log{"t": "broker_patch", "route": route, "error": err.Error()})
+		return 0, err
+	}
+	seq := nextSeq()
+
 	// Write AOF entry with patch marker "*" as-is to log file.
-	// FIXME bufio.Scanner.Scan() is not reliable if line length > 65536 chars,
-	// so reading back in is unreliable.
-	log.Println("*", route, string(data))
-	if err := b.site.patch(route, data); err != nil {
-		echo(Log{"t": "broker_patch", "error": err.Error()})
+	_, span := trace(ctx, "aof_append")
+	appendAOF(patchMarker, route, data)
+	if recorder != nil {
+		recorder.record(route, data)
 	}
+	if cluster != nil {
+		cluster.forward(ctx, patchMarker, route, data)
+	}
+	span.End()
+
+	_, span = trace(ctx, "site_patch")
+	span.SetAttr("route", route)
+	b.site.exec(route, ops, seq)
+	b.site.attribute(route, ops, writerFrom(ctx))
+	span.End()
+
+	// Publish after patching, so that role-based card filtering sees the page's current state.
+	b.publish <- Pub{route, data, ctx, seq}
+	b.bus.changed(ctx, changePatch, route, data, ops, seq)
+	return seq, nil
+}
+
+// broadcast sends a message that does not change page contents to a route's clients.
+// Publishing is serialized as per the broker's ordering, so that messages reach the broker in sequence number order.
+func (b *Broker) broadcast(route string, data []byte) {
+	unlock := b.lock(route)
+	b.publish <- Pub{route, data, context.Background(), nextSeq()}
+	unlock()
 }
 
 // TODO allow only in debug mode?
 func (b *Broker) reset(route string) {
 	if data, err := json.Marshal(OpsD{R: 1}); err == nil {
-		b.publish <- Pub{route, data}
+		b.broadcast(route, data)
 	}
 }
 
 // run starts i/o between the broker and clients.
 func (b *Broker) run() {
+	atomic.StoreInt32(&b.running, 1)
+	defer atomic.StoreInt32(&b.running, 0)
 	for {
 		select {
+		case <-b.halt:
+			return
+		case reply := <-b.ping:
+			close(reply)
+		case reply := <-b.sweep:
+			n := 0
+			for route := range b.history {
+				if _, ok := b.clients[route]; !ok {
+					delete(b.history, route)
+					n++
+				}
+			}
+			reply <- n
 		case sub := <-b.subscribe:
 			b.addClient(sub.route, sub.client)
+			if sub.cards != nil {
+				sub.client.cards[sub.route] = sub.cards
+			} else if sub.since >= 0 {
+				delete(sub.client.cards, sub.route)
+			}
+			if sub.since >= 0 {
+				b.replay(sub.route, sub.client, sub.since)
+			}
 		case client := <-b.unsubscribe:
 			b.dropClient(client)
+		case f := <-b.calls:
+			f()
+		case data := <-b.signals:
+			f := newFrame(data)
+			sent := make(map[*Client]bool)
+			for _, clients := range b.clients {
+				clients.each(func(client *Client) {
+					if !sent[client] {
+						sent[client] = true
+						client.sendFrame(f)
+					}
+				})
+			}
 		case pub := <-b.publish:
+			pub.data = b.historyOf(pub.route).append(pub.data, pub.seq)
 			if clients, ok := b.clients[pub.route]; ok {
-				for client := range clients {
-					if !client.send(pub.data) {
-						b.dropClient(client)
-					}
+				_, span := trace(pub.ctx, "broker_fanout")
+				span.SetAttr("route", pub.route)
+				span.SetAttr("clients", strconv.Itoa(clients.len()))
+				start := time.Now()
+				b.fanout(pub, clients)
+				stats.broadcasted(time.Since(start))
+				span.End()
+			}
+		}
+	}
+}
+
+func (b *Broker) historyOf(route string) *History {
+	h, ok := b.history[route]
+	if !ok {
+		h = newHistory(max0(b.footprint.HistorySize), b.footprint.HistoryBytes)
+		b.history[route] = h
+	}
+	return h
+}
+
+// replay sends a newly subscribed client the patches published to a route after since, if available,
+// else the page's current contents.
+func (b *Broker) replay(route string, client *Client, since int64) {
+	page := b.site.at(route)
+	h := b.historyOf(route)
+	if since > 0 {
+		if msgs, ok := h.since(since); ok {
+			for _, data := range msgs {
+				if page != nil {
+					data = page.filterFor(data, client.roles)
+				}
+				if data, ok := client.selects(route, data); ok {
+					client.send(data)
 				}
 			}
+			return
+		}
+	}
+	if page == nil {
+		client.send(notFound)
+		return
+	}
+	if data := page.marshalFor(client.roles); data != nil {
+		if data, ok := client.selects(route, data); ok {
+			client.send(stamp(data, h.mark()))
 		}
 	}
+	if xs := b.site.annotations.list(route, "", time.Time{}, time.Time{}); len(xs) > 0 {
+		if data, err := json.Marshal(OpsD{A: xs}); err == nil {
+			if data, ok := client.selects(route, page.filterFor(data, client.roles)); ok {
+				client.send(data)
+			}
+		}
+	}
+}
+
+// canAccess reports whether a client is allowed to subscribe to route.
+// Client pages are open only to the client they belong to, regardless of the site's access rules.
+func (b *Broker) canAccess(client *Client, route string) bool {
+	if id := clientOf(route); id != "" {
+		return id == client.id
+	}
+	return b.site.acl.allows(route, client.username, client.roles)
+}
+
+// start runs the broker loop in the background, until stop.
+func (b *Broker) start() {
+	b.loop.Add(1)
+	go func() {
+		defer b.loop.Done()
+		b.run()
+	}()
+}
+
+// spawn runs f in the background. f must return once quit is closed.
+func (b *Broker) spawn(f func()) {
+	b.tasks.Add(1)
+	go func() {
+		defer b.tasks.Done()
+		f()
+	}()
+}
+
+// stop ends the broker's background work: reaping, trimming, scheduled patches, jobs and whatever else was
+// spawned, and then the broker loop, which serves the background work until it has ended.
+// Returns once all of it has returned. Clients must have disconnected first.
+func (b *Broker) stop() {
+	close(b.quit)
+	b.tasks.Wait()
+	b.jobs.stop()
+	close(b.halt)
+	b.loop.Wait()
+}
+
+func (b *Broker) isRunning() bool {
+	return atomic.LoadInt32(&b.running) == 1
+}
+
+// probe reports whether the broker loop responds within timeout.
+func (b *Broker) probe(timeout time.Duration) bool {
+	reply := make(chan struct{})
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case b.ping <- reply:
+	case <-t.C:
+		return false
+	}
+	select {
+	case <-reply:
+		return true
+	case <-t.C:
+		return false
+	}
 }
 
 func (b *Broker) addClient(route string, client *Client) {
 	clients, ok := b.clients[route]
 	if !ok {
-		clients = make(map[*Client]interface{})
+		clients = newClientSet(b.shards)
 		b.clients[route] = clients
 	}
-	clients[client] = nil
+	clients.add(client)
 
 	echo(Log{"t": "ui_add", "addr": client.addr, "route": route})
 }
@@ -197,8 +716,8 @@ func (b *Broker) dropClient(client *Client) {
 
 	for _, route := range client.routes {
 		if clients, ok := b.clients[route]; ok {
-			delete(clients, client)
-			if len(clients) == 0 {
+			clients.remove(client)
+			if clients.len() == 0 {
 				gc = append(gc, route)
 			}
 		}
@@ -209,6 +728,7 @@ func (b *Broker) dropClient(client *Client) {
 	for _, route := range gc {
 		delete(b.clients, route)
 	}
+	delete(b.history, "/"+client.id) // client-level route; cannot be resumed by another client.
 
 	// FIXME leak: this is not captured in the AOF logging; page will be recreated on hydration
 	b.site.del(client.id) // delete transient page, if any.
@@ -0,0 +1,91 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// newTestBroker returns a broker for an empty site, keeping its state in a temporary directory.
+// The broker loop is not started.
+func newTestBroker(t testing.TB, bp Backpressure) *Broker {
+	t.Helper()
+	dir := t.TempDir()
+	return newBroker(
+		newSite(),
+		"",
+		newNotifier(filepath.Join(dir, "subscriptions.json"), SMTPConf{}),
+		newWebhooks(filepath.Join(dir, "webhooks.json")),
+		newJobs(filepath.Join(dir, "jobs.json")),
+		newSchedule(filepath.Join(dir, "schedule.json")),
+		bp,
+		defaultFootprint,
+		SubscriptionLimits{},
+		OrderTotal,
+	)
+}
+
+func TestBrokerStopWaits(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	b.start()
+	var spawned, swept bool
+	b.spawn(func() {
+		<-b.quit
+		spawned = true
+	})
+	b.jobs.define("sweep", Retry{}, func(Progress) error {
+		<-b.quit
+		swept = true
+		return b.collect(Progress{}) // the broker loop is still running
+	})
+	if _, err := b.jobs.run("sweep"); err != nil {
+		t.Fatal(err)
+	}
+	b.stop()
+	if !spawned || !swept {
+		t.Fatalf("stop returned before background work: spawned %v, job %v", spawned, swept)
+	}
+	if b.isRunning() {
+		t.Fatal("broker loop still running")
+	}
+}
+
+func TestFootprintPerServer(t *testing.T) {
+	small := newTestBroker(t, Backpressure{})
+	small.footprint = Footprint{HistorySize: 1, HistoryBytes: 1 << 10, UndoDepth: -1}
+	small.site.undoDepth = max0(small.footprint.UndoDepth)
+	large := newTestBroker(t, Backpressure{})
+	for seq := int64(1); seq <= 3; seq++ {
+		for _, b := range []*Broker{small, large} {
+			b.historyOf("/a").append([]byte(`{}`), seq)
+			if err := b.site.patch("/a", []byte(testPatch), seq); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if n := len(small.historyOf("/a").entries); n != 1 {
+		t.Errorf("want 1 message retained, got %d", n)
+	}
+	if n := len(large.historyOf("/a").entries); n != 3 {
+		t.Errorf("want 3 messages retained, got %d", n)
+	}
+	if n := len(small.site.at("/a").undo); n != 0 {
+		t.Errorf("want no versions retained, got %d", n)
+	}
+	if n := len(large.site.at("/a").undo); n != 3 {
+		t.Errorf("want 3 past versions retained, got %d", n)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"sync"
+)
+
+// Kinds of events published on a Bus.
+const (
+	pageChanged        = "page_changed"        // a page was patched, replaced or deleted
+	clientConnected    = "client_connected"    // a websocket client connected
+	clientDisconnected = "client_disconnected" // a websocket client went away
+	appConnected       = "app_connected"       // an app began serving a route
+	appDisconnected    = "app_disconnected"    // an app stopped serving a route
+)
+
+// How a page changed.
+const (
+	changePatch   = "patch"
+	changeReplace = "replace" // overwritten with a new page, e.g. compacted or imported
+	changeDraft   = "draft"   // replaced with its draft
+	changeDelete  = "delete"
+)
+
+// Event represents something that happened in the server, for subsystems to react to.
+type Event struct {
+	Kind    string
+	Ctx     context.Context // page changes: the writer, trace and remote address
+	Change  string          // page changes: how the page changed
+	Route   string          // page changed, or route served by an app
+	Data    []byte          // page changes: the patch, or the new page; nil if deleted
+	Ops     OpsD            // patches: the parsed patch
+	Version int64           // page changes: the page's new version
+	Client  *Client         // client events
+	Addr    string          // app events: address of the app
+}
+
+// Bus delivers a broker's events to the subsystems interested in them: webhooks, change listeners,
+// notifications, analytics, auditing, search and metrics. Handlers are called in order of subscription,
+// on the publisher's goroutine, with further changes to the page blocked until all handlers return, so
+// handlers must not block. Under OrderTotal, page changes are published one at a time, in version order;
+// under OrderPage, changes to different pages are published concurrently.
+type Bus struct {
+	sync.RWMutex
+	handlers map[string][]func(Event)
+}
+
+func newBus() *Bus {
+	return &Bus{handlers: make(map[string][]func(Event))}
+}
+
+// subscribe calls f with every event of the given kinds.
+func (bus *Bus) subscribe(f func(Event), kinds ...string) {
+	bus.Lock()
+	defer bus.Unlock()
+	for _, kind := range kinds {
+		bus.handlers[kind] = append(bus.handlers[kind], f)
+	}
+}
+
+func (bus *Bus) publish(e Event) {
+	bus.RLock()
+	defer bus.RUnlock()
+	for _, f := range bus.handlers[e.Kind] {
+		f(e)
+	}
+}
+
+// changed publishes a page change.
+func (bus *Bus) changed(ctx context.Context, change, route string, data []byte, ops OpsD, version int64) {
+	bus.publish(Event{Kind: pageChanged, Ctx: ctx, Change: change, Route: route, Data: data, Ops: ops, Version: version})
+}
+
+// wire subscribes the server's subsystems to the broker's events.
+func (b *Broker) wire() {
+	bus := b.bus
+	bus.subscribe(b.site.reindex, pageChanged)
+	bus.subscribe(b.webhooks.onChange, pageChanged)
+	bus.subscribe(b.listeners.onChange, pageChanged)
+	bus.subscribe(b.notifier.onChange, pageChanged)
+	bus.subscribe(recordPublished, pageChanged)
+	bus.subscribe(auditChange, pageChanged)
+	bus.subscribe(b.dropClientPages, clientDisconnected)
+	bus.subscribe(stats.onEvent, pageChanged, clientConnected, clientDisconnected, appConnected, appDisconnected)
+}
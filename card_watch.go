@@ -0,0 +1,83 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// parseCards parses a space-separated list of card names.
+func parseCards(data []byte) map[string]bool {
+	cards := make(map[string]bool)
+	for _, k := range bytes.Fields(data) {
+		cards[string(k)] = true
+	}
+	return cards
+}
+
+// selectCards rewrites a message to include only changes to the given cards.
+// Returns false if nothing remains to be sent.
+func selectCards(data []byte, cards map[string]bool) ([]byte, bool) {
+	var ops OpsD
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return data, true
+	}
+	if ops.R != 0 || ops.U != "" { // control messages
+		return data, true
+	}
+
+	n := 0
+	if ops.P != nil {
+		for k := range ops.P.C {
+			if !cards[k] {
+				delete(ops.P.C, k)
+			}
+		}
+		n++
+	}
+	if len(ops.D) > 0 {
+		d := ops.D[:0]
+		for _, op := range ops.D {
+			k := strings.SplitN(op.K, keySeparator, 2)[0]
+			if len(k) == 0 || cards[k] { // page drops are always relevant
+				d = append(d, op)
+			}
+		}
+		ops.D = d
+		n += len(d)
+	}
+	if len(ops.A) > 0 {
+		xs := ops.A[:0]
+		for _, x := range ops.A {
+			if x.Card == "" || cards[x.Card] {
+				xs = append(xs, x)
+			}
+		}
+		ops.A = xs
+		n += len(xs)
+	}
+	if n == 0 {
+		return nil, false
+	}
+
+	selected, err := json.Marshal(ops)
+	if err != nil {
+		echo(Log{"t": "select_cards", "error": err.Error()})
+		return data, true
+	}
+	return selected, true
+}
@@ -16,7 +16,9 @@ package wave
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -24,59 +26,94 @@ import (
 )
 
 const (
-	// Time allowed to write a message to the peer.
+	// Default time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
 
-	// Time allowed to read the next pong message from the peer.
+	// Default time allowed to read the next pong message from the peer.
 	pongWait = 60 * time.Second
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
 	// Maximum message size allowed from peer.
 	maxMessageSize = 1 * 1024 * 1024 // bytes
 )
 
-var (
-	newline  = []byte{'\n'}
-	notFound = []byte(`{"e":"not_found"}`)
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024, // TODO review
-		WriteBufferSize: 1024, // TODO review
+// KeepAlive represents websocket keepalive settings.
+type KeepAlive struct {
+	PingInterval time.Duration // send pings to peer with this period; must be less than PongTimeout
+	PongTimeout  time.Duration // time allowed to read the next pong message from the peer
+	WriteTimeout time.Duration // time allowed to write a message to the peer
+}
+
+// withDefaults fills in unset values.
+func (k KeepAlive) withDefaults() KeepAlive {
+	if k.PongTimeout <= 0 {
+		k.PongTimeout = pongWait
+	}
+	if k.PingInterval <= 0 || k.PingInterval >= k.PongTimeout {
+		k.PingInterval = (k.PongTimeout * 9) / 10
 	}
+	if k.WriteTimeout <= 0 {
+		k.WriteTimeout = writeWait
+	}
+	return k
+}
+
+var (
+	newline     = []byte{'\n'}
+	notFound    = []byte(`{"e":"not_found"}`)
+	forbidden   = []byte(`{"e":"forbidden"}`)
+	tooMany     = []byte(`{"e":"too_many_subscriptions"}`)
+	clientCount uint32 // clients created so far; spreads clients over ClientSet shards
 )
 
 // Client represent a websocket (UI) client.
 type Client struct {
-	id           string          // unique id
-	addr         string          // remote address
-	username     string          // username, or "default-user"
-	subject      string          // oidc subject identifier
-	accessToken  string          // oidc access token
-	refreshToken string          // oidc refresh token
-	broker       *Broker         // broker
-	conn         *websocket.Conn // connection
-	routes       []string        // watched routes
-	data         chan []byte     // send data
+	id           string                     // unique id
+	addr         string                     // remote address
+	username     string                     // username, or "default-user"
+	subject      string                     // oidc subject identifier
+	roles        []string                   // oidc roles and groups
+	accessToken  string                     // oidc access token
+	refreshToken string                     // oidc refresh token
+	broker       *Broker                    // broker
+	limiter      *RequestLimiter            // charges page writes
+	conn         *websocket.Conn            // connection
+	routes       []string                   // watched routes
+	queue        *SendQueue                 // frames waiting to be sent
+	keepAlive    KeepAlive                  // keepalive settings
+	behind       time.Time                  // when the send queue was first found full; zero if caught up (broker-owned)
+	cards        map[string]map[string]bool // route => cards watched; whole page if absent (broker-owned)
+	watched      map[string]bool            // distinct pages watched, counted against subscription limits (listener-owned)
+	ctx          context.Context            // done when the client disconnects
+	cancel       context.CancelFunc         // cancels ctx
+	view         string                     // roles, sorted; clients having the same view see pages the same way
+	shard        uint32                     // picks the client's shard in a ClientSet
+	wire         int                        // wire grammar version spoken by the client
 }
 
-func newClient(addr, username, subject, accessToken, refreshToken string, broker *Broker, conn *websocket.Conn) *Client {
-	return &Client{uuid.New().String(), addr, username, subject, accessToken, refreshToken, broker, conn, nil, make(chan []byte, 256)}
+func newClient(addr, username, subject string, roles []string, accessToken, refreshToken string, broker *Broker, limiter *RequestLimiter, conn *websocket.Conn, keepAlive KeepAlive, wire int) *Client {
+	// The upgrade request's context ends when the handler returns, so the client gets its own.
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{uuid.New().String(), addr, username, subject, roles, accessToken, refreshToken, broker, limiter, conn, nil, newSendQueue(broker.backpressure.QueueSize), keepAlive, time.Time{}, make(map[string]map[string]bool), make(map[string]bool), ctx, cancel, viewOf(roles), atomic.AddUint32(&clientCount, 1), wire}
 }
 
 func (c *Client) listen() {
+	c.broker.bus.publish(Event{Kind: clientConnected, Client: c})
 	defer func() {
+		c.cancel()
+		licensing.disconnect(c.username)
+		c.broker.bus.publish(Event{Kind: clientDisconnected, Client: c})
+		c.broker.subscriptions.release(c.username, c.origin(), len(c.watched))
 		c.broker.unsubscribe <- c
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadDeadline(time.Now().Add(c.keepAlive.PongTimeout))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.conn.SetReadDeadline(time.Now().Add(c.keepAlive.PongTimeout))
 		return nil
 	})
 	for {
-		_, msg, err := c.conn.ReadMessage()
+		mt, msg, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				echo(Log{"t": "socket_read", "client": c.addr, "err": err.Error()})
@@ -84,21 +121,79 @@ func (c *Client) listen() {
 			break
 		}
 
-		m := parseMsg(msg)
+		m, err := parseMsg(msg)
+		if err != nil {
+			echo(Log{"t": "socket_read", "client": c.addr, "error": err.Error()})
+			continue
+		}
+		if mt == websocket.BinaryMessage && m.t == patchMsgT { // "* addr <msgpack>"
+			if m.data, err = msgpackToJSON(m.data); err != nil {
+				echo(Log{"t": "socket_read", "client": c.addr, "error": err.Error()})
+				continue
+			}
+		}
+		if m.t == patchMsgT {
+			if m.data, err = upgradePatch(m.data, c.wire); err != nil {
+				echo(Log{"t": "socket_read", "client": c.addr, "error": err.Error()})
+				continue
+			}
+		}
+		if m.t != queryMsgT {
+			m.addr = c.own(m.addr)
+		}
+		c.broker.taps.capture(c, "in", m.addr, m.data)
 		switch m.t {
 		case patchMsgT:
-			c.broker.patch(m.addr, m.data)
+			if !c.broker.canAccess(c, m.addr) { // as for watching; pages the client can't see, it can't change
+				stats.authFailed()
+				echo(Log{"t": "socket_patch", "client": c.addr, "route": m.addr, "error": "forbidden"})
+				continue
+			}
+			if ok, wait := c.limiter.allowClient(c.username, c.addr); !ok {
+				echo(Log{"t": "socket_patch", "client": c.addr, "route": m.addr, "error": errRateLimited(wait).Error()})
+				continue
+			}
+			c.broker.patch(withWriter(withRemote(c.ctx, c.addr), c.username, "socket"), m.addr, m.data)
 		case queryMsgT:
 			app := c.broker.getApp(m.addr)
 			if app == nil {
 				echo(Log{"t": "query", "client": c.addr, "route": m.addr, "error": "service unavailable"})
 				continue
 			}
-			app.forward(c.format(m.data))
-		case watchMsgT:
-			c.subscribe(m.addr) // subscribe even if page is currently NA
+			app.forward(c.ctx, c.format(m.data))
+		case watchMsgT, resumeMsgT:
+			since, hash := int64(0), m.data
+			if m.t == resumeMsgT {
+				if since, hash, err = parseResume(m.data); err != nil {
+					echo(Log{"t": "watch", "client": c.addr, "route": m.addr, "error": err.Error()})
+					continue
+				}
+			}
+
+			if !c.broker.canAccess(c, m.addr) {
+				stats.authFailed()
+				echo(Log{"t": "watch", "client": c.addr, "route": m.addr, "error": "forbidden"})
+				c.send(forbidden)
+				continue
+			}
+
+			if !c.admit(m.addr) {
+				echo(Log{"t": "watch", "client": c.addr, "route": m.addr, "error": "too many subscriptions"})
+				c.send(tooMany)
+				continue
+			}
+
+			if analytics != nil && m.t == watchMsgT {
+				who := c.username
+				if who == "default-user" {
+					who = c.origin()
+				}
+				analytics.viewed(m.addr, who)
+			}
 
 			if app := c.broker.getApp(m.addr); app != nil { // do we have an app handling this route?
+				c.subscribe(m.addr)
+
 				switch app.mode {
 				case unicastMode:
 					c.subscribe("/" + c.id) // client-level
@@ -107,76 +202,140 @@ func (c *Client) listen() {
 				}
 
 				boot := emptyJSON
-				if len(m.data) > 0 { // location hash
-					if j, err := json.Marshal(Boot{Hash: string(m.data)}); err == nil {
+				if len(hash) > 0 { // location hash
+					if j, err := json.Marshal(Boot{Hash: string(hash)}); err == nil {
 						boot = j
 					}
 				}
 				// echo(Log{"t": "boot", "client": c.addr, "route": m.addr, "addr": app.addr, "location": string(boot)})
-				app.forward(c.format(boot))
+				app.forward(c.ctx, c.format(boot))
 				continue
 			}
 
-			if page := c.broker.site.at(m.addr); page != nil { // is page?
-				if data := page.marshal(); data != nil {
-					c.send(data)
-					continue
-				}
+			// Subscribe even if page is currently NA; the broker sends the page, or patches missed since the
+			// last-seen sequence number if resuming.
+			c.watch(m.addr, since)
+		case cardsMsgT: // data: "card1 card2 ..."
+			if !c.broker.canAccess(c, m.addr) {
+				stats.authFailed()
+				echo(Log{"t": "watch", "client": c.addr, "route": m.addr, "error": "forbidden"})
+				c.send(forbidden)
+				continue
 			}
-
-			c.send(notFound)
+			if !c.admit(m.addr) {
+				echo(Log{"t": "watch", "client": c.addr, "route": m.addr, "error": "too many subscriptions"})
+				c.send(tooMany)
+				continue
+			}
+			c.watchCards(m.addr, parseCards(m.data))
 		}
 	}
 }
 
 func (c *Client) subscribe(route string) {
 	c.routes = append(c.routes, route) // TODO review
-	c.broker.subscribe <- Sub{route, c}
+	c.broker.subscribe <- Sub{route, c, -1, nil}
+}
+
+// watch subscribes to a page, and requests the page's contents (since == 0), or patches published after since.
+func (c *Client) watch(route string, since int64) {
+	c.routes = append(c.routes, route)
+	c.broker.subscribe <- Sub{route, c, since, nil}
+}
+
+// watchCards subscribes to a subset of cards on a page, and requests their contents.
+func (c *Client) watchCards(route string, cards map[string]bool) {
+	c.routes = append(c.routes, route)
+	c.broker.subscribe <- Sub{route, c, 0, cards}
+}
+
+// selects narrows a message published to route down to the cards watched by this client, if any.
+// Returns false if the message has nothing of interest to the client.
+func (c *Client) selects(route string, data []byte) ([]byte, bool) {
+	if cards, ok := c.cards[route]; ok {
+		return selectCards(data, cards)
+	}
+	return data, true
+}
+
+// writeFrame writes a message as a text (JSON) or binary (MessagePack) frame, encoded once for all
+// clients receiving it. Returns false if the connection is unusable.
+func (c *Client) writeFrame(f *Frame, binary bool) bool {
+	pm, err := f.forWire(c.wire).prepared(binary)
+	if err != nil {
+		echo(Log{"t": "socket_write", "client": c.addr, "error": err.Error()})
+		return true // skip message
+	}
+	return c.conn.WritePreparedMessage(pm) == nil
 }
 
 func (c *Client) send(data []byte) bool {
-	select {
-	case c.data <- data:
-		return true
-	default:
+	return c.sendFrame(newFrame(data))
+}
+
+func (c *Client) sendFrame(f *Frame) bool {
+	if !c.queue.push(f) {
 		return false
 	}
+	c.broker.taps.capture(c, "out", "", f.data)
+	return true
 }
 
 func (c *Client) flush() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := clock.NewTicker(c.keepAlive.PingInterval)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
 	}()
+	binary := c.conn.Subprotocol() == msgpackProtocol
+	var frames []*Frame
 	for {
 		select {
-		case data, ok := <-c.data:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		case <-c.queue.ready:
+			var ok bool
+			frames, ok = c.queue.drain(frames[:0])
+			c.conn.SetWriteDeadline(time.Now().Add(c.keepAlive.WriteTimeout))
 			if !ok {
-				// broker closed the channel.
+				// broker closed the queue.
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
+			if len(frames) == 0 {
+				continue
+			}
+
+			if binary { // one message per frame
+				for _, f := range frames {
+					if !c.writeFrame(f, true) {
+						return
+					}
+				}
+				continue
+			}
+
+			if len(frames) == 1 { // nothing else queued: send the frame as encoded for all its recipients
+				if !c.writeFrame(frames[0], false) {
+					return
+				}
+				continue
+			}
 
 			w, err := c.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
 				return
 			}
-			w.Write(data)
-
-			// push queued messages, if any
-			n := len(c.data)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.data)
+			for i, f := range frames {
+				if i > 0 {
+					w.Write(newline)
+				}
+				w.Write(f.forWire(c.wire).data)
 			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		case <-ticker.C():
+			c.conn.SetWriteDeadline(time.Now().Add(c.keepAlive.WriteTimeout))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -185,7 +344,7 @@ func (c *Client) flush() {
 }
 
 func (c *Client) quit() {
-	close(c.data)
+	c.queue.close()
 }
 
 var (
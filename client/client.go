@@ -0,0 +1,356 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client publishes pages to a Wave server.
+//
+// Changes made to a Page are collected locally, and sent to the server as a single patch when the page
+// (or the whole client) is saved:
+//
+//	c := client.New(client.Config{Address: "http://localhost:10101"})
+//	p := c.Page("/demo")
+//	p.Set("hello", map[string]interface{}{"view": "markdown", "box": "1 1 2 2", "title": "Hello", "content": "World"})
+//	p.Update("hello content", "Everyone")
+//	if err := p.Save(); err != nil {
+//		log.Fatal(err)
+//	}
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config represents the server to publish to. Empty fields take defaults from the same environment
+// variables (H2O_WAVE_ADDRESS, H2O_WAVE_ACCESS_KEY_ID, H2O_WAVE_ACCESS_KEY_SECRET) and defaults as the Python SDK.
+type Config struct {
+	Address         string        // base URL of the server
+	AccessKeyID     string        // API access key ID
+	AccessKeySecret string        // API access key secret
+	Retries         int           // attempts after the first for failed requests; 0 = 3, negative = never retry
+	Backoff         time.Duration // delay before the first retry; doubled for each subsequent retry; 0 = 500ms
+	HTTPClient      *http.Client  // defaults to a client with a 30s timeout
+}
+
+func env(key, value string) string {
+	if v, ok := os.LookupEnv("H2O_WAVE_" + key); ok {
+		return v
+	}
+	return value
+}
+
+func (c Config) withDefaults() Config {
+	if c.Address == "" {
+		c.Address = env("ADDRESS", "http://127.0.0.1:10101")
+	}
+	c.Address = strings.TrimSuffix(c.Address, "/")
+	if c.AccessKeyID == "" {
+		c.AccessKeyID = env("ACCESS_KEY_ID", "access_key_id")
+	}
+	if c.AccessKeySecret == "" {
+		c.AccessKeySecret = env("ACCESS_KEY_SECRET", "access_key_secret")
+	}
+	if c.Retries == 0 {
+		c.Retries = 3
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = 500 * time.Millisecond
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return c
+}
+
+// Client represents a connection to a Wave server. A Client is safe for concurrent use.
+type Client struct {
+	conf  Config
+	mu    sync.Mutex
+	pages map[string]*Page // url => page
+}
+
+// New returns a client for the server described by conf.
+func New(conf Config) *Client {
+	return &Client{conf: conf.withDefaults(), pages: make(map[string]*Page)}
+}
+
+// Page returns a reference to the page at url. The same url always returns the same Page.
+func (c *Client) Page(url string) *Page {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pages[url]
+	if !ok {
+		p = &Page{client: c, url: url}
+		c.pages[url] = p
+	}
+	return p
+}
+
+// Save sends the pending changes of every page obtained from this client, and returns the first error encountered.
+// Pages that fail to save keep their changes, so Save can be retried.
+func (c *Client) Save() error {
+	c.mu.Lock()
+	pages := make([]*Page, 0, len(c.pages))
+	for _, p := range c.pages {
+		pages = append(pages, p)
+	}
+	c.mu.Unlock()
+	var first error
+	for _, p := range pages {
+		if err := p.Save(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Error represents an error response from the server.
+type Error struct {
+	Method     string
+	URL        string
+	Status     int
+	Body       string
+	retryAfter time.Duration // as requested by the server, if at all
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("wave: %s %s: %d %s: %s", e.Method, e.URL, e.Status, http.StatusText(e.Status), e.Body)
+}
+
+// retryable reports whether a failed request should be retried: if the server turned it away (throttled,
+// or unavailable), or if it never reached the server. Other failed GETs are retried too, but other failed
+// patches are not, since the server may have applied them, and applying a patch twice can append twice.
+func retryable(method string, err error) bool {
+	if e, ok := err.(*Error); ok {
+		if e.Status == http.StatusTooManyRequests || e.Status == http.StatusServiceUnavailable {
+			return true
+		}
+		return method == http.MethodGet && e.Status >= 500
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return true
+	}
+	return method == http.MethodGet
+}
+
+// do sends a request, retrying with exponential backoff, or after as long as the server asks, and returns
+// the response body.
+func (c *Client) do(method, url string, body []byte) ([]byte, error) {
+	backoff := c.conf.Backoff
+	for attempt := 0; ; attempt++ {
+		b, err := c.send(method, url, body)
+		if err == nil || !retryable(method, err) || attempt >= c.conf.Retries {
+			return b, err
+		}
+		delay := backoff
+		if e, ok := err.(*Error); ok && e.retryAfter > 0 {
+			delay = e.retryAfter
+		}
+		time.Sleep(delay)
+		backoff *= 2
+	}
+}
+
+// retryAfter returns the delay requested by a response's Retry-After header, in seconds or as a date; 0 if none.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func (c *Client) send(method, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, c.conf.Address+url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.conf.AccessKeyID, c.conf.AccessKeySecret)
+	resp, err := c.conf.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, &Error{method, url, resp.StatusCode, strings.TrimSpace(string(b)), retryAfter(resp)}
+	}
+	return b, nil
+}
+
+// Buffer represents tabular card data, sent as a buffer so that the server can update it in place.
+// Use it as a card property value in Page.Set.
+type Buffer struct {
+	data map[string]interface{} // marshaled buffer
+}
+
+// CyclicBuffer returns a buffer holding the last size rows appended to it.
+// Append rows with Page.Update(card+" "+prop+" -1", row).
+func CyclicBuffer(fields []string, size int) *Buffer {
+	return &Buffer{map[string]interface{}{"c": map[string]interface{}{"f": fields, "n": size}}}
+}
+
+// FixedBuffer returns a buffer holding rows, addressed by index.
+func FixedBuffer(fields []string, rows [][]interface{}) *Buffer {
+	return &Buffer{map[string]interface{}{"f": map[string]interface{}{"f": fields, "d": rows, "n": len(rows)}}}
+}
+
+// MapBuffer returns a buffer holding rows, addressed by key.
+func MapBuffer(fields []string, rows map[string][]interface{}) *Buffer {
+	return &Buffer{map[string]interface{}{"m": map[string]interface{}{"f": fields, "d": rows}}}
+}
+
+// Page represents a page on the server. Changes are kept locally until saved. A Page is safe for concurrent use.
+type Page struct {
+	client  *Client
+	url     string
+	saving  sync.Mutex // serializes saves, so that changes are sent once, in order
+	mu      sync.Mutex // guards changes and ttl
+	changes []map[string]interface{}
+	ttl     int
+}
+
+// URL returns the page's url.
+func (p *Page) URL() string {
+	return p.url
+}
+
+func (p *Page) track(op map[string]interface{}) {
+	p.mu.Lock()
+	p.changes = append(p.changes, op)
+	p.mu.Unlock()
+}
+
+// Set adds a card to the page, replacing any card with the same name.
+// Properties whose values are Buffers are sent as buffers.
+func (p *Page) Set(card string, props map[string]interface{}) {
+	d := make(map[string]interface{}, len(props))
+	var bufs []interface{}
+	for k, v := range props {
+		if b, ok := v.(*Buffer); ok {
+			d["~"+k] = len(bufs)
+			bufs = append(bufs, b.data)
+			continue
+		}
+		d[k] = v
+	}
+	op := map[string]interface{}{"k": card, "d": d}
+	if len(bufs) > 0 {
+		op["b"] = bufs
+	}
+	p.track(op)
+}
+
+// Update sets an attribute. path is a card name followed by one or more space-separated attribute names,
+// list indices or buffer keys, e.g. "stats value" or "chart data -1". A nil value deletes the attribute.
+func (p *Page) Update(path string, value interface{}) {
+	op := map[string]interface{}{"k": path}
+	if value != nil {
+		op["v"] = value
+	}
+	p.track(op)
+}
+
+// Remove deletes a card from the page.
+func (p *Page) Remove(card string) {
+	p.track(map[string]interface{}{"k": card})
+}
+
+// Delete drops the page's contents.
+func (p *Page) Delete() {
+	p.track(map[string]interface{}{})
+}
+
+// Expire deletes the page ttl seconds after its last change, once saved. A negative ttl clears the expiry.
+func (p *Page) Expire(ttl int) {
+	p.mu.Lock()
+	p.ttl = ttl
+	p.mu.Unlock()
+}
+
+// Save sends the page's pending changes to the server as a single patch, retrying if the server is
+// unreachable, throttling or unavailable. If saving fails, the changes are kept, and are sent ahead of
+// later changes on the next save. Changes made while saving are kept for the next save.
+func (p *Page) Save() error {
+	p.saving.Lock()
+	defer p.saving.Unlock()
+
+	p.mu.Lock()
+	n, ttl := len(p.changes), p.ttl
+	if n == 0 && ttl == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	patch := map[string]interface{}{"d": p.changes[:n]}
+	if ttl != 0 {
+		patch["t"] = ttl
+	}
+	body, err := json.Marshal(patch)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if _, err := p.client.do(http.MethodPatch, p.url, body); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.changes = p.changes[n:]; len(p.changes) == 0 {
+		p.changes = nil
+	}
+	if p.ttl == ttl {
+		p.ttl = 0
+	}
+	return nil
+}
+
+// Load returns the page's current cards on the server, keyed by card name, as marshaled by the server:
+// {"d": properties, "b": buffers}. Pending changes are not included.
+func (p *Page) Load() (map[string]interface{}, error) {
+	b, err := p.client.do(http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	var page struct {
+		P struct {
+			C map[string]interface{} `json:"c"`
+		} `json:"p"`
+	}
+	if err := json.Unmarshal(b, &page); err != nil {
+		return nil, err
+	}
+	return page.P.C, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+const (
+	// clientPrefix is the url prefix of client pages: pages at clientPrefix/<client id>/... are sent only
+	// to the client (browser tab) having that id, and are deleted when it disconnects. Reserved, like
+	// other prefixes starting with "/_", so that it doesn't take over any app's pages.
+	clientPrefix = "/_client"
+	// viaClient identifies changes made by the server on behalf of a client going away.
+	viaClient = "client"
+)
+
+// own resolves a route watched or patched by the client. Routes under clientPrefix refer to the client's
+// own pages: /_client/counter is the page at /_client/<client id>/counter.
+func (c *Client) own(route string) string {
+	if !isPathPrefix(clientPrefix, route) {
+		return route
+	}
+	return clientPrefix + "/" + c.id + route[len(clientPrefix):]
+}
+
+// clientOf returns the id of the client whose page is at route, or "" if route is not a client page.
+func clientOf(route string) string {
+	if !isPathPrefix(clientPrefix, route) || len(route) <= len(clientPrefix)+1 {
+		return ""
+	}
+	return strings.SplitN(route[len(clientPrefix)+1:], "/", 2)[0]
+}
+
+// dropClientPages deletes the pages of a client that disconnected.
+func (b *Broker) dropClientPages(e Event) {
+	urls := b.site.pagesOf(e.Client.id)
+	if len(urls) == 0 {
+		return
+	}
+	ctx := withWriter(context.Background(), e.Client.username, viaClient)
+	for _, url := range urls {
+		b.deleteIf(ctx, url, nil)
+	}
+	echo(Log{"t": "client_pages_drop", "client": e.Client.addr, "id": e.Client.id, "pages": strconv.Itoa(len(urls))})
+}
+
+// pagesOf returns the urls of a client's pages. Unlike urlsUnder, it does not sort every url on the site,
+// since it is called whenever a client disconnects.
+func (site *Site) pagesOf(id string) []string {
+	prefix := clientPrefix + "/" + id
+	var urls []string
+	site.RLock()
+	defer site.RUnlock()
+	for url := range site.pages {
+		if isPathPrefix(prefix, url) {
+			urls = append(urls, url)
+		}
+	}
+	for url := range site.evicted {
+		if isPathPrefix(prefix, url) {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// dropClientPages discards client pages restored from a previous run, whose clients are gone, and returns
+// their urls, so that the deletions can be logged once the AOF is open. Must be called before the site is shared.
+func (site *Site) dropClientPages() []string {
+	urls := site.urlsUnder(clientPrefix)
+	for _, url := range urls {
+		site.del(url)
+	}
+	return urls
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestClientOwnRoutes(t *testing.T) {
+	c := &Client{id: "abc"}
+	for _, x := range []struct{ route, want string }{
+		{"/_client/counter", "/_client/abc/counter"},
+		{"/_client", "/_client/abc"},
+		{"/_clientx/counter", "/_clientx/counter"}, // not under /_client
+		{"/client/counter", "/client/counter"},     // an app's page
+		{"/home", "/home"},
+	} {
+		if got := c.own(x.route); got != x.want {
+			t.Errorf("own(%q) = %q, want %q", x.route, got, x.want)
+		}
+	}
+	for _, x := range []struct{ route, want string }{
+		{"/_client/abc/counter", "abc"},
+		{"/_client/abc", "abc"},
+		{"/_client", ""},
+		{"/client/abc/counter", ""},
+	} {
+		if got := clientOf(x.route); got != x.want {
+			t.Errorf("clientOf(%q) = %q, want %q", x.route, got, x.want)
+		}
+	}
+}
+
+func TestClientPagesPrivate(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	alice, bob := &Client{id: "a", username: "alice"}, &Client{id: "b", username: "alice"}
+	if !b.canAccess(alice, "/_client/a/counter") {
+		t.Error("client denied its own page")
+	}
+	if b.canAccess(bob, "/_client/a/counter") {
+		t.Error("client allowed another client's page, of the same user")
+	}
+	if b.site.acl.allows("/_client/a/counter", "alice", nil) {
+		t.Error("client page readable over HTTP without an access key")
+	}
+}
+
+func TestClientPagesDropped(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	ctx := context.Background()
+	for _, route := range []string{"/_client/a/counter", "/_client/a/todo/list", "/_client/b/counter", "/home"} {
+		b.patch(ctx, route, []byte(testPatch))
+	}
+	urls := b.site.pagesOf("a")
+	sort.Strings(urls)
+	if got := strings.Join(urls, " "); got != "/_client/a/counter /_client/a/todo/list" {
+		t.Fatalf("pagesOf: got %q", got)
+	}
+
+	b.dropClientPages(Event{Kind: clientDisconnected, Client: &Client{id: "a", addr: "test"}})
+	if b.site.at("/_client/a/counter") != nil || b.site.at("/_client/a/todo/list") != nil {
+		t.Error("disconnected client's pages kept")
+	}
+	if b.site.at("/_client/b/counter") == nil || b.site.at("/home") == nil {
+		t.Error("other pages dropped")
+	}
+
+	gone := b.site.dropClientPages() // as on restart
+	if len(gone) != 1 || gone[0] != "/_client/b/counter" {
+		t.Errorf("dropped on restart: got %v, want /_client/b/counter", gone)
+	}
+	if b.site.at("/_client/b/counter") != nil || b.site.at("/home") == nil {
+		t.Error("restored client pages kept, or other pages dropped")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the server's source of time, used for timestamps, TTLs, retention, heartbeats and schedules.
+// Implementations must be safe for concurrent use. Inject one via ServerConf to control time in tests
+// or when embedding the server.
+//
+// Durations must be measured as the difference of two Now() readings (or via Since()), never by comparing
+// wall clock values: the system clock's readings carry a monotonic component, so elapsed times, tickers and
+// timers are unaffected by wall clock jumps (NTP steps, VM suspend/resume). Network deadlines are not
+// governed by the clock, since they are enforced by the OS.
+type Clock interface {
+	Now() time.Time
+	// NewTicker returns a ticker that fires every d.
+	NewTicker(d time.Duration) Ticker
+	// After returns a channel that receives once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker delivers ticks at regular intervals.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+var clock Clock = systemClock{}
+
+// since returns the time elapsed since t, as per the configured clock.
+func since(t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) NewTicker(d time.Duration) Ticker       { return systemTicker{time.NewTicker(d)} }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
+
+// ManualClock is a Clock that only moves when told to. Tickers and timers fire as Advance() or Set()
+// pass their deadlines; like the system's, tickers drop ticks that the receiver is not ready for.
+type ManualClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+// NewManualClock creates a ManualClock reading t.
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{now: t}
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	c     chan time.Time
+	at    time.Time
+	every time.Duration // 0 for one-shot timers
+}
+
+func (t *manualTimer) C() <-chan time.Time { return t.c }
+
+func (t *manualTimer) Stop() {
+	c := t.clock
+	c.Lock()
+	defer c.Unlock()
+	c.remove(t)
+}
+
+// Now returns the clock's current reading.
+func (c *ManualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// NewTicker returns a ticker that fires every d of clock time.
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return c.add(d, d)
+}
+
+// After returns a channel that receives once the clock has advanced by d.
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).c
+}
+
+// Advance moves the clock forward by d, firing due tickers and timers.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// Set moves the clock to t, firing due tickers and timers. Setting the clock backwards,
+// as when the wall clock jumps, does not fire anything.
+func (c *ManualClock) Set(t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.set(t)
+}
+
+func (c *ManualClock) add(d, every time.Duration) *manualTimer {
+	c.Lock()
+	defer c.Unlock()
+	t := &manualTimer{c, make(chan time.Time, 1), c.now.Add(d), every}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *ManualClock) set(now time.Time) {
+	c.now = now
+	sort.Slice(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+	var pending []*manualTimer
+	for _, t := range c.timers {
+		if t.at.After(now) {
+			pending = append(pending, t)
+			continue
+		}
+		select {
+		case t.c <- t.at:
+		default: // receiver not ready; drop tick
+		}
+		if t.every > 0 {
+			for !t.at.After(now) {
+				t.at = t.at.Add(t.every)
+			}
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+}
+
+func (c *ManualClock) remove(t *manualTimer) {
+	for i, x := range c.timers {
+		if x == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
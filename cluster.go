@@ -0,0 +1,481 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	peerQueueSize = 4096             // changes buffered per peer before dropping
+	peerBatchSize = 256              // changes sent per request
+	peerBodySize  = 4 * maxPatchSize // bytes, in a replication request body; more changes are split across requests
+	peerMaxDelay  = 30 * time.Second // maximum backoff between failed sends
+)
+
+// ClusterConf represents settings for replicating page changes between servers.
+type ClusterConf struct {
+	Peers           []string // base URLs of the other servers in the cluster, e.g. http://10.0.0.2:10101
+	AccessKeyID     string   // credentials presented to peers; all peers must accept them
+	AccessKeySecret string
+}
+
+// Replica represents a page change replicated from another server.
+type Replica struct {
+	Node   string          `json:"node"`   // originating server
+	Marker string          `json:"marker"` // AOF marker: patch, compacted page or delete
+	Route  string          `json:"route"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// Cluster replicates page changes made on this server to its peers, so that clients connected to any
+// server receive all updates. Each server forwards only the changes that originated on it.
+// Changes to the same page made concurrently on different servers may be applied in different orders.
+type Cluster struct {
+	node  string
+	peers []*Peer
+}
+
+// Peer represents another server in the cluster.
+// If changes are dropped because the peer's queue is full, the peer is marked stale, and once it accepts
+// changes again, it is sent the current state of the pages and access rules whose changes it missed.
+type Peer struct {
+	sync.Mutex
+	node       string // this server
+	url        string
+	conf       ClusterConf
+	queue      chan Replica
+	client     *http.Client
+	sent       int             // changes accepted by the peer
+	lastErr    string          // last failure to send, if the peer has not accepted changes since
+	stalePages map[string]bool // pages whose changes were dropped, to be resent whole
+	staleACL   map[string]bool // access rules whose changes were dropped, to be resent
+	resync     chan struct{}   // signals that the peer went stale
+}
+
+// PeerStatus represents the replication status of a peer, for administration.
+type PeerStatus struct {
+	URL    string `json:"url"`
+	Queued int    `json:"queued"` // changes waiting to be sent
+	Sent   int    `json:"sent"`
+	Stale  int    `json:"stale,omitempty"` // pages and access rules waiting to be resent, because changes to them were dropped
+	Error  string `json:"error,omitempty"`
+}
+
+func (c *Cluster) status() []PeerStatus {
+	xs := make([]PeerStatus, len(c.peers))
+	for i, p := range c.peers {
+		p.Lock()
+		xs[i] = PeerStatus{p.url, len(p.queue), p.sent, len(p.stalePages) + len(p.staleACL), p.lastErr}
+		p.Unlock()
+	}
+	return xs
+}
+
+var cluster *Cluster // nil unless clustering
+
+func newCluster(conf ClusterConf) *Cluster {
+	c := &Cluster{node: uuid.New().String()}
+	for _, url := range conf.Peers {
+		c.peers = append(c.peers, &Peer{
+			sync.Mutex{}, c.node, strings.TrimSuffix(url, "/"), conf, make(chan Replica, peerQueueSize),
+			&http.Client{Timeout: 30 * time.Second}, 0, "", make(map[string]bool), make(map[string]bool), make(chan struct{}, 1),
+		})
+	}
+	return c
+}
+
+// run starts sending changes to each peer, until the broker stops.
+func (c *Cluster) run(b *Broker) {
+	for _, p := range c.peers {
+		p := p
+		b.spawn(func() { p.run(b) })
+	}
+}
+
+// forward queues a change for every peer. System pages are local to each server, and are not replicated.
+func (c *Cluster) forward(ctx context.Context, marker, route string, data []byte) {
+	if writerFrom(ctx).Via == viaPeer || isPathPrefix(systemPrefix, route) {
+		return
+	}
+	r := Replica{c.node, marker, route, data}
+	for _, p := range c.peers {
+		select {
+		case p.queue <- r:
+		default:
+			stats.replicaDropped()
+			p.Lock()
+			if p.markStale(r) {
+				echo(Log{"t": "peer_stale", "peer": p.url, "route": route})
+			}
+			p.Unlock()
+		}
+	}
+}
+
+// markStale records that a change was not sent to the peer, and reports whether the peer was up to date until now.
+// Must be called under lock.
+func (p *Peer) markStale(r Replica) bool {
+	fresh := len(p.stalePages) == 0 && len(p.staleACL) == 0
+	if r.Marker == aclMarker {
+		p.staleACL[r.Route] = true
+	} else {
+		p.stalePages[r.Route] = true
+	}
+	select {
+	case p.resync <- struct{}{}:
+	default:
+	}
+	return fresh
+}
+
+const viaPeer = "peer"
+
+// aclMarker marks replicas of access rules, as set with SetACL. Unlike other markers, it never appears in the AOF.
+const aclMarker = "acl"
+
+// run sends queued changes to the peer in batches, retrying with exponential backoff until accepted,
+// and resends what the peer missed once it goes stale, until the broker stops.
+func (p *Peer) run(b *Broker) {
+	for {
+		select {
+		case r := <-p.queue:
+			batch := []Replica{r}
+		drain:
+			for len(batch) < peerBatchSize {
+				select {
+				case r := <-p.queue:
+					batch = append(batch, r)
+				default:
+					break drain
+				}
+			}
+			if !p.deliver(batch, b.quit) {
+				return
+			}
+		case <-p.resync:
+			rs := p.catchUp(b)
+			for len(rs) > 0 {
+				n := len(rs)
+				if n > peerBatchSize {
+					n = peerBatchSize
+				}
+				if !p.deliver(rs[:n], b.quit) {
+					return
+				}
+				rs = rs[n:]
+			}
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// catchUp returns replicas bringing the peer up to date with the pages and access rules it went stale on,
+// and marks it up to date. Changes still queued for the peer are superseded, and discarded.
+func (p *Peer) catchUp(b *Broker) []Replica {
+	b.pubMux.Lock() // no page changes, so none are queued in the meantime
+	defer b.pubMux.Unlock()
+	p.Lock()
+drain:
+	for {
+		select {
+		case r := <-p.queue:
+			p.markStale(r)
+		default:
+			break drain
+		}
+	}
+	pages, acl := p.stalePages, p.staleACL
+	p.stalePages, p.staleACL = make(map[string]bool), make(map[string]bool)
+	select { // marking queued changes stale signalled again
+	case <-p.resync:
+	default:
+	}
+	p.Unlock()
+
+	var rs []Replica
+	for _, route := range sortedKeys(pages) {
+		var data []byte
+		if page := b.site.peek(route); page != nil {
+			data = page.snapshot()
+		}
+		if data != nil {
+			rs = append(rs, Replica{p.node, compactMarker, route, data})
+		} else {
+			rs = append(rs, Replica{p.node, deleteMarker, route, emptyJSON})
+		}
+	}
+	for _, route := range sortedKeys(acl) {
+		q := b.site.acl.get(route)
+		data, err := json.Marshal(q)
+		if err != nil {
+			continue
+		}
+		rs = append(rs, Replica{p.node, aclMarker, route, data})
+	}
+	echo(Log{"t": "peer_resync", "peer": p.url, "pages": strconv.Itoa(len(pages)), "acl": strconv.Itoa(len(acl))})
+	return rs
+}
+
+// deliver sends a batch of changes to the peer, in as many requests as it takes to keep each under
+// peerBodySize, retrying each with exponential backoff until accepted. A change too large for the peer
+// to accept on its own is dropped. Reports false if quit was closed before the batch was delivered.
+func (p *Peer) deliver(batch []Replica, quit <-chan struct{}) bool {
+	for len(batch) > 0 {
+		n, body, err := encodeReplicas(batch)
+		if err != nil {
+			echo(Log{"t": "peer_send", "peer": p.url, "error": err.Error()})
+			return true
+		}
+		if !p.post(body, n, quit) {
+			return false
+		}
+		batch = batch[n:]
+	}
+	return true
+}
+
+// encodeReplicas encodes as many changes from the head of batch as fit in peerBodySize, and at least one.
+func encodeReplicas(batch []Replica) (int, []byte, error) {
+	var buf bytes.Buffer
+	for i, r := range batch {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if i > 0 && buf.Len()+len(b)+1 > peerBodySize {
+			return i, buf.Bytes(), nil
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return len(batch), buf.Bytes(), nil
+}
+
+// post sends n encoded changes to the peer, retrying with exponential backoff until accepted.
+// Gives up, reporting false, once quit is closed.
+func (p *Peer) post(body []byte, n int, quit <-chan struct{}) bool {
+	for delay := time.Second; ; delay *= 2 {
+		err := p.send(body)
+		if err == errPeerBodyTooLarge {
+			echo(Log{"t": "peer_send", "peer": p.url, "error": err.Error(), "dropped": strconv.Itoa(n)})
+			err = nil // retrying won't help
+		}
+		p.Lock()
+		if err == nil {
+			p.sent += n
+			p.lastErr = ""
+		} else {
+			p.lastErr = err.Error()
+		}
+		p.Unlock()
+		if err == nil {
+			return true
+		}
+		if delay > peerMaxDelay {
+			delay = peerMaxDelay
+		}
+		echo(Log{"t": "peer_send", "peer": p.url, "error": err.Error(), "retry": delay.String()})
+		select {
+		case <-clock.After(delay):
+		case <-quit:
+			return false
+		}
+	}
+}
+
+var errPeerBodyTooLarge = errors.New("peer refused the request as too large")
+
+func (p *Peer) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, p.url+"/_peer", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.conf.AccessKeyID, p.conf.AccessKeySecret)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusRequestEntityTooLarge:
+		return errPeerBodyTooLarge
+	}
+	return fmt.Errorf("peer replied %s", resp.Status)
+}
+
+// join initializes site with a compacted copy of the first peer that responds, so that a server
+// (re)joining the cluster starts with current content.
+func (c *Cluster) join(site *Site) {
+	for _, p := range c.peers {
+		req, err := http.NewRequest(http.MethodGet, p.url+"/_peer", nil)
+		if err != nil {
+			continue
+		}
+		req.SetBasicAuth(p.conf.AccessKeyID, p.conf.AccessKeySecret)
+		resp, err := p.client.Do(req)
+		if err != nil {
+			echo(Log{"t": "peer_join", "peer": p.url, "error": err.Error()})
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			echo(Log{"t": "peer_join", "peer": p.url, "error": resp.Status})
+			continue
+		}
+		n := 0
+		r := bufio.NewReaderSize(resp.Body, 64*1024)
+		for {
+			line, err := r.ReadBytes('\n')
+			if ok, err := replayEntry(site, bytes.TrimSpace(line)); err != nil {
+				echo(Log{"t": "peer_join", "peer": p.url, "error": err.Error()})
+			} else if ok {
+				n++
+			}
+			if err != nil {
+				break
+			}
+		}
+		resp.Body.Close()
+		echo(Log{"t": "peer_join", "peer": p.url, "pages": fmt.Sprint(n)})
+		if err := p.joinACL(site); err != nil {
+			echo(Log{"t": "peer_join", "peer": p.url, "error": "access rules: " + err.Error()})
+		}
+		return
+	}
+}
+
+// joinACL replaces the site's access rules with the peer's.
+func (p *Peer) joinACL(site *Site) error {
+	req, err := http.NewRequest(http.MethodGet, p.url+"/_peer?acl=1", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.conf.AccessKeyID, p.conf.AccessKeySecret)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer replied %s", resp.Status)
+	}
+	var rules []SetACL
+	if err := json.NewDecoder(resp.Body).Decode(&rules); err != nil {
+		return err
+	}
+	return site.acl.load(rules)
+}
+
+// replicate applies a change forwarded by a peer, without forwarding it again.
+func (b *Broker) replicate(r Replica) error {
+	ctx := withWriter(context.Background(), r.Node, viaPeer)
+	switch r.Marker {
+	case patchMarker:
+		ops, err := parsePatch(r.Data)
+		if err != nil {
+			return err
+		}
+		_, err = b.execIf(ctx, r.Route, r.Data, ops, -1)
+		return err
+	case compactMarker:
+		return b.replace(ctx, r.Route, r.Data)
+	case deleteMarker:
+		b.deleteIf(ctx, r.Route, nil)
+		return nil
+	case aclMarker:
+		var q SetACL
+		if err := json.Unmarshal(r.Data, &q); err != nil {
+			return err
+		}
+		return b.site.acl.put(q)
+	}
+	return fmt.Errorf("unknown marker %q", r.Marker)
+}
+
+// PeerHandler exchanges page changes with other servers in the cluster.
+type PeerHandler struct {
+	broker *Broker
+	auth   *Auth
+}
+
+func newPeerHandler(broker *Broker, auth *Auth) *PeerHandler {
+	return &PeerHandler{broker, auth}
+}
+
+func (h *PeerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth.trusted(r); !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet: // join: send a compacted copy of the site, or its access rules
+		if r.URL.Query().Get("acl") != "" {
+			w.Header().Set("Content-Type", contentTypeJSON)
+			json.NewEncoder(w).Encode(h.broker.site.acl.list())
+			return
+		}
+		var buf bytes.Buffer
+		h.broker.pubMux.Lock()
+		h.broker.writeCompacted(log.New(&buf, "", log.LstdFlags), Progress{})
+		h.broker.pubMux.Unlock()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(buf.Bytes())
+	case http.MethodPost: // replicate
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, peerBodySize))
+		if err != nil {
+			if len(body) >= peerBodySize {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		for dec.More() {
+			var q Replica
+			if err := dec.Decode(&q); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			if cluster != nil && q.Node == cluster.node { // listed as its own peer
+				continue
+			}
+			if err := h.broker.replicate(q); err != nil {
+				echo(Log{"t": "peer_replicate", "node": q.Node, "route": q.Route, "error": err.Error()})
+			}
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeerResync(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []Replica
+	)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dec := json.NewDecoder(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		for dec.More() {
+			var q Replica
+			if err := dec.Decode(&q); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			received = append(received, q)
+		}
+	}))
+	defer peer.Close()
+
+	b := newTestBroker(t, Backpressure{})
+	c := newCluster(ClusterConf{Peers: []string{peer.URL}})
+	p := c.peers[0]
+	p.queue = make(chan Replica, 2)
+	defer func(c *Cluster) { cluster = c }(cluster)
+	cluster = c
+
+	ctx := withWriter(context.Background(), "alice", "http")
+	for _, route := range []string{"/a", "/b", "/c", "/d"} {
+		if _, err := b.patchIf(ctx, route, []byte(testPatch), -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.deleteIf(ctx, "/d", nil)
+	if s := c.status()[0]; s.Stale != 2 || s.Queued != 2 {
+		t.Fatalf("want 2 changes queued and 2 pages stale, got %+v", s)
+	}
+
+	c.run(b)
+	defer b.stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n >= 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want 4 pages resent, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // nothing else arrives
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The queued changes to /a and /b are either sent, or superseded by the pages, depending on whether the
+	// peer's sender gets to them before it resyncs; the dropped changes to /c and /d are made up for.
+	want := map[string][]string{
+		"/a": {patchMarker, compactMarker},
+		"/b": {patchMarker, compactMarker},
+		"/c": {compactMarker},
+		"/d": {deleteMarker},
+	}
+	if len(received) != len(want) {
+		t.Fatalf("want %d replicas, got %+v", len(want), received)
+	}
+	for _, r := range received {
+		if r.Node != c.node || (r.Marker != want[r.Route][0] && r.Marker != want[r.Route][len(want[r.Route])-1]) {
+			t.Errorf("%s: want one of %v from %s, got %+v", r.Route, want[r.Route], c.node, r)
+		}
+	}
+	if s := c.status()[0]; s.Stale != 0 || s.Queued != 0 {
+		t.Fatalf("want the peer up to date, got %+v", s)
+	}
+}
+
+func TestEncodeReplicas(t *testing.T) {
+	big := json.RawMessage(`{"d":[{"k":"c content","v":"` + strings.Repeat("x", peerBodySize/3) + `"}]}`)
+	batch := []Replica{{Route: "/a", Data: big}, {Route: "/b", Data: big}, {Route: "/c", Data: big}, {Route: "/d", Data: big}}
+	var routes []string
+	for len(batch) > 0 {
+		n, body, err := encodeReplicas(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 || (n > 1 && len(body) > peerBodySize) {
+			t.Fatalf("want at least one change, in at most %d bytes; got %d in %d", peerBodySize, n, len(body))
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		for dec.More() {
+			var q Replica
+			if err := dec.Decode(&q); err != nil {
+				t.Fatal(err)
+			}
+			routes = append(routes, q.Route)
+		}
+		batch = batch[n:]
+	}
+	if got := strings.Join(routes, ","); got != "/a,/b,/c,/d" {
+		t.Fatalf("want every change once, in order; got %s", got)
+	}
+}
+
+func TestPeerGivesUpOnQuit(t *testing.T) {
+	tried := make(chan struct{}, 1)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case tried <- struct{}{}:
+		default:
+		}
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	}))
+	defer peer.Close()
+
+	b := newTestBroker(t, Backpressure{})
+	p := newCluster(ClusterConf{Peers: []string{peer.URL}}).peers[0]
+	p.queue <- Replica{p.node, patchMarker, "/a", []byte(testPatch)}
+	done := make(chan struct{})
+	go func() {
+		p.run(b)
+		close(done)
+	}()
+	<-tried
+	close(b.quit)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer kept retrying after quit")
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.lastErr == "" || p.sent != 0 {
+		t.Errorf("want the failure reported, got sent %d, error %q", p.sent, p.lastErr)
+	}
+}
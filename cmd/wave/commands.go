@@ -0,0 +1,135 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/h2oai/wave"
+)
+
+// newCommand returns the flag set for a command that takes a single file argument.
+func newCommand(name, arg, about string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [options] %s\n%s\n\nOptions:\n", os.Args[0], name, arg, about)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// withOutput calls write with the file at path, or the standard output if path is empty or "-",
+// replacing the file only if write succeeds; returns the exit code.
+func withOutput(path string, write func(io.Writer) error) int {
+	if path == "" || path == "-" {
+		if err := write(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// compact writes a compacted copy of an AOF log; returns the exit code.
+func compact(args []string) int {
+	fs := newCommand("compact", "<aof>", "Write a compacted copy of an AOF log file, or directory of rotated AOF segments.")
+	out := fs.String("o", "", "write to this file instead of the standard output")
+	skipErrors := fs.Bool("skip-errors", false, "skip malformed AOF entries instead of failing")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	return withOutput(*out, func(w io.Writer) error { return wave.CompactAOF(w, fs.Arg(0), *skipErrors) })
+}
+
+// dump writes the pages in an AOF log as JSON; returns the exit code.
+func dump(args []string) int {
+	fs := newCommand("dump", "<aof>", "Write the pages in an AOF log file, or directory of rotated AOF segments, as a JSON object keyed by page url.")
+	out := fs.String("o", "", "write to this file instead of the standard output")
+	skipErrors := fs.Bool("skip-errors", false, "skip malformed AOF entries instead of failing")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	return withOutput(*out, func(w io.Writer) error { return wave.DumpAOF(w, fs.Arg(0), *skipErrors) })
+}
+
+// load converts pages dumped as JSON to an AOF log; returns the exit code.
+func load(args []string) int {
+	fs := newCommand("load", "<json>", "Write pages dumped as JSON (by dump, or the export job) as an AOF log, for use with -init. Reads the standard input if <json> is -.")
+	out := fs.String("o", "", "write to this file instead of the standard output")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	in := os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	return withOutput(*out, func(w io.Writer) error { return wave.LoadDump(w, in) })
+}
+
+// keygen generates an access key pair, and adds it to the keychain; returns the exit code.
+func keygen(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s keygen [options]\nGenerate an access key pair, and add the key ID and a hash of the secret to the keychain.\nThe secret is printed once, and not stored.\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	keychain := fs.String("keychain", wave.DefaultKeychain, "keychain file to add the key to")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	id, secret, err := wave.GenerateAccessKey(*keychain)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s_ACCESS_KEY_ID=%s\n%s_ACCESS_KEY_SECRET=%s\n", envVarNamePrefix, id, envVarNamePrefix, secret)
+	return 0
+}
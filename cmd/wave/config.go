@@ -0,0 +1,346 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Settings are taken, in order of precedence, from command line flags, H2O_WAVE_* environment variables,
+// the config file, and flag defaults. Every flag can be set in all three places, under the same name.
+
+// setting represents a value read from a config file.
+type setting struct {
+	value string
+	line  int
+}
+
+// readConfigFile reads flag values from a TOML or YAML file, depending on its extension.
+// Only flat files are supported: keys are flag names, optionally grouped under a table or mapping named after
+// their common prefix ([aof] dir = ... for -aof-dir); lists are joined with commas.
+func readConfigFile(path string) (map[string]setting, error) {
+	var parse func(*bufio.Scanner) (map[string]setting, error)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		parse = parseTOML
+	case ".yaml", ".yml":
+		parse = parseYAML
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file format: want .toml, .yaml or .yml", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	settings, err := parse(bufio.NewScanner(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return settings, nil
+}
+
+// lineError represents a syntax error on a line of a config file.
+type lineError struct {
+	line int
+	msg  string
+}
+
+func (e lineError) Error() string { return fmt.Sprintf("%d: %s", e.line, e.msg) }
+
+func parseTOML(sc *bufio.Scanner) (map[string]setting, error) {
+	settings := make(map[string]setting)
+	table := ""
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, lineError{n, "malformed table header"}
+			}
+			table = settingName(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return nil, lineError{n, "want key = value"}
+		}
+		v, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, lineError{n, err.Error()}
+		}
+		if err := put(settings, joinName(table, settingName(strings.TrimSpace(line[:eq]))), v, n); err != nil {
+			return nil, err
+		}
+	}
+	return settings, sc.Err()
+}
+
+func parseYAML(sc *bufio.Scanner) (map[string]setting, error) {
+	settings := make(map[string]setting)
+	parent, list := "", "" // current mapping; key collecting a block list
+	var items []string
+	for n := 1; sc.Scan(); n++ {
+		text := stripComment(sc.Text())
+		line := strings.TrimSpace(text)
+		if line == "" || line == "---" {
+			continue
+		}
+		indented := text[0] == ' ' || text[0] == '\t'
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			if list == "" {
+				return nil, lineError{n, "list item outside a list"}
+			}
+			v, err := parseValue(strings.TrimSpace(strings.TrimPrefix(line, "-")))
+			if err != nil {
+				return nil, lineError{n, err.Error()}
+			}
+			items = append(items, v)
+			s, ok := settings[list]
+			if !ok {
+				s.line = n
+			}
+			s.value = strings.Join(items, ",")
+			settings[list] = s
+			continue
+		}
+		list, items = "", nil
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return nil, lineError{n, "want key: value"}
+		}
+		key, rest := settingName(strings.TrimSpace(line[:colon])), strings.TrimSpace(line[colon+1:])
+		if !indented {
+			parent = ""
+		} else if parent == "" {
+			return nil, lineError{n, "unexpected indentation"}
+		}
+		name := joinName(parent, key)
+		if rest == "" { // mapping or block list follows
+			if indented {
+				list = name
+			} else {
+				parent, list = key, key
+			}
+			continue
+		}
+		v, err := parseValue(rest)
+		if err != nil {
+			return nil, lineError{n, err.Error()}
+		}
+		if err := put(settings, name, v, n); err != nil {
+			return nil, err
+		}
+	}
+	return settings, sc.Err()
+}
+
+func put(settings map[string]setting, name, value string, line int) error {
+	if prev, ok := settings[name]; ok {
+		return lineError{line, fmt.Sprintf("%s already set on line %d", name, prev.line)}
+	}
+	settings[name] = setting{value, line}
+	return nil
+}
+
+// parseValue parses a quoted or bare scalar, or an inline list.
+func parseValue(s string) (string, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return "", fmt.Errorf("unterminated list")
+		}
+		var items []string
+		for _, item := range splitList(s[1 : len(s)-1]) {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			v, err := parseValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ","), nil
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1], nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("malformed string %s", s)
+		}
+		return v, nil
+	}
+	return s, nil
+}
+
+// splitList splits the contents of an inline list on commas outside quotes.
+func splitList(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// stripComment removes a trailing # comment that is outside quotes.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// settingName normalizes a config file key to a flag name: "access_key_id" => "access-key-id".
+func settingName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.Trim(key, `"'`), "_", "-"))
+}
+
+func joinName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "-" + name
+}
+
+// applySettings sets flags not given on the command line from the environment, then from the config file at path,
+// if any. Settings that are not flags, or fail to parse, are reported together.
+func applySettings(path string, skip ...string) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, name := range skip {
+		explicit[name] = true
+	}
+
+	var file map[string]setting
+	if path != "" {
+		var err error
+		if file, err = readConfigFile(path); err != nil {
+			return err
+		}
+	}
+
+	var unknown []string
+	for name := range file {
+		if flag.Lookup(name) == nil {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Slice(unknown, func(i, j int) bool { return file[unknown[i]].line < file[unknown[j]].line })
+	var errs []string
+	for _, name := range unknown {
+		msg := fmt.Sprintf("%s:%d: unknown setting %q", path, file[name].line, name)
+		if alt := closestFlag(name); alt != "" {
+			msg += fmt.Sprintf("; did you mean %q?", alt)
+		}
+		errs = append(errs, msg)
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] {
+			return
+		}
+		env := envVarName(f.Name)
+		if v, ok := os.LookupEnv(env); ok {
+			if err := flag.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: invalid value %q for -%s: %v", env, v, f.Name, err))
+			}
+		} else if s, ok := file[f.Name]; ok {
+			if err := flag.Set(f.Name, s.value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s:%d: invalid value %q for %s: %v", path, s.line, s.value, f.Name, err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// closestFlag returns the name of the flag nearest to name by edit distance, if it is a plausible misspelling.
+func closestFlag(name string) string {
+	best, bestD := "", 3
+	flag.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(name, f.Name); d < bestD {
+			best, bestD = f.Name, d
+		}
+	})
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// values returns the values of settings, without their line numbers.
+func values(settings map[string]setting) map[string]string {
+	m := make(map[string]string, len(settings))
+	for k, s := range settings {
+		m[k] = s.value
+	}
+	return m
+}
+
+var wantSettings = map[string]string{
+	"listen":            ":10101",
+	"access-key-secret": "s3cret # not a comment",
+	"allowed-origins":   "https://example.com,https://*.example.com",
+	"aof-dir":           "/var/lib/wave/aof",
+	"aof-fsync":         "always",
+}
+
+func TestParseTOML(t *testing.T) {
+	const doc = `
+# server
+listen = ":10101"
+access_key_secret = "s3cret # not a comment"
+allowed-origins = ["https://example.com", 'https://*.example.com'] # two
+
+[aof]
+dir = "/var/lib/wave/aof"
+fsync = always
+`
+	settings, err := parseTOML(bufio.NewScanner(strings.NewReader(doc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := values(settings); !reflect.DeepEqual(got, wantSettings) {
+		t.Fatalf("want %v, got %v", wantSettings, got)
+	}
+	if line := settings["aof-fsync"].line; line != 9 {
+		t.Errorf("aof-fsync: want line 9, got %d", line)
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	const doc = `---
+listen: ":10101"
+access_key_secret: "s3cret # not a comment"
+allowed-origins:
+  - https://example.com
+  - 'https://*.example.com'
+aof:
+  dir: /var/lib/wave/aof # data
+  fsync: always
+`
+	settings, err := parseYAML(bufio.NewScanner(strings.NewReader(doc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := values(settings); !reflect.DeepEqual(got, wantSettings) {
+		t.Fatalf("want %v, got %v", wantSettings, got)
+	}
+	if line := settings["allowed-origins"].line; line != 5 {
+		t.Errorf("allowed-origins: want line 5, got %d", line)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	cases := []struct {
+		parse func(*bufio.Scanner) (map[string]setting, error)
+		doc   string
+		want  string
+	}{
+		{parseTOML, "listen = 1\nlisten = 2\n", "2: listen already set on line 1"},
+		{parseTOML, "[aof\n", "1: malformed table header"},
+		{parseTOML, "[[peers]]\n", "1: malformed table header"},
+		{parseTOML, "listen\n", "1: want key = value"},
+		{parseTOML, "origins = [\"a\"\n", "1: unterminated list"},
+		{parseTOML, "secret = \"abc\n", "1: malformed string \"abc"},
+		{parseYAML, "- a\n", "1: list item outside a list"},
+		{parseYAML, "  listen: 1\n", "1: unexpected indentation"},
+		{parseYAML, "listen\n", "1: want key: value"},
+		{parseYAML, "aof:\n  dir: a\naof-dir: b\n", "3: aof-dir already set on line 2"},
+	}
+	for _, c := range cases {
+		_, err := c.parse(bufio.NewScanner(strings.NewReader(c.doc)))
+		if err == nil || err.Error() != c.want {
+			t.Errorf("%q: want error %q, got %v", c.doc, c.want, err)
+		}
+	}
+}
@@ -15,12 +15,16 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/h2oai/wave"
 )
@@ -38,24 +42,143 @@ var (
 )
 
 func main() {
-	// TODO Use github.com/gosidekick/goconfig instead.
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, ok := commands[args[0]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(cmd(args[1:]))
+	}
+	serve(args)
+}
+
+// commands maps subcommand names to functions that take arguments and return the exit code.
+var commands = map[string]func([]string) int{
+	"serve":       func(args []string) int { serve(args); return 0 },
+	"compact":     compact,
+	"dump":        dump,
+	"load":        load,
+	"keygen":      keygen,
+	"conformance": conformance,
+	"bench":       bench,
+}
+
+// usage prints the available commands, followed by the server's options.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [serve] [options]\n", os.Args[0])
+	fmt.Fprintf(out, "       %s compact|dump|load|keygen|conformance|bench [options] [args]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Commands:")
+	fmt.Fprintln(out, "  serve        run the server (default)")
+	fmt.Fprintln(out, "  compact      write a compacted copy of an AOF log")
+	fmt.Fprintln(out, "  dump         write the pages in an AOF log as JSON")
+	fmt.Fprintln(out, "  load         write pages dumped as JSON as an AOF log, for use with -init")
+	fmt.Fprintln(out, "  keygen       generate an access key pair, adding it to the keychain")
+	fmt.Fprintln(out, "  conformance  check a running server's protocol implementation")
+	fmt.Fprintln(out, "  bench        measure how fast a running server delivers patches to many clients")
+	fmt.Fprintf(out, "\nRun '%s <command> -help' for a command's options. Options for serve:\n", os.Args[0])
+	flag.PrintDefaults()
+}
 
+// serve runs the server.
+func serve(args []string) {
 	var (
-		conf    wave.ServerConf
-		version bool
+		conf     wave.ServerConf
+		config   string
+		version  bool
+		logLevel string
+		peers    string
+		origins  string
+		trusted  string
+		spaSkip  string
+		exported string
+		traceLog bool
 	)
 
 	flag.BoolVar(&version, "version", false, "print version and exit")
-	flag.StringVar(&conf.Listen, "listen", ":10101", "listen on this address")
-	flag.StringVar(&conf.WebDir, "web-dir", "./www", "directory to serve web assets from")
+	flag.StringVar(&config, "config", "", "read settings from this TOML or YAML file; keys are flag names (e.g. access-key-secret); flags and "+envVarNamePrefix+"_* environment variables take precedence")
+	flag.StringVar(&conf.Listen, "listen", ":10101", "listen on this address, or unix:///path/to.sock; or a comma-separated list of addresses, each optionally prefixed by what it serves: all=, public= (browsers) or api= (producers and admin), e.g. public=:10101,api=unix:///run/wave.sock")
+	flag.StringVar(&conf.WebDir, "web-dir", "./www", "directory or http(s)/S3 origin URL to serve web assets from")
 	flag.StringVar(&conf.DataDir, "data-dir", "./data", "directory to store site data")
 	flag.StringVar(&conf.AccessKeyID, "access-key-id", "access_key_id", "default access key ID")
 	flag.StringVar(&conf.AccessKeySecret, "access-key-secret", "access_key_secret", "default access key secret")
-	flag.StringVar(&conf.Init, "init", "", "initialize site content from AOF log")
-	flag.StringVar(&conf.Compact, "compact", "", "compact AOF log")
+	flag.StringVar(&conf.Keychain, "keychain", wave.DefaultKeychain, "file holding additional access keys, as generated by the keygen command; ignored if missing")
+	flag.StringVar(&conf.Init, "init", "", "initialize site content from AOF log file, directory of rotated AOF segments, or -aof-archive-url archive")
+	flag.StringVar(&conf.Compact, "compact", "", "compact AOF log file, or directory of rotated AOF segments")
+	flag.StringVar(&conf.AOF.Archive.URL, "aof-archive-url", "", "upload AOF segments superseded by a daily checkpoint to this S3-compatible bucket URL, with an index; replay with -init <url> (-aof-dir only)")
+	flag.StringVar(&conf.AOF.Archive.AccessKeyID, "aof-archive-access-key-id", "", "access key ID for signing -aof-archive-url requests; unsigned if empty")
+	flag.StringVar(&conf.AOF.Archive.SecretAccessKey, "aof-archive-secret-access-key", "", "secret access key for signing -aof-archive-url requests")
+	flag.StringVar(&conf.AOF.Archive.Region, "aof-archive-region", "us-east-1", "signing region for -aof-archive-url")
+	flag.DurationVar(&conf.AOF.Archive.Retention, "aof-archive-retention", 7*24*time.Hour, "keep superseded AOF segments on disk for this long before archiving them")
+	flag.StringVar(&conf.AOF.Dir, "aof-dir", "", "write the AOF log to rotated segments in this directory instead of the standard output; replay with -init")
+	flag.Int64Var(&conf.AOF.MaxBytes, "aof-max-bytes", 0, "start a new AOF segment once the current one grows beyond this size; 0 = never (-aof-dir only)")
+	flag.DurationVar(&conf.AOF.MaxAge, "aof-max-age", 0, "start a new AOF segment once the current one is older than this; 0 = never (-aof-dir only)")
+	flag.StringVar(&conf.AOF.Fsync, "aof-fsync", "interval", "AOF durability: always (sync every entry), interval (sync every -aof-fsync-interval) or never (leave to OS) (-aof-dir only)")
+	flag.DurationVar(&conf.AOF.FsyncInterval, "aof-fsync-interval", time.Second, "AOF sync period for -aof-fsync interval")
+	flag.StringVar(&conf.Record, "record", "", "record applied patches, with timestamps, to this file for replay with -replay")
+	flag.StringVar(&conf.Replay, "replay", "", "replay patches recorded with -record at startup")
+	flag.Float64Var(&conf.ReplaySpeed, "replay-speed", 1, "replay speed multiplier, e.g. 10 for 10x; 0 = as fast as possible")
+	flag.BoolVar(&conf.InitSkipErrors, "init-skip-errors", false, "skip malformed AOF entries instead of failing (-init and -compact)")
 	flag.StringVar(&conf.CertFile, "tls-cert-file", "", "path to certificate file (TLS only)")
 	flag.StringVar(&conf.KeyFile, "tls-key-file", "", "path to private key file (TLS only)")
 	flag.BoolVar(&conf.Debug, "debug", false, "enable debug mode (profiling, inspection, etc.)")
+	flag.BoolVar(&conf.Mock, "mock", false, "populate /mock/charts, /mock/stats and /mock/table with synthetic pages, for development")
+	flag.Float64Var(&conf.MockRate, "mock-rate", 1, "updates per second to -mock pages; 0 = static")
+	flag.BoolVar(&conf.Dev, "dev", false, "enable development mode (reload browsers when -web-dir changes, disable asset caching)")
+	flag.StringVar(&logLevel, "log-level", "info", "log level: debug (includes requests), info, warn or error")
+	flag.BoolVar(&traceLog, "trace", false, "log trace spans for patch and broadcast paths (requires -log-level debug)")
+	flag.StringVar(&conf.OTLP.URL, "otlp-url", "", "export trace spans for patch and broadcast paths to this OpenTelemetry collector's OTLP/HTTP traces endpoint (e.g. http://otel-collector:4318/v1/traces); disabled if empty")
+	flag.StringVar(&conf.OTLP.ServiceName, "otlp-service-name", "", "service name reported with exported trace spans; defaults to waved")
+	flag.StringVar(&conf.SMTP.Addr, "smtp-addr", "", "mail server host:port for email notifications; disabled if empty")
+	flag.StringVar(&conf.SMTP.From, "smtp-from", "wave@localhost", "sender address for email notifications")
+	flag.StringVar(&conf.SMTP.Username, "smtp-username", "", "mail server username")
+	flag.StringVar(&conf.SMTP.Password, "smtp-password", "", "mail server password")
+	flag.DurationVar(&conf.KeepAlive.PingInterval, "ping-interval", 54*time.Second, "websocket ping interval; must be less than -pong-timeout")
+	flag.DurationVar(&conf.KeepAlive.PongTimeout, "pong-timeout", 60*time.Second, "drop websocket clients that do not respond to pings within this duration")
+	flag.DurationVar(&conf.KeepAlive.WriteTimeout, "write-timeout", 10*time.Second, "drop websocket clients that cannot be written to within this duration")
+	flag.IntVar(&conf.Backpressure.QueueSize, "client-queue-size", 0, "max messages queued per websocket client; 0 = 256, or 32 with -profile embedded")
+	flag.StringVar(&conf.Backpressure.Policy, "client-queue-policy", "disconnect", "when a client's queue is full: disconnect, drop-oldest, or collapse (replace the page's queued messages with its latest full page)")
+	flag.DurationVar(&conf.Backpressure.MaxLag, "client-max-lag", 30*time.Second, "disconnect clients whose queue stays full for longer than this (drop-oldest and collapse only); 0 = never")
+	flag.StringVar(&conf.Ordering, "ordering", wave.OrderTotal, "broadcast ordering across pages: total (all clients see changes to all pages in one order) or page (changes to different pages are applied in parallel, and broadcast in order per page only)")
+	flag.IntVar(&conf.WireVersion, "wire-version", 0, "wire grammar version assumed for publishers and UIs that do not declare one, while they migrate; 0 = current")
+	flag.IntVar(&conf.Subscriptions.PerClient, "max-client-subscriptions", 0, "max pages a websocket client can watch concurrently; 0 = unlimited")
+	flag.IntVar(&conf.Subscriptions.PerUser, "max-user-subscriptions", 0, "max pages a user can watch concurrently, across connections; 0 = unlimited")
+	flag.IntVar(&conf.Subscriptions.PerOrigin, "max-origin-subscriptions", 0, "max pages watched concurrently by connections from the same IP address; 0 = unlimited")
+	flag.StringVar(&conf.Profile, "profile", wave.DefaultProfile, "memory-related defaults: default, or embedded (small buffers and history, for Raspberry Pi-class devices)")
+	flag.IntVar(&conf.Footprint.HistorySize, "history-size", 0, "messages retained per page for reconnecting clients to catch up; 0 = 128, or 16 with -profile embedded; -1 = none (send full pages)")
+	flag.IntVar(&conf.Footprint.HistoryBytes, "history-bytes", 0, "bytes retained per page for reconnecting clients to catch up; 0 = 1MiB, or 64KiB with -profile embedded")
+	flag.IntVar(&conf.Footprint.UndoDepth, "undo-depth", 0, "past versions retained per page for diffs; 0 = 32, or 4 with -profile embedded; -1 = none")
+	flag.IntVar(&conf.Footprint.SocketBufferSize, "socket-buffer-size", 0, "websocket read and write buffer size in bytes; 0 = 1024, or 512 with -profile embedded")
+	flag.Float64Var(&conf.RateLimits.Writes.Rate, "rate-limit-writes", 0, "max page writes (PATCH, streamed or published patches) per second per access key; 0 = unlimited")
+	flag.IntVar(&conf.RateLimits.Writes.Burst, "rate-limit-writes-burst", 0, "max page writes per access key at once; 0 = same as -rate-limit-writes")
+	flag.Float64Var(&conf.RateLimits.Connections.Rate, "rate-limit-connections", 0, "max websocket connection attempts per second per IP address; 0 = unlimited")
+	flag.IntVar(&conf.RateLimits.Connections.Burst, "rate-limit-connections-burst", 0, "max websocket connection attempts per IP address at once; 0 = same as -rate-limit-connections")
+	flag.Float64Var(&conf.RateLimits.Posts.Rate, "rate-limit-posts", 0, "max API requests (POST) per second per IP address; 0 = unlimited")
+	flag.IntVar(&conf.RateLimits.Posts.Burst, "rate-limit-posts-burst", 0, "max API requests per IP address at once; 0 = same as -rate-limit-posts")
+	flag.BoolVar(&conf.Compression.Gzip, "gzip", false, "gzip page data and static file responses for clients that accept it")
+	flag.BoolVar(&conf.Compression.Deflate, "ws-deflate", false, "negotiate permessage-deflate compression with websocket clients")
+	flag.Int64Var(&conf.MaxCacheBytes, "max-cache-bytes", 0, "evict least recently accessed pages from memory to disk when the site grows beyond this size; 0 = unlimited, or 32MiB with -profile embedded; -1 = unlimited")
+	flag.StringVar(&conf.Analytics.Privacy, "analytics", wave.AnalyticsOff, "track page views and publisher activity, reported at /_admin/analytics: off, counts (totals only), anonymous (also distinct viewers and publishers, by salted hash) or identified (also who, by username or IP address)")
+	flag.IntVar(&conf.Analytics.Retention, "analytics-retention", 0, "days of usage to keep; 0 = 90")
+	flag.StringVar(&conf.Audit.Path, "audit-log", "", "append a record of every page change, deletion, upload and app registration to this file, queryable at /_admin/audit")
+	flag.StringVar(&conf.Audit.Syslog, "audit-syslog", "", "also send audit records to syslog: local, or udp://host:port or tcp://host:port")
+	flag.BoolVar(&conf.NoSearchIndex, "no-search-index", false, "don't index page contents for searching at /_api/search")
+	flag.StringVar(&conf.CardSchemas, "card-schemas", "", "reject patches whose cards don't match the schemas in this JSON file (a list of {prefix, view, required, types})")
+	flag.StringVar(&conf.RemoteWrite.URL, "remote-write-url", "", "push card values to this Prometheus remote-write endpoint (e.g. http://prometheus:9090/api/v1/write); disabled if empty")
+	flag.StringVar(&conf.RemoteWrite.Username, "remote-write-username", "", "remote-write basic auth username")
+	flag.StringVar(&conf.RemoteWrite.Password, "remote-write-password", "", "remote-write basic auth password")
+	flag.DurationVar(&conf.RemoteWrite.Interval, "remote-write-interval", 0, "how often to push card values; 0 = 15s")
+	flag.StringVar(&exported, "remote-write-metrics", "", "comma-separated cards to push, as name=/route#card (the card's value attribute) or name=/route#card.attr")
+	flag.StringVar(&conf.MetricsListen, "metrics-listen", "", "expose Prometheus metrics at /metrics on this address (e.g. 127.0.0.1:10102); disabled if empty")
+	flag.StringVar(&origins, "allowed-origins", "", "comma-separated origins (e.g. https://cdn.example.com, https://*.example.com or *) allowed to access the server from browsers; same-origin only if empty")
+	flag.BoolVar(&conf.SPAFallback.Disabled, "no-spa-fallback", false, "serve extension-less paths as-is instead of falling back to index.html")
+	flag.StringVar(&spaSkip, "spa-fallback-exclude", "", "comma-separated path prefixes (e.g. /ws,/metrics,/files) never served index.html as a fallback")
+	flag.StringVar(&trusted, "trusted-proxies", "", "comma-separated IP addresses or CIDR ranges (e.g. 10.0.0.0/8) of reverse proxies whose X-Forwarded-For/Proto/Host headers are trusted; ignored from anyone else")
+	flag.StringVar(&peers, "peers", "", "comma-separated base URLs of other servers (e.g. http://10.0.0.2:10101) to replicate page changes with; servers must share access keys")
+	flag.StringVar(&conf.Primary, "primary", "", "run as standby: redirect websocket clients to this primary server address (e.g. wss://host:port/_s)")
 
 	const (
 		oidcClientID      = "oidc-client-id"
@@ -65,37 +188,175 @@ func main() {
 		oidcEndSessionURL = "oidc-end-session-url"
 	)
 
-	conf.OIDCClientID = os.Getenv(envVarName(oidcClientID))
-	flag.StringVar(&conf.OIDCClientID, oidcClientID, conf.OIDCClientID, "OIDC client ID")
+	flag.StringVar(&conf.OIDCClientID, oidcClientID, "", "OIDC client ID")
 
-	conf.OIDCClientSecret = os.Getenv(envVarName(oidcClientSecret))
-	flag.StringVar(&conf.OIDCClientSecret, oidcClientSecret, conf.OIDCClientSecret, "OIDC client secret")
+	flag.StringVar(&conf.OIDCClientSecret, oidcClientSecret, "", "OIDC client secret")
 
-	conf.OIDCProviderURL = os.Getenv(envVarName(oidcProviderURL))
-	flag.StringVar(&conf.OIDCProviderURL, oidcProviderURL, conf.OIDCProviderURL, "OIDC provider URL")
+	flag.StringVar(&conf.OIDCProviderURL, oidcProviderURL, "", "OIDC provider URL")
 
-	conf.OIDCRedirectURL = os.Getenv(envVarName(oidcRedirectURL))
-	flag.StringVar(&conf.OIDCRedirectURL, oidcRedirectURL, conf.OIDCRedirectURL, "OIDC redirect URL")
+	flag.StringVar(&conf.OIDCRedirectURL, oidcRedirectURL, "", "OIDC redirect URL")
 
-	conf.OIDCEndSessionURL = os.Getenv(envVarName(oidcEndSessionURL))
-	flag.StringVar(&conf.OIDCEndSessionURL, oidcEndSessionURL, conf.OIDCEndSessionURL, "OIDC end session URL")
+	flag.StringVar(&conf.OIDCEndSessionURL, oidcEndSessionURL, "", "OIDC end session URL")
 
-	flag.Parse()
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+	if config == "" {
+		config = os.Getenv(envVarName("config"))
+	}
+	if err := applySettings(config, "config", "version"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	if version {
 		fmt.Printf("Wave Development Server\nVersion %s Build %s (%s/%s)\nCopyright (c) H2O.ai, Inc.\n", Version, BuildDate, runtime.GOOS, runtime.GOARCH)
 		return
 	}
 
-	conf.WebDir, _ = filepath.Abs(conf.WebDir)
+	prepareService(&conf)
+	if !strings.HasPrefix(conf.WebDir, "http://") && !strings.HasPrefix(conf.WebDir, "https://") {
+		conf.WebDir, _ = filepath.Abs(conf.WebDir)
+	}
 	conf.DataDir, _ = filepath.Abs(conf.DataDir)
+	if strings.ContainsAny(conf.Listen, ",=") {
+		listeners, err := wave.ParseListeners(conf.Listen)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+			os.Exit(2)
+		}
+		conf.Listen, conf.Listeners = "", listeners
+	}
+	if origins != "" {
+		conf.AllowedOrigins = strings.Split(origins, ",")
+	}
+	if spaSkip != "" {
+		conf.SPAFallback.Exclude = strings.Split(spaSkip, ",")
+	}
+	if exported != "" {
+		conf.RemoteWrite.Metrics = strings.Split(exported, ",")
+	}
+	if trusted != "" {
+		conf.TrustedProxies = strings.Split(trusted, ",")
+	}
+	if peers != "" {
+		conf.Cluster.Peers = strings.Split(peers, ",")
+		conf.Cluster.AccessKeyID, conf.Cluster.AccessKeySecret = conf.AccessKeyID, conf.AccessKeySecret
+	}
+
+	if err := conf.Validate(); err != nil {
+		for _, e := range err.(wave.ConfErrors) {
+			fmt.Fprintln(os.Stderr, "invalid configuration:", e)
+		}
+		os.Exit(2)
+	}
+
+	level, err := wave.ParseLevel(logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	conf.Logger = wave.NewStdLogger(level)
+	if traceLog {
+		conf.Tracer = wave.LogTracer{}
+	}
 
 	conf.Version = Version
 	conf.BuildDate = BuildDate
 
+	stop := make(chan struct{})
+	conf.Stop = stop
+	if runService(conf, level, stop) {
+		return
+	}
+	go stopOnSignal(stop)
 	wave.Run(conf)
 }
 
+// stopOnSignal closes stop on an interrupt or termination signal, so that the server shuts down gracefully.
+// A second signal exits immediately.
+func stopOnSignal(stop chan struct{}) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	close(stop)
+	<-signals
+	os.Exit(1)
+}
+
+// conformance checks a running server's protocol implementation, printing a report; returns the exit code.
+func conformance(args []string) int {
+	var (
+		conf   wave.ConformanceConf
+		asJSON bool
+	)
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	fs.StringVar(&conf.Address, "address", "http://localhost:10101", "base URL of the server to check")
+	fs.StringVar(&conf.AccessKeyID, "access-key-id", "access_key_id", "access key ID of the server")
+	fs.StringVar(&conf.AccessKeySecret, "access-key-secret", "access_key_secret", "access key secret of the server")
+	fs.DurationVar(&conf.Timeout, "timeout", 5*time.Second, "maximum wait for each request or socket message")
+	fs.BoolVar(&asJSON, "json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	r := wave.RunConformance(conf)
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+	} else {
+		for _, c := range r.Checks {
+			if c.Passed {
+				fmt.Printf("PASS %s (%.1fms)\n", c.Name, c.Elapsed)
+			} else {
+				fmt.Printf("FAIL %s: %s\n", c.Name, c.Detail)
+			}
+		}
+		fmt.Printf("%s: %d passed, %d failed (grammar version %d)\n", r.Address, r.Passed, r.Failed, r.Grammar)
+	}
+	if r.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// bench measures fan-out performance of a running server; returns the exit code.
+func bench(args []string) int {
+	var (
+		conf   wave.BenchConf
+		asJSON bool
+	)
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.StringVar(&conf.Address, "address", "http://localhost:10101", "base URL of the server to measure")
+	fs.StringVar(&conf.AccessKeyID, "access-key-id", "access_key_id", "access key ID of the server")
+	fs.StringVar(&conf.AccessKeySecret, "access-key-secret", "access_key_secret", "access key secret of the server")
+	fs.IntVar(&conf.Clients, "clients", 1000, "websocket clients watching the page")
+	fs.IntVar(&conf.Patches, "patches", 100, "patches to publish to the page")
+	fs.IntVar(&conf.Size, "size", 256, "bytes of content per patch")
+	fs.DurationVar(&conf.Interval, "interval", 0, "time between patches; 0 = as fast as the server accepts them")
+	fs.BoolVar(&conf.Msgpack, "msgpack", false, "receive MessagePack frames instead of JSON")
+	fs.BoolVar(&conf.Deflate, "deflate", false, "negotiate permessage-deflate compression (see the server's -ws-deflate)")
+	fs.DurationVar(&conf.Timeout, "timeout", time.Minute, "maximum wait for all patches to be delivered")
+	fs.BoolVar(&asJSON, "json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	r, err := wave.RunBench(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+	} else {
+		fmt.Printf("%s: %d clients, %d patches: delivered %d of %d in %.0fms (%.0f/s)\n", r.Address, r.Clients, r.Patches, r.Delivered, r.Expected, r.Elapsed, r.Throughput)
+		fmt.Printf("latency: p50 %.1fms, p90 %.1fms, p99 %.1fms, max %.1fms\n", r.P50, r.P90, r.P99, r.Max)
+	}
+	if r.Delivered < r.Expected {
+		return 1
+	}
+	return 0
+}
+
 func envVarName(n string) string {
 	envVar := strings.ToUpper(strings.ReplaceAll(n, "-", "_"))
 	return fmt.Sprintf("%s_%s", envVarNamePrefix, envVar)
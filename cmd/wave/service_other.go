@@ -0,0 +1,28 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import "github.com/h2oai/wave"
+
+// prepareService adjusts the configuration for running as a service; services are only supported on Windows.
+func prepareService(conf *wave.ServerConf) {}
+
+// runService runs the server as a service, if requested; services are only supported on Windows.
+func runService(conf wave.ServerConf, level wave.Level, stop chan struct{}) bool {
+	return false
+}
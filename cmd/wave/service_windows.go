@@ -0,0 +1,263 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/h2oai/wave"
+)
+
+var (
+	asService   bool
+	serviceName string
+)
+
+func init() {
+	flag.BoolVar(&asService, "service", false, "run as a Windows service, logging to the Windows event log")
+	flag.StringVar(&serviceName, "service-name", "waved", "Windows service name, also used as the event log source")
+}
+
+var (
+	advapi32                          = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW          = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW                  = advapi32.NewProc("ReportEventW")
+)
+
+// Service control manager and event log constants, from winsvc.h and winnt.h.
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorCallNotImplemented   = 120
+	errorServiceSpecificError = 1066
+
+	eventlogErrorType       = 1
+	eventlogWarningType     = 2
+	eventlogInformationType = 4
+)
+
+// stopWaitHint is how long, in milliseconds, the service control manager is told to expect stopping to take.
+const stopWaitHint = 15000
+
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// service runs the server under the Windows service control manager.
+type service struct {
+	sync.Mutex
+	conf     wave.ServerConf
+	stop     chan struct{}
+	stopping bool
+	handle   uintptr
+	status   serviceStatus
+}
+
+// prepareService adjusts the configuration for running as a service.
+func prepareService(conf *wave.ServerConf) {
+	if !asService {
+		return
+	}
+	// Services start in the system directory; resolve relative paths against the executable's directory instead.
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+	// Services have no standard output, which is where the AOF log is written by default.
+	if conf.AOF.Dir == "" {
+		conf.AOF.Dir = filepath.Join(conf.DataDir, "aof")
+	}
+}
+
+// runService runs the server as a Windows service if -service is set, returning once the service stops;
+// returns false if -service is not set.
+func runService(conf wave.ServerConf, level wave.Level, stop chan struct{}) bool {
+	if !asService {
+		return false
+	}
+	logger, err := newEventLogger(serviceName, level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed opening event log:", err)
+		os.Exit(1)
+	}
+	conf.Logger = logger
+	s := &service{conf: conf, stop: stop}
+	name, err := syscall.UTF16PtrFromString(serviceName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bad service name:", err)
+		os.Exit(2)
+	}
+	table := []serviceTableEntry{{name, syscall.NewCallback(s.main)}, {nil, 0}}
+	if r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+		logger.Log(wave.ErrorLevel, wave.Log{"t": "service", "error": err.Error()})
+		fmt.Fprintln(os.Stderr, "not started by the service control manager:", err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// main is the service's entry point, called by the service control manager on its own thread.
+func (s *service) main(argc, argv uintptr) uintptr {
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+	h, _, err := procRegisterServiceCtrlHandlerExW.Call(uintptr(unsafe.Pointer(name)), syscall.NewCallback(s.control), 0)
+	if h == 0 {
+		s.conf.Logger.Log(wave.ErrorLevel, wave.Log{"t": "service", "error": err.Error()})
+		return 0
+	}
+	s.Lock()
+	s.handle = h
+	s.Unlock()
+	s.setState(serviceStartPending, 0, 0)
+	done := make(chan struct{})
+	go func() {
+		wave.Run(s.conf)
+		close(done)
+	}()
+	s.setState(serviceRunning, serviceAcceptStop|serviceAcceptShutdown, 0)
+	<-done
+	s.Lock()
+	failed := !s.stopping
+	s.Unlock()
+	if failed { // the server quit by itself, e.g. because its address is in use
+		s.conf.Logger.Log(wave.ErrorLevel, wave.Log{"t": "service", "error": "server stopped unexpectedly"})
+		s.setStopped(1)
+	} else {
+		s.setStopped(0)
+	}
+	return 0
+}
+
+// control handles requests from the service control manager.
+func (s *service) control(ctrl, eventType, eventData, context uintptr) uintptr {
+	switch ctrl {
+	case serviceControlStop, serviceControlShutdown:
+		s.Lock()
+		stopping := s.stopping
+		s.stopping = true
+		s.Unlock()
+		if !stopping {
+			s.setState(serviceStopPending, 0, stopWaitHint)
+			close(s.stop)
+		}
+	case serviceControlInterrogate:
+		s.report()
+	default:
+		return errorCallNotImplemented
+	}
+	return 0
+}
+
+func (s *service) setState(state, accepts, waitHint uint32) {
+	s.Lock()
+	s.status = serviceStatus{serviceType: serviceWin32OwnProcess, currentState: state, controlsAccepted: accepts, waitHint: waitHint}
+	s.Unlock()
+	s.report()
+}
+
+func (s *service) setStopped(exitCode uint32) {
+	s.Lock()
+	s.status = serviceStatus{serviceType: serviceWin32OwnProcess, currentState: serviceStopped}
+	if exitCode != 0 {
+		s.status.win32ExitCode, s.status.serviceSpecificExitCode = errorServiceSpecificError, exitCode
+	}
+	s.Unlock()
+	s.report()
+}
+
+func (s *service) report() {
+	s.Lock()
+	defer s.Unlock()
+	procSetServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&s.status)))
+}
+
+// eventLogger writes messages to the Windows event log, as JSON.
+type eventLogger struct {
+	handle uintptr
+	min    wave.Level
+}
+
+func newEventLogger(source string, min wave.Level) (*eventLogger, error) {
+	src, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(src)))
+	if h == 0 {
+		return nil, err
+	}
+	return &eventLogger{h, min}, nil
+}
+
+// Log implements wave.Logger.
+func (l *eventLogger) Log(level wave.Level, fields wave.Log) {
+	if level < l.min {
+		return
+	}
+	if level != wave.InfoLevel {
+		fields["level"] = level.String()
+	}
+	j, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	msg, err := syscall.UTF16PtrFromString(string(j))
+	if err != nil {
+		return
+	}
+	kind := eventlogInformationType
+	switch level {
+	case wave.WarnLevel:
+		kind = eventlogWarningType
+	case wave.ErrorLevel:
+		kind = eventlogErrorType
+	}
+	strings := [1]*uint16{msg}
+	procReportEventW.Call(l.handle, uintptr(kind), 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&strings[0])), 0)
+}
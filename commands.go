@@ -0,0 +1,179 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Actions connected UIs can be told to take.
+const (
+	CommandNavigate   = "navigate"    // open another page
+	CommandClearCache = "clear_cache" // drop cached assets and page contents, and reload
+	CommandToast      = "toast"       // show a transient message
+)
+
+// Command represents an action pushed to connected UIs, outside of any page.
+type Command struct {
+	Action  string `json:"action"`            // CommandNavigate, CommandClearCache or CommandToast
+	Route   string `json:"route,omitempty"`   // page to open, and optional #hash, for CommandNavigate
+	Text    string `json:"text,omitempty"`    // message, for CommandToast
+	Type    string `json:"type,omitempty"`    // info (default), success, warning or error, for CommandToast
+	Timeout int    `json:"timeout,omitempty"` // seconds the message stays up, for CommandToast; 0 = 5
+}
+
+// CommandRequest represents a command and the clients it is for: all connected clients if no target
+// is set, else the clients matching every target given.
+type CommandRequest struct {
+	Command
+	Client   string `json:"client,omitempty"`   // client ID, as listed by GET /_admin
+	User     string `json:"user,omitempty"`     // clients signed in as this user
+	Watching string `json:"watching,omitempty"` // clients watching this page, or a page under it
+}
+
+// CommandResponse represents the outcome of a command request.
+type CommandResponse struct {
+	Clients int `json:"clients"` // clients the command was sent to
+}
+
+func (c Command) validate() error {
+	switch c.Action {
+	case CommandNavigate:
+		if err := validateRoute(c.Route); err != nil {
+			return fmt.Errorf("navigate: %v", err)
+		}
+	case CommandClearCache:
+	case CommandToast:
+		if c.Text == "" {
+			return errors.New("toast: want text")
+		}
+		switch c.Type {
+		case "", "info", "success", "warning", "error":
+		default:
+			return fmt.Errorf("toast: unknown type %q", c.Type)
+		}
+		if c.Timeout < 0 {
+			return errors.New("toast: timeout must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", c.Action)
+	}
+	return nil
+}
+
+// validateRoute checks that route is a path on this server. Browsers read "//host" and "/\host" as
+// links to other sites, and strip tabs and newlines before doing so, so those are refused too.
+func validateRoute(route string) error {
+	if !strings.HasPrefix(route, "/") || strings.HasPrefix(route, "//") || strings.ContainsRune(route, '\\') {
+		return fmt.Errorf("want a path on this server, got %q", route)
+	}
+	u, err := url.Parse(route)
+	if err != nil {
+		return fmt.Errorf("bad route %q: %v", route, err)
+	}
+	if u.Scheme != "" || u.Host != "" || u.Opaque != "" {
+		return fmt.Errorf("want a path on this server, got %q", route)
+	}
+	return nil
+}
+
+// targets reports whether a client watching route is one of the clients a command is for.
+func (q CommandRequest) targets(c *Client, route string) bool {
+	return (q.Client == "" || c.id == q.Client) &&
+		(q.User == "" || c.username == q.User) &&
+		(q.Watching == "" || isPathPrefix(q.Watching, route))
+}
+
+// command sends a command to the clients it targets, and returns how many that was.
+// Clients whose send queue is full miss the command.
+func (b *Broker) command(q CommandRequest) (int, error) {
+	data, err := json.Marshal(OpsD{X: &q.Command})
+	if err != nil {
+		return 0, err
+	}
+	f := newFrame(data)
+	n := 0
+	b.call(func() {
+		sent := make(map[*Client]bool)
+		for route, clients := range b.clients {
+			clients.each(func(c *Client) {
+				if !sent[c] && q.targets(c, route) {
+					sent[c] = true
+					if c.sendFrame(f) {
+						n++
+					}
+				}
+			})
+		}
+	})
+	return n, nil
+}
+
+// CommandHandler pushes commands to connected UIs: POST a CommandRequest. Requires an access key.
+type CommandHandler struct {
+	broker *Broker
+	auth   *Auth
+}
+
+func newCommandHandler(broker *Broker, auth *Auth) *CommandHandler {
+	return &CommandHandler{broker, auth}
+}
+
+func (h *CommandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.auth.trusted(r); !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		if len(b) >= maxMessageSize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var q CommandRequest
+	if err := json.Unmarshal(b, &q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := q.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := h.broker.command(q)
+	if err != nil {
+		echo(Log{"t": "command", "action": q.Action, "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	echo(Log{"t": "command", "action": q.Action, "client": q.Client, "user": q.User, "watching": q.Watching, "clients": strconv.Itoa(n)})
+	auditRequest(r, AuditCommand, q.Watching, int64(len(b)))
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(CommandResponse{n})
+}
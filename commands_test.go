@@ -0,0 +1,64 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import "testing"
+
+func TestCommandNavigateRoute(t *testing.T) {
+	for _, route := range []string{"/", "/incident", "/wallboards/1?x=1", "/app#menu/settings"} {
+		if err := (Command{Action: CommandNavigate, Route: route}).validate(); err != nil {
+			t.Errorf("%q: want ok, got %v", route, err)
+		}
+	}
+	for _, route := range []string{
+		"",
+		"incident",
+		"//evil.example/x",
+		"/\\evil.example/x",
+		"/x\\y",
+		"/\t/evil.example",
+		"/\n/evil.example",
+		"https://evil.example/x",
+		"javascript:alert(1)",
+	} {
+		if err := (Command{Action: CommandNavigate, Route: route}).validate(); err == nil {
+			t.Errorf("%q: want error", route)
+		}
+	}
+}
+
+func TestCommandValidate(t *testing.T) {
+	valid := []Command{
+		{Action: CommandClearCache},
+		{Action: CommandToast, Text: "hi"},
+		{Action: CommandToast, Text: "hi", Type: "error", Timeout: 10},
+	}
+	for _, c := range valid {
+		if err := c.validate(); err != nil {
+			t.Errorf("%+v: want ok, got %v", c, err)
+		}
+	}
+	invalid := []Command{
+		{Action: "reboot"},
+		{Action: CommandToast},
+		{Action: CommandToast, Text: "hi", Type: "loud"},
+		{Action: CommandToast, Text: "hi", Timeout: -1},
+	}
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Errorf("%+v: want error", c)
+		}
+	}
+}
@@ -14,27 +14,178 @@
 
 package wave
 
+import (
+	"fmt"
+	"strings"
+)
+
 // ServerConf represents Server configuration options.
 type ServerConf struct {
 	Version           string
 	BuildDate         string
-	Listen            string
+	Listen            string       // address to listen on, serving everything: host:port, or unix:///path/to.sock
+	Listeners         []ListenConf // more addresses to listen on, each serving all or part of the interface
 	WebDir            string
 	DataDir           string
 	AccessKeyID       string
 	AccessKeySecret   string
+	Keychain          string // file holding additional access keys, as written by GenerateAccessKey; ignored if missing
 	Init              string
 	Compact           string
+	InitSkipErrors    bool    // skip malformed AOF entries instead of failing
+	AOF               AOFConf // append-only log rotation and durability
+	Record            string  // record applied patches to this file, for timed replay
+	Replay            string  // replay patches recorded to this file at startup
+	ReplaySpeed       float64 // replay speed multiplier; 0 = as fast as possible
 	CertFile          string
 	KeyFile           string
 	Debug             bool
+	Dev               bool    // reload browsers when web assets change; disable asset caching
+	Mock              bool    // populate /mock/* with synthetic pages
+	MockRate          float64 // mock page updates per second; 0 = static
 	OIDCClientID      string
 	OIDCClientSecret  string
 	OIDCProviderURL   string
 	OIDCRedirectURL   string
 	OIDCEndSessionURL string
+	Primary           string
+	Cluster           ClusterConf // replicate page changes to peer servers
+	MetricsListen     string
+	MaxCacheBytes     int64              // evict least recently accessed pages from memory beyond this size; 0 = unlimited
+	Logger            Logger             // defaults to a StdLogger at info level
+	Tracer            Tracer             // defaults to no tracing
+	OTLP              OTLPConf           // export trace spans to an OpenTelemetry collector, in place of Tracer
+	Clock             Clock              // defaults to the system clock
+	SMTP              SMTPConf           // mail server for email notifications
+	KeepAlive         KeepAlive          // websocket keepalive settings
+	Backpressure      Backpressure       // slow client handling
+	Compression       Compression        // websocket and HTTP response compression
+	Subscriptions     SubscriptionLimits // concurrent page subscription limits
+	RateLimits        RateLimits         // request rate limits
+	TrustedProxies    []string           // IP addresses or CIDR ranges of reverse proxies whose X-Forwarded-* headers are believed
+	SPAFallback       SPAFallback        // serve index.html for client-side routes
+	AllowedOrigins    []string           // cross-origin browser access, e.g. "https://example.com", "https://*.example.com" or "*"; same-origin only if empty
+	OnReady           func(*LocalSite)   // called with direct access to pages once the server is set up, before it listens; must not block
+	Stop              <-chan struct{}    // closing it shuts the server down gracefully, and Run returns
+	Profile           string             // "default" or "embedded"; tunes memory-related defaults
+	Footprint         Footprint          // memory retained per route, page and connection
+	Analytics         AnalyticsConf      // page view and publisher activity tracking
+	RemoteWrite       RemoteWriteConf    // push card values to a Prometheus remote-write endpoint
+	Entitlements      Entitlements       // what the server may do, for products enforcing their licensing; unlimited if nil
+	Validators        []CardValidator    // reject patches whose cards fail these checks
+	Audit             AuditConf          // record write operations for compliance
+	NoSearchIndex     bool               // don't index page contents for /_api/search
+	CardSchemas       string             // JSON file holding a list of CardSchema, checked in addition to Validators
+	Ordering          string             // how broadcasts to different pages are ordered: OrderTotal (default) or OrderPage
+	WireVersion       int                // wire grammar version assumed for publishers and UIs that don't declare one; 0 = current
 }
 
 func (c *ServerConf) oidcEnabled() bool {
 	return c.OIDCClientID != "" && c.OIDCClientSecret != "" && c.OIDCProviderURL != "" && c.OIDCRedirectURL != ""
 }
+
+// ConfErrors lists the problems found in a configuration.
+type ConfErrors []string
+
+func (e ConfErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// Validate checks the configuration for missing, malformed or conflicting settings, reporting all problems found.
+func (c ServerConf) Validate() error {
+	var errs ConfErrors
+	fail := func(format string, args ...interface{}) { errs = append(errs, fmt.Sprintf(format, args...)) }
+
+	listeners := c.listeners()
+	if len(listeners) == 0 {
+		fail("no listen address")
+	}
+	seen := make(map[string]bool)
+	for _, l := range listeners {
+		if err := l.validate(); err != nil {
+			fail("%v", err)
+		}
+		if seen[l.Address] {
+			fail("listener %q: address repeated", l.Address)
+		}
+		seen[l.Address] = true
+	}
+	if c.AccessKeyID == "" || c.AccessKeySecret == "" {
+		fail("access key ID and secret must both be set")
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		fail("TLS needs both a certificate file and a key file")
+	}
+	oidc := []struct{ name, value string }{
+		{"client ID", c.OIDCClientID},
+		{"client secret", c.OIDCClientSecret},
+		{"provider URL", c.OIDCProviderURL},
+		{"redirect URL", c.OIDCRedirectURL},
+	}
+	var missing []string
+	for _, s := range oidc {
+		if s.value == "" {
+			missing = append(missing, s.name)
+		}
+	}
+	if len(missing) > 0 && len(missing) < len(oidc) {
+		fail("OIDC is partially configured: missing %s", strings.Join(missing, ", "))
+	}
+	if err := c.AOF.validate(); err != nil {
+		fail("AOF: %v", err)
+	}
+	if c.AOF.Dir == "" && (c.AOF.Archive.URL != "" || c.AOF.MaxBytes != 0 || c.AOF.MaxAge != 0) {
+		fail("AOF rotation and archiving require an AOF directory")
+	}
+	if c.AOF.MaxBytes < 0 || c.AOF.MaxAge < 0 {
+		fail("AOF segment limits must not be negative")
+	}
+	if err := c.Analytics.validate(); err != nil {
+		fail("%v", err)
+	}
+	if err := c.Audit.validate(); err != nil {
+		fail("%v", err)
+	}
+	if err := c.RemoteWrite.validate(); err != nil {
+		fail("%v", err)
+	}
+	if err := c.OTLP.validate(); err != nil {
+		fail("%v", err)
+	}
+	if c.OTLP.URL != "" && c.Tracer != nil {
+		fail("OTLP export and a custom tracer cannot both be set")
+	}
+	if err := c.Backpressure.validate(); err != nil {
+		fail("%v", err)
+	}
+	if err := validateOrdering(c.Ordering); err != nil {
+		fail("%v", err)
+	}
+	if v := c.WireVersion; v != 0 && (v < wireOldest || v > grammarVersion) {
+		fail("wire version must be between %d and %d, got %d", wireOldest, grammarVersion, v)
+	}
+	if k := c.KeepAlive; k.PingInterval > 0 && k.PongTimeout > 0 && k.PingInterval >= k.PongTimeout {
+		fail("websocket ping interval (%s) must be less than the pong timeout (%s)", k.PingInterval, k.PongTimeout)
+	}
+	if l := c.RateLimits; l.Writes.Rate < 0 || l.Writes.Burst < 0 || l.Connections.Rate < 0 || l.Connections.Burst < 0 || l.Posts.Rate < 0 || l.Posts.Burst < 0 {
+		fail("rate limits must not be negative")
+	}
+	for i, v := range c.Validators {
+		if v.Check == nil {
+			fail("card validator %d has no check", i)
+		}
+	}
+	if c.ReplaySpeed < 0 {
+		fail("replay speed must not be negative")
+	}
+	if _, err := c.withProfile(); err != nil {
+		fail("%v", err)
+	}
+	if _, err := newTrustedProxies(c.TrustedProxies); err != nil {
+		fail("%v", err)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
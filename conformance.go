@@ -0,0 +1,510 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// ConformanceConf represents the server targeted by RunConformance.
+type ConformanceConf struct {
+	Address         string // base URL, e.g. http://localhost:10101
+	AccessKeyID     string // credentials for writes
+	AccessKeySecret string
+	Timeout         time.Duration // maximum wait for each expected socket message
+}
+
+// ConformanceCheck represents the outcome of a single protocol check.
+type ConformanceCheck struct {
+	Name    string  `json:"name"`
+	Passed  bool    `json:"passed"`
+	Detail  string  `json:"detail,omitempty"` // why the check failed
+	Elapsed float64 `json:"elapsed_ms"`
+}
+
+// ConformanceReport represents the outcome of a conformance run.
+type ConformanceReport struct {
+	Address string             `json:"address"`
+	Grammar int                `json:"grammar"` // grammar version the checks were written against
+	Checks  []ConformanceCheck `json:"checks"`
+	Passed  int                `json:"passed"`
+	Failed  int                `json:"failed"`
+}
+
+type conformance struct {
+	conf   ConformanceConf
+	client *http.Client
+	prefix string // all pages created by the run are under this prefix
+}
+
+// RunConformance exercises the HTTP and websocket protocol of a running server: authentication,
+// patch semantics, message ordering and resynchronization. Pages are created under a unique prefix,
+// and dropped once the run completes.
+func RunConformance(conf ConformanceConf) ConformanceReport {
+	conf.Address = strings.TrimSuffix(conf.Address, "/")
+	if conf.Timeout <= 0 {
+		conf.Timeout = 5 * time.Second
+	}
+	c := &conformance{conf, &http.Client{Timeout: conf.Timeout}, "/conformance-" + uuid.New().String()[:8]}
+	checks := []struct {
+		name string
+		run  func() error
+	}{
+		{"auth/patch_requires_credentials", c.patchRequiresCredentials},
+		{"auth/patch_rejects_bad_credentials", c.patchRejectsBadCredentials},
+		{"patch/put_card", c.putCard},
+		{"patch/set_attribute", c.setAttribute},
+		{"patch/delete_attribute", c.deleteAttribute},
+		{"patch/cyclic_buffer", c.cyclicBuffer},
+		{"patch/delete_card", c.deleteCard},
+		{"patch/drop_page", c.dropPage},
+		{"patch/reject_malformed", c.rejectMalformed},
+		{"socket/not_found", c.socketNotFound},
+		{"socket/initial_page", c.socketInitialPage},
+		{"socket/ordering", c.socketOrdering},
+		{"socket/resume", c.socketResume},
+		{"socket/resume_stale", c.socketResumeStale},
+	}
+	r := ConformanceReport{Address: conf.Address, Grammar: grammarVersion}
+	for _, check := range checks {
+		start := time.Now()
+		err := check.run()
+		x := ConformanceCheck{Name: check.name, Passed: err == nil, Elapsed: float64(time.Since(start)) / float64(time.Millisecond)}
+		if err != nil {
+			x.Detail = err.Error()
+			r.Failed++
+		} else {
+			r.Passed++
+		}
+		r.Checks = append(r.Checks, x)
+	}
+	c.cleanup()
+	return r
+}
+
+func (c *conformance) url(page string) string {
+	return c.prefix + "/" + page
+}
+
+func (c *conformance) do(method, url string, body string, credentials bool) (int, []byte, error) {
+	req, err := http.NewRequest(method, c.conf.Address+url, strings.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	if credentials {
+		req.SetBasicAuth(c.conf.AccessKeyID, c.conf.AccessKeySecret)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+// patch applies a patch, failing unless the server accepts it.
+func (c *conformance) patch(page, body string) error {
+	code, b, err := c.do(http.MethodPatch, c.url(page), body, true)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("PATCH %s: want 200, got %d: %s", c.url(page), code, bytes.TrimSpace(b))
+	}
+	return nil
+}
+
+// load returns a page's cards.
+func (c *conformance) load(page string) (map[string]CardD, error) {
+	code, b, err := c.do(http.MethodGet, c.url(page), "", true)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: want 200, got %d", c.url(page), code)
+	}
+	var ops OpsD
+	if err := json.Unmarshal(b, &ops); err != nil {
+		return nil, fmt.Errorf("GET %s: %v", c.url(page), err)
+	}
+	if ops.P == nil {
+		return nil, fmt.Errorf("GET %s: want page, got %s", c.url(page), b)
+	}
+	return ops.P.C, nil
+}
+
+func (c *conformance) expectStatus(method, page, body string, credentials bool, want int) error {
+	code, _, err := c.do(method, c.url(page), body, credentials)
+	if err != nil {
+		return err
+	}
+	if code != want {
+		return fmt.Errorf("%s %s: want %d, got %d", method, c.url(page), want, code)
+	}
+	return nil
+}
+
+func (c *conformance) patchRequiresCredentials() error {
+	return c.expectStatus(http.MethodPatch, "auth", `{"d":[]}`, false, http.StatusUnauthorized)
+}
+
+func (c *conformance) patchRejectsBadCredentials() error {
+	secret := c.conf.AccessKeySecret
+	c.conf.AccessKeySecret += "x"
+	defer func() { c.conf.AccessKeySecret = secret }()
+	return c.expectStatus(http.MethodPatch, "auth", `{"d":[]}`, true, http.StatusUnauthorized)
+}
+
+func (c *conformance) attr(page, card, key string) (interface{}, bool, error) {
+	cards, err := c.load(page)
+	if err != nil {
+		return nil, false, err
+	}
+	cd, ok := cards[card]
+	if !ok {
+		return nil, false, fmt.Errorf("card %q not found", card)
+	}
+	v, ok := cd.D[key]
+	return v, ok, nil
+}
+
+func (c *conformance) expectAttr(page, card, key string, want interface{}) error {
+	v, ok, err := c.attr(page, card, key)
+	if err != nil {
+		return err
+	}
+	if !ok || v != want {
+		return fmt.Errorf("%s.%s: want %v, got %v", card, key, want, v)
+	}
+	return nil
+}
+
+func (c *conformance) putCard() error {
+	if err := c.patch("patch", `{"d":[{"k":"a","d":{"view":"markdown","title":"A","content":"1"}}]}`); err != nil {
+		return err
+	}
+	return c.expectAttr("patch", "a", "content", "1")
+}
+
+func (c *conformance) setAttribute() error {
+	if err := c.patch("patch", `{"d":[{"k":"a content","v":"2"}]}`); err != nil {
+		return err
+	}
+	return c.expectAttr("patch", "a", "content", "2")
+}
+
+func (c *conformance) deleteAttribute() error {
+	if err := c.patch("patch", `{"d":[{"k":"a title"}]}`); err != nil {
+		return err
+	}
+	if _, ok, err := c.attr("patch", "a", "title"); err != nil || ok {
+		if err == nil {
+			err = errors.New("a.title: want deleted, still present")
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *conformance) cyclicBuffer() error {
+	if err := c.patch("patch", `{"d":[{"k":"b","d":{"view":"plot","~data":0},"b":[{"c":{"f":["x"],"n":3}}]}]}`); err != nil {
+		return err
+	}
+	for i := 1; i <= 4; i++ {
+		if err := c.patch("patch", fmt.Sprintf(`{"d":[{"k":"b data -1","v":[%d]}]}`, i)); err != nil {
+			return err
+		}
+	}
+	cards, err := c.load("patch")
+	if err != nil {
+		return err
+	}
+	cd := cards["b"]
+	if len(cd.B) != 1 || cd.B[0].C == nil {
+		return fmt.Errorf("b: want one cyclic buffer, got %v", cd.B)
+	}
+	got := make(map[float64]bool)
+	for _, t := range cd.B[0].C.D {
+		if len(t) == 1 {
+			if x, ok := t[0].(float64); ok {
+				got[x] = true
+			}
+		}
+	}
+	if len(cd.B[0].C.D) != 3 || !got[2] || !got[3] || !got[4] {
+		return fmt.Errorf("b data: want the last 3 of 4 appended rows, got %v", cd.B[0].C.D)
+	}
+	return nil
+}
+
+func (c *conformance) deleteCard() error {
+	if err := c.patch("patch", `{"d":[{"k":"b"}]}`); err != nil {
+		return err
+	}
+	cards, err := c.load("patch")
+	if err != nil {
+		return err
+	}
+	if _, ok := cards["b"]; ok {
+		return errors.New("b: want deleted, still present")
+	}
+	return nil
+}
+
+func (c *conformance) dropPage() error {
+	if err := c.patch("patch", `{"d":[{}]}`); err != nil {
+		return err
+	}
+	cards, err := c.load("patch")
+	if err != nil {
+		return err
+	}
+	if len(cards) != 0 {
+		return fmt.Errorf("want no cards after drop, got %d", len(cards))
+	}
+	return nil
+}
+
+func (c *conformance) rejectMalformed() error {
+	for _, body := range []string{`{`, `{"d":"x"}`, `{"d":[{"k":"x","c":{"n":"x"}}]}`} {
+		if err := c.expectStatus(http.MethodPatch, "patch", body, true, http.StatusBadRequest); err != nil {
+			return fmt.Errorf("%v, for %s", err, body)
+		}
+	}
+	return nil
+}
+
+// socket is a websocket connection to the server, reading messages one line at a time.
+type socket struct {
+	conn    *websocket.Conn
+	timeout time.Duration
+	pending []OpsD
+}
+
+func (c *conformance) dial() (*socket, error) {
+	addr := "ws" + strings.TrimPrefix(c.conf.Address, "http") + "/_s"
+	conn, _, err := websocket.DefaultDialer.Dial(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &socket{conn: conn, timeout: c.conf.Timeout}, nil
+}
+
+func (s *socket) send(msg string) error {
+	return s.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+func (s *socket) read() (OpsD, error) {
+	for len(s.pending) == 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+		_, b, err := s.conn.ReadMessage()
+		if err != nil {
+			return OpsD{}, err
+		}
+		for _, line := range bytes.Split(b, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var ops OpsD
+			if err := json.Unmarshal(line, &ops); err != nil {
+				return OpsD{}, fmt.Errorf("bad message %q: %v", line, err)
+			}
+			s.pending = append(s.pending, ops)
+		}
+	}
+	ops := s.pending[0]
+	s.pending = s.pending[1:]
+	return ops, nil
+}
+
+// readError is like read, but also returns server-reported errors, which OpsD does not capture.
+func (s *socket) readError() (string, error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	_, b, err := s.conn.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	var e struct {
+		E string `json:"e"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(b), &e); err != nil {
+		return "", err
+	}
+	return e.E, nil
+}
+
+func (s *socket) close() {
+	s.conn.Close()
+}
+
+func (c *conformance) socketNotFound() error {
+	s, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	if err := s.send("+ " + c.url("missing") + " "); err != nil {
+		return err
+	}
+	e, err := s.readError()
+	if err != nil {
+		return err
+	}
+	if e != "not_found" {
+		return fmt.Errorf("want not_found, got %q", e)
+	}
+	return nil
+}
+
+func (c *conformance) socketInitialPage() error {
+	if err := c.patch("socket", `{"d":[{"k":"n","d":{"view":"markdown","content":"0"}}]}`); err != nil {
+		return err
+	}
+	s, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	if err := s.send("+ " + c.url("socket") + " "); err != nil {
+		return err
+	}
+	ops, err := s.read()
+	if err != nil {
+		return err
+	}
+	if ops.P == nil || ops.P.C["n"].D["content"] != "0" {
+		return errors.New("want the page on watch")
+	}
+	if ops.S <= 0 {
+		return errors.New("want a sequence number with the page")
+	}
+	return nil
+}
+
+// expectPatches reads n patches setting "n content" to first, first+1, ..., with increasing sequence numbers,
+// and returns the last sequence number.
+func expectPatches(s *socket, first, n int, after int64) (int64, error) {
+	for i := first; i < first+n; i++ {
+		ops, err := s.read()
+		if err != nil {
+			return after, fmt.Errorf("patch %d: %v", i, err)
+		}
+		if len(ops.D) != 1 || ops.D[0].V != fmt.Sprint(i) {
+			return after, fmt.Errorf("patch %d: out of order or missing, got %v", i, ops.D)
+		}
+		if ops.S <= after {
+			return after, fmt.Errorf("patch %d: want sequence number > %d, got %d", i, after, ops.S)
+		}
+		after = ops.S
+	}
+	return after, nil
+}
+
+func (c *conformance) sendPatches(first, n int) error {
+	for i := first; i < first+n; i++ {
+		if err := c.patch("socket", fmt.Sprintf(`{"d":[{"k":"n content","v":"%d"}]}`, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const conformancePatches = 20
+
+// watchSocket watches the socket test page, consuming the initial page, and returns its sequence number.
+func (c *conformance) watchSocket() (*socket, int64, error) {
+	s, err := c.dial()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := s.send("+ " + c.url("socket") + " "); err != nil {
+		s.close()
+		return nil, 0, err
+	}
+	ops, err := s.read()
+	if err != nil {
+		s.close()
+		return nil, 0, err
+	}
+	return s, ops.S, nil
+}
+
+func (c *conformance) socketOrdering() error {
+	s, seq, err := c.watchSocket()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	if err := c.sendPatches(1, conformancePatches); err != nil {
+		return err
+	}
+	_, err = expectPatches(s, 1, conformancePatches, seq)
+	return err
+}
+
+func (c *conformance) socketResume() error {
+	s, seq, err := c.watchSocket()
+	if err != nil {
+		return err
+	}
+	s.close()
+	if err := c.sendPatches(100, 5); err != nil {
+		return err
+	}
+	if s, err = c.dial(); err != nil {
+		return err
+	}
+	defer s.close()
+	if err := s.send(fmt.Sprintf("^ %s %d", c.url("socket"), seq)); err != nil {
+		return err
+	}
+	_, err = expectPatches(s, 100, 5, seq)
+	return err
+}
+
+func (c *conformance) socketResumeStale() error {
+	s, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	if err := s.send(fmt.Sprintf("^ %s %d", c.url("socket"), 1)); err != nil {
+		return err
+	}
+	ops, err := s.read()
+	if err != nil {
+		return err
+	}
+	if ops.P == nil {
+		return fmt.Errorf("want the whole page when resuming from before the server's history, got %v", ops)
+	}
+	return nil
+}
+
+func (c *conformance) cleanup() {
+	c.do(http.MethodPost, "/", `{"delete_pages":{"prefix":"`+c.prefix+`"}}`, true)
+}
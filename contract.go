@@ -0,0 +1,172 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+)
+
+// WireFixture represents a golden example of the patch grammar: a patch, and the page that results from
+// applying it to an empty page. SDKs (Python, R, etc.) can use these to verify their encodings.
+type WireFixture struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Patch       json.RawMessage `json:"patch"`
+	Page        json.RawMessage `json:"page"`
+}
+
+var wireFixtures = []WireFixture{
+	{
+		"add_card", "Add a card.",
+		json.RawMessage(`{"d":[{"k":"c","d":{"view":"markdown","box":"1 1 2 2","title":"Hello","content":"World"}}]}`),
+		json.RawMessage(`{"p":{"c":{"c":{"d":{"box":"1 1 2 2","content":"World","title":"Hello","view":"markdown"}}}}}`),
+	},
+	{
+		"set_attr", "Set card attributes; the key is the card name and attribute, separated by a space.",
+		json.RawMessage(`{"d":[{"k":"c","d":{"view":"markdown","title":"Hello"}},{"k":"c title","v":"Hi"},{"k":"c content","v":"*new*"}]}`),
+		json.RawMessage(`{"p":{"c":{"c":{"d":{"content":"*new*","title":"Hi","view":"markdown"}}}}}`),
+	},
+	{
+		"set_nested", "Set nested values; list elements are addressed by index.",
+		json.RawMessage(`{"d":[{"k":"c","d":{"view":"list","items":[{"label":"a"},{"label":"b"}],"extra":{"x":1}}},{"k":"c items 1 label","v":"B"},{"k":"c extra x","v":2}]}`),
+		json.RawMessage(`{"p":{"c":{"c":{"d":{"extra":{"x":2},"items":[{"label":"a"},{"label":"B"}],"view":"list"}}}}}`),
+	},
+	{
+		"delete_attr", "Delete an attribute by setting it without a value.",
+		json.RawMessage(`{"d":[{"k":"c","d":{"view":"markdown","title":"Hello","content":"World"}},{"k":"c content"}]}`),
+		json.RawMessage(`{"p":{"c":{"c":{"d":{"title":"Hello","view":"markdown"}}}}}`),
+	},
+	{
+		"delete_card", "Delete a card by setting its name without a value.",
+		json.RawMessage(`{"d":[{"k":"a","d":{"view":"markdown"}},{"k":"b","d":{"view":"markdown"}},{"k":"a"}]}`),
+		json.RawMessage(`{"p":{"c":{"b":{"d":{"view":"markdown"}}}}}`),
+	},
+	{
+		"drop_page", "Drop all cards with an empty operation.",
+		json.RawMessage(`{"d":[{"k":"a","d":{"view":"markdown"}},{},{"k":"b","d":{"view":"markdown"}}]}`),
+		json.RawMessage(`{"p":{"c":{"b":{"d":{"view":"markdown"}}}}}`),
+	},
+	{
+		"fixed_buffer", "Add a card with a fixed-size buffer; '~data': 0 binds the attribute 'data' to the first buffer.",
+		json.RawMessage(`{"d":[{"k":"c","d":{"view":"plot","~data":0},"b":[{"f":{"f":["x","y"],"d":[[1,2],[3,4],[5,6]],"n":3}}]}]}`),
+		json.RawMessage(`{"p":{"c":{"c":{"d":{"view":"plot","~data":0},"b":[{"f":{"f":["x","y"],"d":[[1,2],[3,4],[5,6]],"n":3}}]}}}}`),
+	},
+	{
+		"fixed_buffer_set", "Set rows and fields of a fixed-size buffer by index.",
+		json.RawMessage(`{"d":[{"k":"c","d":{"view":"plot","~data":0},"b":[{"f":{"f":["x","y"],"d":[[1,2],[3,4]],"n":2}}]},{"k":"c data 0","v":[7,8]},{"k":"c data 1 y","v":0}]}`),
+		json.RawMessage(`{"p":{"c":{"c":{"d":{"view":"plot","~data":0},"b":[{"f":{"f":["x","y"],"d":[[7,8],[3,0]],"n":2}}]}}}}`),
+	},
+	{
+		"cyclic_buffer", "Append to a cyclic buffer with index -1; the oldest row is overwritten.",
+		json.RawMessage(`{"d":[{"k":"c","d":{"view":"plot","~data":0},"b":[{"c":{"f":["x","y"],"d":[[1,2],[3,4]],"n":2,"i":0}}]},{"k":"c data -1","v":[5,6]}]}`),
+		json.RawMessage(`{"p":{"c":{"c":{"d":{"view":"plot","~data":0},"b":[{"c":{"f":["x","y"],"d":[[5,6],[3,4]],"n":2,"i":1}}]}}}}`),
+	},
+	{
+		"map_buffer", "Set rows and fields of a map buffer by key.",
+		json.RawMessage(`{"d":[{"k":"c","d":{"view":"plot","~data":0},"b":[{"m":{"f":["x","y"],"d":{"a":[1,2]}}}]},{"k":"c data b","v":[3,4]},{"k":"c data a y","v":9}]}`),
+		json.RawMessage(`{"p":{"c":{"c":{"d":{"view":"plot","~data":0},"b":[{"m":{"f":["x","y"],"d":{"a":[1,9],"b":[3,4]}}}]}}}}`),
+	},
+}
+
+// ContractRequest represents a request to check an SDK's encoding of a fixture.
+type ContractRequest struct {
+	Fixture string          `json:"fixture"`
+	Patch   json.RawMessage `json:"patch"` // the SDK's encoding
+}
+
+// ContractResponse represents the result of checking an SDK's encoding of a fixture.
+type ContractResponse struct {
+	OK       bool            `json:"ok"`
+	Expected json.RawMessage `json:"expected"`
+	Actual   json.RawMessage `json:"actual,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// ContractHandler serves the wire contract: GET lists the fixtures; POST applies an SDK's encoding of a fixture
+// to an empty scratch page, and reports whether the result matches the fixture's page.
+// Nothing is written to the site.
+type ContractHandler struct{}
+
+func newContractHandler() *ContractHandler {
+	return &ContractHandler{}
+}
+
+func (h *ContractHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(wireFixtures)
+	case http.MethodPost:
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchSize))
+		if err != nil {
+			if len(b) >= maxPatchSize {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		var req ContractRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		var fixture *WireFixture
+		for i := range wireFixtures {
+			if wireFixtures[i].Name == req.Fixture {
+				fixture = &wireFixtures[i]
+			}
+		}
+		if fixture == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(checkFixture(fixture, req.Patch))
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// checkFixture applies patch to an empty page, and compares the result with the fixture's page.
+func checkFixture(f *WireFixture, patch []byte) ContractResponse {
+	resp := ContractResponse{Expected: f.Page}
+	site := newSite()
+	if err := site.patch("/", patch, 0); err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	page := site.at("/")
+	if page == nil {
+		resp.Error = "patch produced no page"
+		return resp
+	}
+	actual := page.marshal()
+	resp.Actual = actual
+	resp.OK = jsonEqual(actual, f.Page)
+	return resp
+}
+
+// jsonEqual reports whether two JSON documents are structurally equal.
+func jsonEqual(a, b []byte) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	corsMethods = "GET, POST, PATCH, DELETE"
+	corsHeaders = "Authorization, Content-Type, Accept, If-Match, If-None-Match, Range, traceparent"
+	corsExposed = "ETag, Retry-After"
+	corsMaxAge  = "600" // seconds browsers may cache preflight responses
+)
+
+// CORS decides which cross-origin requests are allowed, from a list of origins:
+// "*" for any origin, "https://example.com" for an exact origin, or "https://*.example.com" for its subdomains.
+// Same-origin requests, and requests without an Origin header (non-browser clients), are always allowed.
+type CORS struct {
+	origins []string
+}
+
+func newCORS(origins []string) *CORS {
+	var xs []string
+	for _, o := range origins {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			xs = append(xs, strings.ToLower(o))
+		}
+	}
+	return &CORS{xs}
+}
+
+// allows reports whether origin is allowed.
+func (c *CORS) allows(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range c.origins {
+		if o == "*" || o == origin {
+			return true
+		}
+		if i := strings.Index(o, "://*."); i >= 0 {
+			scheme, suffix := o[:i+3], o[i+4:] // "https://", ".example.com"
+			if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, suffix) && len(origin) > len(scheme)+len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// crossOrigin returns the request's Origin, if the request is from a different origin than the server's.
+// The server's origin is as seen by the browser, so includes the scheme and host forwarded by trusted proxies.
+func crossOrigin(r *http.Request) (string, bool) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return "", false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(u.Scheme+"://"+u.Host, proxies.baseURL(r)) {
+		return origin, true
+	}
+	return "", false
+}
+
+// checkOrigin is a websocket origin check admitting allowed origins.
+func (c *CORS) checkOrigin(r *http.Request) bool {
+	origin, cross := crossOrigin(r)
+	return !cross || c.allows(origin)
+}
+
+// wrap adds CORS headers to responses to allowed cross-origin requests, and answers preflight requests.
+// Requests from other origins are served as before, without CORS headers, so browsers withhold the responses.
+func (c *CORS) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin, cross := crossOrigin(r)
+		if !cross || !c.allows(origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" { // preflight
+			header.Set("Access-Control-Allow-Methods", corsMethods)
+			header.Set("Access-Control-Allow-Headers", corsHeaders)
+			header.Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		header.Set("Access-Control-Expose-Headers", corsExposed)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const assetPollInterval = 500 * time.Millisecond
+
+// assetState summarizes the files under a directory, so that changes can be detected by polling.
+type assetState struct {
+	files    int
+	size     int64
+	modified time.Time
+}
+
+func scanAssets(dir string) assetState {
+	var s assetState
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		s.files++
+		s.size += info.Size()
+		if info.ModTime().After(s.modified) {
+			s.modified = info.ModTime()
+		}
+		return nil
+	})
+	return s
+}
+
+// watchAssets tells every connected browser to reload whenever files under dir are added, removed or modified,
+// until the broker stops.
+func (b *Broker) watchAssets(dir string) {
+	data, err := json.Marshal(OpsD{L: 1})
+	if err != nil {
+		return
+	}
+	last := scanAssets(dir)
+	ticker := clock.NewTicker(assetPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if s := scanAssets(dir); s != last {
+				last = s
+				echo(Log{"t": "assets_changed", "dir": dir})
+				b.signals <- data
+			}
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// noCache prevents browsers from caching responses.
+func noCache(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		h.ServeHTTP(w, r)
+	})
+}
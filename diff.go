@@ -0,0 +1,305 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var errVersionNotRetained = errors.New("version not retained")
+
+// Undo records the state of the cards touched by a change, as it was before the change.
+type Undo struct {
+	prev    int64             // page version before the change
+	version int64             // page version after the change
+	all     bool              // the change dropped the page; cards holds the entire previous page
+	cards   map[string]*CardD // card name => previous content; nil if the card did not exist
+}
+
+// record saves the state of the cards about to be changed by ops, retaining up to depth changes.
+// Must be called under lock.
+func (p *Page) record(ops OpsD, version int64, depth int) {
+	if depth == 0 {
+		return
+	}
+	u := Undo{prev: p.version, version: version, cards: make(map[string]*CardD)}
+	for _, op := range ops.D {
+		if len(op.K) == 0 {
+			u.all = true
+			break
+		}
+	}
+	if u.all {
+		for k, c := range p.cards {
+			d := c.dump()
+			u.cards[k] = &d
+		}
+	} else {
+		for _, op := range ops.D {
+			k := strings.SplitN(op.K, keySeparator, 2)[0]
+			if _, ok := u.cards[k]; ok {
+				continue
+			}
+			if c, ok := p.cards[k]; ok {
+				d := c.dump()
+				u.cards[k] = &d
+			} else {
+				u.cards[k] = nil
+			}
+		}
+	}
+	if len(p.undo) >= depth {
+		p.undo = append(p.undo[:0], p.undo[1:]...)
+	}
+	p.undo = append(p.undo, u)
+}
+
+// replaced records the page's replacement by another page at version, and returns the page's undo history,
+// for the replacement to carry on with.
+func (p *Page) replaced(version int64, depth int) []Undo {
+	p.Lock()
+	defer p.Unlock()
+	p.record(OpsD{D: []OpD{{}}}, version, depth)
+	return p.undo
+}
+
+// at returns the page's cards as of version, which must be the current version or one of the retained past versions.
+func (p *Page) at(version int64) (map[string]CardD, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	i := len(p.undo)
+	if version != p.version {
+		for i = len(p.undo) - 1; i >= 0 && p.undo[i].prev != version; i-- {
+		}
+		if i < 0 {
+			return nil, errVersionNotRetained
+		}
+	}
+	cards := p.dump().C
+	for j := len(p.undo) - 1; j >= i; j-- {
+		u := p.undo[j]
+		if u.all {
+			cards = make(map[string]CardD, len(u.cards))
+		}
+		for k, c := range u.cards {
+			if c == nil {
+				delete(cards, k)
+			} else {
+				cards[k] = *c
+			}
+		}
+	}
+	return cards, nil
+}
+
+// versions returns the versions a diff can be requested for, oldest first.
+func (p *Page) versions() []int64 {
+	p.RLock()
+	defer p.RUnlock()
+	vs := make([]int64, 0, len(p.undo)+1)
+	for _, u := range p.undo {
+		vs = append(vs, u.prev)
+	}
+	return append(vs, p.version)
+}
+
+// PageDiff represents the differences between two versions of a page.
+type PageDiff struct {
+	URL   string     `json:"url"`
+	From  int64      `json:"from"`
+	To    int64      `json:"to"`
+	Cards []CardDiff `json:"cards"`
+}
+
+// CardDiff represents the differences between two versions of a card.
+type CardDiff struct {
+	Name   string      `json:"name"`
+	Change string      `json:"change"` // added, removed or changed
+	Fields []FieldDiff `json:"fields"`
+}
+
+// FieldDiff represents the difference between two versions of a card attribute. Buffers are compared whole.
+type FieldDiff struct {
+	Name   string      `json:"name"`
+	Change string      `json:"change"` // added, removed or changed
+	Old    interface{} `json:"old,omitempty"`
+	New    interface{} `json:"new,omitempty"`
+}
+
+const (
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	changeChanged = "changed"
+)
+
+// diffCards compares two versions of a page's cards, ignoring hidden cards.
+func diffCards(from, to map[string]CardD, hidden map[string]bool) []CardDiff {
+	names := make(map[string]bool)
+	for k := range from {
+		names[k] = true
+	}
+	for k := range to {
+		names[k] = true
+	}
+	var diffs []CardDiff
+	for k := range names {
+		if hidden[k] {
+			continue
+		}
+		a, inFrom := from[k]
+		b, inTo := to[k]
+		var change string
+		switch {
+		case !inFrom:
+			change = changeAdded
+		case !inTo:
+			change = changeRemoved
+		default:
+			change = changeChanged
+		}
+		if fields := diffFields(cardFields(a), cardFields(b)); len(fields) > 0 {
+			diffs = append(diffs, CardDiff{k, change, fields})
+		} else if change != changeChanged {
+			diffs = append(diffs, CardDiff{k, change, []FieldDiff{}})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Name < diffs[j].Name })
+	return diffs
+}
+
+// cardFields returns a card's attributes, with buffer references resolved to the buffers themselves.
+func cardFields(c CardD) map[string]interface{} {
+	fields := make(map[string]interface{}, len(c.D))
+	for k, v := range c.D {
+		if strings.HasPrefix(k, dataPrefix) {
+			if i, ok := v.(int); ok && i >= 0 && i < len(c.B) {
+				fields[k[len(dataPrefix):]] = c.B[i]
+				continue
+			}
+		}
+		fields[k] = v
+	}
+	return fields
+}
+
+func diffFields(from, to map[string]interface{}) []FieldDiff {
+	var diffs []FieldDiff
+	for k, a := range from {
+		if b, ok := to[k]; !ok {
+			diffs = append(diffs, FieldDiff{k, changeRemoved, a, nil})
+		} else if !sameJSON(a, b) {
+			diffs = append(diffs, FieldDiff{k, changeChanged, a, b})
+		}
+	}
+	for k, b := range to {
+		if _, ok := from[k]; !ok {
+			diffs = append(diffs, FieldDiff{k, changeAdded, nil, b})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Name < diffs[j].Name })
+	return diffs
+}
+
+func sameJSON(a, b interface{}) bool {
+	x, err1 := json.Marshal(a)
+	y, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && bytes.Equal(x, y)
+}
+
+// DiffHandler compares two versions of a page: GET /_api/diff?url=/foo&from=v1[&to=v2].
+// to defaults to the current version. Only the page's most recent versions are retained.
+type DiffHandler struct {
+	site *Site
+	auth *Auth
+}
+
+func newDiffHandler(site *Site, auth *Auth) *DiffHandler {
+	return &DiffHandler{site, auth}
+}
+
+func (h *DiffHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	viewer, ok := h.auth.identify(r)
+	if !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	url := q.Get("url")
+	if url == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if !viewer.trusted && !h.site.acl.allows(url, viewer.username, viewer.roles) {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	page := h.site.at(url)
+	if page == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	from, err := parseVersion(q.Get("from"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	page.RLock()
+	to := page.version
+	page.RUnlock()
+	if s := q.Get("to"); s != "" {
+		if to, err = parseVersion(s); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	a, err := page.at(from)
+	if err == nil {
+		var b map[string]CardD
+		if b, err = page.at(to); err == nil {
+			var hidden map[string]bool
+			if !viewer.trusted {
+				hidden = page.hidden(viewer.roles)
+			}
+			diff := PageDiff{url, from, to, diffCards(a, b, hidden)}
+			if diff.Cards == nil {
+				diff.Cards = []CardDiff{}
+			}
+			w.Header().Set("Content-Type", contentTypeJSON)
+			json.NewEncoder(w).Encode(diff)
+			return
+		}
+	}
+	// Tell the caller which versions are available.
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(http.StatusGone)
+	json.NewEncoder(w).Encode(struct {
+		Error    string  `json:"error"`
+		Versions []int64 `json:"versions"`
+	}{err.Error(), page.versions()})
+}
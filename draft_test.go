@@ -0,0 +1,123 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestPublishDraftRequiresApproval(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	b.approvals.protect("/ops", true)
+	ctx := withWriter(context.Background(), "alice", "http")
+	if _, _, err := b.publishIf(ctx, draftURL("/ops"), []byte(testPatch), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := b.publishDraft(ctx, "/ops")
+	if err != nil || id == "" {
+		t.Fatalf("publishing draft of protected page: got %q, %v; want a pending patch", id, err)
+	}
+	if b.site.at("/ops") != nil {
+		t.Fatal("draft published without approval")
+	}
+	if err := b.approve(id); err != nil {
+		t.Fatal(err)
+	}
+	page := b.site.at("/ops")
+	if page == nil {
+		t.Fatal("approved draft not published")
+	}
+	if _, ok := page.cards["status"]; !ok {
+		t.Error("published page lacks the draft's cards")
+	}
+}
+
+func TestPublishDraftValidated(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	ctx := context.Background()
+	if _, _, err := b.publishIf(ctx, draftURL("/news"), []byte(testPatch), -1); err != nil {
+		t.Fatal(err)
+	}
+	defer func(v *Validators) { validators = v }(validators)
+	validators = newValidators([]CardValidator{{Prefix: "/news", Check: func(route, card string, data map[string]interface{}) error {
+		return errors.New("frozen")
+	}}})
+	if _, err := b.publishDraft(ctx, "/news"); err == nil {
+		t.Fatal("draft failing validation published")
+	}
+	if b.site.at("/news") != nil {
+		t.Error("invalid draft published")
+	}
+	if _, err := b.publishDraft(ctx, "/missing"); err != errNoDraft {
+		t.Errorf("publishing missing draft: got %v, want %v", err, errNoDraft)
+	}
+}
+
+func TestPublishDraftRecorded(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	ctx := context.Background()
+	if _, _, err := b.publishIf(ctx, "/news", []byte(testPatch), -1); err != nil {
+		t.Fatal(err)
+	}
+	before := b.site.version("/news")
+	if _, _, err := b.publishIf(ctx, draftURL("/news"), []byte(`{"d":[{"k":"headline","d":{"view":"markdown","content":"extra"}}]}`), -1); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	r, err := newRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = r
+	defer func() {
+		recorder = nil
+		r.close()
+	}()
+
+	if _, err := b.publishDraft(ctx, "/news"); err != nil {
+		t.Fatal(err)
+	}
+	page := b.site.at("/news")
+	old, err := page.at(before)
+	if err != nil {
+		t.Fatalf("version before publishing not retained: %v", err)
+	}
+	if _, ok := old["status"]; !ok || len(old) != 1 {
+		t.Errorf("want the page as it was before publishing, got %+v", old)
+	}
+
+	recorded, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p RecordedPatch
+	if err := json.Unmarshal(recorded, &p); err != nil {
+		t.Fatalf("want the published draft recorded, got %q: %v", recorded, err)
+	}
+	replayed := newSite()
+	replayed.patch("/news", []byte(testPatch), 1)
+	if err := replayed.patch("/news", p.Data, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := replayed.at("/news").cards; len(got) != 1 || got["headline"] == nil {
+		t.Errorf("want the recording to replay to the draft, got %+v", got)
+	}
+}
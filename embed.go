@@ -0,0 +1,201 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listenerQueueSize is the number of changes buffered per change listener.
+const listenerQueueSize = 1024
+
+// viaEmbed identifies changes made through a LocalSite.
+const viaEmbed = "embed"
+
+// Change represents a change to a page, as seen by change listeners.
+type Change struct {
+	Event   string // "patch" or "delete"
+	Route   string
+	Version int64
+	Data    []byte // the change, in wire format: a patch, or a whole page; nil if the page was deleted
+	Via     string // how the change arrived, e.g. "http", "ws", "peer" or "embed"
+}
+
+type listener struct {
+	prefix string
+	queue  chan Change
+	quit   chan struct{}
+}
+
+// Listeners holds change listeners registered by programs embedding the server.
+type Listeners struct {
+	sync.RWMutex
+	next      int
+	listeners map[int]*listener
+}
+
+func newListeners() *Listeners {
+	return &Listeners{listeners: make(map[int]*listener)}
+}
+
+// add registers f to be called, in order, with changes to pages at or below prefix; returns a function that unregisters f.
+func (ls *Listeners) add(prefix string, f func(Change)) func() {
+	l := &listener{prefix, make(chan Change, listenerQueueSize), make(chan struct{})}
+	ls.Lock()
+	id := ls.next
+	ls.next++
+	ls.listeners[id] = l
+	ls.Unlock()
+	go func() {
+		for {
+			select {
+			case <-l.quit:
+				return
+			case c := <-l.queue:
+				f(c)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ls.Lock()
+			delete(ls.listeners, id)
+			ls.Unlock()
+			close(l.quit)
+		})
+	}
+}
+
+// notify queues a change for interested listeners. System pages are never reported.
+// Changes are dropped for listeners that have fallen too far behind, since publishing must not block.
+func (ls *Listeners) notify(ctx context.Context, event, route string, data []byte, version int64) {
+	if isPathPrefix(systemPrefix, route) {
+		return
+	}
+	ls.RLock()
+	defer ls.RUnlock()
+	if len(ls.listeners) == 0 {
+		return
+	}
+	c := Change{event, route, version, data, writerFrom(ctx).Via}
+	for _, l := range ls.listeners {
+		if !isPathPrefix(l.prefix, route) {
+			continue
+		}
+		select {
+		case l.queue <- c:
+		default:
+			stats.changeDropped()
+			echo(Log{"t": "listener_drop", "route": route})
+		}
+	}
+}
+
+// onChange notifies listeners of a page change published on the broker's bus.
+func (ls *Listeners) onChange(e Event) {
+	event := patchEvent
+	if e.Change == changeDelete {
+		event = deleteEvent
+	}
+	ls.notify(e.Ctx, event, e.Route, e.Data, e.Version)
+}
+
+// LocalSite gives programs that embed the server direct access to pages, bypassing HTTP.
+// Changes made through it are logged to the AOF, replicated, and broadcast to clients, like any other.
+// Obtain one via ServerConf.OnReady.
+type LocalSite struct {
+	broker *Broker
+}
+
+// Patch applies changes, in wire format, to the page at route, and returns the page's new version.
+// If the route requires approval, the patch is queued instead, and the version returned is 0.
+func (s *LocalSite) Patch(ctx context.Context, route string, data []byte) (int64, error) {
+	return s.PatchIf(ctx, route, data, -1)
+}
+
+// PatchIf is like Patch, but fails unless the page's current version is want
+// (0 if the page must not exist, -1 for any version).
+func (s *LocalSite) PatchIf(ctx context.Context, route string, data []byte, want int64) (int64, error) {
+	_, version, err := s.broker.publishIf(withWriter(ctx, "", viaEmbed), route, data, want)
+	return version, err
+}
+
+// PatchFor is like Patch, but the changes are undone after d, by the server: attributes changed are restored
+// to their previous values, and cards put or deleted to their previous contents.
+// Returns the ID of the undoing patch, which can be canceled with DELETE /_schedule?id=.
+func (s *LocalSite) PatchFor(ctx context.Context, route string, data []byte, d time.Duration) (int64, string, error) {
+	ctx, revert := withRevert(withWriter(ctx, "", viaEmbed), d)
+	_, version, err := s.broker.publishIf(ctx, route, data, -1)
+	if err != nil || revert.Patch == nil {
+		return version, "", err
+	}
+	return version, revert.Patch.ID, nil
+}
+
+// Read returns the page at route, in wire format, and its version; ok is false if there is no such page.
+func (s *LocalSite) Read(route string) (data []byte, version int64, ok bool) {
+	page := s.broker.site.at(route)
+	if page == nil {
+		return nil, 0, false
+	}
+	version = s.broker.site.version(route)
+	if data = page.marshal(); data == nil {
+		return nil, 0, false
+	}
+	return data, version, true
+}
+
+// Delete removes the page at route; returns false if there is no such page.
+func (s *LocalSite) Delete(ctx context.Context, route string) bool {
+	return s.broker.deleteIf(withWriter(ctx, "", viaEmbed), route, func(*Page) bool { return true })
+}
+
+// Export writes the pages at or below prefix, with their cards and TTLs, to w as one JSON object keyed by url,
+// the same format accepted by Import and by PUT /_api/site.
+func (s *LocalSite) Export(ctx context.Context, w io.Writer, prefix string) error {
+	_, err := s.broker.exportSite(ctx, w, prefix, false)
+	return err
+}
+
+// Import replaces pages with those read from r, as written by Export, and returns how many were imported.
+// Pages that could not be imported are reported in the error; the rest are imported regardless.
+func (s *LocalSite) Import(ctx context.Context, r io.Reader) (int, error) {
+	resp := s.broker.importJSON(withWriter(ctx, "", viaEmbed), r, "/")
+	if len(resp.Errors) > 0 {
+		var msgs []string
+		for _, e := range resp.Errors {
+			if e.URL != "" {
+				msgs = append(msgs, e.URL+": "+e.Error)
+			} else {
+				msgs = append(msgs, e.Error)
+			}
+		}
+		return resp.Imported, fmt.Errorf("failed importing %d pages: %s", len(resp.Errors), strings.Join(msgs, "; "))
+	}
+	return resp.Imported, nil
+}
+
+// Listen calls f, in order and on its own goroutine, with every change made to pages at or below prefix,
+// however the change was made. f must keep up: changes are dropped if too many are pending.
+// Returns a function that stops listening.
+func (s *LocalSite) Listen(prefix string, f func(Change)) (stop func()) {
+	return s.broker.listeners.add(prefix, f)
+}
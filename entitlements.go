@@ -0,0 +1,220 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Feature names an optional capability that can be withheld by Entitlements.
+type Feature string
+
+// Features subject to entitlements.
+const (
+	FeatureCluster       Feature = "cluster"       // replication to peer servers
+	FeatureOIDC          Feature = "oidc"          // single sign-on
+	FeatureWebhooks      Feature = "webhooks"      // registering webhooks
+	FeatureNotifications Feature = "notifications" // page change subscriptions
+	FeatureAnalytics     Feature = "analytics"     // usage tracking
+	FeatureArchive       Feature = "archive"       // AOF archiving to object storage
+	FeatureApps          Feature = "apps"          // registering apps
+)
+
+// Entitlements decides what the server may do, so that products embedding it can enforce their licensing.
+// Methods are called on request paths, and must be fast and safe for concurrent use.
+type Entitlements interface {
+	MaxUsers() int               // distinct users connected at once; 0 = unlimited
+	MaxPages() int               // pages in the site, excluding system pages; 0 = unlimited
+	Allows(feature Feature) bool // whether an optional feature may be used
+	Notice() string              // shown to users turned away, e.g. "Contact sales@example.com to add seats."; may be empty
+}
+
+// License is a fixed set of Entitlements.
+type License struct {
+	Users    int       // distinct users connected at once; 0 = unlimited
+	Pages    int       // pages in the site; 0 = unlimited
+	Features []Feature // optional features allowed; all if nil
+	Message  string    // shown to users turned away
+}
+
+func (l License) MaxUsers() int  { return l.Users }
+func (l License) MaxPages() int  { return l.Pages }
+func (l License) Notice() string { return l.Message }
+
+func (l License) Allows(feature Feature) bool {
+	if l.Features == nil {
+		return true
+	}
+	for _, f := range l.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// LicenseError reports that an operation exceeds the server's entitlements.
+type LicenseError struct {
+	Limit  string // "users", "pages", or the feature withheld
+	Notice string
+}
+
+func (e *LicenseError) Error() string {
+	var msg string
+	switch e.Limit {
+	case "users":
+		msg = "The maximum number of users for this license has been reached."
+	case "pages":
+		msg = "The maximum number of pages for this license has been reached."
+	default:
+		msg = fmt.Sprintf("The %s feature is not included in this license.", e.Limit)
+	}
+	if e.Notice != "" {
+		msg += " " + e.Notice
+	}
+	return msg
+}
+
+// Licensing enforces Entitlements, tracking connected users.
+type Licensing struct {
+	sync.Mutex
+	ents  Entitlements   // nil = unlimited
+	users map[string]int // username => websocket connections
+}
+
+var licensing = newLicensing(nil)
+
+func newLicensing(ents Entitlements) *Licensing {
+	return &Licensing{ents: ents, users: make(map[string]int)}
+}
+
+func (l *Licensing) refuse(limit string) error {
+	return &LicenseError{limit, l.ents.Notice()}
+}
+
+// allows checks whether a feature may be used.
+func (l *Licensing) allows(f Feature) error {
+	if l.ents == nil || l.ents.Allows(f) {
+		return nil
+	}
+	return l.refuse(string(f))
+}
+
+// check verifies that the features configured are allowed.
+func (l *Licensing) check(conf ServerConf) []error {
+	var errs []error
+	used := map[Feature]bool{
+		FeatureCluster:   len(conf.Cluster.Peers) > 0,
+		FeatureOIDC:      conf.oidcEnabled(),
+		FeatureAnalytics: conf.Analytics.enabled(),
+		FeatureArchive:   conf.AOF.Archive.URL != "",
+	}
+	for _, f := range []Feature{FeatureCluster, FeatureOIDC, FeatureAnalytics, FeatureArchive} {
+		if used[f] {
+			if err := l.allows(f); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// connect admits a websocket connection by a user, unless it would exceed the user limit.
+// Admitted connections must be released with disconnect.
+func (l *Licensing) connect(username string) error {
+	l.Lock()
+	defer l.Unlock()
+	if n := l.users[username]; n == 0 && l.ents != nil {
+		if max := l.ents.MaxUsers(); max > 0 && len(l.users) >= max {
+			warn(Log{"t": "license", "limit": "users", "max": strconv.Itoa(max), "user": username})
+			return l.refuse("users")
+		}
+	}
+	l.users[username]++
+	return nil
+}
+
+func (l *Licensing) disconnect(username string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.users[username]--; l.users[username] <= 0 {
+		delete(l.users, username)
+	}
+}
+
+// connected returns the number of distinct users connected.
+func (l *Licensing) connected() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.users)
+}
+
+// canCreate checks whether a page can be added at url, unless it would exceed the page limit.
+// Must be called with page changes blocked.
+func (l *Licensing) canCreate(site *Site, url string) error {
+	if l.ents == nil || isPathPrefix(systemPrefix, url) {
+		return nil
+	}
+	max := l.ents.MaxPages()
+	if max <= 0 {
+		return nil
+	}
+	site.RLock()
+	defer site.RUnlock()
+	if _, ok := site.pages[url]; ok {
+		return nil
+	}
+	if _, ok := site.evicted[url]; ok {
+		return nil
+	}
+	n := 0
+	for u := range site.pages {
+		if !isPathPrefix(systemPrefix, u) {
+			n++
+		}
+	}
+	n += len(site.evicted) // system pages are never evicted
+	if n >= max {
+		warn(Log{"t": "license", "limit": "pages", "max": strconv.Itoa(max), "route": url})
+		return l.refuse("pages")
+	}
+	return nil
+}
+
+// LicenseStatus represents usage against the server's entitlements.
+type LicenseStatus struct {
+	Users    int `json:"users"`
+	MaxUsers int `json:"max_users,omitempty"`
+	MaxPages int `json:"max_pages,omitempty"`
+}
+
+func (l *Licensing) status() *LicenseStatus {
+	if l.ents == nil {
+		return nil
+	}
+	return &LicenseStatus{l.connected(), l.ents.MaxUsers(), l.ents.MaxPages()}
+}
+
+// refuseRequest responds to a request that exceeds the server's entitlements, if err is a LicenseError.
+func refuseRequest(w http.ResponseWriter, err error) bool {
+	if e, ok := err.(*LicenseError); ok {
+		http.Error(w, e.Error(), http.StatusPaymentRequired)
+		return true
+	}
+	return false
+}
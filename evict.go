@@ -0,0 +1,245 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const trimEvery = 5 * time.Second // how often to check the site's memory budget
+
+// EvictedPage records a page that was evicted from memory and spilled to disk.
+type EvictedPage struct {
+	path     string        // spill file
+	version  int64         // version at eviction
+	modified time.Time     // time of the last change
+	ttl      time.Duration // time-to-live
+	cards    int           // number of cards
+	size     int64         // estimated size, in bytes
+}
+
+// spillFile represents the contents of a spill file: the page, and what the server knows about its history.
+type spillFile struct {
+	Page    json.RawMessage       `json:"page"` // as in snapshots
+	Writers map[string]CardWriter `json:"writers,omitempty"`
+	Undo    []spilledUndo         `json:"undo,omitempty"`
+}
+
+// spilledUndo represents an Undo in a spill file.
+type spilledUndo struct {
+	Prev    int64             `json:"prev"`
+	Version int64             `json:"version"`
+	All     bool              `json:"all,omitempty"`
+	Cards   map[string]*CardD `json:"cards"`
+}
+
+// access marks the page as recently used.
+func (p *Page) access() {
+	atomic.StoreInt64(&p.accessed, clock.Now().UnixNano())
+}
+
+// spillTo sets the directory evicted pages are written to, clearing out any pages spilled by a previous run,
+// which are recovered from the AOF instead.
+func (site *Site) spillTo(dir string) {
+	os.RemoveAll(dir)
+	site.spillDir = dir
+}
+
+// resident returns the page at url if it is in memory, else nil.
+func (site *Site) resident(url string) *Page {
+	site.RLock()
+	defer site.RUnlock()
+	return site.pages[url]
+}
+
+// peek returns the page at url, loading it from disk if evicted, but without bringing it back into memory.
+func (site *Site) peek(url string) *Page {
+	site.RLock()
+	p, ok := site.pages[url]
+	e, evicted := site.evicted[url]
+	site.RUnlock()
+	if ok {
+		return p
+	}
+	if evicted {
+		p, err := loadSpilled(site.ns, e)
+		if err != nil {
+			echo(Log{"t": "page_reload", "url": url, "error": err.Error()})
+			return nil
+		}
+		return p
+	}
+	return nil
+}
+
+// reload brings an evicted page back into memory.
+func (site *Site) reload(url string) *Page {
+	site.Lock()
+	defer site.Unlock()
+	if p, ok := site.pages[url]; ok { // reloaded concurrently
+		return p
+	}
+	e, ok := site.evicted[url]
+	if !ok {
+		return nil
+	}
+	delete(site.evicted, url)
+	p, err := loadSpilled(site.ns, e)
+	os.Remove(e.path)
+	if err != nil {
+		echo(Log{"t": "page_reload", "url": url, "error": err.Error()})
+		return nil
+	}
+	p.access()
+	site.pages[url] = p
+	stats.pageReloaded()
+	return p
+}
+
+func loadSpilled(ns *Namespace, e *EvictedPage) (*Page, error) {
+	data, err := ioutil.ReadFile(e.path)
+	if err != nil {
+		return nil, err
+	}
+	var f spillFile
+	var ops OpsD
+	if err := json.Unmarshal(data, &f); err != nil || json.Unmarshal(f.Page, &ops) != nil || ops.P == nil {
+		return nil, fmt.Errorf("bad spill file %s", e.path)
+	}
+	p := loadPage(ns, ops.P)
+	p.version, p.modified, p.ttl = e.version, e.modified, e.ttl
+	p.writers = f.Writers
+	for _, u := range f.Undo {
+		p.undo = append(p.undo, Undo{u.Prev, u.Version, u.All, u.Cards})
+	}
+	return p, nil
+}
+
+// evict spills least recently accessed pages to disk until the site's estimated size is within budget bytes.
+// Page sizes are estimated from their serialized form, without blocking changes; lock is used to block
+// changes to each page only while it is spilled, so that none are lost.
+func (site *Site) evict(budget int64, lock func(url string) func()) {
+	type candidate struct {
+		url      string
+		page     *Page
+		size     int64
+		accessed int64
+	}
+
+	site.RLock()
+	candidates := make([]candidate, 0, len(site.pages))
+	for url, p := range site.pages {
+		candidates = append(candidates, candidate{url: url, page: p})
+	}
+	site.RUnlock()
+
+	var total int64
+	for i := range candidates {
+		c := &candidates[i]
+		c.size = int64(len(c.page.marshal()))
+		c.accessed = atomic.LoadInt64(&c.page.accessed)
+		total += c.size
+	}
+	atomic.StoreInt64(&stats.residentBytes, total)
+	if total <= budget {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].accessed < candidates[j].accessed })
+	for _, c := range candidates {
+		if total <= budget {
+			break
+		}
+		if isPathPrefix(systemPrefix, c.url) {
+			continue
+		}
+		unlock := lock(c.url)
+		if site.resident(c.url) != c.page { // replaced, deleted or evicted since measured
+			unlock()
+			continue
+		}
+		err := site.spill(c.url, c.page, c.size)
+		unlock()
+		if err != nil {
+			echo(Log{"t": "page_evict", "url": c.url, "error": err.Error()})
+			return
+		}
+		total -= c.size
+	}
+	atomic.StoreInt64(&stats.residentBytes, total)
+}
+
+// spill writes a page to disk, along with its writers and undo history, and drops it from memory.
+func (site *Site) spill(url string, p *Page, size int64) error {
+	page := p.snapshot()
+	if page == nil {
+		return fmt.Errorf("failed marshaling page")
+	}
+	f := spillFile{Page: page}
+	p.RLock()
+	f.Writers = p.writers
+	for _, u := range p.undo {
+		f.Undo = append(f.Undo, spilledUndo{u.prev, u.version, u.all, u.cards})
+	}
+	data, err := json.Marshal(f)
+	p.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(site.spillDir, 0700); err != nil {
+		return err
+	}
+	h := sha1.Sum([]byte(url))
+	path := filepath.Join(site.spillDir, hex.EncodeToString(h[:])+".json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+
+	p.RLock()
+	e := &EvictedPage{path, p.version, p.modified, p.ttl, len(p.cards), size}
+	p.RUnlock()
+
+	site.Lock()
+	if site.pages[url] == p {
+		delete(site.pages, url)
+		site.evicted[url] = e
+	}
+	site.Unlock()
+	stats.pageEvicted()
+	return nil
+}
+
+// trim periodically evicts pages from memory to keep the site within budget bytes.
+func (b *Broker) trim(budget int64) {
+	ticker := clock.NewTicker(trimEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-b.quit:
+			return
+		}
+		b.site.evict(budget, b.lock)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEvictKeepsHistory(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	b.site.spillTo(filepath.Join(t.TempDir(), "evicted"))
+	ctx := withWriter(context.Background(), "alice", "http")
+	if _, err := b.patchIf(ctx, "/ops", []byte(testPatch), -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.patchIf(ctx, "/ops", []byte(`{"d":[{"k":"status content","v":"down"}]}`), -1); err != nil {
+		t.Fatal(err)
+	}
+	before := b.site.at("/ops")
+	versions := before.versions()
+	old, err := before.at(versions[len(versions)-2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.site.evict(0, b.lock)
+	if b.site.resident("/ops") != nil {
+		t.Fatal("page not evicted")
+	}
+	for name, p := range map[string]*Page{"peeked": b.site.peek("/ops"), "reloaded": b.site.at("/ops")} {
+		if p == nil {
+			t.Fatalf("%s: page lost", name)
+		}
+		if w := p.writers["status"]; w.By != "alice" || w.Via != "http" {
+			t.Errorf("%s: want status written by alice over http, got %+v", name, w)
+		}
+		if got := p.versions(); !reflect.DeepEqual(got, versions) {
+			t.Errorf("%s: want versions %v, got %v", name, versions, got)
+		}
+		was, err := p.at(versions[len(versions)-2])
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(was, old) {
+			t.Errorf("%s: want previous version %+v, got %+v", name, old, was)
+		}
+	}
+}
+
+func TestEvictLocksSpilledPagesOnly(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	b.site.spillTo(filepath.Join(t.TempDir(), "evicted"))
+	ctx := withWriter(context.Background(), "alice", "http")
+	for i, route := range []string{"/old", "/new"} {
+		if _, err := b.patchIf(ctx, route, []byte(testPatch), -1); err != nil {
+			t.Fatal(err)
+		}
+		b.site.at(route).accessed = int64(i + 1)
+	}
+	var locked []string
+	b.site.evict(int64(len(b.site.at("/new").marshal())), func(url string) func() {
+		locked = append(locked, url)
+		return b.lock(url)
+	})
+	if !reflect.DeepEqual(locked, []string{"/old"}) {
+		t.Fatalf("want only /old locked, got %v", locked)
+	}
+	if b.site.resident("/old") != nil || b.site.resident("/new") == nil {
+		t.Fatal("want the least recently accessed page evicted")
+	}
+}
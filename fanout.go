@@ -0,0 +1,270 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// parallelFanoutMin is the number of clients watching a page beyond which a message is
+// delivered to them by several goroutines, one per shard.
+const parallelFanoutMin = 512
+
+// Frame represents a message queued for delivery to one or more clients. Clients seeing
+// a published message the same way share a frame, so that it is framed, compressed and
+// converted to MessagePack once, rather than once per client.
+type Frame struct {
+	data   []byte                     // JSON message
+	route  string                     // page the message was published to; "" for messages that aren't
+	mu     sync.Mutex                 // guards text, binary, legacy
+	text   *websocket.PreparedMessage // encoded on first use
+	binary *websocket.PreparedMessage // encoded on first use
+	legacy map[int]*Frame             // wire version => frame for clients speaking it; converted on first use
+}
+
+func newFrame(data []byte) *Frame {
+	return &Frame{data: data}
+}
+
+// prepared returns the frame as a text (JSON) or binary (MessagePack) websocket message.
+func (f *Frame) prepared(binary bool) (*websocket.PreparedMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !binary {
+		if f.text == nil {
+			pm, err := websocket.NewPreparedMessage(websocket.TextMessage, f.data)
+			if err != nil {
+				return nil, err
+			}
+			f.text = pm
+		}
+		return f.text, nil
+	}
+	if f.binary == nil {
+		b, err := jsonToMsgpack(f.data)
+		if err != nil {
+			return nil, err
+		}
+		pm, err := websocket.NewPreparedMessage(websocket.BinaryMessage, b)
+		if err != nil {
+			return nil, err
+		}
+		f.binary = pm
+	}
+	return f.binary, nil
+}
+
+// forWire returns the frame as seen by clients speaking wire version v.
+func (f *Frame) forWire(v int) *Frame {
+	if v >= grammarVersion {
+		return f
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if g, ok := f.legacy[v]; ok {
+		return g
+	}
+	data, err := downgradeMsg(f.data, v)
+	if err != nil {
+		echo(Log{"t": "wire_downgrade", "version": strconv.Itoa(v), "error": err.Error()})
+		data = f.data
+	}
+	if f.legacy == nil {
+		f.legacy = make(map[int]*Frame)
+	}
+	g := newFrame(data)
+	f.legacy[v] = g
+	return g
+}
+
+// ClientSet represents the clients watching a page, spread over shards so that messages
+// can be delivered to large audiences in parallel. Broker-owned.
+type ClientSet struct {
+	shards []map[*Client]interface{}
+	n      int
+}
+
+func newClientSet(shards int) *ClientSet {
+	s := &ClientSet{shards: make([]map[*Client]interface{}, shards)}
+	for i := range s.shards {
+		s.shards[i] = make(map[*Client]interface{})
+	}
+	return s
+}
+
+// fanoutShards is the number of shards per ClientSet: one per CPU available to the server.
+func fanoutShards() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+func (s *ClientSet) shardOf(c *Client) map[*Client]interface{} {
+	return s.shards[c.shard%uint32(len(s.shards))]
+}
+
+func (s *ClientSet) add(c *Client) {
+	shard := s.shardOf(c)
+	if _, ok := shard[c]; !ok {
+		shard[c] = nil
+		s.n++
+	}
+}
+
+func (s *ClientSet) remove(c *Client) {
+	shard := s.shardOf(c)
+	if _, ok := shard[c]; ok {
+		delete(shard, c)
+		s.n--
+	}
+}
+
+func (s *ClientSet) len() int {
+	return s.n
+}
+
+func (s *ClientSet) each(f func(*Client)) {
+	for _, shard := range s.shards {
+		for c := range shard {
+			f(c)
+		}
+	}
+}
+
+// Fanout tailors a published message to the clients watching its page, doing the work once
+// per distinct view of the page: per set of roles, if the page hides cards from some viewers,
+// and per set of watched cards, for clients watching part of the page.
+type Fanout struct {
+	route     string
+	page      *Page
+	data      []byte
+	filtering bool              // whether viewers having different roles see data differently
+	mu        sync.Mutex        // guards frames
+	frames    map[string]*Frame // view => frame; nil if the message has nothing of interest to the view
+}
+
+func newFanout(route string, page *Page, data []byte) *Fanout {
+	return &Fanout{route, page, data, page != nil && page.filters(data), sync.Mutex{}, make(map[string]*Frame)}
+}
+
+// frameFor returns the message as seen by a client, or nil if it has nothing of interest to the client.
+func (f *Fanout) frameFor(c *Client) *Frame {
+	view := ""
+	if f.filtering {
+		view = c.view
+	}
+	cards, partial := c.cards[f.route]
+	if partial {
+		view += "\n" + cardsKey(cards)
+	}
+
+	f.mu.Lock()
+	frame, ok := f.frames[view]
+	f.mu.Unlock()
+	if ok {
+		return frame
+	}
+
+	data := f.data
+	if f.filtering {
+		data = f.page.filter(data, c.roles)
+	}
+	if partial {
+		data, ok = selectCards(data, cards)
+	}
+	if !partial || ok {
+		frame = newFrame(data)
+		frame.route = f.route
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if existing, ok := f.frames[view]; ok { // tailored concurrently by another shard
+		return existing
+	}
+	f.frames[view] = frame
+	return frame
+}
+
+// viewOf identifies the clients having the same roles, which see pages the same way.
+func viewOf(roles []string) string {
+	if len(roles) == 0 {
+		return ""
+	}
+	xs := append([]string(nil), roles...)
+	sort.Strings(xs)
+	return strings.Join(xs, "\x00")
+}
+
+func cardsKey(cards map[string]bool) string {
+	xs := make([]string, 0, len(cards))
+	for k := range cards {
+		xs = append(xs, k)
+	}
+	sort.Strings(xs)
+	return strings.Join(xs, " ")
+}
+
+// fanout delivers a published message to the clients watching its route. Large audiences
+// are served by one goroutine per shard; the broker loop waits for all of them, so that
+// broker-owned state is never touched concurrently by anything else.
+func (b *Broker) fanout(pub Pub, clients *ClientSet) {
+	f := newFanout(pub.route, b.site.at(pub.route), pub.data)
+	deliver := func(c *Client) bool {
+		frame := f.frameFor(c)
+		return frame == nil || b.deliver(c, pub.route, f.page, frame)
+	}
+
+	var dropped []*Client
+	if clients.len() < parallelFanoutMin || len(clients.shards) == 1 {
+		clients.each(func(c *Client) {
+			if !deliver(c) {
+				dropped = append(dropped, c)
+			}
+		})
+	} else {
+		var (
+			wg sync.WaitGroup
+			mu sync.Mutex
+		)
+		for _, shard := range clients.shards {
+			wg.Add(1)
+			go func(shard map[*Client]interface{}) {
+				defer wg.Done()
+				var xs []*Client
+				for c := range shard {
+					if !deliver(c) {
+						xs = append(xs, c)
+					}
+				}
+				if len(xs) > 0 {
+					mu.Lock()
+					dropped = append(dropped, xs...)
+					mu.Unlock()
+				}
+			}(shard)
+		}
+		wg.Wait()
+	}
+
+	for _, c := range dropped {
+		stats.clientDropped()
+		b.dropClient(c)
+	}
+}
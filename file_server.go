@@ -21,6 +21,8 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+
+	"github.com/google/uuid"
 )
 
 // FileServer represents a file server.
@@ -74,6 +76,9 @@ func (fs *FileServer) unloadFile(url string) error {
 	if tokens[0] != "" || tokens[1] != "_f" || path.Ext(tokens[3]) == "" {
 		return errInvalidUnloadPath
 	}
+	if _, err := uuid.Parse(tokens[2]); err != nil { // not a file ID; on Windows, could be a path like ..\..
+		return errInvalidUnloadPath
+	}
 
 	dirpath := filepath.Join(fs.dir, tokens[2])
 	return os.RemoveAll(dirpath)
@@ -38,7 +38,8 @@ func newFileStore(dir string) http.Handler {
 
 // UploadResponse represents a response to a file upload operation.
 type UploadResponse struct {
-	Files []string `json:"files"`
+	Files []string `json:"files"`          // paths
+	URLs  []string `json:"urls,omitempty"` // absolute URLs, as seen by the client
 }
 
 func (fs *FileStore) uploadFiles(r *http.Request) ([]string, error) {
@@ -101,7 +102,13 @@ func (fs *FileStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		res, err := json.Marshal(UploadResponse{Files: files})
+		base := proxies.baseURL(r)
+		urls := make([]string, len(files))
+		for i, f := range files {
+			urls[i] = base + f
+			auditRequest(r, AuditUpload, f, r.MultipartForm.File["files"][i].Size)
+		}
+		res, err := json.Marshal(UploadResponse{files, urls})
 		if err != nil {
 			echo(Log{"t": "file_upload", "error": err.Error()})
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -0,0 +1,129 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies represents the reverse proxies (load balancers, ingress controllers) in front of the server,
+// whose X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers are believed.
+// Forwarded headers from anyone else are ignored, since clients can set them to anything.
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// proxies are the trusted proxies; none unless configured.
+var proxies = &TrustedProxies{}
+
+// newTrustedProxies parses a list of IP addresses and CIDR ranges, e.g. "10.0.0.1" or "10.0.0.0/8".
+func newTrustedProxies(specs []string) (*TrustedProxies, error) {
+	tp := &TrustedProxies{}
+	for _, s := range specs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad trusted proxy address: %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			tp.nets = append(tp.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted proxy range: %v", err)
+		}
+		tp.nets = append(tp.nets, n)
+	}
+	return tp, nil
+}
+
+func (tp *TrustedProxies) trusts(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range tp.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client a request originates from: the remote address, unless it is
+// a trusted proxy, in which case the nearest hop in X-Forwarded-For that is not a trusted proxy.
+func (tp *TrustedProxies) clientAddr(r *http.Request) string {
+	if !tp.trusts(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	addr := r.RemoteAddr
+	for i := len(hops) - 1; i >= 0; i-- { // each proxy appends the address it received the request from
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		addr = hop
+		if !tp.trusts(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// forwarded returns the first value of a forwarded header, if the request came through a trusted proxy.
+func (tp *TrustedProxies) forwarded(r *http.Request, header string) string {
+	if !tp.trusts(r.RemoteAddr) {
+		return ""
+	}
+	v := r.Header.Get(header)
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// baseURL returns the scheme and host clients used to reach the server, e.g. "https://wave.example.com".
+func (tp *TrustedProxies) baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := strings.ToLower(tp.forwarded(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	host := r.Host
+	if h := tp.forwarded(r, "X-Forwarded-Host"); h != "" {
+		host = h
+	}
+	return scheme + "://" + host
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewTrustedProxies(t *testing.T) {
+	for _, c := range []struct {
+		specs []string
+		ok    bool
+	}{
+		{nil, true},
+		{[]string{"10.0.0.1", " 192.168.0.0/16 ", "", "::1", "fd00::/8"}, true},
+		{[]string{"10.0.0"}, false},
+		{[]string{"10.0.0.0/33"}, false},
+		{[]string{"proxy.example.com"}, false},
+	} {
+		if _, err := newTrustedProxies(c.specs); (err == nil) != c.ok {
+			t.Errorf("newTrustedProxies(%q): error %v, want ok %v", c.specs, err, c.ok)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	tp, err := newTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7:5000"},
+		{"spoofed by untrusted peer", "203.0.113.7:5000", []string{"1.2.3.4"}, "203.0.113.7:5000"},
+		{"spoofed from private range", "172.16.0.9:5000", []string{"10.0.0.1"}, "172.16.0.9:5000"},
+		{"one proxy", "10.0.0.1:5000", []string{"198.51.100.2"}, "198.51.100.2"},
+		{"proxy without header", "10.0.0.1:5000", nil, "10.0.0.1:5000"},
+		{"chained proxies", "10.0.0.1:5000", []string{"198.51.100.2, 192.168.1.1"}, "198.51.100.2"},
+		{"chained headers", "10.0.0.1:5000", []string{"198.51.100.2", "192.168.1.1"}, "198.51.100.2"},
+		{"client spoofs leftmost hops", "10.0.0.1:5000", []string{"1.2.3.4, 198.51.100.2"}, "198.51.100.2"},
+		{"empty hops skipped", "10.0.0.1:5000", []string{"198.51.100.2, , "}, "198.51.100.2"},
+		{"all hops trusted", "10.0.0.1:5000", []string{"192.168.1.2, 192.168.1.1"}, "192.168.1.2"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		for _, h := range c.xff {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		if got := tp.clientAddr(r); got != c.want {
+			t.Errorf("%s: clientAddr = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	tp, err := newTrustedProxies([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		remote string
+		tls    bool
+		proto  string
+		host   string
+		want   string
+	}{
+		{"direct", "203.0.113.7:5000", false, "", "", "http://wave.local"},
+		{"direct tls", "203.0.113.7:5000", true, "", "", "https://wave.local"},
+		{"untrusted proto and host", "203.0.113.7:5000", false, "https", "evil.example.com", "http://wave.local"},
+		{"forwarded", "10.0.0.1:5000", false, "https", "wave.example.com", "https://wave.example.com"},
+		{"forwarded case", "10.0.0.1:5000", false, "HTTPS", "", "https://wave.local"},
+		{"first of several", "10.0.0.1:5000", false, "https, http", "a.example.com, b.example.com", "https://a.example.com"},
+		{"downgrade behind proxy", "10.0.0.1:5000", true, "http", "", "http://wave.local"},
+		{"bad proto ignored", "10.0.0.1:5000", false, "javascript", "", "http://wave.local"},
+	} {
+		r := httptest.NewRequest("GET", "http://wave.local/", nil)
+		r.RemoteAddr = c.remote
+		if c.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if c.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", c.proto)
+		}
+		if c.host != "" {
+			r.Header.Set("X-Forwarded-Host", c.host)
+		}
+		if got := tp.baseURL(r); got != c.want {
+			t.Errorf("%s: baseURL = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
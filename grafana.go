@@ -0,0 +1,335 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	grafanaColumns     = 24 // width of Grafana's grid
+	waveColumns        = 12 // width of Wave's grid
+	grafanaRowsPerWave = 3  // Grafana grid rows per Wave grid row (approximate)
+	defaultPollEvery   = 30 * time.Second
+	minPollEvery       = 5 * time.Second
+)
+
+var errNoSample = errors.New("query returned no samples")
+
+// GrafanaDashboard represents the subset of a Grafana dashboard JSON model that can be imported.
+type GrafanaDashboard struct {
+	Title   string          `json:"title"`
+	Refresh interface{}     `json:"refresh"` // "30s", or false if disabled
+	Panels  []*GrafanaPanel `json:"panels"`
+	Rows    []struct {      // schema versions < 16
+		Panels []*GrafanaPanel `json:"panels"`
+	} `json:"rows"`
+}
+
+// GrafanaPanel represents a panel on a Grafana dashboard.
+type GrafanaPanel struct {
+	ID          int             `json:"id"`
+	Type        string          `json:"type"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	GridPos     *GrafanaGridPos `json:"gridPos"`
+	Span        int             `json:"span"` // schema versions < 16; width in 12ths
+	Targets     []struct {
+		Expr  string `json:"expr"`  // Prometheus
+		RefID string `json:"refId"` // query name
+	} `json:"targets"`
+	Content string `json:"content"` // text panels, older versions
+	Options struct {
+		Content string `json:"content"` // text panels
+	} `json:"options"`
+	Panels []*GrafanaPanel `json:"panels"` // collapsed rows
+}
+
+// GrafanaGridPos represents a panel's position on Grafana's 24-column grid.
+type GrafanaGridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// ImportResponse represents the result of importing a dashboard.
+type ImportResponse struct {
+	Route       string   `json:"route"`
+	Cards       int      `json:"cards"`
+	Pollers     int      `json:"pollers"`
+	Unsupported []string `json:"unsupported,omitempty"` // titles of panels imported as placeholders
+}
+
+// Poller periodically evaluates a Prometheus query, and updates a card's value with the result.
+type Poller struct {
+	Card  string
+	Query string
+	Every time.Duration
+}
+
+// convertGrafana converts a Grafana dashboard to a Wave page, and returns the page, pollers for cards
+// whose values can be fetched from Prometheus, and the titles of panels that could not be converted.
+func convertGrafana(d *GrafanaDashboard, prometheus bool) (*PageD, []Poller, []string) {
+	panels := d.Panels
+	for _, row := range d.Rows { // legacy rows: lay out panels left to right, top to bottom
+		x := 0
+		y := len(panels) * 8
+		for _, p := range row.Panels {
+			w := p.Span * 2
+			if w <= 0 {
+				w = grafanaColumns
+			}
+			if x+w > grafanaColumns {
+				x, y = 0, y+8
+			}
+			p.GridPos = &GrafanaGridPos{x, y, w, 8}
+			panels = append(panels, p)
+			x += w
+		}
+	}
+
+	every := parseRefresh(d.Refresh)
+	page := &PageD{C: make(map[string]CardD)}
+	var pollers []Poller
+	var unsupported []string
+	for _, p := range flattenPanels(panels) {
+		if p.Type == "row" {
+			continue
+		}
+		name := fmt.Sprintf("panel%d", p.ID)
+		data := map[string]interface{}{"box": gridBox(p.GridPos), "title": p.Title}
+		switch p.Type {
+		case "stat", "singlestat", "gauge", "bargauge":
+			data["view"] = "small_stat"
+			data["value"] = "-"
+			if q := p.query(); prometheus && q != "" {
+				pollers = append(pollers, Poller{name, q, every})
+			}
+		case "text":
+			content := p.Options.Content
+			if content == "" {
+				content = p.Content
+			}
+			data["view"] = "markdown"
+			data["content"] = content
+		default:
+			data["view"] = "markdown"
+			data["content"] = placeholderContent(p)
+			unsupported = append(unsupported, p.Title)
+		}
+		page.C[name] = CardD{D: data}
+	}
+	return page, pollers, unsupported
+}
+
+func flattenPanels(panels []*GrafanaPanel) []*GrafanaPanel {
+	var xs []*GrafanaPanel
+	for _, p := range panels {
+		xs = append(xs, p)
+		if len(p.Panels) > 0 {
+			xs = append(xs, flattenPanels(p.Panels)...)
+		}
+	}
+	return xs
+}
+
+// query returns the panel's first Prometheus query, if any.
+func (p *GrafanaPanel) query() string {
+	for _, t := range p.Targets {
+		if t.Expr != "" {
+			return t.Expr
+		}
+	}
+	return ""
+}
+
+func placeholderContent(p *GrafanaPanel) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Imported from a Grafana `%s` panel, which has no equivalent card.\n", p.Type)
+	for _, t := range p.Targets {
+		if t.Expr != "" {
+			fmt.Fprintf(&sb, "\n- `%s`", t.Expr)
+		}
+	}
+	return sb.String()
+}
+
+// gridBox converts a panel position on Grafana's grid to a Wave box ("column row width height", 1-based).
+func gridBox(g *GrafanaGridPos) string {
+	if g == nil {
+		return "1 1 4 3"
+	}
+	scale := grafanaColumns / waveColumns
+	col, width := g.X/scale+1, g.W/scale
+	if width < 1 {
+		width = 1
+	}
+	row := g.Y/grafanaRowsPerWave + 1
+	height := (g.H + grafanaRowsPerWave - 1) / grafanaRowsPerWave
+	if height < 1 {
+		height = 1
+	}
+	return fmt.Sprintf("%d %d %d %d", col, row, width, height)
+}
+
+// parseRefresh parses a dashboard's auto-refresh interval, e.g. "30s".
+func parseRefresh(v interface{}) time.Duration {
+	s, ok := v.(string)
+	if !ok || s == "" {
+		return defaultPollEvery
+	}
+	if strings.HasSuffix(s, "d") { // time.ParseDuration does not support days
+		s = strings.TrimSuffix(s, "d") + "h"
+		if d, err := time.ParseDuration(s); err == nil {
+			return d * 24
+		}
+		return defaultPollEvery
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return defaultPollEvery
+	}
+	if d < minPollEvery {
+		return minPollEvery
+	}
+	return d
+}
+
+// Pollers runs the pollers bound to pages imported from dashboards.
+type Pollers struct {
+	sync.Mutex
+	client *http.Client
+	stops  map[string]context.CancelFunc // route => stops the route's pollers
+}
+
+func newPollers() *Pollers {
+	return &Pollers{client: &http.Client{Timeout: 10 * time.Second}, stops: make(map[string]context.CancelFunc)}
+}
+
+// importGrafana replaces the page at route with a conversion of dashboard. If prometheus (a Prometheus base URL)
+// is not empty, stat panels are bound to pollers that keep their values up to date.
+func (b *Broker) importGrafana(route string, dashboard []byte, prometheus string) (*ImportResponse, error) {
+	var d GrafanaDashboard
+	if err := json.Unmarshal(dashboard, &d); err != nil {
+		return nil, fmt.Errorf("failed unmarshaling dashboard: %v", err)
+	}
+	page, pollers, unsupported := convertGrafana(&d, prometheus != "")
+	ops := []OpD{{}} // drop the existing page, if any
+	for name, c := range page.C {
+		ops = append(ops, OpD{K: name, D: c.D})
+	}
+	data, err := json.Marshal(OpsD{D: ops})
+	if err != nil {
+		return nil, err
+	}
+	b.patch(context.Background(), route, data)
+
+	b.pollers.replace(b, route, prometheus, pollers)
+	echo(Log{"t": "grafana_import", "route": route, "title": d.Title, "cards": fmt.Sprint(len(page.C)), "pollers": fmt.Sprint(len(pollers))})
+	return &ImportResponse{route, len(page.C), len(pollers), unsupported}, nil
+}
+
+// replace stops the pollers running for route, if any, and starts new ones.
+func (ps *Pollers) replace(b *Broker, route, prometheus string, pollers []Poller) {
+	ps.Lock()
+	defer ps.Unlock()
+	if stop, ok := ps.stops[route]; ok {
+		stop()
+		delete(ps.stops, route)
+	}
+	if len(pollers) == 0 {
+		return
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	ps.stops[route] = stop
+	for _, p := range pollers {
+		go ps.run(ctx, b, route, prometheus, p)
+	}
+}
+
+func (ps *Pollers) run(ctx context.Context, b *Broker, route, prometheus string, p Poller) {
+	ticker := clock.NewTicker(p.Every)
+	defer ticker.Stop()
+	for {
+		if value, err := ps.query(ctx, prometheus, p.Query); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			echo(Log{"t": "poll", "route": route, "card": p.Card, "error": err.Error()})
+		} else if data, err := json.Marshal(OpsD{D: []OpD{{K: p.Card + keySeparator + "value", V: value}}}); err == nil {
+			b.patch(context.Background(), route, data)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// query evaluates an instant query using the Prometheus HTTP API, and returns the first sample's value.
+func (ps *Pollers) query(ctx context.Context, prometheus, q string) (string, error) {
+	u := strings.TrimSuffix(prometheus, "/") + "/api/v1/query?query=" + url.QueryEscape(q)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("prometheus: %s", resp.Status)
+	}
+	var r struct {
+		Data struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return "", err
+	}
+	switch r.Data.ResultType {
+	case "scalar", "string": // [time, "value"]
+		var sample []interface{}
+		if err := json.Unmarshal(r.Data.Result, &sample); err == nil && len(sample) == 2 {
+			return fmt.Sprint(sample[1]), nil
+		}
+	case "vector": // [{"metric": {...}, "value": [time, "value"]}, ...]
+		var samples []struct {
+			Value []interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(r.Data.Result, &samples); err == nil && len(samples) > 0 && len(samples[0].Value) == 2 {
+			return fmt.Sprint(samples[0].Value[1]), nil
+		}
+	}
+	return "", errNoSample
+}
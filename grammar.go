@@ -0,0 +1,340 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grammarVersion identifies the revision of the wire grammar implemented here. It must be incremented
+// whenever the syntax or semantics of any production below changes, along with a migration in wireMigrations
+// so that publishers and UIs speaking the previous version keep working.
+//
+// Socket messages (browser => server), one per websocket frame:
+//
+//	message = type " " addr " " data
+//	type    = "*" (patch) | "@" (query) | "+" (watch) | "^" (resume) | "&" (watch cards) | "#" (noop)
+//	addr    = route                             ; route or app address, no spaces
+//	data    = patch                             ; for "*"
+//	        | any                               ; for "@", forwarded to the app as-is
+//	        | [ hash ]                          ; for "+"
+//	        | seq [ " " hash ]                  ; for "^", seq is a decimal sequence number
+//	        | card { " " card }                 ; for "&"
+//
+// AOF entries, one per line:
+//
+//	entry   = date " " time " " marker " " url " " data
+//	        | date " " time " #" [ " " any ]    ; comment
+//	date    = yyyy "/" mm "/" dd
+//	time    = hh ":" mm ":" ss
+//	marker  = "*" (patch) | "=" (compacted page) | "-" (deleted page)
+//	data    = patch                             ; for "*"
+//	        | page                              ; for "="
+//	        | "{}"                              ; for "-"
+//
+// Patches are JSON objects, {"d": [op, ...], "t": ttl}, with ops applied in order. If ttl is positive, the page is
+// deleted once it has not been changed for ttl seconds; if negative, any TTL is cleared. Each op is one of:
+//
+//	{}                                  drop the page
+//	{"k": card}                         delete a card
+//	{"k": card, "d": {...}, "b": [...]} put a card, with optional buffers
+//	{"k": path}                         delete an attribute
+//	{"k": path, "v": value}             set an attribute
+//	{"k": path, "c"|"f"|"m": buffer}    set an attribute to a cyclic, fixed or map buffer
+//
+// where path is a card name followed by one or more space-separated attribute names, list indices or buffer keys.
+const grammarVersion = 2
+
+// MsgT represents message types.
+type MsgT int
+
+const (
+	badMsgT MsgT = iota
+	noopMsgT
+	patchMsgT
+	queryMsgT
+	watchMsgT
+	resumeMsgT
+	cardsMsgT
+)
+
+// Msg represents a message.
+type Msg struct {
+	t    MsgT
+	addr string
+	data []byte
+}
+
+var (
+	msgSep     = []byte{' '}
+	invalidMsg = Msg{t: badMsgT}
+)
+
+func parseMsgT(s []byte) MsgT {
+	if len(s) == 1 {
+		switch s[0] {
+		case '*':
+			return patchMsgT
+		case '@':
+			return queryMsgT
+		case '+':
+			return watchMsgT
+		case '^':
+			return resumeMsgT
+		case '&':
+			return cardsMsgT
+		case '#':
+			return noopMsgT
+		}
+	}
+	return badMsgT
+}
+
+// parseMsg parses a socket message.
+func parseMsg(s []byte) (Msg, error) {
+	parts := bytes.SplitN(s, msgSep, 3)
+	if len(parts) != 3 {
+		return invalidMsg, fmt.Errorf("message: want type, address and data separated by spaces, got %d fields", len(parts))
+	}
+	t, addr, data := parts[0], parts[1], parts[2]
+	action := parseMsgT(t)
+	if action == badMsgT {
+		return invalidMsg, fmt.Errorf("message: unknown type %q", t)
+	}
+	if len(addr) == 0 {
+		return invalidMsg, fmt.Errorf("message: empty address")
+	}
+	return Msg{action, string(addr), data}, nil
+}
+
+// parseResume parses the data of a resume message: "seq[ hash]".
+func parseResume(data []byte) (int64, []byte, error) {
+	parts := bytes.SplitN(data, msgSep, 2)
+	seq, err := strconv.ParseInt(string(parts[0]), 10, 64)
+	if err != nil || seq < 0 {
+		return 0, nil, fmt.Errorf("resume: want non-negative sequence number, got %q", parts[0])
+	}
+	if len(parts) == 2 {
+		return seq, parts[1], nil
+	}
+	return seq, nil, nil
+}
+
+// AOFEntry represents an entry in the append-only log.
+type AOFEntry struct {
+	time   time.Time
+	marker byte
+	url    string
+	data   []byte
+}
+
+// parseAOFEntry parses an AOF line. Comments are returned with the comment marker, and no url or data.
+func parseAOFEntry(line []byte) (AOFEntry, error) {
+	tokens := bytes.SplitN(line, msgSep, 4) // "date time marker entry"
+	if len(tokens) < 3 || (len(tokens) == 3 && !bytes.Equal(tokens[2], []byte(commentMarker))) {
+		return AOFEntry{}, fmt.Errorf("aof: want date, time, marker and entry, got %d fields", len(tokens))
+	}
+	t, err := time.ParseInLocation(aofTimeLayout, string(tokens[0])+" "+string(tokens[1]), time.Local)
+	if err != nil {
+		return AOFEntry{}, fmt.Errorf("aof: bad timestamp: %v", err)
+	}
+	marker := tokens[2]
+	if len(marker) != 1 {
+		return AOFEntry{}, fmt.Errorf("aof: bad marker %q", marker)
+	}
+	switch m := marker[0]; m {
+	case commentMarker[0]:
+		return AOFEntry{time: t, marker: m}, nil
+	case patchMarker[0], compactMarker[0], deleteMarker[0]:
+		tokens = bytes.SplitN(tokens[3], msgSep, 2) // "url data"
+		if len(tokens) < 2 {
+			return AOFEntry{}, fmt.Errorf("aof: want url and data")
+		}
+		if len(tokens[0]) == 0 || tokens[0][0] != '/' {
+			return AOFEntry{}, fmt.Errorf("aof: bad url %q", tokens[0])
+		}
+		return AOFEntry{t, m, string(tokens[0]), tokens[1]}, nil
+	default:
+		return AOFEntry{}, fmt.Errorf("aof: unknown marker %q", marker)
+	}
+}
+
+// parsePatch parses and validates a patch.
+func parsePatch(data []byte) (OpsD, error) {
+	var ops OpsD
+	if err := json.Unmarshal(data, &ops); err != nil { // TODO speed up
+		return ops, fmt.Errorf("patch: failed unmarshaling data: %v", err)
+	}
+	for i, op := range ops.D {
+		if err := validateOp(op); err != nil {
+			return ops, fmt.Errorf("patch: d[%d]: %v", i, err)
+		}
+	}
+	return ops, nil
+}
+
+func validateOp(op OpD) error {
+	values := 0
+	for _, set := range []bool{op.V != nil, op.C != nil, op.F != nil, op.M != nil, op.D != nil} {
+		if set {
+			values++
+		}
+	}
+	if values > 1 {
+		return fmt.Errorf("v, c, f, m and d are mutually exclusive")
+	}
+	if len(op.K) == 0 {
+		if values > 0 || op.B != nil {
+			return fmt.Errorf("page drop must not have a value")
+		}
+		return nil
+	}
+	ks := strings.Split(op.K, keySeparator)
+	for _, k := range ks {
+		if len(k) == 0 {
+			return fmt.Errorf("key %q: empty segment", op.K)
+		}
+	}
+	if op.D != nil && len(ks) > 1 {
+		return fmt.Errorf("key %q: card data can only be put at a card name", op.K)
+	}
+	if op.B != nil && op.D == nil {
+		return fmt.Errorf("key %q: buffers require card data", op.K)
+	}
+	if (op.C != nil || op.F != nil || op.M != nil) && len(ks) == 1 {
+		return fmt.Errorf("key %q: buffers can only be set at an attribute", op.K)
+	}
+	for _, b := range op.B {
+		if err := validateBuf(b); err != nil {
+			return fmt.Errorf("key %q: %v", op.K, err)
+		}
+	}
+	switch {
+	case op.C != nil:
+		return validateBuf(BufD{C: op.C})
+	case op.F != nil:
+		return validateBuf(BufD{F: op.F})
+	case op.M != nil:
+		return validateBuf(BufD{M: op.M})
+	}
+	return nil
+}
+
+func validateBuf(b BufD) error {
+	n := 0
+	var fields []string
+	var size int
+	if b.C != nil {
+		n++
+		fields, size = b.C.F, b.C.N
+	}
+	if b.F != nil {
+		n++
+		fields, size = b.F.F, b.F.N
+	}
+	if b.M != nil {
+		n++
+		fields = b.M.F
+	}
+	if n != 1 {
+		return fmt.Errorf("buffer must have exactly one of c, f or m")
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("buffer must have fields")
+	}
+	if size < 0 {
+		return fmt.Errorf("buffer size must not be negative")
+	}
+	return nil
+}
+
+// ParseResponse represents the result of a parse-only request.
+type ParseResponse struct {
+	Version int    `json:"version"`
+	OK      bool   `json:"ok"`
+	Ops     int    `json:"ops,omitempty"` // number of operations in a valid patch
+	Error   string `json:"error,omitempty"`
+}
+
+// ParseHandler parses, but does not apply, the request body: POST /_parse?kind=patch|message|aof.
+// Parsing a body costs as much as applying it, so requests are charged to the caller's write allowance.
+type ParseHandler struct {
+	auth    *Auth
+	limiter *RequestLimiter
+}
+
+func newParseHandler(auth *Auth, limiter *RequestLimiter) *ParseHandler {
+	return &ParseHandler{auth, limiter}
+}
+
+func (h *ParseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	viewer, ok := h.auth.identify(r)
+	if !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if !h.limiter.allowWrite(w, r, viewer.username) {
+		return
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchSize))
+	if err != nil {
+		if len(b) >= maxPatchSize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	resp := ParseResponse{Version: grammarVersion}
+	switch r.URL.Query().Get("kind") {
+	case "", "patch":
+		var ops OpsD
+		if ops, err = parsePatch(b); err == nil {
+			resp.Ops = len(ops.D)
+		}
+	case "message":
+		var m Msg
+		if m, err = parseMsg(b); err == nil && m.t == patchMsgT {
+			_, err = parsePatch(m.data)
+		}
+	case "aof":
+		var e AOFEntry
+		if e, err = parseAOFEntry(bytes.TrimRight(b, "\r\n")); err == nil && e.marker == patchMarker[0] {
+			_, err = parsePatch(e.data)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.OK = true
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(resp)
+}
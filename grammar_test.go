@@ -0,0 +1,255 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+// checkErr fails the test unless err matches want: nil if want is empty, else an error containing want.
+func checkErr(t *testing.T, err error, want string) bool {
+	t.Helper()
+	if want == "" {
+		if err != nil {
+			t.Errorf("want no error, got %v", err)
+			return false
+		}
+		return true
+	}
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("want error containing %q, got %v", want, err)
+	}
+	return false
+}
+
+func TestParseMsg(t *testing.T) {
+	tests := []struct {
+		in      string
+		t       MsgT
+		addr    string
+		data    string
+		wantErr string
+	}{
+		{`* /demo {"d":[]}`, patchMsgT, "/demo", `{"d":[]}`, ""},
+		{`@ /app {"x": 1}`, queryMsgT, "/app", `{"x": 1}`, ""},
+		{`+ /demo `, watchMsgT, "/demo", ``, ""},
+		{`+ /demo abc123`, watchMsgT, "/demo", `abc123`, ""},
+		{`^ /demo 42 abc123`, resumeMsgT, "/demo", `42 abc123`, ""},
+		{`& /demo a b`, cardsMsgT, "/demo", `a b`, ""},
+		{`# /demo `, noopMsgT, "/demo", ``, ""},
+		{`* /demo`, badMsgT, "", "", "got 2 fields"},
+		{`*`, badMsgT, "", "", "got 1 fields"},
+		{`! /demo x`, badMsgT, "", "", `unknown type "!"`},
+		{`** /demo x`, badMsgT, "", "", `unknown type "**"`},
+		{`*  x`, badMsgT, "", "", "empty address"},
+	}
+	for _, tc := range tests {
+		m, err := parseMsg([]byte(tc.in))
+		if !checkErr(t, err, tc.wantErr) {
+			if m.t != badMsgT {
+				t.Errorf("%q: want an invalid message, got type %d", tc.in, m.t)
+			}
+			continue
+		}
+		if m.t != tc.t || m.addr != tc.addr || string(m.data) != tc.data {
+			t.Errorf("%q: want %d %q %q, got %d %q %q", tc.in, tc.t, tc.addr, tc.data, m.t, m.addr, m.data)
+		}
+	}
+}
+
+func TestParseResume(t *testing.T) {
+	tests := []struct {
+		in      string
+		seq     int64
+		hash    string
+		wantErr string
+	}{
+		{`0`, 0, "", ""},
+		{`42`, 42, "", ""},
+		{`42 abc123`, 42, "abc123", ""},
+		{``, 0, "", "want non-negative sequence number"},
+		{`-1`, 0, "", "want non-negative sequence number"},
+		{`x abc123`, 0, "", `got "x"`},
+		{`99999999999999999999`, 0, "", "want non-negative sequence number"},
+	}
+	for _, tc := range tests {
+		seq, hash, err := parseResume([]byte(tc.in))
+		if !checkErr(t, err, tc.wantErr) {
+			continue
+		}
+		if seq != tc.seq || string(hash) != tc.hash {
+			t.Errorf("%q: want %d %q, got %d %q", tc.in, tc.seq, tc.hash, seq, hash)
+		}
+	}
+}
+
+func TestParseAOFEntry(t *testing.T) {
+	tests := []struct {
+		in      string
+		marker  byte
+		url     string
+		data    string
+		wantErr string
+	}{
+		{`2021/03/01 09:00:00 * /ops {"d":[]}`, '*', "/ops", `{"d":[]}`, ""},
+		{`2021/03/01 09:00:00 = /ops {"p":{"c":{}}}`, '=', "/ops", `{"p":{"c":{}}}`, ""},
+		{`2021/03/01 09:00:00 - /ops {}`, '-', "/ops", `{}`, ""},
+		{`2021/03/01 09:00:00 # wave-aof-format 1`, '#', "", "", ""},
+		{`2021/03/01 09:00:00 #`, '#', "", "", ""},
+		{`2021/03/01 09:00:00`, 0, "", "", "got 2 fields"},
+		{`2021/03/01 09:00:00 *`, 0, "", "", "got 3 fields"},
+		{`2021-03-01 09:00:00 * /ops {}`, 0, "", "", "bad timestamp"},
+		{`2021/03/01 9am * /ops {}`, 0, "", "", "bad timestamp"},
+		{`2021/03/01 09:00:00 ** /ops {}`, 0, "", "", `bad marker "**"`},
+		{`2021/03/01 09:00:00 ? /ops {}`, 0, "", "", `unknown marker "?"`},
+		{`2021/03/01 09:00:00 * /ops`, 0, "", "", "want url and data"},
+		{`2021/03/01 09:00:00 * ops {}`, 0, "", "", `bad url "ops"`},
+		{`2021/03/01 09:00:00 *  {}`, 0, "", "", `bad url ""`},
+	}
+	for _, tc := range tests {
+		e, err := parseAOFEntry([]byte(tc.in))
+		if !checkErr(t, err, tc.wantErr) {
+			continue
+		}
+		if e.marker != tc.marker || e.url != tc.url || string(e.data) != tc.data {
+			t.Errorf("%q: want %c %q %q, got %c %q %q", tc.in, tc.marker, tc.url, tc.data, e.marker, e.url, e.data)
+		}
+		if want := "2021-03-01 09:00:00"; e.time.Format("2006-01-02 15:04:05") != want {
+			t.Errorf("%q: want time %s, got %s", tc.in, want, e.time)
+		}
+	}
+}
+
+func TestValidateOp(t *testing.T) {
+	cyc := &CycBufD{F: []string{"x"}, N: 10}
+	fix := &FixBufD{F: []string{"x"}, N: 10}
+	mp := &MapBufD{F: []string{"x"}}
+	card := map[string]interface{}{"view": "markdown"}
+	tests := []struct {
+		name    string
+		op      OpD
+		wantErr string
+	}{
+		{"drop page", OpD{}, ""},
+		{"delete card", OpD{K: "c"}, ""},
+		{"put card", OpD{K: "c", D: card}, ""},
+		{"put card with buffers", OpD{K: "c", D: card, B: []BufD{{C: cyc}, {F: fix}, {M: mp}}}, ""},
+		{"delete attribute", OpD{K: "c x"}, ""},
+		{"set attribute", OpD{K: "c x 0", V: 1}, ""},
+		{"set cyclic buffer", OpD{K: "c x", C: cyc}, ""},
+		{"set fixed buffer", OpD{K: "c x", F: fix}, ""},
+		{"set map buffer", OpD{K: "c x", M: mp}, ""},
+
+		{"value and card data", OpD{K: "c", V: 1, D: card}, "mutually exclusive"},
+		{"two buffers", OpD{K: "c x", C: cyc, F: fix}, "mutually exclusive"},
+		{"page drop with value", OpD{V: 1}, "page drop must not have a value"},
+		{"page drop with buffers", OpD{B: []BufD{{C: cyc}}}, "page drop must not have a value"},
+		{"empty leading segment", OpD{K: " x", V: 1}, "empty segment"},
+		{"empty inner segment", OpD{K: "c  x", V: 1}, "empty segment"},
+		{"empty trailing segment", OpD{K: "c ", V: 1}, "empty segment"},
+		{"card data at attribute", OpD{K: "c x", D: card}, "card data can only be put at a card name"},
+		{"buffers without card data", OpD{K: "c", B: []BufD{{C: cyc}}}, "buffers require card data"},
+		{"cyclic buffer at card", OpD{K: "c", C: cyc}, "buffers can only be set at an attribute"},
+		{"fixed buffer at card", OpD{K: "c", F: fix}, "buffers can only be set at an attribute"},
+		{"map buffer at card", OpD{K: "c", M: mp}, "buffers can only be set at an attribute"},
+		{"card buffer with no kind", OpD{K: "c", D: card, B: []BufD{{}}}, "exactly one of c, f or m"},
+		{"card buffer with two kinds", OpD{K: "c", D: card, B: []BufD{{C: cyc, M: mp}}}, "exactly one of c, f or m"},
+		{"card buffer without fields", OpD{K: "c", D: card, B: []BufD{{M: &MapBufD{}}}}, "buffer must have fields"},
+		{"cyclic buffer without fields", OpD{K: "c x", C: &CycBufD{N: 1}}, "buffer must have fields"},
+		{"fixed buffer with negative size", OpD{K: "c x", F: &FixBufD{F: []string{"x"}, N: -1}}, "size must not be negative"},
+		{"cyclic buffer with negative size", OpD{K: "c x", C: &CycBufD{F: []string{"x"}, N: -1}}, "size must not be negative"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			checkErr(t, validateOp(tc.op), tc.wantErr)
+		})
+	}
+}
+
+func TestParsePatch(t *testing.T) {
+	tests := []struct {
+		in      string
+		ops     int
+		wantErr string
+	}{
+		{`{"d":[{"k":"c","d":{"view":"markdown"}},{"k":"c content","v":"x"}],"t":60}`, 2, ""},
+		{`{}`, 0, ""},
+		{`{"d":`, 0, "failed unmarshaling data"},
+		{`{"d":[{"k":"c"},{"k":"c x","v":1,"d":{}}]}`, 0, "d[1]: v, c, f, m and d are mutually exclusive"},
+	}
+	for _, tc := range tests {
+		ops, err := parsePatch([]byte(tc.in))
+		if checkErr(t, err, tc.wantErr) && len(ops.D) != tc.ops {
+			t.Errorf("%s: want %d ops, got %d", tc.in, tc.ops, len(ops.D))
+		}
+	}
+}
+
+func TestParseHandler(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newParseHandler(newAuth(map[string][]byte{"id": hash}, false, nil, oauth2.Config{}), newRequestLimiter(RateLimits{}))
+	post := func(kind string, body []byte, auth bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/_parse?kind="+kind, bytes.NewReader(body))
+		if auth {
+			r.SetBasicAuth("id", "secret")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post("patch", []byte(`{"d":[]}`), false); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated: want %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := post("patch", bytes.Repeat([]byte(" "), maxPatchSize+1), true); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized: want %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+	if w := post("unknown", []byte(`{}`), true); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown kind: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	tests := []struct {
+		kind, body string
+		ok         bool
+	}{
+		{"patch", `{"d":[{"k":"c content","v":"x"}]}`, true},
+		{"patch", `{"d":[{"k":"c ","v":"x"}]}`, false},
+		{"message", `* /demo {"d":[{"k":"c content","v":"x"}]}`, true},
+		{"message", `* /demo {"d":[{"k":"c","b":[]}]}`, false},
+		{"message", `! /demo x`, false},
+		{"aof", "2021/03/01 09:00:00 * /ops {\"d\":[]}\n", true},
+		{"aof", "2021/03/01 09:00:00 * /ops {\"d\":[{\"v\":1}]}\n", false},
+	}
+	for _, tc := range tests {
+		w := post(tc.kind, []byte(tc.body), true)
+		var resp ParseResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s %s: %v", tc.kind, tc.body, err)
+		}
+		if resp.OK != tc.ok || resp.Version != grammarVersion || (resp.Error == "") != tc.ok {
+			t.Errorf("%s %s: want ok=%v, got %+v", tc.kind, tc.body, tc.ok, resp)
+		}
+	}
+}
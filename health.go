@@ -0,0 +1,47 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const brokerProbeTimeout = 2 * time.Second
+
+// HealthHandler serves liveness (/healthz) and readiness (/readyz) probes.
+type HealthHandler struct {
+	broker *Broker
+	ready  *int32 // set to 1 once the site has been loaded
+	live   bool   // liveness probe if true, else readiness probe
+}
+
+func newHealthHandler(broker *Broker, ready *int32, live bool) *HealthHandler {
+	return &HealthHandler{broker, ready, live}
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.live && (atomic.LoadInt32(h.ready) == 0 || !h.broker.isRunning()) {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	if !h.broker.probe(brokerProbeTimeout) {
+		echo(Log{"t": "health", "error": "broker unresponsive"})
+		http.Error(w, "broker unresponsive", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
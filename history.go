@@ -0,0 +1,116 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// seqBase is the first sequence number issued by this process. Using the boot time ensures that
+// sequence numbers seen by clients before a restart are (practically) never mistaken for new ones.
+var seqBase = time.Now().UnixNano() / int64(time.Microsecond)
+
+// lastSeq is the last sequence number issued. Sequence numbers are unique across routes, and double as page versions.
+var lastSeq = seqBase
+
+// nextSeq issues a sequence number.
+func nextSeq() int64 {
+	return atomic.AddInt64(&lastSeq, 1)
+}
+
+// History holds recently published messages for a route, so that reconnecting clients can catch up.
+// Not thread-safe; owned by the broker loop.
+type History struct {
+	maxSize  int            // max messages retained; see Footprint
+	maxBytes int            // max bytes retained
+	seq      int64          // sequence number of the most recent message
+	floor    int64          // all messages published after this sequence number are retained
+	entries  []HistoryEntry // oldest first
+	size     int            // total bytes retained
+}
+
+// HistoryEntry represents a published message.
+type HistoryEntry struct {
+	seq  int64
+	data []byte // sequence-stamped message
+}
+
+func newHistory(maxSize, maxBytes int) *History {
+	return &History{maxSize: maxSize, maxBytes: maxBytes, seq: -1}
+}
+
+// append stamps data with a sequence number, retains it, and returns the stamped message.
+// Messages must be appended in sequence number order.
+func (h *History) append(data []byte, seq int64) []byte {
+	if h.seq < 0 { // first message; anything earlier is unknown
+		h.floor = seq - 1
+	}
+	if seq > h.seq {
+		h.seq = seq
+	}
+	data = stamp(data, seq)
+	h.entries = append(h.entries, HistoryEntry{seq, data})
+	h.size += len(data)
+	for len(h.entries) > h.maxSize || (h.size > h.maxBytes && len(h.entries) > 1) {
+		h.floor = h.entries[0].seq
+		h.size -= len(h.entries[0].data)
+		h.entries[0] = HistoryEntry{}
+		h.entries = h.entries[1:]
+	}
+	return data
+}
+
+// mark returns the sequence number that a full copy of the page should be stamped with.
+func (h *History) mark() int64 {
+	if h.seq < 0 { // nothing published yet; resume from now
+		s := atomic.LoadInt64(&lastSeq)
+		h.seq, h.floor = s, s
+	}
+	return h.seq
+}
+
+// since returns the messages published after seq, or false if some of them are no longer retained.
+func (h *History) since(seq int64) ([][]byte, bool) {
+	if h.seq < 0 || seq > h.seq || seq < h.floor {
+		return nil, false // not issued by this process, or no longer retained
+	}
+	if seq == h.seq {
+		return nil, true
+	}
+	var msgs [][]byte
+	for _, e := range h.entries {
+		if e.seq > seq {
+			msgs = append(msgs, e.data)
+		}
+	}
+	return msgs, true
+}
+
+// stamp splices a sequence number into a JSON object: {...} => {"s":seq,...}
+func stamp(data []byte, seq int64) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+	s := strconv.FormatInt(seq, 10)
+	b := make([]byte, 0, len(data)+len(s)+6)
+	b = append(b, `{"s":`...)
+	b = append(b, s...)
+	if rest := data[1:]; len(rest) > 0 && rest[0] != '}' {
+		b = append(b, ',')
+	}
+	return append(b, data[1:]...)
+}
@@ -0,0 +1,319 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job states.
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+const (
+	jobHistorySize = 100             // finished jobs to retain
+	jobNotifyEvery = 1 * time.Second // minimum interval between progress notifications
+)
+
+var errUnknownJob = errors.New("unknown job kind")
+
+// Job represents the status of a long-running administrative operation.
+type Job struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	State    string     `json:"state"`
+	Total    int        `json:"total"` // units of work, if known
+	Done     int        `json:"done"`  // units of work completed
+	Attempts int        `json:"attempts"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Retry represents a job's retry policy.
+type Retry struct {
+	Attempts int           // maximum attempts; 0 or 1 = never retry
+	Backoff  time.Duration // delay before the first retry; doubled on each subsequent retry
+}
+
+// Progress is used by a running job to report progress. The zero Progress discards reports.
+type Progress struct {
+	jobs *Jobs
+	id   string
+}
+
+// total sets the expected units of work.
+func (p Progress) total(n int) {
+	if p.jobs == nil {
+		return
+	}
+	p.jobs.update(p.id, func(j *Job) { j.Total = n })
+}
+
+// step records completed units of work.
+func (p Progress) step(n int) {
+	if p.jobs == nil {
+		return
+	}
+	p.jobs.update(p.id, func(j *Job) { j.Done += n })
+}
+
+type jobKind struct {
+	run   func(Progress) error
+	retry Retry
+}
+
+// Jobs tracks asynchronously executed jobs, persisted as JSON to a file in the data directory.
+type Jobs struct {
+	sync.RWMutex
+	path     string             // "" = not persisted
+	jobs     map[string]*Job    // id => job
+	kinds    map[string]jobKind // kind => definition
+	changed  func([]Job)        // called with all jobs when any job changes; nil if not set
+	notified time.Time          // last time changed was called for progress
+	running  sync.WaitGroup     // jobs in progress
+	quit     chan struct{}      // closed by stop, cutting retries short
+}
+
+func newJobs(path string) *Jobs {
+	js := &Jobs{path: path, jobs: make(map[string]*Job), kinds: make(map[string]jobKind), quit: make(chan struct{})}
+	if err := js.load(); err != nil {
+		echo(Log{"t": "jobs_load", "path": path, "error": err.Error()})
+	}
+	return js
+}
+
+func (js *Jobs) load() error {
+	if js.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(js.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var jobs []*Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return err
+	}
+	now := clock.Now()
+	for _, j := range jobs {
+		if j.State == jobRunning { // server stopped while the job was running
+			j.State, j.Error, j.Finished = jobFailed, "interrupted", &now
+		}
+		js.jobs[j.ID] = j
+	}
+	return nil
+}
+
+// save prunes old finished jobs and persists the rest. Must be called under lock.
+func (js *Jobs) save() error {
+	jobs := js.sorted()
+	n := 0
+	for _, j := range jobs {
+		if j.State != jobRunning {
+			if n++; n > jobHistorySize {
+				delete(js.jobs, j.ID)
+			}
+		}
+	}
+	if js.path == "" {
+		return nil
+	}
+	kept := make([]*Job, 0, len(js.jobs))
+	for _, j := range jobs {
+		if _, ok := js.jobs[j.ID]; ok {
+			kept = append(kept, j)
+		}
+	}
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	return writeFile(js.path, data)
+}
+
+// sorted returns jobs, most recently started first. Must be called under lock.
+func (js *Jobs) sorted() []*Job {
+	jobs := make([]*Job, 0, len(js.jobs))
+	for _, j := range js.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Started.After(jobs[k].Started) })
+	return jobs
+}
+
+// define registers a kind of job that can be started by name.
+func (js *Jobs) define(kind string, retry Retry, f func(Progress) error) {
+	js.Lock()
+	js.kinds[kind] = jobKind{f, retry}
+	js.Unlock()
+}
+
+// run starts a job of a previously defined kind, and returns the new job's ID.
+func (js *Jobs) run(kind string) (string, error) {
+	js.RLock()
+	k, ok := js.kinds[kind]
+	js.RUnlock()
+	if !ok {
+		return "", errUnknownJob
+	}
+	return js.startWith(kind, k.retry, k.run), nil
+}
+
+// schedule starts a job of a previously defined kind at regular intervals, until quit is closed.
+func (js *Jobs) schedule(kind string, every time.Duration, quit <-chan struct{}) {
+	ticker := clock.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-quit:
+			return
+		}
+		if _, err := js.run(kind); err != nil {
+			echo(Log{"t": "job_schedule", "kind": kind, "error": err.Error()})
+			return
+		}
+	}
+}
+
+// start runs f once in the background, and returns the new job's ID.
+func (js *Jobs) start(kind string, f func(Progress) error) string {
+	return js.startWith(kind, Retry{}, f)
+}
+
+// startWith runs f in the background, retrying on failure as per retry, and returns the new job's ID.
+func (js *Jobs) startWith(kind string, retry Retry, f func(Progress) error) string {
+	j := &Job{ID: uuid.New().String(), Kind: kind, State: jobRunning, Started: clock.Now()}
+	js.Lock()
+	js.jobs[j.ID] = j
+	js.persist()
+	js.Unlock()
+	js.notify(true)
+
+	echo(Log{"t": "job_start", "id": j.ID, "kind": kind})
+	js.running.Add(1)
+	go func() {
+		defer js.running.Done()
+		var err error
+		backoff := retry.Backoff
+	attempts:
+		for attempt := 1; ; attempt++ {
+			js.update(j.ID, func(j *Job) { j.Attempts, j.Done = attempt, 0 })
+			if err = f(Progress{js, j.ID}); err == nil || attempt >= retry.Attempts {
+				break
+			}
+			echo(Log{"t": "job_retry", "id": j.ID, "kind": kind, "attempt": strconv.Itoa(attempt), "error": err.Error()})
+			select {
+			case <-clock.After(backoff):
+			case <-js.quit:
+				break attempts
+			}
+			backoff *= 2
+		}
+		js.Lock()
+		if j, ok := js.jobs[j.ID]; ok {
+			now := clock.Now()
+			j.Finished = &now
+			if err != nil {
+				j.State, j.Error = jobFailed, err.Error()
+			} else {
+				j.State, j.Error = jobSucceeded, ""
+			}
+			js.persist()
+		}
+		js.Unlock()
+		js.notify(true)
+		if err != nil {
+			echo(Log{"t": "job_fail", "id": j.ID, "kind": kind, "error": err.Error()})
+		} else {
+			echo(Log{"t": "job_done", "id": j.ID, "kind": kind})
+		}
+	}()
+	return j.ID
+}
+
+// stop gives up retrying failed jobs, and waits for jobs in progress to finish.
+func (js *Jobs) stop() {
+	close(js.quit)
+	js.running.Wait()
+}
+
+// persist saves jobs, logging failures. Must be called under lock.
+func (js *Jobs) persist() {
+	if err := js.save(); err != nil {
+		echo(Log{"t": "jobs_save", "path": js.path, "error": err.Error()})
+	}
+}
+
+func (js *Jobs) update(id string, f func(*Job)) {
+	js.Lock()
+	if j, ok := js.jobs[id]; ok {
+		f(j)
+	}
+	js.Unlock()
+	js.notify(false)
+}
+
+// notify reports changes to the changed callback; progress-only changes are throttled.
+func (js *Jobs) notify(force bool) {
+	js.Lock()
+	changed := js.changed
+	if changed == nil || (!force && since(js.notified) < jobNotifyEvery) {
+		js.Unlock()
+		return
+	}
+	js.notified = clock.Now()
+	js.Unlock()
+	changed(js.list())
+}
+
+// get returns a copy of a job's status.
+func (js *Jobs) get(id string) (Job, bool) {
+	js.RLock()
+	defer js.RUnlock()
+	j, ok := js.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// list returns a copy of all jobs, most recently started first.
+func (js *Jobs) list() []Job {
+	js.RLock()
+	defer js.RUnlock()
+	jobs := js.sorted()
+	xs := make([]Job, len(jobs))
+	for i, j := range jobs {
+		xs[i] = *j
+	}
+	return xs
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultKeychain is the default path of the keychain file.
+const DefaultKeychain = ".wave-keychain"
+
+// loadKeychain reads access keys from a keychain file: one "<key ID> <bcrypt hash of secret>" pair per line.
+// A missing file is an empty keychain.
+func loadKeychain(path string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return keys, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want <key ID> <hash>", path, n)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad hash: %v", path, n, err)
+		}
+		keys[fields[0]] = []byte(fields[1])
+	}
+	return keys, sc.Err()
+}
+
+// GenerateAccessKey creates a random access key pair, and appends the key ID and the hash of the secret to the
+// keychain file at path, creating it if necessary. The secret itself is not stored.
+func GenerateAccessKey(path string) (id, secret string, err error) {
+	b := make([]byte, 8+24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	id, secret = hex.EncodeToString(b[:8]), base64.RawURLEncoding.EncodeToString(b[8:])
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", id, hash); err != nil {
+		f.Close()
+		return "", "", err
+	}
+	return id, secret, f.Close()
+}
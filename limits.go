@@ -0,0 +1,89 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"sync"
+)
+
+// SubscriptionLimits caps the number of distinct pages watched concurrently. 0 means unlimited.
+type SubscriptionLimits struct {
+	PerClient int // per websocket connection
+	PerUser   int // across all of a user's connections; without OIDC, all clients share the same user
+	PerOrigin int // across all connections from the same remote IP address
+}
+
+// Subscriptions tracks pages watched per user and per origin, against limits.
+type Subscriptions struct {
+	sync.Mutex
+	limits  SubscriptionLimits
+	users   map[string]int // username => pages watched
+	origins map[string]int // remote IP => pages watched
+}
+
+func newSubscriptions(limits SubscriptionLimits) *Subscriptions {
+	return &Subscriptions{limits: limits, users: make(map[string]int), origins: make(map[string]int)}
+}
+
+// acquire counts a new page watched by a user from an origin, unless that would exceed a limit.
+func (s *Subscriptions) acquire(user, origin string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.limits.PerUser > 0 && s.users[user] >= s.limits.PerUser {
+		return false
+	}
+	if s.limits.PerOrigin > 0 && s.origins[origin] >= s.limits.PerOrigin {
+		return false
+	}
+	s.users[user]++
+	s.origins[origin]++
+	return true
+}
+
+// release discounts n pages watched by a user from an origin.
+func (s *Subscriptions) release(user, origin string, n int) {
+	if n == 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.users[user] -= n; s.users[user] <= 0 {
+		delete(s.users, user)
+	}
+	if s.origins[origin] -= n; s.origins[origin] <= 0 {
+		delete(s.origins, origin)
+	}
+}
+
+// admit records that the client watches the page at route, and reports whether doing so is within limits.
+// Watching the same page again is always admitted.
+func (c *Client) admit(route string) bool {
+	if c.watched[route] {
+		return true
+	}
+	if max := c.broker.subscriptions.limits.PerClient; max > 0 && len(c.watched) >= max {
+		return false
+	}
+	if !c.broker.subscriptions.acquire(c.username, c.origin()) {
+		return false
+	}
+	c.watched[route] = true
+	return true
+}
+
+// origin returns the client's remote IP address.
+func (c *Client) origin() string {
+	return originOf(c.addr)
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// What a listener serves.
+const (
+	ServeAll    = "all"    // everything (default)
+	ServePublic = "public" // the browser-facing interface: web assets, websockets, sign-in and uploads
+	ServeAPI    = "api"    // the authenticated producer and admin interface: page reads and writes, /_admin, /_api and friends
+)
+
+const unixScheme = "unix://"
+
+// ListenConf represents an address to listen on, and the part of the interface served there.
+type ListenConf struct {
+	Address  string       // host:port, or unix:///path/to.sock
+	Serves   string       // ServeAll, ServePublic or ServeAPI; ServeAll if empty
+	Listener net.Listener // already open on Address, if set, e.g. by tests that pick a random port; closed when the server stops
+}
+
+// ParseListeners parses a comma-separated list of addresses, each optionally prefixed
+// with what it serves, e.g. "public=:10101,api=unix:///run/wave.sock".
+func ParseListeners(spec string) ([]ListenConf, error) {
+	var listeners []ListenConf
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		l := ListenConf{Address: s}
+		if i := strings.Index(s, "="); i >= 0 {
+			l.Serves, l.Address = s[:i], s[i+1:]
+		}
+		if err := l.validate(); err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func (l ListenConf) validate() error {
+	switch l.Serves {
+	case "", ServeAll, ServePublic, ServeAPI:
+	default:
+		return fmt.Errorf("listener %q: want %s, %s or %s, got %q", l.Address, ServeAll, ServePublic, ServeAPI, l.Serves)
+	}
+	if path := strings.TrimPrefix(l.Address, unixScheme); path != l.Address {
+		if path == "" {
+			return errors.New("listener: unix socket path missing")
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(l.Address); err != nil {
+		return fmt.Errorf("listener %q: %v", l.Address, err)
+	}
+	return nil
+}
+
+func (l ListenConf) unix() bool {
+	return strings.HasPrefix(l.Address, unixScheme)
+}
+
+// listeners returns the addresses to listen on: conf.Listen, serving everything, and any conf.Listeners.
+func (c *ServerConf) listeners() []ListenConf {
+	var listeners []ListenConf
+	if c.Listen != "" {
+		listeners = append(listeners, ListenConf{Address: c.Listen})
+	}
+	return append(listeners, c.Listeners...)
+}
+
+// listen opens a TCP or unix domain socket listener. A socket file left behind by an
+// unclean shutdown is replaced, but not one still accepting connections.
+func listen(address string) (net.Listener, error) {
+	path := strings.TrimPrefix(address, unixScheme)
+	if path == address {
+		return net.Listen("tcp", address)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s: socket in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// serve accepts connections on l until the server shuts down. TLS applies to TCP listeners only;
+// unix domain sockets are local, and served in the clear.
+func serve(server *http.Server, l ListenConf, certFile, keyFile string) error {
+	ln := l.Listener
+	if ln == nil {
+		var err error
+		if ln, err = listen(l.Address); err != nil {
+			return err
+		}
+	}
+	if certFile != "" && keyFile != "" && !l.unix() {
+		return server.ServeTLS(ln, certFile, keyFile)
+	}
+	return server.Serve(ln)
+}
+
+// Paths reserved for producers and administrators.
+var apiPaths = []string{
+	"/_admin", "/_api/", "/_c/", "/_contract", "/_d/", "/_p", "/_parse", "/_peer",
+	"/_publish", "/_schedule", "/_stream", "/_taps", "/_webhooks",
+}
+
+// Paths used by browsers and producers alike.
+var sharedPaths = []string{
+	"/healthz", "/readyz", "/_f", "/_annotations", "/_subscriptions",
+}
+
+func hasPathPrefix(url string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if isPathPrefix(prefix, url) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAPIRequest reports whether r is meant for the producer and admin interface.
+func isAPIRequest(r *http.Request) bool {
+	if hasPathPrefix(r.URL.Path, apiPaths) {
+		return true
+	}
+	if strings.HasPrefix(r.URL.Path, "/_") && !isPathPrefix(clientPrefix, r.URL.Path) { // client pages are written by apps
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet:
+		return r.Header.Get("Content-Type") == contentTypeJSON
+	case http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true // page writes and app requests
+}
+
+// scopeTo hides the parts of the interface a listener doesn't serve.
+func scopeTo(serves string, h http.Handler) http.Handler {
+	if serves == "" || serves == ServeAll {
+		return h
+	}
+	api := serves == ServeAPI
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasPathPrefix(r.URL.Path, sharedPaths) && isAPIRequest(r) != api {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
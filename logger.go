@@ -0,0 +1,198 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log represents key-value data for a log message.
+type Log map[string]string
+
+// Level represents the severity of a log message.
+type Level int
+
+// Log levels, in increasing order of severity.
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	}
+	return "error"
+}
+
+// ParseLevel converts a level name ("debug", "info", "warn", "error") to a Level.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "info", "":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, errors.New("unknown log level: " + s)
+}
+
+// Logger represents a structured logger. Implementations must be safe for concurrent use.
+type Logger interface {
+	// Log records a message; by convention, fields["t"] names the event.
+	Log(level Level, fields Log)
+}
+
+// StdLogger writes messages as "# {json}" lines via the standard library logger,
+// so that they can be interleaved with (and skipped by) AOF log replay.
+type StdLogger struct {
+	min Level
+}
+
+// NewStdLogger creates a StdLogger that discards messages below min.
+func NewStdLogger(min Level) *StdLogger {
+	return &StdLogger{min}
+}
+
+// Log implements Logger.
+func (l *StdLogger) Log(level Level, fields Log) {
+	if level < l.min {
+		return
+	}
+	if level != InfoLevel {
+		m := make(Log, len(fields)+1) // fields belongs to the caller
+		for k, v := range fields {
+			m[k] = v
+		}
+		m["level"] = level.String()
+		fields = m
+	}
+	if j, err := json.Marshal(fields); err == nil { // TODO speed up
+		log.Println("#", string(j))
+	}
+}
+
+var logger Logger = NewStdLogger(InfoLevel)
+
+// echo logs a message at info level, or at error level if the message carries an error.
+func echo(m Log) {
+	level := InfoLevel
+	if _, ok := m["error"]; ok {
+		level = ErrorLevel
+	} else if _, ok := m["err"]; ok {
+		level = ErrorLevel
+	}
+	logger.Log(level, m)
+}
+
+// warn logs a message at warn level.
+func warn(m Log) {
+	logger.Log(WarnLevel, m)
+}
+
+// debug logs a message at debug level.
+func debug(m Log) {
+	logger.Log(DebugLevel, m)
+}
+
+// ResponseRecorder captures the status code written by a handler.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *ResponseRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack implements http.Hijacker, which is required for websocket upgrades.
+func (w *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Flush implements http.Flusher.
+func (w *ResponseRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type keyNoteKey struct{}
+
+// keyNote holds the ID of the access key a request was verified to authenticate with, for logging.
+type keyNote struct {
+	sync.Mutex
+	id string
+}
+
+// noteKey notes that r was verified to authenticate with the access key id.
+func noteKey(r *http.Request, id string) {
+	if n, ok := r.Context().Value(keyNoteKey{}).(*keyNote); ok {
+		n.Lock()
+		n.id = id
+		n.Unlock()
+	}
+}
+
+// logRequests logs the method, path, status, latency, remote address and verified access key ID of each request,
+// at debug level. Key IDs that were not verified are not logged, since anyone can send any.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &ResponseRecorder{w, http.StatusOK}
+		key := &keyNote{}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), keyNoteKey{}, key)))
+		m := Log{
+			"t":       "request",
+			"method":  r.Method,
+			"path":    r.URL.Path,
+			"status":  strconv.Itoa(rec.status),
+			"latency": time.Since(start).String(),
+			"remote":  getRemoteAddr(r),
+		}
+		key.Lock()
+		if key.id != "" {
+			m["key_id"] = key.id
+		}
+		key.Unlock()
+		debug(m)
+	})
+}
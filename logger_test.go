@@ -0,0 +1,82 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+// logRecorder keeps the messages logged.
+type logRecorder struct {
+	logs []Log
+}
+
+func (l *logRecorder) Log(level Level, fields Log) {
+	l.logs = append(l.logs, fields)
+}
+
+func TestStdLoggerKeepsFields(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	fields := Log{"t": "test"}
+	NewStdLogger(DebugLevel).Log(WarnLevel, fields)
+	if _, ok := fields["level"]; ok || len(fields) != 1 {
+		t.Fatalf("want the caller's fields left alone, got %v", fields)
+	}
+}
+
+func TestLogRequestsVerifiedKeys(t *testing.T) {
+	defer func(l Logger) { logger = l }(logger)
+	rec := &logRecorder{}
+	logger = rec
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := newAuth(map[string][]byte{"id": hash}, false, nil, oauth2.Config{})
+	h := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_api/pages" { // checks credentials
+			auth.trusted(r)
+		}
+	}))
+	tests := []struct {
+		path, id, secret, want string
+	}{
+		{"/_api/pages", "id", "secret", "id"},
+		{"/_api/pages", "attacker-chosen", "x", ""},
+		{"/public", "id", "secret", ""}, // never checked
+	}
+	for _, tc := range tests {
+		rec.logs = nil
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		r.SetBasicAuth(tc.id, tc.secret)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if len(rec.logs) != 1 {
+			t.Fatalf("want one request logged, got %v", rec.logs)
+		}
+		if got := rec.logs[0]["key_id"]; got != tc.want {
+			t.Errorf("%s as %s: want key_id %q, got %q", tc.path, tc.id, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics holds operational counters. All fields must be accessed atomically.
+type Metrics struct {
+	clients         int64 // connected websocket clients
+	patches         int64 // patches applied
+	broadcasts      int64 // broadcasts sent
+	broadcastNanos  int64 // cumulative broadcast latency
+	aofBytes        int64 // bytes written to the AOF log
+	authFailures    int64 // failed authentication or authorization attempts
+	droppedClients  int64 // clients dropped because their send queue was full
+	droppedMessages int64 // messages discarded by the backpressure policy
+	collapsedQueues int64 // client queues collapsed to a full page
+	evictions       int64 // pages evicted from memory
+	reloads         int64 // evicted pages brought back into memory
+	residentBytes   int64 // estimated size of pages in memory, as of the last budget check
+	droppedReplicas int64 // page changes not replicated because a peer's queue was full
+	webhooksSent    int64 // webhook deliveries accepted
+	webhookFailures int64 // failed webhook delivery attempts
+	droppedWebhooks int64 // webhook events discarded because a webhook's queue was full
+	droppedChanges  int64 // page changes not reported because a change listener's queue was full
+	limitedRequests int64 // requests rejected for exceeding a rate limit
+	canceledPatches int64 // patches discarded because the writer went away before they were applied
+	remoteSamples   int64 // card values pushed to the remote-write endpoint
+	remoteFailures  int64 // failed remote-write pushes
+	exportedSpans   int64 // trace spans accepted by the OTLP collector
+	droppedSpans    int64 // trace spans not exported, because the export queue was full or the collector failed
+	apps            int64 // routes served by apps
+	wireConversions int64 // messages converted from or to an older wire grammar version
+}
+
+var stats = &Metrics{}
+
+func (m *Metrics) clientConnected()     { atomic.AddInt64(&m.clients, 1) }
+func (m *Metrics) clientDisconnected()  { atomic.AddInt64(&m.clients, -1) }
+func (m *Metrics) patchApplied()        { atomic.AddInt64(&m.patches, 1) }
+func (m *Metrics) aofWritten(n int)     { atomic.AddInt64(&m.aofBytes, int64(n)) }
+func (m *Metrics) authFailed()          { atomic.AddInt64(&m.authFailures, 1) }
+func (m *Metrics) clientDropped()       { atomic.AddInt64(&m.droppedClients, 1) }
+func (m *Metrics) messageDropped(n int) { atomic.AddInt64(&m.droppedMessages, int64(n)) }
+func (m *Metrics) queueCollapsed()      { atomic.AddInt64(&m.collapsedQueues, 1) }
+func (m *Metrics) pageEvicted()         { atomic.AddInt64(&m.evictions, 1) }
+func (m *Metrics) pageReloaded()        { atomic.AddInt64(&m.reloads, 1) }
+func (m *Metrics) replicaDropped()      { atomic.AddInt64(&m.droppedReplicas, 1) }
+func (m *Metrics) webhookDelivered()    { atomic.AddInt64(&m.webhooksSent, 1) }
+func (m *Metrics) webhookFailed()       { atomic.AddInt64(&m.webhookFailures, 1) }
+func (m *Metrics) webhookDropped()      { atomic.AddInt64(&m.droppedWebhooks, 1) }
+func (m *Metrics) changeDropped()       { atomic.AddInt64(&m.droppedChanges, 1) }
+func (m *Metrics) requestLimited()      { atomic.AddInt64(&m.limitedRequests, 1) }
+func (m *Metrics) patchCanceled()       { atomic.AddInt64(&m.canceledPatches, 1) }
+func (m *Metrics) remoteWritten(n int)  { atomic.AddInt64(&m.remoteSamples, int64(n)) }
+func (m *Metrics) remoteWriteFailed()   { atomic.AddInt64(&m.remoteFailures, 1) }
+func (m *Metrics) spansExported(n int)  { atomic.AddInt64(&m.exportedSpans, int64(n)) }
+func (m *Metrics) spansDropped(n int)   { atomic.AddInt64(&m.droppedSpans, int64(n)) }
+func (m *Metrics) wireConverted()       { atomic.AddInt64(&m.wireConversions, 1) }
+
+func (m *Metrics) broadcasted(d time.Duration) {
+	atomic.AddInt64(&m.broadcasts, 1)
+	atomic.AddInt64(&m.broadcastNanos, int64(d))
+}
+
+// onEvent follows events published on the broker's bus.
+func (m *Metrics) onEvent(e Event) {
+	switch e.Kind {
+	case pageChanged:
+		if e.Change == changePatch {
+			m.patchApplied()
+		}
+	case clientConnected:
+		m.clientConnected()
+	case clientDisconnected:
+		m.clientDisconnected()
+	case appConnected:
+		atomic.AddInt64(&m.apps, 1)
+	case appDisconnected:
+		atomic.AddInt64(&m.apps, -1)
+	}
+}
+
+// newMetricsServer exposes /metrics on a separate listener, so that it can be bound to an internal-only address.
+func newMetricsServer(addr string, site *Site) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newMetricsHandler(site, stats))
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+func serveMetrics(server *http.Server) {
+	echo(Log{"t": "metrics_listen", "address": server.Addr})
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		echo(Log{"t": "metrics_listen", "error": err.Error()})
+	}
+}
+
+// MetricsHandler serves metrics in the Prometheus text exposition format.
+type MetricsHandler struct {
+	site    *Site
+	metrics *Metrics
+}
+
+func newMetricsHandler(site *Site, metrics *Metrics) *MetricsHandler {
+	return &MetricsHandler{site, metrics}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := h.metrics
+	h.site.RLock()
+	pages := len(h.site.pages)
+	evicted := len(h.site.evicted)
+	h.site.RUnlock()
+
+	var b bytes.Buffer
+	metric := func(name, kind, help string, v interface{}) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, v)
+	}
+	metric("wave_clients", "gauge", "Connected websocket clients.", atomic.LoadInt64(&m.clients))
+	metric("wave_apps", "gauge", "Routes served by apps.", atomic.LoadInt64(&m.apps))
+	metric("wave_pages", "gauge", "Pages held in memory.", pages)
+	metric("wave_evicted_pages", "gauge", "Pages evicted from memory to disk.", evicted)
+	metric("wave_resident_bytes", "gauge", "Estimated size of pages held in memory, as of the last memory budget check.", atomic.LoadInt64(&m.residentBytes))
+	metric("wave_evictions_total", "counter", "Pages evicted from memory to stay within the memory budget.", atomic.LoadInt64(&m.evictions))
+	metric("wave_reloads_total", "counter", "Evicted pages brought back into memory on access.", atomic.LoadInt64(&m.reloads))
+	metric("wave_patches_total", "counter", "Patches applied.", atomic.LoadInt64(&m.patches))
+	metric("wave_canceled_patches_total", "counter", "Patches discarded because the writer went away before they were applied.", atomic.LoadInt64(&m.canceledPatches))
+	metric("wave_aof_bytes_total", "counter", "Bytes written to the AOF log.", atomic.LoadInt64(&m.aofBytes))
+	metric("wave_auth_failures_total", "counter", "Failed authentication or authorization attempts.", atomic.LoadInt64(&m.authFailures))
+	metric("wave_dropped_clients_total", "counter", "Clients dropped because their send queue was full.", atomic.LoadInt64(&m.droppedClients))
+	metric("wave_dropped_messages_total", "counter", "Messages discarded because a client's send queue was full.", atomic.LoadInt64(&m.droppedMessages))
+	metric("wave_webhook_deliveries_total", "counter", "Webhook deliveries accepted.", atomic.LoadInt64(&m.webhooksSent))
+	metric("wave_webhook_failures_total", "counter", "Failed webhook delivery attempts, including retries.", atomic.LoadInt64(&m.webhookFailures))
+	metric("wave_dropped_webhooks_total", "counter", "Webhook events discarded because a webhook's send queue was full.", atomic.LoadInt64(&m.droppedWebhooks))
+	metric("wave_rate_limited_requests_total", "counter", "Requests rejected for exceeding a rate limit.", atomic.LoadInt64(&m.limitedRequests))
+	metric("wave_dropped_changes_total", "counter", "Page changes not reported because a change listener's queue was full.", atomic.LoadInt64(&m.droppedChanges))
+	metric("wave_dropped_replicas_total", "counter", "Page changes not replicated because a peer's send queue was full.", atomic.LoadInt64(&m.droppedReplicas))
+	metric("wave_remote_write_samples_total", "counter", "Card values pushed to the remote-write endpoint.", atomic.LoadInt64(&m.remoteSamples))
+	metric("wave_remote_write_failures_total", "counter", "Failed remote-write pushes.", atomic.LoadInt64(&m.remoteFailures))
+	metric("wave_exported_spans_total", "counter", "Trace spans accepted by the OTLP collector.", atomic.LoadInt64(&m.exportedSpans))
+	metric("wave_dropped_spans_total", "counter", "Trace spans not exported, because the export queue was full or the collector failed.", atomic.LoadInt64(&m.droppedSpans))
+	metric("wave_wire_conversions_total", "counter", "Patches and messages converted from or to an older wire grammar version.", atomic.LoadInt64(&m.wireConversions))
+	metric("wave_collapsed_queues_total", "counter", "Client send queues collapsed to a full page.", atomic.LoadInt64(&m.collapsedQueues))
+
+	const broadcast = "wave_broadcast_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Time taken to fan out a message to subscribers.\n# TYPE %s summary\n", broadcast, broadcast)
+	fmt.Fprintf(&b, "%s_sum %g\n", broadcast, time.Duration(atomic.LoadInt64(&m.broadcastNanos)).Seconds())
+	fmt.Fprintf(&b, "%s_count %d\n", broadcast, atomic.LoadInt64(&m.broadcasts))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// aofFormat is the version of the on-disk format of AOF segments and snapshots written by this server.
+// Files state their format in a comment entry before their first page entry, e.g. "# wave-aof-format 1";
+// files without one are version 0.
+//
+// To change the format, bump aofFormat, and add a migration from the previous version to aofMigrations.
+const aofFormat = 1
+
+const aofFormatPrefix = "wave-aof-format "
+
+// aofMigration upgrades a file from one format version to the next, writing the upgraded contents to w.
+type aofMigration func(r *bufio.Reader, w io.Writer) error
+
+// aofMigrations[v] upgrades format version v to v+1.
+var aofMigrations = []aofMigration{
+	migrateAOFv0,
+}
+
+// migrateAOFv0 adds a format header; entries are unchanged.
+func migrateAOFv0(r *bufio.Reader, w io.Writer) error {
+	writeAOFHeader(log.New(w, "", log.LstdFlags), 1)
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// writeAOFHeader writes a format header, which must precede a file's page entries.
+func writeAOFHeader(l *log.Logger, version int) error {
+	return l.Output(2, commentMarker+" "+aofFormatPrefix+strconv.Itoa(version))
+}
+
+// readAOFFormat returns the format version of an AOF segment or snapshot.
+// Files without page entries are considered current.
+func readAOFFormat(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if len(line) == 0 {
+			return aofFormat, nil
+		}
+		tokens := bytes.SplitN(bytes.TrimRight(line, "\r\n"), msgSep, 4) // "date time # wave-aof-format N"
+		if len(tokens) < 3 || !bytes.Equal(tokens[2], []byte(commentMarker)) {
+			return 0, nil // page entry, or malformed: no header
+		}
+		if len(tokens) == 4 && bytes.HasPrefix(tokens[3], []byte(aofFormatPrefix)) {
+			v, err := strconv.Atoi(string(tokens[3][len(aofFormatPrefix):]))
+			if err != nil {
+				return 0, fmt.Errorf("%s: bad format header: %v", path, err)
+			}
+			return v, nil
+		}
+	}
+}
+
+// migrateAOF upgrades the AOF at path, which is either a file or a directory of rotated segments, to the current format.
+// Originals are kept in a "backups" directory next to them.
+func migrateAOF(path string) error {
+	segments, err := aofSegments(path)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := migrateAOFSegment(segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateAOFSegment(path string) error {
+	v, err := readAOFFormat(path)
+	if err != nil {
+		return err
+	}
+	if v > aofFormat {
+		return fmt.Errorf("%s: format version %d is newer than this server supports (%d)", path, v, aofFormat)
+	}
+	if v == aofFormat {
+		return nil
+	}
+	backup := filepath.Join(filepath.Dir(path), "backups", filepath.Base(path)+".v"+strconv.Itoa(v))
+	if err := os.MkdirAll(filepath.Dir(backup), 0700); err != nil {
+		return err
+	}
+	if err := linkOrCopy(path, backup); err != nil {
+		return fmt.Errorf("%s: backup failed: %v", path, err)
+	}
+	for from := v; from < aofFormat; from++ {
+		if err := migrateAOFFile(path, aofMigrations[from]); err != nil {
+			return fmt.Errorf("%s: migrating from format version %d failed: %v", path, from, err)
+		}
+	}
+	echo(Log{"t": "aof_migrate", "file": path, "from": strconv.Itoa(v), "to": strconv.Itoa(aofFormat), "backup": backup})
+	return nil
+}
+
+// migrateAOFFile applies a migration to a file, replacing the file only once the upgraded copy is complete.
+func migrateAOFFile(path string, migrate aofMigration) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp") // hidden, so never mistaken for a segment
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(dst, 64*1024)
+	err = migrate(bufio.NewReaderSize(src, 64*1024), w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// linkOrCopy hard-links src to dst, copying it if linking is not supported.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil || os.IsExist(err) { // left behind by an interrupted migration
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
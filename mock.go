@@ -0,0 +1,182 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const (
+	mockPrefix    = "/mock"
+	mockSeries    = 60 // points kept per chart
+	mockTableRows = 50
+)
+
+var mockStatuses = []string{"running", "queued", "failed", "done"}
+
+// Mock populates the site with synthetic pages, and keeps them changing, for front-end and SDK development
+// against realistic data without writing publishers.
+type Mock struct {
+	broker *Broker
+	rand   *rand.Rand
+	tick   int
+	cpu    float64 // random walks behind the charts and stats
+	mem    float64
+	users  float64
+	cpus   []float64 // per table row
+}
+
+func newMock(broker *Broker) *Mock {
+	m := &Mock{broker: broker, rand: rand.New(rand.NewSource(clock.Now().UnixNano())), cpu: 40, mem: 60, users: 1200}
+	m.cpus = make([]float64, mockTableRows)
+	for i := range m.cpus {
+		m.cpus[i] = m.rand.Float64() * 100
+	}
+	return m
+}
+
+// run creates the mock pages, then updates them rate times per second, until the broker stops.
+func (m *Mock) run(rate float64) {
+	m.put("charts", m.charts())
+	m.put("stats", m.stats())
+	m.put("table", m.table())
+	echo(Log{"t": "mock_start", "prefix": mockPrefix, "rate": strconv.FormatFloat(rate, 'g', -1, 64)})
+	if rate <= 0 {
+		return
+	}
+	ticker := clock.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			m.update()
+		case <-m.broker.quit:
+			return
+		}
+	}
+}
+
+func (m *Mock) put(page string, cards []OpD) {
+	m.patch(page, append([]OpD{{}}, cards...)) // drop any previous copy first
+}
+
+func (m *Mock) patch(page string, ops []OpD) {
+	data, err := json.Marshal(OpsD{D: ops})
+	if err != nil {
+		echo(Log{"t": "mock", "error": err.Error()})
+		return
+	}
+	m.broker.apply(withWriter(context.Background(), "", "mock"), mockPrefix+"/"+page, data)
+}
+
+// walk moves x by a random step, keeping it within [lo, hi].
+func (m *Mock) walk(x, step, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, x+(m.rand.Float64()*2-1)*step))
+}
+
+func mockCard(name string, d map[string]interface{}, bufs ...BufD) OpD {
+	return OpD{K: name, D: d, B: bufs}
+}
+
+func mockSeriesBuf(fields ...string) BufD {
+	return BufD{C: &CycBufD{F: fields, N: mockSeries}}
+}
+
+func mockLine(x, y string, max float64) map[string]interface{} {
+	return map[string]interface{}{"marks": []interface{}{map[string]interface{}{"type": "line", "x_scale": "time", "x": "=" + x, "y": "=" + y, "y_min": 0, "y_max": max}}}
+}
+
+func (m *Mock) charts() []OpD {
+	return []OpD{
+		mockCard("header", map[string]interface{}{"view": "header", "box": "1 1 12 1", "title": "Charts", "subtitle": "Synthetic time series"}),
+		mockCard("cpu", map[string]interface{}{"view": "plot", "box": "1 2 6 4", "title": "CPU usage (%)", "plot": mockLine("time", "usage", 100), "~data": 0}, mockSeriesBuf("time", "usage")),
+		mockCard("memory", map[string]interface{}{"view": "plot", "box": "7 2 6 4", "title": "Memory usage (%)", "plot": mockLine("time", "usage", 100), "~data": 0}, mockSeriesBuf("time", "usage")),
+		mockCard("requests", map[string]interface{}{"view": "plot", "box": "1 6 12 4", "title": "Requests per tick",
+			"plot":  map[string]interface{}{"marks": []interface{}{map[string]interface{}{"type": "interval", "x": "=tick", "y": "=count", "y_min": 0}}},
+			"~data": 0}, BufD{C: &CycBufD{F: []string{"tick", "count"}, N: mockSeries / 3}}),
+	}
+}
+
+func (m *Mock) stats() []OpD {
+	return []OpD{
+		mockCard("header", map[string]interface{}{"view": "header", "box": "1 1 12 1", "title": "Stats", "subtitle": "Synthetic metrics"}),
+		mockCard("users", map[string]interface{}{"view": "small_stat", "box": "1 2 2 1", "title": "Active users", "value": "0"}),
+		mockCard("uptime", map[string]interface{}{"view": "small_stat", "box": "3 2 2 1", "title": "Uptime (ticks)", "value": "0"}),
+		mockCard("cpu", map[string]interface{}{"view": "small_series_stat", "box": "5 2 4 1", "title": "CPU", "value": "={{intl cpu minimum_fraction_digits=1 maximum_fraction_digits=1}}%",
+			"data": map[string]interface{}{"cpu": 0}, "plot_value": "cpu", "plot_category": "tick", "plot_zero_value": 0, "~plot_data": 0}, mockSeriesBuf("tick", "cpu")),
+		mockCard("memory", map[string]interface{}{"view": "large_stat", "box": "9 2 4 2", "title": "Memory", "value": "0%", "aux_value": "of 64 GB", "caption": "Resident memory across all nodes"}),
+	}
+}
+
+func (m *Mock) table() []OpD {
+	rows := make([]interface{}, mockTableRows)
+	for i := range rows {
+		rows[i] = map[string]interface{}{"name": fmt.Sprintf("job%d", i), "cells": []interface{}{
+			strconv.Itoa(i + 1), fmt.Sprintf("Job %d", i+1), mockStatuses[m.rand.Intn(len(mockStatuses))], m.cpuCell(i),
+		}}
+	}
+	columns := []interface{}{
+		map[string]interface{}{"name": "id", "label": "ID", "sortable": true},
+		map[string]interface{}{"name": "name", "label": "Name", "searchable": true},
+		map[string]interface{}{"name": "status", "label": "Status", "filterable": true},
+		map[string]interface{}{"name": "cpu", "label": "CPU (%)", "sortable": true},
+	}
+	return []OpD{
+		mockCard("header", map[string]interface{}{"view": "header", "box": "1 1 12 1", "title": "Table", "subtitle": "Synthetic jobs"}),
+		mockCard("jobs", map[string]interface{}{"view": "form", "box": "1 2 12 10", "items": []interface{}{
+			map[string]interface{}{"table": map[string]interface{}{"name": "jobs", "columns": columns, "rows": rows, "height": "600px"}},
+		}}),
+	}
+}
+
+func (m *Mock) cpuCell(i int) string {
+	return strconv.FormatFloat(m.cpus[i], 'f', 1, 64)
+}
+
+// update advances every mock page by one tick.
+func (m *Mock) update() {
+	m.tick++
+	now := clock.Now().UTC().Format(time.RFC3339)
+	tick := strconv.Itoa(m.tick)
+	m.cpu = m.walk(m.cpu, 8, 0, 100)
+	m.mem = m.walk(m.mem, 2, 0, 100)
+	m.users = m.walk(m.users, 50, 0, 5000)
+
+	m.patch("charts", []OpD{
+		{K: "cpu data -1", V: []interface{}{now, m.cpu}},
+		{K: "memory data -1", V: []interface{}{now, m.mem}},
+		{K: "requests data -1", V: []interface{}{tick, m.rand.Intn(100)}},
+	})
+	m.patch("stats", []OpD{
+		{K: "users value", V: strconv.Itoa(int(m.users))},
+		{K: "uptime value", V: tick},
+		{K: "cpu data cpu", V: m.cpu},
+		{K: "cpu plot_data -1", V: []interface{}{tick, m.cpu}},
+		{K: "memory value", V: strconv.FormatFloat(m.mem, 'f', 0, 64) + "%"},
+	})
+	i := m.rand.Intn(mockTableRows)
+	m.cpus[i] = m.walk(m.cpus[i], 20, 0, 100)
+	ops := []OpD{{K: fmt.Sprintf("jobs items 0 table rows %d cells 3", i), V: m.cpuCell(i)}}
+	if m.rand.Intn(10) == 0 {
+		ops = append(ops, OpD{K: fmt.Sprintf("jobs items 0 table rows %d cells 2", i), V: mockStatuses[m.rand.Intn(len(mockStatuses))]})
+	}
+	m.patch("table", ops)
+}
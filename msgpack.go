@@ -0,0 +1,335 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// MessagePack is supported as an alternate wire format. Pages are always stored, logged and relayed in their
+// canonical (JSON) form; payloads are transcoded on the way in and out, so that JSON and MessagePack clients can be
+// mixed freely.
+
+const (
+	contentTypeMsgpack = "application/msgpack"
+	// msgpackProtocol is the websocket subprotocol requested by clients that want to receive MessagePack.
+	msgpackProtocol = "wave.msgpack"
+)
+
+// msgpackMaxDepth is how deeply arrays and maps may nest in decoded documents, as with encoding/json.
+const msgpackMaxDepth = 10000
+
+var (
+	errMsgpackTruncated = errors.New("msgpack: unexpected end of data")
+	errMsgpackDepth     = errors.New("msgpack: exceeded max depth")
+)
+
+// jsonToMsgpack transcodes a JSON document to MessagePack.
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeMsgpack(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// msgpackToJSON transcodes a MessagePack document to JSON.
+func msgpackToJSON(data []byte) ([]byte, error) {
+	v, rest, err := decodeMsgpack(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("msgpack: %d trailing bytes", len(rest))
+	}
+	return json.Marshal(v)
+}
+
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			encodeMsgpackInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		encodeMsgpackFloat(buf, f)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			encodeMsgpackInt(buf, int64(v))
+		} else {
+			encodeMsgpackFloat(buf, v)
+		}
+	case int:
+		encodeMsgpackInt(buf, int64(v))
+	case int64:
+		encodeMsgpackInt(buf, v)
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 0xdc, 0xdd)
+		for _, x := range v {
+			if err := encodeMsgpack(buf, x); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeMsgpackHeader(buf, len(v), 0x80, 0xde, 0xdf)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeMsgpack(buf, k)
+			if err := encodeMsgpack(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot encode %T", v)
+	}
+	return nil
+}
+
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix, b16, b32 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func encodeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func encodeMsgpackFloat(buf *bytes.Buffer, f float64) {
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+}
+
+// decodeMsgpack decodes one value, nested depth arrays or maps deep, and returns the remaining bytes.
+func decodeMsgpack(b []byte, depth int) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errMsgpackTruncated
+	}
+	c, b := b[0], b[1:]
+	switch {
+	case c <= 0x7f:
+		return int64(c), b, nil
+	case c >= 0xe0:
+		return int64(int8(c)), b, nil
+	case c&0xf0 == 0x80:
+		return decodeMsgpackMap(b, int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return decodeMsgpackArray(b, int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return decodeMsgpackString(b, int(c&0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, b, nil
+	case 0xc2:
+		return false, b, nil
+	case 0xc3:
+		return true, b, nil
+	case 0xc4, 0xd9: // bin 8, str 8
+		n, b, err := msgpackLen(b, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return decodeMsgpackString(b, n)
+	case 0xc5, 0xda: // bin 16, str 16
+		n, b, err := msgpackLen(b, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return decodeMsgpackString(b, n)
+	case 0xc6, 0xdb: // bin 32, str 32
+		n, b, err := msgpackLen(b, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return decodeMsgpackString(b, n)
+	case 0xca:
+		if len(b) < 4 {
+			return nil, nil, errMsgpackTruncated
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), b[4:], nil
+	case 0xcb:
+		if len(b) < 8 {
+			return nil, nil, errMsgpackTruncated
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8-64
+		size := 1 << (c - 0xcc)
+		n, b, err := msgpackUint(b, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n > math.MaxInt64 {
+			return float64(n), b, nil
+		}
+		return int64(n), b, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8-64
+		size := 1 << (c - 0xd0)
+		n, b, err := msgpackUint(b, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		shift := uint(64 - 8*size) // sign-extend
+		return int64(n<<shift) >> shift, b, nil
+	case 0xdc, 0xdd:
+		n, b, err := msgpackLen(b, 2<<(c-0xdc))
+		if err != nil {
+			return nil, nil, err
+		}
+		return decodeMsgpackArray(b, n, depth)
+	case 0xde, 0xdf:
+		n, b, err := msgpackLen(b, 2<<(c-0xde))
+		if err != nil {
+			return nil, nil, err
+		}
+		return decodeMsgpackMap(b, n, depth)
+	}
+	return nil, nil, fmt.Errorf("msgpack: unsupported type 0x%x", c)
+}
+
+func msgpackUint(b []byte, size int) (uint64, []byte, error) {
+	if len(b) < size {
+		return 0, nil, errMsgpackTruncated
+	}
+	var n uint64
+	for _, x := range b[:size] {
+		n = n<<8 | uint64(x)
+	}
+	return n, b[size:], nil
+}
+
+func msgpackLen(b []byte, size int) (int, []byte, error) {
+	n, b, err := msgpackUint(b, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > uint64(len(b)) { // every element occupies at least a byte
+		return 0, nil, errMsgpackTruncated
+	}
+	return int(n), b, nil
+}
+
+func decodeMsgpackString(b []byte, n int) (interface{}, []byte, error) {
+	if len(b) < n {
+		return nil, nil, errMsgpackTruncated
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func decodeMsgpackArray(b []byte, n, depth int) (interface{}, []byte, error) {
+	if depth >= msgpackMaxDepth {
+		return nil, nil, errMsgpackDepth
+	}
+	xs := make([]interface{}, n)
+	for i := range xs {
+		x, rest, err := decodeMsgpack(b, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		xs[i], b = x, rest
+	}
+	return xs, b, nil
+}
+
+func decodeMsgpackMap(b []byte, n, depth int) (interface{}, []byte, error) {
+	if depth >= msgpackMaxDepth {
+		return nil, nil, errMsgpackDepth
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, rest, err := decodeMsgpack(b, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, rest, err := decodeMsgpack(rest, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			key = fmt.Sprint(k)
+		}
+		m[key], b = v, rest
+	}
+	return m, b, nil
+}
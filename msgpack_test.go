@@ -0,0 +1,117 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	many := func(n int, f func(i int) string) string {
+		xs := make([]string, n)
+		for i := range xs {
+			xs[i] = f(i)
+		}
+		return strings.Join(xs, ",")
+	}
+	docs := []string{
+		`null`, `true`, `false`, `0`, `127`, `128`, `255`, `256`, `65535`, `65536`, `4294967296`, `9007199254740993`,
+		`-1`, `-32`, `-33`, `-128`, `-129`, `-32768`, `-32769`, `-2147483649`, `1.5`, `-0.25`, `1e300`,
+		`""`, `"` + strings.Repeat("a", 31) + `"`, `"` + strings.Repeat("b", 32) + `"`,
+		`"` + strings.Repeat("c", 256) + `"`, `"` + strings.Repeat("d", 65536) + `"`, `"héllo, 世界"`,
+		`[]`, `[` + many(15, func(i int) string { return fmt.Sprint(i) }) + `]`,
+		`[` + many(16, func(i int) string { return fmt.Sprint(i) }) + `]`,
+		`[` + many(65536, func(i int) string { return "1" }) + `]`,
+		`{}`, `{` + many(16, func(i int) string { return fmt.Sprintf(`"k%d":%d`, i, i) }) + `}`,
+		`{"d":[{"k":"status","d":{"view":"markdown","content":"up","items":[1,2.5,"x",null,true,{"a":[]}]}}],"t":60}`,
+	}
+	for _, doc := range docs {
+		mp, err := jsonToMsgpack([]byte(doc))
+		if err != nil {
+			t.Fatalf("%.40s: encode: %v", doc, err)
+		}
+		back, err := msgpackToJSON(mp)
+		if err != nil {
+			t.Fatalf("%.40s: decode: %v", doc, err)
+		}
+		var want, got interface{}
+		json.Unmarshal([]byte(doc), &want)
+		if err := json.Unmarshal(back, &got); err != nil {
+			t.Fatalf("%.40s: bad JSON %.40s: %v", doc, back, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%.40s: got %.40s", doc, back)
+		}
+	}
+}
+
+func TestMsgpackDecode(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"float 32", []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, `1.5`},
+		{"uint 64 beyond int 64", []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, `18446744073709552000`},
+		{"bin 8", []byte{0xc4, 0x02, 'h', 'i'}, `"hi"`},
+		{"int key", []byte{0x81, 0x01, 0xa1, 'x'}, `{"1":"x"}`},
+	}
+	for _, c := range cases {
+		got, err := msgpackToJSON(c.data)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if string(got) != c.want {
+			t.Errorf("%s: want %s, got %s", c.name, c.want, got)
+		}
+	}
+	for _, data := range [][]byte{
+		{},
+		{0xa3, 'a'},              // string shorter than declared
+		{0x92, 0x01},             // array shorter than declared
+		{0xdd, 0xff, 0xff},       // truncated length
+		{0xcb, 0x00},             // truncated float
+		{0xdc, 0xff, 0xff, 0x01}, // length beyond the data
+	} {
+		if _, err := msgpackToJSON(data); err != errMsgpackTruncated {
+			t.Errorf("% x: want %v, got %v", data, errMsgpackTruncated, err)
+		}
+	}
+	if _, err := msgpackToJSON([]byte{0x01, 0x02}); err == nil {
+		t.Error("trailing bytes: want error")
+	}
+	if _, err := msgpackToJSON([]byte{0xc1}); err == nil {
+		t.Error("unsupported type: want error")
+	}
+}
+
+func TestMsgpackMaxDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{0x91}, depth), 0x01) // [[[...1...]]]
+	}
+	if _, err := msgpackToJSON(nested(msgpackMaxDepth)); err != nil {
+		t.Fatalf("%d levels: want ok, got %v", msgpackMaxDepth, err)
+	}
+	if _, err := msgpackToJSON(nested(msgpackMaxDepth + 1)); err != errMsgpackDepth {
+		t.Fatalf("%d levels: want %v, got %v", msgpackMaxDepth+1, errMsgpackDepth, err)
+	}
+	if _, err := msgpackToJSON(nested(1 << 20)); err != errMsgpackDepth { // would exhaust the stack
+		t.Fatalf("%d levels: want %v, got %v", 1<<20, errMsgpackDepth, err)
+	}
+}
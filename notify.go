@@ -0,0 +1,442 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Notification channels.
+const (
+	emailChannel   = "email"
+	webhookChannel = "webhook"
+)
+
+// Notification frequencies.
+const (
+	immediateFrequency = "immediate"
+	hourlyFrequency    = "hourly"
+)
+
+const (
+	notifyQueueSize = 1024 // immediate notifications waiting to be sent; more are folded into the next digest
+	notifyWorkers   = 4    // immediate notifications sent at a time
+)
+
+// Notification represents an immediate notification waiting to be sent.
+type Notification struct {
+	sub    Subscription
+	digest Digest
+}
+
+// Subscription represents a user's request to be notified of changes to a page.
+type Subscription struct {
+	User      string `json:"user"`
+	Route     string `json:"route"`
+	Channel   string `json:"channel"`   // "email" or "webhook"
+	Target    string `json:"target"`    // email address or webhook URL
+	Frequency string `json:"frequency"` // "immediate" or "hourly"
+}
+
+func (s Subscription) key() string {
+	return s.User + "\n" + s.Route + "\n" + s.Channel + "\n" + s.Target
+}
+
+// Digest represents a summary of changes to a page, sent to subscribers.
+type Digest struct {
+	Route   string    `json:"route"`
+	Changes int       `json:"changes"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+}
+
+// SMTPConf represents the mail server used to send email notifications.
+type SMTPConf struct {
+	Addr     string // host:port
+	From     string
+	Username string
+	Password string
+}
+
+// Notifier notifies subscribers of changes to pages.
+// Subscriptions are persisted as JSON to a file in the data directory.
+type Notifier struct {
+	sync.Mutex
+	path    string
+	smtp    SMTPConf
+	client  *http.Client
+	subs    map[string]Subscription // key => subscription
+	pending map[string]*Digest      // key => digest of changes not yet sent (hourly subscriptions, and overflow)
+	queue   chan Notification       // immediate notifications, sent by run's workers
+}
+
+func newNotifier(path string, smtp SMTPConf) *Notifier {
+	n := &Notifier{
+		path:    path,
+		smtp:    smtp,
+		client:  &http.Client{Timeout: 10 * time.Second, Transport: publicTransport()},
+		subs:    make(map[string]Subscription),
+		pending: make(map[string]*Digest),
+		queue:   make(chan Notification, notifyQueueSize),
+	}
+	if err := n.load(); err != nil {
+		echo(Log{"t": "subscriptions_load", "path": path, "error": err.Error()})
+	}
+	return n
+}
+
+func (n *Notifier) load() error {
+	data, err := ioutil.ReadFile(n.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var subs []Subscription
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return err
+	}
+	for _, s := range subs {
+		n.subs[s.key()] = s
+	}
+	return nil
+}
+
+// save persists subscriptions. Must be called under lock.
+func (n *Notifier) save() error {
+	subs := make([]Subscription, 0, len(n.subs))
+	for _, s := range n.subs {
+		subs = append(subs, s)
+	}
+	data, err := json.MarshalIndent(subs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(n.path, data)
+}
+
+func (n *Notifier) validate(s Subscription) error {
+	if s.Route == "" || s.Target == "" {
+		return errors.New("want route and target")
+	}
+	if strings.ContainsAny(s.Route, "\r\n") || strings.ContainsAny(s.Target, "\r\n") {
+		return errors.New("route and target must not contain line breaks")
+	}
+	switch s.Channel {
+	case emailChannel:
+		if n.smtp.Addr == "" {
+			return errors.New("email notifications are not configured")
+		}
+		if a, err := mail.ParseAddress(s.Target); err != nil || a.Address != s.Target {
+			return errors.New("want email address")
+		}
+	case webhookChannel:
+		u, err := url.Parse(s.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			return errors.New("want http(s) webhook URL")
+		}
+		if ip := net.ParseIP(u.Hostname()); (ip != nil && !isPublicIP(ip)) || strings.EqualFold(u.Hostname(), "localhost") {
+			return errors.New("webhook URL must not point to a private or loopback address")
+		}
+	default:
+		return fmt.Errorf("unknown channel: %q", s.Channel)
+	}
+	switch s.Frequency {
+	case immediateFrequency, hourlyFrequency:
+	default:
+		return fmt.Errorf("unknown frequency: %q", s.Frequency)
+	}
+	return nil
+}
+
+func (n *Notifier) subscribe(s Subscription) error {
+	if err := n.validate(s); err != nil {
+		return err
+	}
+	n.Lock()
+	defer n.Unlock()
+	n.subs[s.key()] = s
+	return n.save()
+}
+
+func (n *Notifier) unsubscribe(s Subscription) error {
+	n.Lock()
+	defer n.Unlock()
+	k := s.key()
+	delete(n.subs, k)
+	delete(n.pending, k)
+	return n.save()
+}
+
+// list returns a user's subscriptions.
+func (n *Notifier) list(user string) []Subscription {
+	n.Lock()
+	defer n.Unlock()
+	subs := make([]Subscription, 0)
+	for _, s := range n.subs {
+		if s.User == user {
+			subs = append(subs, s)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].key() < subs[j].key() })
+	return subs
+}
+
+// changed records a change to the page at route, notifying immediate subscribers.
+func (n *Notifier) changed(route string) {
+	now := clock.Now()
+	n.Lock()
+	defer n.Unlock()
+	for k, s := range n.subs {
+		if s.Route != route {
+			continue
+		}
+		if s.Frequency == immediateFrequency {
+			select {
+			case n.queue <- Notification{s, Digest{route, 1, now, now}}:
+				continue
+			default: // too many in flight; sent with the next digest instead
+			}
+		}
+		d, ok := n.pending[k]
+		if !ok {
+			d = &Digest{Route: route, Since: now}
+			n.pending[k] = d
+		}
+		d.Changes++
+		d.Until = now
+	}
+}
+
+// onChange tracks a page change published on the broker's bus.
+func (n *Notifier) onChange(e Event) {
+	n.changed(e.Route)
+}
+
+// run sends immediate notifications as they are queued, and hourly digests, until quit is closed.
+// Returns once the workers sending them have returned.
+func (n *Notifier) run(quit <-chan struct{}) {
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	for i := 0; i < notifyWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case x := <-n.queue:
+					n.send(x.sub, x.digest)
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
+	ticker := clock.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			n.flush()
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (n *Notifier) flush() {
+	n.Lock()
+	pending := n.pending
+	n.pending = make(map[string]*Digest)
+	subs := make(map[string]Subscription, len(pending))
+	for k := range pending {
+		if s, ok := n.subs[k]; ok {
+			subs[k] = s
+		}
+	}
+	n.Unlock()
+
+	for k, d := range pending {
+		if s, ok := subs[k]; ok {
+			n.send(s, *d)
+		}
+	}
+}
+
+func (n *Notifier) send(s Subscription, d Digest) {
+	var err error
+	switch s.Channel {
+	case emailChannel:
+		err = n.sendEmail(s.Target, d)
+	case webhookChannel:
+		err = n.sendWebhook(s.Target, d)
+	}
+	if err != nil {
+		echo(Log{"t": "notify", "user": s.User, "route": s.Route, "channel": s.Channel, "error": err.Error()})
+	}
+}
+
+func (n *Notifier) sendWebhook(url string, d Digest) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(url, contentTypeJSON, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) sendEmail(to string, d Digest) error {
+	c := n.smtp
+	var auth smtp.Auth
+	if c.Username != "" {
+		host, _, err := net.SplitHostPort(c.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	if strings.ContainsAny(to, "\r\n") { // subscribed before line breaks were refused
+		return errors.New("bad email address")
+	}
+	route := strings.NewReplacer("\r", " ", "\n", " ").Replace(d.Route)
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%d change(s) to %s between %s and %s.\r\n",
+		c.From, to, mime.QEncoding.Encode("utf-8", "Wave: "+d.Route+" changed"), d.Changes, route, d.Since.Format(time.RFC1123), d.Until.Format(time.RFC1123))
+	return smtp.SendMail(c.Addr, auth, c.From, []string{to}, []byte(msg))
+}
+
+// privateNets are address ranges reserved for private networks (RFC 1918, RFC 6598 and RFC 4193).
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isPublicIP reports whether ip is a public unicast address: not loopback, private, link-local or unspecified.
+func isPublicIP(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicTransport returns a transport that connects only to public addresses, so that users can't have the
+// server make requests into its own network. The check is made on connecting, after names are resolved, so
+// it holds for redirects, and for names that resolve differently later.
+func publicTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("refusing to connect to non-public address %s", host)
+			}
+			return nil
+		},
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil // the proxy would connect on our behalf, unchecked
+	t.DialContext = dialer.DialContext
+	return t
+}
+
+// SubscriptionHandler serves the subscription preferences API for authenticated users:
+// GET lists, POST adds (or updates), and DELETE removes the caller's subscriptions.
+type SubscriptionHandler struct {
+	notifier *Notifier
+	site     *Site
+	auth     *Auth
+}
+
+func newSubscriptionHandler(notifier *Notifier, site *Site, auth *Auth) *SubscriptionHandler {
+	return &SubscriptionHandler{notifier, site, auth}
+}
+
+func (h *SubscriptionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	viewer, ok := h.auth.identify(r)
+	user, roles := viewer.username, viewer.roles
+	if !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(h.notifier.list(user))
+	case http.MethodPost, http.MethodDelete:
+		if r.Method == http.MethodPost && refuseRequest(w, licensing.allows(FeatureNotifications)) {
+			return
+		}
+		var s Subscription
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		s.User = user
+		var err error
+		if r.Method == http.MethodPost {
+			if !viewer.trusted && !h.site.acl.allows(s.Route, user, roles) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			err = h.notifier.subscribe(s)
+		} else {
+			err = h.notifier.unsubscribe(s)
+		}
+		if err != nil {
+			echo(Log{"t": "subscription", "user": user, "route": s.Route, "error": err.Error()})
+			http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(http.StatusBadRequest), err), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestSubscriptionValidation(t *testing.T) {
+	n := newNotifier(filepath.Join(t.TempDir(), "subscriptions.json"), SMTPConf{Addr: "mail.example.com:25"})
+	tests := []struct {
+		name string
+		sub  Subscription
+		ok   bool
+	}{
+		{"email", Subscription{Route: "/demo", Channel: emailChannel, Target: "ops@example.com", Frequency: hourlyFrequency}, true},
+		{"webhook", Subscription{Route: "/demo", Channel: webhookChannel, Target: "https://hooks.example.com/x", Frequency: immediateFrequency}, true},
+		{"header in route", Subscription{Route: "/demo\r\nBcc: all@example.com", Channel: emailChannel, Target: "ops@example.com", Frequency: hourlyFrequency}, false},
+		{"header in address", Subscription{Route: "/demo", Channel: emailChannel, Target: "ops@example.com\r\nBcc: all@example.com", Frequency: hourlyFrequency}, false},
+		{"not an address", Subscription{Route: "/demo", Channel: emailChannel, Target: "Ops <ops@example.com>", Frequency: hourlyFrequency}, false},
+		{"loopback webhook", Subscription{Route: "/demo", Channel: webhookChannel, Target: "http://127.0.0.1:10101/_admin", Frequency: immediateFrequency}, false},
+		{"localhost webhook", Subscription{Route: "/demo", Channel: webhookChannel, Target: "http://localhost/", Frequency: immediateFrequency}, false},
+		{"private webhook", Subscription{Route: "/demo", Channel: webhookChannel, Target: "http://10.1.2.3/", Frequency: immediateFrequency}, false},
+		{"link-local webhook", Subscription{Route: "/demo", Channel: webhookChannel, Target: "http://169.254.169.254/latest/meta-data", Frequency: immediateFrequency}, false},
+		{"ipv6 loopback webhook", Subscription{Route: "/demo", Channel: webhookChannel, Target: "http://[::1]/", Frequency: immediateFrequency}, false},
+		{"not a webhook URL", Subscription{Route: "/demo", Channel: webhookChannel, Target: "file:///etc/passwd", Frequency: immediateFrequency}, false},
+	}
+	for _, tc := range tests {
+		if err := n.validate(tc.sub); (err == nil) != tc.ok {
+			t.Errorf("%s: want ok=%v, got %v", tc.name, tc.ok, err)
+		}
+	}
+}
+
+func TestNotifierRefusesPrivateAddresses(t *testing.T) {
+	hit := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hit = true }))
+	defer srv.Close()
+	n := newNotifier(filepath.Join(t.TempDir(), "subscriptions.json"), SMTPConf{})
+	if err := n.sendWebhook(srv.URL, Digest{Route: "/demo"}); err == nil || hit {
+		t.Fatal("want webhook to a loopback address refused")
+	}
+}
+
+func TestNotifierOverflow(t *testing.T) {
+	n := newNotifier(filepath.Join(t.TempDir(), "subscriptions.json"), SMTPConf{})
+	s := Subscription{User: "u", Route: "/demo", Channel: webhookChannel, Target: "https://hooks.example.com/x", Frequency: immediateFrequency}
+	n.subs[s.key()] = s
+	for i := 0; i < notifyQueueSize+3; i++ { // no workers running, so the queue fills up
+		n.changed("/demo")
+	}
+	if len(n.queue) != notifyQueueSize {
+		t.Fatalf("want %d queued, got %d", notifyQueueSize, len(n.queue))
+	}
+	if d := n.pending[s.key()]; d == nil || d.Changes != 3 {
+		t.Fatalf("want 3 changes folded into the next digest, got %+v", d)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+)
+
+// CompactAOF restores a site from an AOF log file, or directory of rotated segments, and writes a compacted copy
+// of it to w, one entry per page. Expired pages are dropped.
+func CompactAOF(w io.Writer, path string, skipErrors bool) error {
+	site := newSite()
+	if err := initSite(site, path, skipErrors); err != nil {
+		return err
+	}
+	l := log.New(w, "", log.LstdFlags)
+	if err := writeAOFHeader(l, aofFormat); err != nil {
+		return err
+	}
+	now := clock.Now()
+	for _, url := range site.urls() {
+		page := site.pages[url]
+		if page.expired(now) {
+			continue
+		}
+		if data := page.snapshot(); data != nil {
+			l.Println(compactMarker, url, string(data))
+		}
+	}
+	return nil
+}
+
+// DumpAOF restores a site from an AOF log file, or directory of rotated segments, and writes its pages to w as a
+// JSON object keyed by page url, in the same format as the export job. Expired pages are dropped.
+func DumpAOF(w io.Writer, path string, skipErrors bool) error {
+	site := newSite()
+	if err := initSite(site, path, skipErrors); err != nil {
+		return err
+	}
+	now := clock.Now()
+	pages := make(map[string]json.RawMessage)
+	for _, url := range site.snapshotURLs() {
+		page := site.pages[url]
+		if page.expired(now) {
+			continue
+		}
+		if data := page.snapshot(); data != nil {
+			pages[url] = data
+		}
+	}
+	return json.NewEncoder(w).Encode(pages)
+}
+
+// LoadDump reads pages written by DumpAOF or the export job from r, and writes them to w as a compacted AOF log,
+// from which the server can be initialized.
+func LoadDump(w io.Writer, r io.Reader) error {
+	var pages map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&pages); err != nil {
+		return fmt.Errorf("failed reading site: %v", err)
+	}
+	urls := make([]string, 0, len(pages))
+	for url := range pages {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	site := newSite()
+	for _, url := range urls {
+		if err := site.set(url, pages[url], 0); err != nil {
+			return fmt.Errorf("page %s: %v", url, err)
+		}
+		if site.pages[url] == nil {
+			return fmt.Errorf("page %s: want {\"p\": {...}}", url)
+		}
+	}
+
+	l := log.New(w, "", log.LstdFlags)
+	if err := writeAOFHeader(l, aofFormat); err != nil {
+		return err
+	}
+	for _, url := range urls {
+		if data := site.pages[url].snapshot(); data != nil {
+			l.Println(compactMarker, url, string(data))
+		}
+	}
+	return nil
+}
@@ -64,6 +64,7 @@ type OIDCSession struct {
 	nonce      string
 	subject    string
 	username   string
+	roles      []string
 	successURL string
 	token      *oauth2.Token
 }
@@ -116,7 +117,7 @@ func (h *OIDCInitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	sessionID := uuid.New().String()
 
 	h.sessions.set(sessionID, OIDCSession{state: state, nonce: nonce, successURL: successURL})
-	expiration := time.Now().Add(365 * 24 * time.Hour)
+	expiration := clock.Now().Add(365 * 24 * time.Hour)
 	cookie := http.Cookie{Name: oidcSessionKey, Value: sessionID, Path: "/", Expires: expiration}
 	http.SetCookie(w, &cookie)
 	http.Redirect(w, r, h.oauth2Config.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
@@ -200,8 +201,10 @@ func (h *OAuth2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var claims struct {
-		PreferredUsername string `json:"preferred_username"`
-		Nonce             string `json:"nonce"`
+		PreferredUsername string   `json:"preferred_username"`
+		Nonce             string   `json:"nonce"`
+		Roles             []string `json:"roles"`
+		Groups            []string `json:"groups"`
 	}
 	err = idToken.Claims(&claims)
 	if err != nil {
@@ -222,6 +225,7 @@ func (h *OAuth2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	session.token = oauth2Token
 	session.subject = idToken.Subject
 	session.username = claims.PreferredUsername
+	session.roles = append(claims.Roles, claims.Groups...)
 
 	echo(Log{"t": "login", "subject": session.subject, "username": session.username})
 
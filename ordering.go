@@ -0,0 +1,75 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// How broadcasts to different pages are ordered.
+const (
+	// OrderTotal applies and broadcasts all page changes one at a time, by a single sequencer: every client,
+	// webhook and change listener sees changes to all pages in the same order, the order of their versions.
+	OrderTotal = "total"
+	// OrderPage applies changes to different pages in parallel. Changes to each page are still seen in
+	// order, but changes to different pages may be broadcast in a different order than they were made.
+	OrderPage = "page"
+)
+
+// routeLockStripes is the number of locks shared by pages under OrderPage.
+const routeLockStripes = 256
+
+// RouteLocks serializes changes to each page, with pages sharing a fixed number of locks.
+type RouteLocks struct {
+	stripes [routeLockStripes]sync.Mutex
+}
+
+func (ls *RouteLocks) of(route string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(route))
+	return &ls.stripes[h.Sum32()%routeLockStripes]
+}
+
+func validateOrdering(ordering string) error {
+	switch ordering {
+	case "", OrderTotal, OrderPage:
+		return nil
+	}
+	return fmt.Errorf("unknown broadcast ordering %q: want %s or %s", ordering, OrderTotal, OrderPage)
+}
+
+// lock blocks changes to route, and returns a function that unblocks them. Under OrderTotal, changes to
+// all pages are blocked. Under OrderPage, only changes to route are, unless the page is yet to be created:
+// creating pages is serialized in either mode, so that limits on the number of pages hold.
+// Operations spanning pages, such as compaction, lock pubMux for writing, to block changes to all pages.
+func (b *Broker) lock(route string) func() {
+	if b.ordering == OrderPage {
+		b.pubMux.RLock()
+		l := b.routeLocks.of(route)
+		l.Lock()
+		if b.site.has(route) { // checked under the page's lock, so it can't be deleted in the meantime
+			return func() {
+				l.Unlock()
+				b.pubMux.RUnlock()
+			}
+		}
+		l.Unlock()
+		b.pubMux.RUnlock()
+	}
+	b.pubMux.Lock()
+	return b.pubMux.Unlock
+}
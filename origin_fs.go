@@ -0,0 +1,175 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const originCacheTTL = 5 * time.Minute
+
+// newAssetFS returns a file system for serving web assets from either a local directory,
+// or a remote HTTP/S3-compatible origin if dir is an http:// or https:// URL.
+func newAssetFS(dir string) http.FileSystem {
+	if isOriginURL(dir) {
+		return newOriginFS(dir, originCacheTTL)
+	}
+	return http.Dir(dir)
+}
+
+func isOriginURL(dir string) bool {
+	return strings.HasPrefix(dir, "http://") || strings.HasPrefix(dir, "https://")
+}
+
+// joinAssetDir appends elem to a local directory path or origin URL.
+func joinAssetDir(dir, elem string) string {
+	if isOriginURL(dir) {
+		return strings.TrimSuffix(dir, "/") + "/" + elem
+	}
+	return filepath.Join(dir, elem)
+}
+
+// OriginFS is a read-only http.FileSystem backed by a remote HTTP origin,
+// typically an S3-compatible bucket (or CDN) that allows anonymous reads.
+// Fetched files are cached in memory for ttl; stale copies are served if the origin is unavailable.
+type OriginFS struct {
+	sync.RWMutex
+	origin string
+	ttl    time.Duration
+	client *http.Client
+	files  map[string]*OriginFile // path => file
+}
+
+// OriginFile represents a cached file fetched from an origin.
+type OriginFile struct {
+	name    string
+	data    []byte
+	modTime time.Time
+	fetched time.Time
+}
+
+func newOriginFS(origin string, ttl time.Duration) *OriginFS {
+	return &OriginFS{
+		origin: strings.TrimSuffix(origin, "/"),
+		ttl:    ttl,
+		client: &http.Client{Timeout: 30 * time.Second},
+		files:  make(map[string]*OriginFile),
+	}
+}
+
+// Open implements http.FileSystem.
+func (fs *OriginFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	if path.Ext(name) == "" { // origins have no directories; treat ext-less paths as such, so that index.html is served.
+		return &originDir{name}, nil
+	}
+
+	fs.RLock()
+	f, ok := fs.files[name]
+	fs.RUnlock()
+
+	if ok && since(f.fetched) < fs.ttl {
+		return newOriginReader(f), nil
+	}
+
+	fresh, err := fs.fetch(name)
+	if err != nil {
+		if ok { // serve stale
+			echo(Log{"t": "origin_fetch", "path": name, "error": err.Error(), "stale": "true"})
+			return newOriginReader(f), nil
+		}
+		return nil, err
+	}
+
+	fs.Lock()
+	fs.files[name] = fresh
+	fs.Unlock()
+
+	return newOriginReader(fresh), nil
+}
+
+func (fs *OriginFS) fetch(name string) (*OriginFile, error) {
+	resp, err := fs.client.Get(fs.origin + name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusForbidden: // S3 returns 403 for missing keys if listing is denied
+		return nil, os.ErrNotExist
+	default:
+		return nil, fmt.Errorf("origin returned %s for %s", resp.Status, name)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	modTime := clock.Now()
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		modTime = t
+	}
+
+	return &OriginFile{name, data, modTime, clock.Now()}, nil
+}
+
+// originReader implements http.File over a cached origin file.
+type originReader struct {
+	*bytes.Reader
+	f *OriginFile
+}
+
+func newOriginReader(f *OriginFile) *originReader {
+	return &originReader{bytes.NewReader(f.data), f}
+}
+
+func (r *originReader) Close() error                             { return nil }
+func (r *originReader) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+func (r *originReader) Stat() (os.FileInfo, error)               { return r, nil }
+func (r *originReader) Name() string                             { return path.Base(r.f.name) }
+func (r *originReader) Size() int64                              { return int64(len(r.f.data)) }
+func (r *originReader) Mode() os.FileMode                        { return 0444 }
+func (r *originReader) ModTime() time.Time                       { return r.f.modTime }
+func (r *originReader) IsDir() bool                              { return false }
+func (r *originReader) Sys() interface{}                         { return nil }
+
+// originDir implements http.File for a (virtual, empty) directory on an origin.
+type originDir struct {
+	name string
+}
+
+func (d *originDir) Close() error                             { return nil }
+func (d *originDir) Read([]byte) (int, error)                 { return 0, os.ErrInvalid }
+func (d *originDir) Seek(int64, int) (int64, error)           { return 0, os.ErrInvalid }
+func (d *originDir) Readdir(count int) ([]os.FileInfo, error) { return nil, nil }
+func (d *originDir) Stat() (os.FileInfo, error)               { return d, nil }
+func (d *originDir) Name() string                             { return path.Base(d.name) }
+func (d *originDir) Size() int64                              { return 0 }
+func (d *originDir) Mode() os.FileMode                        { return os.ModeDir | 0555 }
+func (d *originDir) ModTime() time.Time                       { return time.Time{} }
+func (d *originDir) IsDir() bool                              { return true }
+func (d *originDir) Sys() interface{}                         { return nil }
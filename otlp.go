@@ -0,0 +1,240 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultOTLPServiceName = "waved"
+	otlpBatchSize          = 512             // spans per export request
+	otlpQueueSize          = 4096            // spans waiting to be exported; more are dropped
+	otlpInterval           = 5 * time.Second // longest a span waits to be exported
+	otlpSpanKindInternal   = 1
+)
+
+// OTLPConf configures exporting trace spans to an OpenTelemetry collector, over OTLP/HTTP with JSON encoding.
+type OTLPConf struct {
+	URL         string // traces endpoint, e.g. http://otel-collector:4318/v1/traces; disabled if empty
+	ServiceName string // service.name resource attribute; "" = waved
+}
+
+func (c OTLPConf) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid OTLP URL %q: want http(s)://host/v1/traces", c.URL)
+	}
+	return nil
+}
+
+// OTLPTracer is a Tracer that exports completed spans to an OpenTelemetry collector, in batches.
+// Spans are dropped, and counted, if the collector falls behind or rejects them.
+type OTLPTracer struct {
+	url     string
+	service string
+	spans   chan *OTLPSpan
+	stop    chan struct{}
+	done    chan struct{}
+	client  *http.Client
+}
+
+func newOTLPTracer(conf OTLPConf) *OTLPTracer {
+	service := conf.ServiceName
+	if service == "" {
+		service = defaultOTLPServiceName
+	}
+	return &OTLPTracer{conf.URL, service, make(chan *OTLPSpan, otlpQueueSize), make(chan struct{}), make(chan struct{}), &http.Client{Timeout: 10 * time.Second}}
+}
+
+// OTLPSpan represents a span recorded by OTLPTracer.
+type OTLPSpan struct {
+	t      *OTLPTracer
+	name   string
+	tc     TraceContext
+	parent string
+	start  time.Time
+	end    time.Time
+	attrs  Log
+}
+
+// Start implements Tracer.
+func (t *OTLPTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, tc, parent := childTraceContext(ctx)
+	return ctx, &OTLPSpan{t: t, name: name, tc: tc, parent: parent, start: time.Now(), attrs: Log{}}
+}
+
+// SetAttr implements Span.
+func (s *OTLPSpan) SetAttr(k, v string) {
+	s.attrs[k] = v
+}
+
+// End implements Span.
+func (s *OTLPSpan) End() {
+	s.end = time.Now()
+	select {
+	case s.t.spans <- s:
+	default:
+		stats.spansDropped(1)
+	}
+}
+
+// run exports spans as batches fill up, or at least every otlpInterval, until flush is called.
+func (t *OTLPTracer) run() {
+	echo(Log{"t": "otlp", "url": t.url, "service": t.service})
+	defer close(t.done)
+	ticker := time.NewTicker(otlpInterval)
+	defer ticker.Stop()
+	var batch []*OTLPSpan
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			stats.spansDropped(len(batch))
+			echo(Log{"t": "otlp", "spans": strconv.Itoa(len(batch)), "error": err.Error()})
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) >= otlpBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					if batch = append(batch, s); len(batch) >= otlpBatchSize {
+						export()
+					}
+				default:
+					export()
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush exports the spans still queued, and stops run.
+func (t *OTLPTracer) flush() {
+	close(t.stop)
+	<-t.done
+}
+
+// OTLP/HTTP JSON payload: https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         int        `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string        `json:"key"`
+		Value otlpAttrValue `json:"value"`
+	}
+	otlpAttrValue struct {
+		String string `json:"stringValue"`
+	}
+)
+
+// encodeOTLP returns the OTLP request carrying spans.
+func encodeOTLP(service string, spans []*OTLPSpan) otlpRequest {
+	xs := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		x := otlpSpan{
+			TraceID:      s.tc.TraceID,
+			SpanID:       s.tc.SpanID,
+			ParentSpanID: s.parent,
+			Name:         s.name,
+			Kind:         otlpSpanKindInternal,
+			Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+			End:          strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		keys := make([]string, 0, len(s.attrs))
+		for k := range s.attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			x.Attributes = append(x.Attributes, otlpAttr{k, otlpAttrValue{s.attrs[k]}})
+		}
+		xs[i] = x
+	}
+	return otlpRequest{[]otlpResourceSpans{{
+		Resource:   otlpResource{[]otlpAttr{{"service.name", otlpAttrValue{service}}}},
+		ScopeSpans: []otlpScopeSpans{{otlpScope{"github.com/h2oai/wave"}, xs}},
+	}}}
+}
+
+// export sends spans to the collector.
+func (t *OTLPTracer) export(spans []*OTLPSpan) error {
+	b, err := json.Marshal(encodeOTLP(t.service, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "waved")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp: %s", resp.Status)
+	}
+	stats.spansExported(len(spans))
+	return nil
+}
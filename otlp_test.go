@@ -0,0 +1,100 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestOTLPExport(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		reqs []otlpRequest
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	otlp := newOTLPTracer(OTLPConf{URL: collector.URL + "/v1/traces", ServiceName: "test"})
+	go otlp.run()
+
+	producer := TraceContext{"0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331", "01"}
+	ctx, span := otlp.Start(WithTraceContext(context.Background(), producer), "http_patch")
+	span.SetAttr("route", "/demo")
+	_, child := otlp.Start(ctx, "site_patch")
+	child.End()
+	span.End()
+	otlp.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reqs) != 1 {
+		t.Fatalf("want 1 export, got %d", len(reqs))
+	}
+	rs := reqs[0].ResourceSpans
+	if len(rs) != 1 || len(rs[0].ScopeSpans) != 1 {
+		t.Fatalf("want 1 resource and scope, got %+v", rs)
+	}
+	if a := rs[0].Resource.Attributes; len(a) != 1 || a[0].Key != "service.name" || a[0].Value.String != "test" {
+		t.Fatalf("want service.name test, got %+v", a)
+	}
+	spans := rs[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("want 2 spans, got %d", len(spans))
+	}
+	c, p := spans[0], spans[1] // in the order they ended
+	if p.Name != "http_patch" || p.TraceID != producer.TraceID || p.ParentSpanID != producer.SpanID {
+		t.Fatalf("want http_patch continuing the producer's trace, got %+v", p)
+	}
+	if len(p.Attributes) != 1 || p.Attributes[0].Key != "route" || p.Attributes[0].Value.String != "/demo" {
+		t.Fatalf("want the route attribute, got %+v", p.Attributes)
+	}
+	if c.Name != "site_patch" || c.TraceID != producer.TraceID || c.ParentSpanID != p.SpanID {
+		t.Fatalf("want site_patch as a child of http_patch, got %+v", c)
+	}
+	if c.Start == "" || c.End < c.Start {
+		t.Fatalf("want start and end times, got %q, %q", c.Start, c.End)
+	}
+}
+
+func TestOTLPConfValidate(t *testing.T) {
+	for _, u := range []string{"", "http://otel-collector:4318/v1/traces", "https://otel.example.com/v1/traces"} {
+		if err := (OTLPConf{URL: u}).validate(); err != nil {
+			t.Errorf("%q: want ok, got %v", u, err)
+		}
+	}
+	for _, u := range []string{"otel-collector:4318", "grpc://otel-collector:4317", "http:///v1/traces"} {
+		if err := (OTLPConf{URL: u}).validate(); err == nil {
+			t.Errorf("%q: want error", u)
+		}
+	}
+}
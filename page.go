@@ -18,13 +18,21 @@ import (
 	"encoding/json"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Page represents a web page.
 type Page struct {
+	accessed int64 // unix time of the last access, in nanoseconds; first for 64-bit alignment of atomic access
 	sync.RWMutex
-	cards map[string]*Card
-	cache []byte
+	cards      map[string]*Card
+	cache      []byte
+	restricted map[string][]string   // card name => roles required to view the card
+	version    int64                 // sequence number of the last change; 0 if restored from the AOF
+	modified   time.Time             // time of the last change
+	ttl        time.Duration         // delete the page once unchanged for this long; 0 if forever
+	writers    map[string]CardWriter // card name => last writer, if known
+	undo       []Undo                // changes to recent versions, oldest first, for diffs
 }
 
 func newPage() *Page {
@@ -74,10 +82,31 @@ func (p *Page) marshal() []byte {
 	return cache
 }
 
+// marshalCard marshals a single card; ok is false if the page has no such card.
+func (p *Page) marshalCard(name string) (data []byte, ok bool) {
+	p.RLock()
+	card, ok := p.cards[name]
+	if !ok {
+		p.RUnlock()
+		return nil, false
+	}
+	d := card.dump()
+	p.RUnlock()
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		echo(Log{"t": "card_marshal", "error": err.Error()})
+		return nil, true
+	}
+	return data, true
+}
+
 func loadPage(ns *Namespace, d *PageD) *Page {
 	cards := make(map[string]*Card)
 	for k, v := range d.C {
 		cards[k] = loadCard(ns, v)
 	}
-	return &Page{cards: cards}
+	p := &Page{cards: cards}
+	p.restrict()
+	return p
 }
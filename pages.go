@@ -0,0 +1,127 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageListLimit = 100
+	maxPageListLimit     = 1000
+)
+
+// PageInfo represents a summary of a page.
+type PageInfo struct {
+	URL      string    `json:"url"`
+	Cards    int       `json:"cards"`
+	Version  int64     `json:"version"`
+	Modified time.Time `json:"modified"`
+}
+
+// PageList represents a page of results from a page listing.
+type PageList struct {
+	Pages []PageInfo `json:"pages"`
+	Next  string     `json:"next,omitempty"` // pass as ?after= to fetch the next page of results
+}
+
+// info returns a summary of the page at url, or false if there is no such page.
+func (site *Site) info(url string) (PageInfo, bool) {
+	site.RLock()
+	e, evicted := site.evicted[url]
+	site.RUnlock()
+	if evicted {
+		return PageInfo{url, e.cards, e.version, e.modified}, true
+	}
+	p := site.resident(url)
+	if p == nil {
+		return PageInfo{}, false
+	}
+	p.RLock()
+	defer p.RUnlock()
+	return PageInfo{url, len(p.cards), p.version, p.modified}, true
+}
+
+// PageListHandler lists pages: GET /_api/pages?prefix=/foo&after=/foo/bar&limit=100.
+// Results are sorted by url. Callers see only the pages they are allowed to read.
+type PageListHandler struct {
+	site *Site
+	auth *Auth
+}
+
+func newPageListHandler(site *Site, auth *Auth) *PageListHandler {
+	return &PageListHandler{site, auth}
+}
+
+func (h *PageListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	viewer, ok := h.auth.identify(r)
+	if !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	prefix, after := q.Get("prefix"), q.Get("after")
+	if prefix == "" {
+		prefix = "/"
+	}
+	limit := defaultPageListLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if n > maxPageListLimit {
+			n = maxPageListLimit
+		}
+		limit = n
+	}
+
+	urls := h.site.urlsUnder(prefix)
+	i := sort.SearchStrings(urls, after)
+	if i < len(urls) && urls[i] == after {
+		i++
+	}
+	list := PageList{Pages: []PageInfo{}}
+	for ; i < len(urls); i++ {
+		if r.Context().Err() != nil { // client went away
+			return
+		}
+		url := urls[i]
+		if !viewer.trusted && !h.site.acl.allows(url, viewer.username, viewer.roles) {
+			continue
+		}
+		if len(list.Pages) == limit {
+			list.Next = list.Pages[limit-1].URL
+			break
+		}
+		if info, ok := h.site.info(url); ok {
+			list.Pages = append(list.Pages, info)
+		}
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import "fmt"
+
+// Profiles tune memory-related defaults for the hardware the server runs on.
+const (
+	DefaultProfile  = "default"
+	EmbeddedProfile = "embedded" // Raspberry Pi-class devices: small buffers, little history, pages spilled to disk early
+)
+
+// Footprint caps the memory retained per route, page and connection. Zero values use the profile's defaults.
+// History and diffs can be disabled with -1, in which case reconnecting clients are sent full pages,
+// and diffs are only available against a page's current version.
+type Footprint struct {
+	HistorySize      int // messages retained per route, so that reconnecting clients can catch up; -1 = none
+	HistoryBytes     int // bytes retained per route
+	UndoDepth        int // past versions retained per page, for diffs; -1 = none
+	SocketBufferSize int // websocket read and write buffer size, in bytes
+}
+
+var (
+	defaultFootprint  = Footprint{HistorySize: 128, HistoryBytes: 1 << 20, UndoDepth: 32, SocketBufferSize: 1024}
+	embeddedFootprint = Footprint{HistorySize: 16, HistoryBytes: 64 << 10, UndoDepth: 4, SocketBufferSize: 512}
+)
+
+const (
+	embeddedQueueSize     = 32       // max messages queued per websocket client
+	embeddedMaxCacheBytes = 32 << 20 // pages beyond this size are spilled to disk
+)
+
+// withProfile fills in settings left unset with the profile's defaults.
+// Note that no profile relies on memory-mapped files: persistence only uses regular file I/O,
+// so the server runs on file systems and kernels without mmap support.
+func (c ServerConf) withProfile() (ServerConf, error) {
+	fp := defaultFootprint
+	switch c.Profile {
+	case "", DefaultProfile:
+	case EmbeddedProfile:
+		fp = embeddedFootprint
+		if c.Backpressure.QueueSize <= 0 {
+			c.Backpressure.QueueSize = embeddedQueueSize
+		}
+		if c.MaxCacheBytes == 0 {
+			c.MaxCacheBytes = embeddedMaxCacheBytes
+		}
+	default:
+		return c, fmt.Errorf("unknown profile %q: want %s or %s", c.Profile, DefaultProfile, EmbeddedProfile)
+	}
+	f := &c.Footprint
+	if f.HistorySize == 0 {
+		f.HistorySize = fp.HistorySize
+	}
+	if f.HistoryBytes <= 0 {
+		f.HistoryBytes = fp.HistoryBytes
+	}
+	if f.UndoDepth == 0 {
+		f.UndoDepth = fp.UndoDepth
+	}
+	if f.SocketBufferSize <= 0 {
+		f.SocketBufferSize = fp.SocketBufferSize
+	}
+	return c, nil
+}
+
+func max0(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
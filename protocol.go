@@ -14,12 +14,23 @@
 
 package wave
 
+import (
+	"encoding/json"
+	"time"
+)
+
 // OpsD represents the set of changes to be applied to a Page. This is a discriminated union.
 type OpsD struct {
 	P *PageD                 `json:"p,omitempty"` // page
 	C map[string]interface{} `json:"c,omitempty"` // FIXME comment - is this required?
 	D []OpD                  `json:"d,omitempty"` // deltas
 	R int                    `json:"r,omitempty"` // reset
+	U string                 `json:"u,omitempty"` // redirect: websocket address of the primary server
+	S int64                  `json:"s,omitempty"` // sequence number
+	A []*Annotation          `json:"a,omitempty"` // annotations added, updated or deleted
+	T int                    `json:"t,omitempty"` // time-to-live, in seconds since the last change; negative clears
+	L int                    `json:"l,omitempty"` // reload: web assets changed (dev mode)
+	X *Command               `json:"x,omitempty"` // command: an action for the UI to take
 }
 
 // OpD represents a delta operation (effector)
@@ -77,6 +88,18 @@ type CycBufD struct {
 type AppRequest struct {
 	RegisterApp   *RegisterApp   `json:"register_app,omitempty"`
 	UnregisterApp *UnregisterApp `json:"unregister_app,omitempty"`
+	SetPrimary    *SetPrimary    `json:"set_primary,omitempty"`
+	SetACL        *SetACL        `json:"set_acl,omitempty"`
+	SetApproval   *SetApproval   `json:"set_approval,omitempty"`
+	ListPending   *ListPending   `json:"list_pending,omitempty"`
+	ApprovePatch  *ApprovePatch  `json:"approve_patch,omitempty"`
+	RejectPatch   *RejectPatch   `json:"reject_patch,omitempty"`
+	PublishDraft  *PublishDraft  `json:"publish_draft,omitempty"`
+	DeletePages   *DeletePages   `json:"delete_pages,omitempty"`
+	GetJob        *GetJob        `json:"get_job,omitempty"`
+	ListJobs      *ListJobs      `json:"list_jobs,omitempty"`
+	StartJob      *StartJob      `json:"start_job,omitempty"`
+	ImportGrafana *ImportGrafana `json:"import_grafana,omitempty"`
 }
 
 // RegisterApp represents a request to register an app.
@@ -90,3 +113,91 @@ type RegisterApp struct {
 type UnregisterApp struct {
 	Route string `json:"route"`
 }
+
+// SetACL represents a request to restrict read access to a page or path prefix.
+// If both users and roles are empty, the restriction is lifted.
+type SetACL struct {
+	Route string   `json:"route"`
+	Users []string `json:"users"`
+	Roles []string `json:"roles"`
+}
+
+// SetApproval represents a request to require (or stop requiring) approval for patches to a route prefix.
+type SetApproval struct {
+	Route    string `json:"route"`
+	Required bool   `json:"required"`
+}
+
+// ListPending represents a request to list patches pending approval.
+type ListPending struct{}
+
+// ApprovePatch represents a request to apply a pending patch.
+type ApprovePatch struct {
+	ID string `json:"id"`
+}
+
+// RejectPatch represents a request to discard a pending patch.
+type RejectPatch struct {
+	ID string `json:"id"`
+}
+
+// PendingResponse represents the response to a patch queued for approval.
+type PendingResponse struct {
+	ID string `json:"pending"`
+}
+
+// RevertResponse represents the response to a patch that will be undone later.
+type RevertResponse struct {
+	ID       string    `json:"revert"` // ID of the undoing patch, which can be canceled with DELETE /_schedule?id=
+	RevertAt time.Time `json:"revert_at"`
+}
+
+// ScheduledResponse represents the response to a patch scheduled to be applied later.
+type ScheduledResponse struct {
+	ID      string    `json:"scheduled"`
+	ApplyAt time.Time `json:"apply_at"`
+}
+
+// PublishDraft represents a request to replace a page with its draft.
+// The draft of the page at /foo is the page at /_draft/foo. If the page requires approval, the
+// replacement is held for approval like a patch, and the response is a PendingResponse.
+type PublishDraft struct {
+	Route string `json:"route"`
+}
+
+// DeletePages represents a request to delete all pages at or below a route prefix, asynchronously.
+type DeletePages struct {
+	Prefix string `json:"prefix"`
+}
+
+// GetJob represents a request for the status of a job.
+type GetJob struct {
+	ID string `json:"id"`
+}
+
+// ListJobs represents a request for the status of all running and recently finished jobs.
+type ListJobs struct{}
+
+// StartJob represents a request to start a built-in job: "compact", "export", "gc" or, if archiving is configured, "archive".
+type StartJob struct {
+	Kind string `json:"kind"`
+}
+
+// JobResponse represents the response to a request that started a job.
+type JobResponse struct {
+	ID string `json:"job"`
+}
+
+// ImportGrafana represents a request to replace the page at a route with a conversion of a Grafana dashboard.
+// If a Prometheus base URL is provided, stat panels backed by Prometheus queries are kept up to date.
+type ImportGrafana struct {
+	Route      string          `json:"route"`
+	Dashboard  json.RawMessage `json:"dashboard"`  // dashboard JSON model
+	Prometheus string          `json:"prometheus"` // e.g. http://localhost:9090
+}
+
+// SetPrimary represents a request to redirect clients to a primary server (failover).
+// An empty address stops redirection.
+type SetPrimary struct {
+	Address string `json:"address"`
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// PublishRequest represents a patch sent over a publishing socket.
+type PublishRequest struct {
+	ID      string          `json:"id,omitempty"` // echoed in the acknowledgement
+	Route   string          `json:"route"`
+	Data    json.RawMessage `json:"data"`              // patch, as accepted by PATCH
+	Version *int64          `json:"version,omitempty"` // apply only if the page is at this version (0 = must not exist)
+}
+
+// PublishAck acknowledges a PublishRequest.
+type PublishAck struct {
+	ID      string `json:"id,omitempty"`
+	Version int64  `json:"version,omitempty"` // page version once applied
+	Pending string `json:"pending,omitempty"` // ID of the patch queued for approval
+	Error   string `json:"error,omitempty"`
+}
+
+const (
+	publishReadBufferSize  = 64 * 1024
+	publishWriteBufferSize = 4 * 1024
+)
+
+// PublishHandler accepts a websocket over which producers send patches, one JSON object per line, and
+// receives an acknowledgement for each, with the page version it produced. Patches are applied in order
+// as they arrive; all acknowledgements for a frame are sent together in a single frame.
+// Unlike the streaming publish request, producers learn of each outcome while the connection stays open.
+type PublishHandler struct {
+	broker   *Broker
+	auth     *Auth
+	limiter  *RequestLimiter
+	upgrader *websocket.Upgrader
+}
+
+func newPublishHandler(broker *Broker, auth *Auth, limiter *RequestLimiter, checkOrigin func(*http.Request) bool) *PublishHandler {
+	upgrader := &websocket.Upgrader{ReadBufferSize: publishReadBufferSize, WriteBufferSize: publishWriteBufferSize, CheckOrigin: checkOrigin}
+	return &PublishHandler{broker, auth, limiter, upgrader}
+}
+
+func (h *PublishHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, ok := h.auth.trusted(r)
+	if !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	wire, err := wireVersionOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		echo(Log{"t": "publish_upgrade", "error": err.Error()})
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxStreamLine)
+
+	ctx := withWriter(withRemote(extractTraceContext(r), getRemoteAddr(r)), username, "publish")
+	applied, failed := 0, 0
+	var acks bytes.Buffer
+	enc := json.NewEncoder(&acks)
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		acks.Reset()
+		for _, line := range bytes.Split(msg, newline) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			ack := h.publish(ctx, username, line, wire)
+			if ack.Error != "" {
+				failed++
+			} else {
+				applied++
+			}
+			enc.Encode(ack)
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, bytes.TrimSuffix(acks.Bytes(), newline)); err != nil {
+			break
+		}
+	}
+	echo(Log{"t": "publish", "remote": getRemoteAddr(r), "applied": strconv.Itoa(applied), "failed": strconv.Itoa(failed)})
+}
+
+func (h *PublishHandler) publish(ctx context.Context, username string, line []byte, wire int) PublishAck {
+	var q PublishRequest
+	if err := json.Unmarshal(line, &q); err != nil {
+		return PublishAck{Error: err.Error()}
+	}
+	if q.Route == "" || len(q.Data) == 0 {
+		return PublishAck{ID: q.ID, Error: "want route and data"}
+	}
+	data, err := upgradePatch(q.Data, wire)
+	if err != nil {
+		return PublishAck{ID: q.ID, Error: err.Error()}
+	}
+	if ok, wait := h.limiter.allowKey(username); !ok {
+		return PublishAck{ID: q.ID, Error: errRateLimited(wait).Error()}
+	}
+	want := int64(-1)
+	if q.Version != nil {
+		want = *q.Version
+	}
+	id, version, err := h.broker.publishIf(ctx, q.Route, data, want)
+	if err != nil {
+		return PublishAck{ID: q.ID, Error: err.Error()}
+	}
+	return PublishAck{ID: q.ID, Version: version, Pending: id}
+}
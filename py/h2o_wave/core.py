@@ -18,6 +18,7 @@ import logging
 import os
 import os.path
 import sys
+from urllib.parse import quote
 from typing import List, Dict, Union, Tuple, Any, Optional
 
 import httpx
@@ -443,6 +444,7 @@ class PageBase:
     def __init__(self, url: str):
         self.url = url
         self._changes = []
+        self._ttl: Optional[int] = None
 
     def add(self, key: str, card: Any) -> Ref:
         """
@@ -492,12 +494,26 @@ class PageBase:
         self._changes.append(op)
 
     def _diff(self):
-        if len(self._changes) == 0:
+        if len(self._changes) == 0 and self._ttl is None:
             return None
-        d = marshal(dict(d=self._changes))
+        p = dict(d=self._changes)
+        if self._ttl is not None:
+            p['t'] = self._ttl
+            self._ttl = None
+        d = marshal(p)
         self._changes.clear()
         return d
 
+    def expire(self, ttl: int):
+        """
+        Delete this page from the remote site once it has not been changed for the given number of seconds.
+        Takes effect on the next save.
+
+        Args:
+            ttl: The time-to-live, in seconds. Use 0 to keep the page forever.
+        """
+        self._ttl = ttl if ttl > 0 else -1
+
     def drop(self):
         """
         Delete this page from the remote site. Same as ``del site[url]``.
@@ -538,6 +554,18 @@ class Page(PageBase):
         """
         return self.site.load(self.url)
 
+    def load_card(self, name: str) -> dict:
+        """
+        Retrieve the serialized form of a single card on this page from the remote site.
+
+        Args:
+            name: The name of the card.
+
+        Returns:
+            The serialized form of the card
+        """
+        return self.site.load(f'{self.url}?card={quote(name)}')
+
     def sync(self):
         """
         DEPRECATED: Use `h2o_wave.core.Page.save` instead.
@@ -578,6 +606,18 @@ class AsyncPage(PageBase):
         """
         return await self.site.load(self.url)
 
+    async def load_card(self, name: str) -> dict:
+        """
+        Retrieve the serialized form of a single card on this page from the remote site.
+
+        Args:
+            name: The name of the card.
+
+        Returns:
+            The serialized form of the card
+        """
+        return await self.site.load(f'{self.url}?card={quote(name)}')
+
     async def push(self):
         """
         DEPRECATED: Use `h2o_wave.core.AsyncPage.save` instead.
@@ -0,0 +1,122 @@
+# Copyright 2020 H2O.ai, Inc.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# Checks this SDK's patch encoding against the server's golden wire fixtures (GET/POST /_contract).
+# Requires a running server; set H2O_WAVE_ADDRESS to point to it.
+
+import os
+import sys
+import json
+import httpx
+from h2o_wave import data
+from h2o_wave.core import PageBase
+
+encoders = {}
+
+
+def encodes(f):
+    encoders[f.__name__] = f
+    return f
+
+
+@encodes
+def add_card(page: PageBase):
+    page.add('c', dict(view='markdown', box='1 1 2 2', title='Hello', content='World'))
+
+
+@encodes
+def set_attr(page: PageBase):
+    c = page.add('c', dict(view='markdown', title='Hello'))
+    c.title = 'Hi'
+    c.content = '*new*'
+
+
+@encodes
+def set_nested(page: PageBase):
+    c = page.add('c', dict(view='list', items=[dict(label='a'), dict(label='b')], extra=dict(x=1)))
+    c.items[1].label = 'B'
+    c.extra.x = 2
+
+
+@encodes
+def delete_attr(page: PageBase):
+    c = page.add('c', dict(view='markdown', title='Hello', content='World'))
+    c.content = None
+
+
+@encodes
+def delete_card(page: PageBase):
+    page.add('a', dict(view='markdown'))
+    page.add('b', dict(view='markdown'))
+    del page['a']
+
+
+@encodes
+def drop_page(page: PageBase):
+    page.add('a', dict(view='markdown'))
+    page.drop()
+    page.add('b', dict(view='markdown'))
+
+
+@encodes
+def fixed_buffer(page: PageBase):
+    page.add('c', dict(view='plot', data=data('x y', 3, rows=[[1, 2], [3, 4], [5, 6]])))
+
+
+@encodes
+def fixed_buffer_set(page: PageBase):
+    c = page.add('c', dict(view='plot', data=data('x y', 2, rows=[[1, 2], [3, 4]])))
+    c.data[0] = [7, 8]
+    c.data[1].y = 0
+
+
+@encodes
+def cyclic_buffer(page: PageBase):
+    c = page.add('c', dict(view='plot', data=data('x y', -2, rows=[[1, 2], [3, 4]])))
+    c.data[-1] = [5, 6]
+
+
+@encodes
+def map_buffer(page: PageBase):
+    c = page.add('c', dict(view='plot', data=data('x y', rows=dict(a=[1, 2]))))
+    c.data.b = [3, 4]
+    c.data.a.y = 9
+
+
+def main():
+    address = os.environ.get('H2O_WAVE_ADDRESS', 'http://127.0.0.1:10101')
+    fixtures = httpx.get(f'{address}/_contract').json()
+    failed = 0
+    for fixture in fixtures:
+        name = fixture['name']
+        encode = encoders.get(name)
+        if encode is None:
+            print(f'{name}: no encoder')
+            failed += 1
+            continue
+        page = PageBase('/')
+        encode(page)
+        patch = json.loads(page._diff())
+        result = httpx.post(f'{address}/_contract', json=dict(fixture=name, patch=patch)).json()
+        if result['ok']:
+            print(f'{name}: ok')
+        else:
+            failed += 1
+            print(f'{name}: FAIL')
+            print('  expected:', json.dumps(result.get('expected')))
+            print('  actual:  ', json.dumps(result.get('actual')), result.get('error', ''))
+    sys.exit(1 if failed else 0)
+
+
+main()
@@ -0,0 +1,199 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bucketSweepEvery is how often idle token buckets are discarded.
+const bucketSweepEvery = time.Minute
+
+// RateLimit represents a token bucket: requests are admitted at Rate per second on average, and up to Burst at once.
+type RateLimit struct {
+	Rate  float64 // requests per second; 0 = unlimited
+	Burst int     // max requests at once; defaults to Rate, rounded up
+}
+
+// RateLimits represents the rate limits applied to incoming requests.
+type RateLimits struct {
+	Writes      RateLimit // page writes, per verified access key or signed-in websocket user, else per client IP address
+	Connections RateLimit // websocket connection attempts, per client IP address
+	Posts       RateLimit // API requests (POST), per client IP address
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// RateLimiter tracks a token bucket per key, e.g. an access key or an IP address.
+type RateLimiter struct {
+	sync.Mutex
+	limit   RateLimit
+	burst   float64
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newRateLimiter(limit RateLimit) *RateLimiter {
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+	return &RateLimiter{sync.Mutex{}, limit, burst, make(map[string]*bucket), clock.Now()}
+}
+
+// allow takes a token from key's bucket; if none is left, returns false and how long until one is available.
+func (rl *RateLimiter) allow(key string) (bool, time.Duration) {
+	if rl.limit.Rate <= 0 {
+		return true, 0
+	}
+	now := clock.Now()
+	rl.Lock()
+	defer rl.Unlock()
+	if now.Sub(rl.swept) >= bucketSweepEvery {
+		rl.sweep(now)
+	}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{rl.burst, now}
+		rl.buckets[key] = b
+	} else {
+		b.tokens = rl.refill(b, now)
+		b.at = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (rl *RateLimiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(rl.burst, b.tokens+now.Sub(b.at).Seconds()*rl.limit.Rate)
+}
+
+// sweep discards full buckets, which are no different from new ones.
+func (rl *RateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if rl.refill(b, now) >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.swept = now
+}
+
+// RequestLimiter applies rate limits to incoming requests. One limiter is shared by all listeners, so that
+// clients can't multiply their allowance by spreading requests across addresses.
+// Page writes are charged by the handlers applying them, once credentials have been verified.
+type RequestLimiter struct {
+	writes      *RateLimiter
+	connections *RateLimiter
+	posts       *RateLimiter
+}
+
+func newRequestLimiter(limits RateLimits) *RequestLimiter {
+	return &RequestLimiter{newRateLimiter(limits.Writes), newRateLimiter(limits.Connections), newRateLimiter(limits.Posts)}
+}
+
+// wrap rejects requests that exceed the connection and API rate limits with 429 Too Many Requests.
+func (l *RequestLimiter) wrap(h http.Handler) http.Handler {
+	connections, posts := l.connections, l.posts
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			rl  *RateLimiter
+			key string
+		)
+		switch {
+		case r.Method == http.MethodPost:
+			rl, key = posts, originOf(getRemoteAddr(r))
+		case strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+			rl, key = connections, originOf(getRemoteAddr(r))
+		}
+		if rl != nil {
+			if ok, wait := rl.allow(key); !ok {
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowWrite charges a page write to the access key a request was verified to authenticate with, or, if
+// key is empty, to the client's IP address, so that unverified credentials can't drain a key's allowance.
+// Rejects the request with 429 Too Many Requests if over the limit.
+func (l *RequestLimiter) allowWrite(w http.ResponseWriter, r *http.Request, key string) bool {
+	bucket := "key:" + key
+	if key == "" {
+		bucket = "ip:" + originOf(getRemoteAddr(r))
+	}
+	if ok, wait := l.writes.allow(bucket); !ok {
+		tooManyRequests(w, wait)
+		return false
+	}
+	return true
+}
+
+// allowKey charges a page write to a verified access key; if the key is over its limit, returns false and
+// how long until it isn't. For writes carried by long-lived requests, which are charged one patch at a time.
+func (l *RequestLimiter) allowKey(key string) (bool, time.Duration) {
+	ok, wait := l.writes.allow("key:" + key)
+	if !ok {
+		stats.requestLimited()
+	}
+	return ok, wait
+}
+
+// allowClient charges a page write made over a websocket to the client's signed-in user, else to its
+// IP address; if over the limit, returns false and how long until it isn't.
+func (l *RequestLimiter) allowClient(username, addr string) (bool, time.Duration) {
+	bucket := "user:" + username
+	if username == "" || username == "default-user" {
+		bucket = "ip:" + originOf(addr)
+	}
+	ok, wait := l.writes.allow(bucket)
+	if !ok {
+		stats.requestLimited()
+	}
+	return ok, wait
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	stats.requestLimited()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// errRateLimited returns the error reported for a patch refused by a rate limit.
+func errRateLimited(wait time.Duration) error {
+	return fmt.Errorf("%s: retry after %ds", strings.ToLower(http.StatusText(http.StatusTooManyRequests)), int(math.Ceil(wait.Seconds())))
+}
+
+// originOf returns the IP address in a remote address.
+func originOf(addr string) string {
+	if host, _, err := net.SplitHostPort(strings.TrimSpace(addr)); err == nil {
+		return host
+	}
+	return strings.TrimSpace(addr)
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRequestLimiterSharedAcrossListeners(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	limiter := newRequestLimiter(RateLimits{Posts: RateLimit{Rate: 0.001, Burst: 2}})
+	public, internal := limiter.wrap(ok), limiter.wrap(ok)
+
+	post := func(h http.Handler) int {
+		r := httptest.NewRequest(http.MethodPost, "/demo", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := post(public); code != http.StatusOK {
+		t.Fatalf("first request: got %d", code)
+	}
+	if code := post(internal); code != http.StatusOK {
+		t.Fatalf("second request, on another listener: got %d", code)
+	}
+	for _, h := range []http.Handler{public, internal} {
+		if code := post(h); code != http.StatusTooManyRequests {
+			t.Fatalf("request beyond the burst: got %d, want %d", code, http.StatusTooManyRequests)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/demo", nil)
+	w := httptest.NewRecorder()
+	public.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reads are not limited: got %d", w.Code)
+	}
+}
+
+func TestAllowWriteOnceVerified(t *testing.T) {
+	limiter := newRequestLimiter(RateLimits{Writes: RateLimit{Rate: 0.001, Burst: 1}})
+	write := func(key string) int {
+		r := httptest.NewRequest(http.MethodPatch, "/demo", nil)
+		r.SetBasicAuth("alice", "wrong")
+		w := httptest.NewRecorder()
+		if limiter.allowWrite(w, r, key) {
+			return http.StatusOK
+		}
+		return w.Code
+	}
+	if code := write(""); code != http.StatusOK {
+		t.Fatalf("first unverified write: got %d", code)
+	}
+	if code := write(""); code != http.StatusTooManyRequests {
+		t.Fatalf("unverified write beyond the burst: got %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := write("alice"); code != http.StatusOK {
+		t.Fatalf("verified write after unverified ones claiming the same key: got %d", code)
+	}
+	if ok, _ := limiter.allowKey("alice"); ok {
+		t.Fatal("streamed write beyond the key's burst: allowed")
+	}
+	if ok, _ := limiter.allowKey("bob"); !ok {
+		t.Fatal("streamed write for another key: refused")
+	}
+}
+
+// socketPatches sends patches over a client's websocket, one per route, and returns once the client has read
+// them all and disconnected.
+func socketPatches(t *testing.T, b *Broker, limiter *RequestLimiter, routes ...string) {
+	t.Helper()
+	b.start()
+	defer b.stop()
+	c, conn, _ := slowClient(t, b)
+	c.limiter = limiter
+	done := make(chan struct{})
+	go func() {
+		c.listen()
+		close(done)
+	}()
+	for _, route := range routes {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("* "+route+" "+testPatch)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+	<-done
+}
+
+func TestSocketPatchesLimited(t *testing.T) {
+	b := newTestBroker(t, Backpressure{})
+	socketPatches(t, b, newRequestLimiter(RateLimits{Writes: RateLimit{Rate: 0.001, Burst: 2}}), "/a", "/b", "/c")
+	for route, want := range map[string]bool{"/a": true, "/b": true, "/c": false} {
+		if got := b.site.at(route) != nil; got != want {
+			t.Errorf("%s: patched %v, want %v", route, got, want)
+		}
+	}
+}
+
+func TestAllowClient(t *testing.T) {
+	limiter := newRequestLimiter(RateLimits{Writes: RateLimit{Rate: 0.001, Burst: 1}})
+	for _, c := range []struct {
+		username, addr string
+		ok             bool
+	}{
+		{"default-user", "10.0.0.1:5000", true},
+		{"default-user", "10.0.0.1:5001", false}, // same address
+		{"default-user", "10.0.0.2:5000", true},
+		{"alice", "10.0.0.1:5000", true}, // signed in
+		{"alice", "10.0.0.3:5000", false},
+	} {
+		if ok, _ := limiter.allowClient(c.username, c.addr); ok != c.ok {
+			t.Errorf("allowClient(%q, %q) = %v, want %v", c.username, c.addr, ok, c.ok)
+		}
+	}
+}
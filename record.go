@@ -0,0 +1,137 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RecordedPatch represents a line of a recording: a patch, as accepted by /_stream, stamped with the time it was applied.
+type RecordedPatch struct {
+	Time  time.Time       `json:"time"`
+	Route string          `json:"route"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// Recorder writes every patch applied to the site to a file, one JSON object per line, for timed replay.
+// System pages are not recorded.
+type Recorder struct {
+	sync.Mutex
+	w *bufio.Writer
+	f *os.File
+}
+
+var recorder *Recorder // nil unless recording
+
+func newRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{w: bufio.NewWriter(f), f: f}, nil
+}
+
+func (r *Recorder) record(route string, data []byte) {
+	if isPathPrefix(systemPrefix, route) {
+		return
+	}
+	b, err := json.Marshal(RecordedPatch{clock.Now(), route, data})
+	if err != nil {
+		echo(Log{"t": "record", "route": route, "error": err.Error()})
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.f == nil { // closed
+		return
+	}
+	r.w.Write(b)
+	r.w.WriteByte('\n')
+	if err := r.w.Flush(); err != nil {
+		echo(Log{"t": "record", "route": route, "error": err.Error()})
+	}
+}
+
+// close closes the recording; patches applied afterwards are not recorded.
+func (r *Recorder) close() {
+	r.Lock()
+	defer r.Unlock()
+	if r.f != nil {
+		r.w.Flush()
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+// immediately is always ready to receive from.
+var immediately = func() <-chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
+
+// replayRecording applies a recording through the broker, preserving the time between patches, divided by speed.
+// A speed of 0 replays as fast as possible. Replay ends early if the broker stops.
+func (b *Broker) replayRecording(path string, speed float64) {
+	f, err := os.Open(path)
+	if err != nil {
+		echo(Log{"t": "replay", "error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	echo(Log{"t": "replay_start", "file": path, "speed": strconv.FormatFloat(speed, 'g', -1, 64)})
+	ctx := withWriter(context.Background(), "", "replay")
+	r := bufio.NewReaderSize(f, 64*1024)
+	var last time.Time
+	line, applied := 0, 0
+	for {
+		s, err := r.ReadBytes('\n')
+		if len(s) > 0 {
+			line++
+			var p RecordedPatch
+			if jerr := json.Unmarshal(s, &p); jerr != nil || p.Route == "" || len(p.Data) == 0 {
+				echo(Log{"t": "replay", "file": path, "line": strconv.Itoa(line), "error": "want time, route and data"})
+			} else {
+				var wait <-chan time.Time
+				if speed > 0 && !last.IsZero() && p.Time.After(last) {
+					wait = clock.After(time.Duration(float64(p.Time.Sub(last)) / speed))
+				} else {
+					wait = immediately
+				}
+				select {
+				case <-wait:
+				case <-b.quit: // the server is stopping
+					echo(Log{"t": "replay_stopped", "file": path, "read": strconv.Itoa(line), "applied": strconv.Itoa(applied)})
+					return
+				}
+				last = p.Time
+				if _, perr := b.patchIf(ctx, p.Route, p.Data, -1); perr == nil {
+					applied++
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	echo(Log{"t": "replay_end", "file": path, "read": strconv.Itoa(line), "applied": strconv.Itoa(applied)})
+}
@@ -0,0 +1,300 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultRemoteWriteInterval = 15 * time.Second
+
+var metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// RemoteWriteConf configures pushing card values to a Prometheus remote-write endpoint,
+// so that KPIs maintained on dashboards can feed alerting.
+type RemoteWriteConf struct {
+	URL      string        // e.g. http://prometheus:9090/api/v1/write; disabled if empty
+	Username string        // basic auth, if set
+	Password string        // basic auth password
+	Interval time.Duration // how often to push; 0 = 15s
+	Metrics  []string      // cards to export, as "name=/route#card" or "name=/route#card.attr"; attr defaults to value
+}
+
+func (c RemoteWriteConf) validate() error {
+	if c.URL == "" {
+		if len(c.Metrics) > 0 {
+			return fmt.Errorf("remote-write metrics require a remote-write URL")
+		}
+		return nil
+	}
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid remote-write URL %q: want http(s)://host/path", c.URL)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("remote-write interval must not be negative")
+	}
+	if len(c.Metrics) == 0 {
+		return fmt.Errorf("remote-write needs at least one metric")
+	}
+	_, err := parseExportedCards(c.Metrics)
+	return err
+}
+
+// exportedCard represents a card attribute exported as a time series.
+type exportedCard struct {
+	name  string
+	route string
+	card  string
+	attr  []string // path to the attribute within the card's data
+}
+
+// parseExportedCards parses "name=/route#card.attr" specs.
+func parseExportedCards(specs []string) ([]exportedCard, error) {
+	var xs []exportedCard
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		bad := func(reason string) error {
+			return fmt.Errorf("invalid remote-write metric %q: %s; want name=/route#card or name=/route#card.attr", spec, reason)
+		}
+		eq := strings.Index(spec, "=")
+		if eq < 0 {
+			return nil, bad("no name")
+		}
+		name, target := strings.TrimSpace(spec[:eq]), strings.TrimSpace(spec[eq+1:])
+		if !metricNameRe.MatchString(name) {
+			return nil, bad("name must match " + metricNameRe.String())
+		}
+		hash := strings.LastIndex(target, "#")
+		if hash < 0 || !strings.HasPrefix(target, "/") {
+			return nil, bad("no route or card")
+		}
+		route, ref := target[:hash], strings.Split(target[hash+1:], ".")
+		if ref[0] == "" {
+			return nil, bad("no card")
+		}
+		x := exportedCard{name: name, route: route, card: ref[0], attr: ref[1:]}
+		if len(x.attr) == 0 {
+			x.attr = []string{"value"}
+		}
+		key := name + "\x00" + route + "\x00" + x.card
+		if seen[key] {
+			return nil, bad("duplicate series")
+		}
+		seen[key] = true
+		xs = append(xs, x)
+	}
+	return xs, nil
+}
+
+// RemoteWriter periodically pushes the values of exported cards to a Prometheus remote-write endpoint.
+type RemoteWriter struct {
+	url      string
+	username string
+	password string
+	interval time.Duration
+	cards    []exportedCard
+	site     *Site
+	client   *http.Client
+}
+
+func newRemoteWriter(conf RemoteWriteConf, site *Site) *RemoteWriter {
+	cards, _ := parseExportedCards(conf.Metrics) // validated
+	interval := conf.Interval
+	if interval == 0 {
+		interval = defaultRemoteWriteInterval
+	}
+	return &RemoteWriter{conf.URL, conf.Username, conf.Password, interval, cards, site, &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (rw *RemoteWriter) run(quit <-chan struct{}) {
+	echo(Log{"t": "remote_write", "url": rw.url, "series": strconv.Itoa(len(rw.cards))})
+	ticker := clock.NewTicker(rw.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if err := rw.push(); err != nil {
+				stats.remoteWriteFailed()
+				echo(Log{"t": "remote_write", "error": err.Error()})
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// push sends the current value of each exported card. Cards that are missing, or not numeric, are skipped.
+func (rw *RemoteWriter) push() error {
+	now := clock.Now().UnixNano() / int64(time.Millisecond)
+	var series []timeSeries
+	for _, x := range rw.cards {
+		p := rw.site.peek(x.route)
+		if p == nil {
+			continue
+		}
+		v, ok := p.value(x.card, x.attr)
+		if !ok {
+			continue
+		}
+		f, ok := toFloat(v)
+		if !ok {
+			continue
+		}
+		series = append(series, timeSeries{
+			labels: [][2]string{{"__name__", x.name}, {"card", x.card}, {"route", x.route}}, // sorted by name
+			value:  f,
+			time:   now,
+		})
+	}
+	if len(series) == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, rw.url, bytes.NewReader(snappyEncode(encodeWriteRequest(series))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "waved")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if rw.username != "" {
+		req.SetBasicAuth(rw.username, rw.password)
+	}
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("remote-write: %s", resp.Status)
+	}
+	stats.remoteWritten(len(series))
+	return nil
+}
+
+// value returns the card attribute at path, if any.
+func (p *Page) value(card string, path []string) (interface{}, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	c, ok := p.cards[card]
+	if !ok {
+		return nil, false
+	}
+	var x interface{} = c.data
+	for _, k := range path {
+		if x = get(x, k); x == nil {
+			return nil, false
+		}
+	}
+	return x, true
+}
+
+// toFloat converts a JSON number, or a string holding one, to a float.
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		return f, err == nil
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// timeSeries represents a single sample of a labeled time series.
+type timeSeries struct {
+	labels [][2]string // name, value; sorted by name
+	value  float64
+	time   int64 // unix millis
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest protobuf message:
+// WriteRequest{repeated TimeSeries timeseries = 1}, TimeSeries{repeated Label labels = 1; repeated Sample samples = 2},
+// Label{string name = 1; string value = 2}, Sample{double value = 1; int64 timestamp = 2}.
+func encodeWriteRequest(series []timeSeries) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protoBytes(label, 1, []byte(l[0]))
+			label = protoBytes(label, 2, []byte(l[1]))
+			ts = protoBytes(ts, 1, label)
+		}
+		var sample []byte
+		sample = protoKey(sample, 1, 1) // 64-bit
+		sample = append(sample, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(sample[len(sample)-8:], math.Float64bits(s.value))
+		sample = protoKey(sample, 2, 0) // varint
+		sample = protoVarint(sample, uint64(s.time))
+		ts = protoBytes(ts, 2, sample)
+		req = protoBytes(req, 1, ts)
+	}
+	return req
+}
+
+func protoKey(b []byte, field, wireType int) []byte {
+	return protoVarint(b, uint64(field<<3|wireType))
+}
+
+func protoVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = protoKey(b, field, 2) // length-delimited
+	b = protoVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// snappyEncode frames data in the snappy block format, as required by remote-write.
+// The data is sent as uncompressed literals; requests are small, and this avoids a dependency on a snappy encoder.
+func snappyEncode(data []byte) []byte {
+	b := protoVarint(nil, uint64(len(data)))
+	const maxLiteral = 1 << 16
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxLiteral {
+			n = maxLiteral
+		}
+		switch m := n - 1; {
+		case m < 60:
+			b = append(b, byte(m<<2))
+		case m < 1<<8:
+			b = append(b, 60<<2, byte(m))
+		default:
+			b = append(b, 61<<2, byte(m), byte(m>>8))
+		}
+		b = append(b, data[:n]...)
+		data = data[n:]
+	}
+	return b
+}
@@ -17,70 +17,138 @@ package wave
 import (
 	"bufio"
 	"bytes"
-	"log"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"time"
 )
 
-var (
-	logSep = []byte(" ")
-)
+// aofTimeLayout is the layout of AOF entry timestamps, as written by the standard library logger.
+const aofTimeLayout = "2006/01/02 15:04:05"
 
-func initSite(site *Site, aofPath string) {
-	file, err := os.Open(aofPath)
+// aofSegments returns the AOF files at path: the file itself, or the files in the directory, in name order.
+// Rotated segments must be named so that they sort chronologically, e.g. by timestamp.
+func aofSegments(path string) ([]string, error) {
+	fi, err := os.Stat(path)
 	if err != nil {
-		log.Fatalln("#", "failed opening AOF file:", err)
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, f := range files {
+		if !f.IsDir() && f.Name()[0] != '.' {
+			segments = append(segments, filepath.Join(path, f.Name()))
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// initSite replays the AOF at aofPath, which is either a file or a directory of rotated segments.
+// Replay stops at the first malformed entry, reporting the segment, line and byte offset,
+// unless skipErrors is set, in which case malformed entries are logged and skipped.
+// An incomplete last line in the last segment, as left behind by a crash mid-write, is always skipped.
+func initSite(site *Site, aofPath string, skipErrors bool) error {
+	if err := migrateAOF(aofPath); err != nil {
+		return fmt.Errorf("failed migrating AOF: %v", err)
+	}
+	segments, err := aofSegments(aofPath)
+	if err != nil {
+		return fmt.Errorf("failed opening AOF: %v", err)
 	}
-	defer file.Close()
 
 	startTime := time.Now()
+	lines, used := 0, 0
+	for i, segment := range segments {
+		n, u, err := replayAOF(site, segment, skipErrors, i == len(segments)-1)
+		lines, used = lines+n, used+u
+		if err != nil {
+			return fmt.Errorf("failed replaying AOF: %v", err)
+		}
+	}
+
+	echo(Log{"t": "init", "segments": strconv.Itoa(len(segments)), "read": strconv.Itoa(lines), "used": strconv.Itoa(used), "elapsed": time.Since(startTime).String()})
+	return nil
+}
+
+// replayAOF replays a single AOF segment, returning the number of lines read and entries used.
+func replayAOF(site *Site, path string, skipErrors, last bool) (int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReaderSize(file, 64*1024)
 	line, used := 0, 0
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() { // FIXME not reliable if line length > 65536 chars
-		line++
-		data := scanner.Bytes()
-		tokens := bytes.SplitN(data, logSep, 4) // "date time marker entry"
-		if len(tokens) < 4 {
-			log.Println("#", "warning: want (date, time, marker, entry); skipped line", line)
-			continue
+	var offset int64
+	for {
+		b, err := r.ReadBytes('\n') // unbounded: entries can be arbitrarily long
+		if err != nil && err != io.EOF {
+			return line, used, fmt.Errorf("%s: offset %d: %v", path, offset, err)
 		}
+		if len(b) == 0 {
+			return line, used, nil
+		}
+		line++
+		torn := err == io.EOF // no trailing newline
+		start := offset
+		offset += int64(len(b))
 
-		marker, entry := tokens[2], tokens[3]
-		if len(marker) > 0 {
-			mark := marker[0]
-			if mark == '#' { // comment
-				continue
+		ok, rerr := replayEntry(site, bytes.TrimRight(b, "\r\n"))
+		if rerr != nil {
+			if torn && last {
+				warn(Log{"t": "init", "error": "incomplete last entry: " + rerr.Error(), "file": path, "line": strconv.Itoa(line), "offset": strconv.FormatInt(start, 10)})
+				return line, used, nil
 			}
-			tokens = bytes.SplitN(entry, logSep, 2) // "url data"
-			if len(tokens) < 2 {
-				log.Println("#", "warning: want (url, data); skipped line", line)
-				continue
-			}
-			url, data := tokens[0], tokens[1]
-			switch mark {
-			case '*': // patch existing page
-				site.patch(string(url), data)
-				used++
-			case '=': // compacted page; overwrite
-				site.set(string(url), data)
-				used++
-			default:
-				log.Println("#", "warning: bad marker", marker, "on line", line)
+			if !skipErrors {
+				return line, used, fmt.Errorf("%s:%d (offset %d): %v", path, line, start, rerr)
 			}
+			warn(Log{"t": "init", "error": rerr.Error(), "file": path, "line": strconv.Itoa(line), "offset": strconv.FormatInt(start, 10)})
+		} else if ok {
+			used++
+		}
+		if torn {
+			return line, used, nil
 		}
-	}
-
-	log.Printf("# init: %d lines read, %d lines used, %s\n", line, used, time.Since(startTime))
-
-	if err := scanner.Err(); err != nil {
-		log.Fatalln("#", "failed scanning AOF file:", err)
 	}
 }
 
-func compactSite(aofPath string) {
-	site := newSite()
-	initSite(site, aofPath)
-	for url, page := range site.pages {
-		log.Println("=", url, string(page.marshal()))
+// replayEntry applies a single AOF line to the site, and reports whether the line changed the site.
+// Comments and blank lines are ignored.
+func replayEntry(site *Site, line []byte) (bool, error) {
+	if len(line) == 0 {
+		return false, nil
+	}
+	e, err := parseAOFEntry(line)
+	if err != nil {
+		return false, err
+	}
+	switch e.marker {
+	case patchMarker[0]: // patch existing page
+		if err := site.patch(e.url, e.data, 0); err != nil {
+			return false, err
+		}
+		site.touch(e.url, e.time)
+	case compactMarker[0]: // compacted page; overwrite
+		if err := site.set(e.url, e.data, 0); err != nil {
+			return false, err
+		}
+		site.touch(e.url, e.time)
+	case deleteMarker[0]: // deleted page
+		site.del(e.url)
+	default:
+		return false, nil
 	}
+	return true, nil
 }
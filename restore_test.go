@@ -0,0 +1,144 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	aofHeader = "2021/03/01 09:00:00 # wave-aof-format 1\n"
+	aofPage   = `2021/03/01 09:00:00 = /ops {"p":{"c":{"status":{"d":{"view":"markdown","content":"up"}}}}}` + "\n"
+	aofPatch  = `2021/03/01 09:00:01 * /ops {"d":[{"k":"status content","v":"down"}]}` + "\n"
+	aofTorn   = `2021/03/01 09:00:02 * /ops {"d":[{"k":"status content","v":"ba`
+)
+
+func writeAOFSegments(t *testing.T, segments ...string) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "aof")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range segments {
+		name := filepath.Join(dir, "site-2021030"+string(rune('1'+i))+"T090000.000000000.aof")
+		if err := ioutil.WriteFile(name, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// statusOf returns the content of the status card on /ops, or "" if there is none.
+func statusOf(site *Site) string {
+	p := site.peek("/ops")
+	if p == nil {
+		return ""
+	}
+	p.RLock()
+	defer p.RUnlock()
+	s, _ := p.dump().C["status"].D["content"].(string)
+	return s
+}
+
+func TestReplayRotated(t *testing.T) {
+	dir := writeAOFSegments(t, aofHeader+aofPage, aofHeader+aofPatch)
+	site := newSite()
+	if err := initSite(site, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(site); got != "down" {
+		t.Fatalf("want segments replayed in order, ending with down, got %q", got)
+	}
+}
+
+func TestReplayTornLastEntry(t *testing.T) {
+	dir := writeAOFSegments(t, aofHeader+aofPage, aofHeader+aofPatch+aofTorn)
+	site := newSite()
+	if err := initSite(site, dir, false); err != nil {
+		t.Fatalf("want the incomplete last entry skipped, got %v", err)
+	}
+	if got := statusOf(site); got != "down" {
+		t.Fatalf("want the entries before the torn one, got %q", got)
+	}
+}
+
+func TestReplayTornEarlierSegment(t *testing.T) {
+	dir := writeAOFSegments(t, aofHeader+aofPage+aofTorn, aofHeader+aofPatch)
+	if err := initSite(newSite(), dir, false); err == nil || !strings.Contains(err.Error(), "20210301") {
+		t.Fatalf("want an error naming the first segment, got %v", err)
+	}
+
+	site := newSite()
+	if err := initSite(site, dir, true); err != nil {
+		t.Fatalf("skipping errors: %v", err)
+	}
+	if got := statusOf(site); got != "down" {
+		t.Fatalf("want replay to carry on past the skipped entry, got %q", got)
+	}
+}
+
+func TestReplayMalformed(t *testing.T) {
+	dir := writeAOFSegments(t, aofHeader+aofPage+"2021/03/01 09:00:01 ? /ops {}\n"+aofPatch)
+	err := initSite(newSite(), dir, false)
+	if err == nil || !strings.Contains(err.Error(), ":3 ") {
+		t.Fatalf("want an error at line 3, got %v", err)
+	}
+}
+
+func TestReplayMigratesFormat(t *testing.T) {
+	dir := writeAOFSegments(t, aofPage+aofPatch) // format 0: no header
+	site := newSite()
+	if err := initSite(site, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(site); got != "down" {
+		t.Fatalf("got %q, want down", got)
+	}
+	segments, _ := aofSegments(dir)
+	if v, err := readAOFFormat(segments[0]); err != nil || v != aofFormat {
+		t.Fatalf("want the segment migrated to format %d, got %d, %v", aofFormat, v, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "backups")); err != nil {
+		t.Fatalf("want the original backed up: %v", err)
+	}
+}
+
+func TestOpenAOFRepairsTornSegment(t *testing.T) {
+	dir := writeAOFSegments(t, aofHeader+aofPage+aofPatch+aofTorn)
+	segments, _ := aofSegments(dir)
+	a, err := openAOF(AOFConf{Dir: dir, Fsync: fsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.close()
+	data, err := ioutil.ReadFile(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := aofHeader + aofPage + aofPatch; string(data) != want {
+		t.Fatalf("want the segment truncated to its last complete entry, got %q", data)
+	}
+	site := newSite()
+	if err := initSite(site, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(site); got != "down" {
+		t.Fatalf("got %q, want down", got)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errRevertDrop     = errors.New("cannot revert dropping a page")
+	errRevertApproval = errors.New("cannot revert patches to pages requiring approval")
+)
+
+type revertKey struct{}
+
+// Revert represents a request for the changes made by a patch to be undone after a while.
+type Revert struct {
+	After time.Duration   // undo the changes this long after they are applied
+	Patch *ScheduledPatch // the undoing patch, once scheduled
+}
+
+// withRevert asks for the patch applied with ctx to be reverted after a while.
+func withRevert(ctx context.Context, after time.Duration) (context.Context, *Revert) {
+	r := &Revert{After: after}
+	return context.WithValue(ctx, revertKey{}, r), r
+}
+
+func revertFrom(ctx context.Context) *Revert {
+	r, _ := ctx.Value(revertKey{}).(*Revert)
+	return r
+}
+
+// parseRevertAfter parses a revert delay: a number of seconds, or a duration such as "90s" or "5m".
+func parseRevertAfter(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, errors.New("invalid revert_after: want seconds, or a duration such as 90s")
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, errors.New("invalid revert_after: must be positive")
+	}
+	return d, nil
+}
+
+// revertOf returns a patch restoring what ops are about to change on the page at url.
+// Attributes are restored one by one, so that changes made to other attributes in the meantime
+// survive the revert; cards that are put, deleted, or have buffers changed are restored whole.
+func (site *Site) revertOf(url string, ops OpsD) ([]byte, error) {
+	page := site.at(url)
+	if page != nil {
+		page.RLock()
+		defer page.RUnlock()
+	}
+	prev := func(name string) (*Card, bool) {
+		if page == nil {
+			return nil, false
+		}
+		c, ok := page.cards[name]
+		return c, ok
+	}
+
+	var undo []OpD
+	whole := make(map[string]bool) // cards restored whole
+	attrs := make(map[string]bool) // "card attr" => restored
+	for _, op := range ops.D {
+		if len(op.K) == 0 {
+			return nil, errRevertDrop
+		}
+		ks := strings.SplitN(op.K, keySeparator, 3)
+		name := ks[0]
+		if whole[name] {
+			continue
+		}
+		card, ok := prev(name)
+		if len(ks) == 1 || op.C != nil || op.F != nil || op.M != nil || (ok && isBuf(card.data[ks[1]])) {
+			whole[name] = true
+			if !ok {
+				undo = append(undo, OpD{K: name}) // didn't exist: delete
+				continue
+			}
+			d := card.dump()
+			undo = append(undo, OpD{K: name, D: d.D, B: d.B})
+			continue
+		}
+		if !ok { // setting attributes on a missing card changes nothing
+			continue
+		}
+		k := name + keySeparator + ks[1]
+		if attrs[k] {
+			continue
+		}
+		attrs[k] = true
+		undo = append(undo, OpD{K: k, V: deepClone(card.data[ks[1]])}) // nil deletes
+	}
+	return json.Marshal(OpsD{D: undo})
+}
+
+func isBuf(v interface{}) bool {
+	_, ok := v.(Buf)
+	return ok
+}
+
+// scheduleRevert schedules the undoing of ops, as requested by ctx, if at all. Must be called with changes to route
+// locked, before ops are applied.
+func (b *Broker) scheduleRevert(ctx context.Context, route string, ops OpsD) error {
+	r := revertFrom(ctx)
+	if r == nil || r.After <= 0 {
+		return nil
+	}
+	data, err := b.site.revertOf(route, ops)
+	if err != nil {
+		return err
+	}
+	p, err := b.schedule.addRevert(route, data, clock.Now().Add(r.After), writerFrom(ctx).By)
+	if err != nil {
+		return err
+	}
+	r.Patch = p
+	echo(Log{"t": "patch_revert", "route": route, "id": p.ID, "apply_at": p.ApplyAt.Format(time.RFC3339)})
+	return nil
+}
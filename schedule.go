@@ -0,0 +1,267 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// viaSchedule identifies changes made by applying scheduled patches.
+const viaSchedule = "schedule"
+
+// scheduleFailed marks scheduled patches that could not be applied when they fell due.
+const scheduleFailed = "failed"
+
+// ScheduledPatch represents a patch held until it is due.
+type ScheduledPatch struct {
+	ID          string    `json:"id"`
+	Route       string    `json:"route"`
+	Data        string    `json:"data"`
+	ApplyAt     time.Time `json:"apply_at"`
+	By          string    `json:"by,omitempty"` // access key ID of the writer
+	Created     time.Time `json:"created"`
+	Revert      bool      `json:"revert,omitempty"`       // undoes an earlier patch
+	RevertAfter float64   `json:"revert_after,omitempty"` // once applied, undo this patch after this many seconds
+	Status      string    `json:"status,omitempty"`       // "" while waiting, scheduleFailed if it could not be applied
+	Error       string    `json:"error,omitempty"`        // why it could not be applied
+}
+
+// Schedule holds patches to be applied at a later time, for scheduled content changes.
+// Scheduled patches are persisted as JSON to a file in the data directory, and survive restarts;
+// patches that fell due while the server was down are applied when it starts. A patch is only
+// removed once applied; patches that fail are kept, marked as failed, until canceled.
+type Schedule struct {
+	sync.Mutex
+	path    string
+	patches map[string]*ScheduledPatch // id => patch
+	wake    chan struct{}              // signals a change to the next due time
+}
+
+func newSchedule(path string) *Schedule {
+	s := &Schedule{path: path, patches: make(map[string]*ScheduledPatch), wake: make(chan struct{}, 1)}
+	if err := s.load(); err != nil {
+		echo(Log{"t": "schedule_load", "path": path, "error": err.Error()})
+	}
+	return s
+}
+
+func (s *Schedule) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var patches []*ScheduledPatch
+	if err := json.Unmarshal(data, &patches); err != nil {
+		return err
+	}
+	for _, p := range patches {
+		s.patches[p.ID] = p
+	}
+	return nil
+}
+
+// save persists scheduled patches. Must be called under lock.
+func (s *Schedule) save() error {
+	data, err := json.MarshalIndent(s.sorted(""), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(s.path, data)
+}
+
+// sorted returns the patches to routes at or below prefix (all routes if empty), soonest due first.
+// Must be called under lock.
+func (s *Schedule) sorted(prefix string) []*ScheduledPatch {
+	ps := make([]*ScheduledPatch, 0, len(s.patches))
+	for _, p := range s.patches {
+		if prefix == "" || isPathPrefix(prefix, p.Route) {
+			ps = append(ps, p)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		if !ps[i].ApplyAt.Equal(ps[j].ApplyAt) {
+			return ps[i].ApplyAt.Before(ps[j].ApplyAt)
+		}
+		return ps[i].Created.Before(ps[j].Created)
+	})
+	return ps
+}
+
+// add schedules a patch to be applied to route at t, and undone revertAfter later if positive.
+func (s *Schedule) add(route string, data []byte, t time.Time, by string, revertAfter time.Duration) (*ScheduledPatch, error) {
+	return s.put(&ScheduledPatch{uuid.New().String(), route, string(data), t.UTC(), by, clock.Now().UTC(), false, revertAfter.Seconds(), "", ""})
+}
+
+// addRevert schedules a patch undoing an earlier one.
+func (s *Schedule) addRevert(route string, data []byte, t time.Time, by string) (*ScheduledPatch, error) {
+	return s.put(&ScheduledPatch{uuid.New().String(), route, string(data), t.UTC(), by, clock.Now().UTC(), true, 0, "", ""})
+}
+
+func (s *Schedule) put(p *ScheduledPatch) (*ScheduledPatch, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.patches[p.ID] = p
+	if err := s.save(); err != nil {
+		delete(s.patches, p.ID)
+		return nil, err
+	}
+	s.notify()
+	return p, nil
+}
+
+// cancel unschedules a patch, or discards a failed one; returns false if there is no such patch, or it has
+// already been applied.
+func (s *Schedule) cancel(id string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.patches[id]; !ok {
+		return false, nil
+	}
+	delete(s.patches, id)
+	s.notify()
+	return true, s.save()
+}
+
+func (s *Schedule) list(prefix string) []*ScheduledPatch {
+	s.Lock()
+	defer s.Unlock()
+	return s.sorted(prefix)
+}
+
+// notify wakes the scheduler. Must be called under lock.
+func (s *Schedule) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due returns copies of the patches due as of now, soonest first, and the time the next patch is due, if any.
+// Patches stay scheduled until done reports their outcome; failed patches are skipped.
+func (s *Schedule) due(now time.Time) ([]ScheduledPatch, time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	var due []ScheduledPatch
+	var next time.Time
+	for _, p := range s.sorted("") {
+		if p.Status == scheduleFailed {
+			continue
+		}
+		if p.ApplyAt.After(now) {
+			next = p.ApplyAt
+			break
+		}
+		due = append(due, *p)
+	}
+	return due, next
+}
+
+// done records the outcome of applying a patch: it is removed if applied, else kept, marked as failed.
+// Patches canceled in the meantime are left alone.
+func (s *Schedule) done(id string, applyErr error) {
+	s.Lock()
+	defer s.Unlock()
+	p, ok := s.patches[id]
+	if !ok {
+		return
+	}
+	if applyErr == nil {
+		delete(s.patches, id)
+	} else {
+		p.Status, p.Error = scheduleFailed, applyErr.Error()
+	}
+	if err := s.save(); err != nil {
+		echo(Log{"t": "schedule_save", "error": err.Error()})
+	}
+}
+
+// run applies scheduled patches as they fall due.
+func (s *Schedule) run(b *Broker) {
+	for {
+		due, next := s.due(clock.Now())
+		for _, p := range due {
+			ctx := withWriter(context.Background(), p.By, viaSchedule)
+			if p.RevertAfter > 0 {
+				ctx, _ = withRevert(ctx, time.Duration(p.RevertAfter*float64(time.Second)))
+			}
+			_, err := b.patchIf(ctx, p.Route, []byte(p.Data), -1)
+			if err != nil {
+				echo(Log{"t": "schedule_apply", "id": p.ID, "route": p.Route, "error": err.Error()})
+			} else {
+				echo(Log{"t": "schedule_apply", "id": p.ID, "route": p.Route})
+			}
+			s.done(p.ID, err)
+		}
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = clock.After(next.Sub(clock.Now()))
+		}
+		select {
+		case <-timer:
+		case <-s.wake:
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// ScheduleHandler serves scheduled patches to administrators:
+// GET lists them, soonest due first, optionally ?prefix=/foo; DELETE ?id= cancels one.
+// Patches are scheduled with PATCH /<route>?apply_at=<RFC 3339 time>.
+type ScheduleHandler struct {
+	schedule *Schedule
+	auth     *Auth
+}
+
+func newScheduleHandler(schedule *Schedule, auth *Auth) *ScheduleHandler {
+	return &ScheduleHandler{schedule, auth}
+}
+
+func (h *ScheduleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth.trusted(r); !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(h.schedule.list(r.URL.Query().Get("prefix")))
+	case http.MethodDelete:
+		ok, err := h.schedule.cancel(r.URL.Query().Get("id"))
+		if err != nil {
+			echo(Log{"t": "schedule_cancel", "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
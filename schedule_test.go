@@ -0,0 +1,79 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScheduleDue(t *testing.T) {
+	s := newSchedule(filepath.Join(t.TempDir(), "schedule.json"))
+	now := time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)
+	late, _ := s.add("/b", []byte(testPatch), now.Add(-time.Minute), "alice", 0)
+	early, _ := s.add("/a", []byte(testPatch), now.Add(-time.Hour), "alice", 0)
+	s.add("/c", []byte(testPatch), now.Add(time.Hour), "alice", 0)
+
+	due, next := s.due(now)
+	if len(due) != 2 || due[0].ID != early.ID || due[1].ID != late.ID {
+		t.Fatalf("want the two past patches, soonest first, got %+v", due)
+	}
+	if !next.Equal(now.Add(time.Hour)) {
+		t.Fatalf("want next due in an hour, got %v", next)
+	}
+	if again, _ := s.due(now); len(again) != 2 {
+		t.Fatalf("patches dropped before being applied: %+v", again)
+	}
+}
+
+func TestScheduleKeepsFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	s := newSchedule(path)
+	now := clock.Now()
+	ok, _ := s.add("/ok", []byte(testPatch), now, "alice", 0)
+	bad, _ := s.add("/bad", []byte(`{"d":[{"k":`), now, "alice", 0)
+
+	b := newTestBroker(t, Backpressure{})
+	b.schedule = s
+	go s.run(b)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ps := s.list("")
+		if len(ps) == 1 && ps[0].Status == scheduleFailed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want only the failed patch left, got %+v", ps)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(b.quit)
+
+	if b.site.at("/ok") == nil {
+		t.Errorf("patch %s not applied", ok.ID)
+	}
+	restarted := newSchedule(path)
+	ps := restarted.list("")
+	if len(ps) != 1 || ps[0].ID != bad.ID || ps[0].Status != scheduleFailed || ps[0].Error == "" {
+		t.Fatalf("want the failed patch kept, with its error, got %+v", ps)
+	}
+	if due, _ := restarted.due(now.Add(time.Hour)); len(due) != 0 {
+		t.Fatalf("failed patch retried: %+v", due)
+	}
+	if found, err := restarted.cancel(bad.ID); !found || err != nil {
+		t.Fatalf("discard failed patch: got %v, %v", found, err)
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	minTermLength       = 2
+	maxSearchTerms      = 16
+	defaultSearchLimit  = 20
+	maxSearchCardsShown = 10
+)
+
+// unsearchable lists card attributes that hold layout rather than content.
+var unsearchable = map[string]bool{"view": true, "box": true}
+
+// SearchIndex is an inverted index of the text on every page, kept up to date as pages change,
+// so that searching never requires scanning the site.
+type SearchIndex struct {
+	sync.RWMutex
+	path     string                    // persisted here; not persisted if empty
+	postings map[string]map[string]int // term => url => occurrences
+	docs     map[string]*searchDoc     // url => indexed cards
+}
+
+// searchDoc represents the indexed contents of a page.
+type searchDoc struct {
+	Modified time.Time              `json:"t"` // page's last change, as of indexing
+	Cards    map[string]*searchCard `json:"c"`
+}
+
+// searchCard represents the indexed contents of a card.
+type searchCard struct {
+	Terms map[string]int `json:"t"`           // term => occurrences
+	Roles []string       `json:"r,omitempty"` // roles required to view the card, if restricted
+}
+
+// searchFile represents a persisted index.
+type searchFile struct {
+	Saved time.Time             `json:"saved"`
+	Docs  map[string]*searchDoc `json:"docs"`
+}
+
+func newSearchIndex(path string) *SearchIndex {
+	return &SearchIndex{path: path, postings: make(map[string]map[string]int), docs: make(map[string]*searchDoc)}
+}
+
+// tokenize returns the occurrences of each search term in s.
+func tokenize(s string, terms map[string]int) {
+	for _, t := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if len(t) >= minTermLength {
+			terms[t]++
+		}
+	}
+}
+
+// cardTerms extracts the search terms in a card's attributes. Buffers (tabular data) are not indexed.
+func cardTerms(c *Card) map[string]int {
+	terms := make(map[string]int)
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch x := v.(type) {
+		case string:
+			tokenize(x, terms)
+		case map[string]interface{}:
+			for _, y := range x {
+				walk(y)
+			}
+		case []interface{}:
+			for _, y := range x {
+				walk(y)
+			}
+		}
+	}
+	for k, v := range c.data {
+		if !unsearchable[k] {
+			walk(v)
+		}
+	}
+	return terms
+}
+
+// update re-indexes the given cards of the page at url, or the whole page if cards is nil.
+// Must be called with the page locked.
+func (ix *SearchIndex) update(url string, p *Page, cards map[string]bool) {
+	if isPathPrefix(systemPrefix, url) {
+		return
+	}
+	ix.RLock()
+	_, ok := ix.docs[url]
+	ix.RUnlock()
+	if !ok {
+		cards = nil
+	}
+	fresh := make(map[string]*searchCard)
+	if cards == nil {
+		for name, c := range p.cards {
+			fresh[name] = &searchCard{cardTerms(c), p.restricted[name]}
+		}
+	} else {
+		for name := range cards {
+			if c, ok := p.cards[name]; ok {
+				fresh[name] = &searchCard{cardTerms(c), p.restricted[name]}
+			} else {
+				fresh[name] = nil // deleted
+			}
+		}
+	}
+
+	ix.Lock()
+	defer ix.Unlock()
+	doc, ok := ix.docs[url]
+	if !ok || cards == nil {
+		if ok {
+			ix.unpost(url, doc)
+		}
+		doc = &searchDoc{Cards: make(map[string]*searchCard)}
+		ix.docs[url] = doc
+	}
+	doc.Modified = p.modified
+	for name, c := range fresh {
+		if old, ok := doc.Cards[name]; ok {
+			ix.unpostCard(url, old.Terms)
+			delete(doc.Cards, name)
+		}
+		if c != nil && len(c.Terms) > 0 {
+			doc.Cards[name] = c
+			ix.postCard(url, c.Terms)
+		}
+	}
+}
+
+// reindex brings the index up to date with a page change published on the broker's bus.
+// Patches re-index only the cards they touch; deleted pages are dropped by the site itself.
+func (site *Site) reindex(e Event) {
+	if site.search == nil || e.Change == changeDelete {
+		return
+	}
+	p := site.peek(e.Route)
+	if p == nil {
+		return
+	}
+	var cards map[string]bool
+	if e.Change == changePatch {
+		cards = make(map[string]bool)
+		for _, op := range e.Ops.D {
+			if len(op.K) == 0 {
+				cards = nil // page dropped
+				break
+			}
+			cards[strings.SplitN(op.K, keySeparator, 2)[0]] = true
+		}
+	}
+	p.RLock()
+	site.search.update(e.Route, p, cards)
+	p.RUnlock()
+}
+
+// stamp records the time of the last change to the page at url.
+func (ix *SearchIndex) stamp(url string, t time.Time) {
+	ix.Lock()
+	defer ix.Unlock()
+	if doc, ok := ix.docs[url]; ok {
+		doc.Modified = t
+	}
+}
+
+// remove drops the page at url from the index.
+func (ix *SearchIndex) remove(url string) {
+	ix.Lock()
+	defer ix.Unlock()
+	if doc, ok := ix.docs[url]; ok {
+		ix.unpost(url, doc)
+		delete(ix.docs, url)
+	}
+}
+
+func (ix *SearchIndex) postCard(url string, terms map[string]int) {
+	for t, n := range terms {
+		urls, ok := ix.postings[t]
+		if !ok {
+			urls = make(map[string]int)
+			ix.postings[t] = urls
+		}
+		urls[url] += n
+	}
+}
+
+func (ix *SearchIndex) unpostCard(url string, terms map[string]int) {
+	for t, n := range terms {
+		if urls, ok := ix.postings[t]; ok {
+			if urls[url] -= n; urls[url] <= 0 {
+				delete(urls, url)
+			}
+			if len(urls) == 0 {
+				delete(ix.postings, t)
+			}
+		}
+	}
+}
+
+func (ix *SearchIndex) unpost(url string, doc *searchDoc) {
+	for _, c := range doc.Cards {
+		ix.unpostCard(url, c.Terms)
+	}
+}
+
+// SearchHit represents a page matching a search.
+type SearchHit struct {
+	URL   string   `json:"url"`
+	Score int      `json:"score"` // occurrences of the search terms on the page
+	Cards []string `json:"cards"` // cards containing all the search terms, if any
+}
+
+// SearchResults represents the pages matching a search, best matches first.
+type SearchResults struct {
+	Hits  []SearchHit `json:"hits"`
+	Total int         `json:"total"` // pages matched, including those beyond the limit
+}
+
+// search returns the pages at or below prefix containing every term in q, as seen by someone having the given roles
+// (or everything, if trusted). allows reports whether a page may be read at all.
+func (ix *SearchIndex) search(q, prefix string, limit int, roles []string, trusted bool, allows func(url string) bool) SearchResults {
+	terms := make(map[string]int)
+	tokenize(q, terms)
+	res := SearchResults{Hits: []SearchHit{}}
+	if len(terms) == 0 || len(terms) > maxSearchTerms {
+		return res
+	}
+
+	ix.RLock()
+	var candidates map[string]bool
+	for t := range terms { // pages having all terms, possibly in cards the viewer can't see
+		next := make(map[string]bool)
+		for url := range ix.postings[t] {
+			if candidates == nil || candidates[url] {
+				next[url] = true
+			}
+		}
+		candidates = next
+		if len(candidates) == 0 {
+			break
+		}
+	}
+	var hits []SearchHit
+	for url := range candidates {
+		if !isPathPrefix(prefix, url) {
+			continue
+		}
+		doc := ix.docs[url]
+		hit := SearchHit{URL: url, Cards: []string{}}
+		found := make(map[string]bool)
+		for name, c := range doc.Cards {
+			if !trusted && len(c.Roles) > 0 && !hasAnyRole(c.Roles, roles) {
+				continue
+			}
+			all := true
+			for t := range terms {
+				if n := c.Terms[t]; n > 0 {
+					hit.Score += n
+					found[t] = true
+				} else {
+					all = false
+				}
+			}
+			if all {
+				hit.Cards = append(hit.Cards, name)
+			}
+		}
+		if len(found) == len(terms) {
+			hits = append(hits, hit)
+		}
+	}
+	ix.RUnlock()
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].URL < hits[j].URL
+	})
+	for _, h := range hits {
+		if !trusted && !allows(h.URL) {
+			continue
+		}
+		res.Total++
+		if len(res.Hits) < limit {
+			sort.Strings(h.Cards)
+			if len(h.Cards) > maxSearchCardsShown {
+				h.Cards = h.Cards[:maxSearchCardsShown]
+			}
+			res.Hits = append(res.Hits, h)
+		}
+	}
+	return res
+}
+
+// save persists the index, if any, and if it has a path.
+func (ix *SearchIndex) save() error {
+	if ix == nil || ix.path == "" {
+		return nil
+	}
+	ix.RLock()
+	data, err := json.Marshal(searchFile{clock.Now(), ix.docs})
+	ix.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(ix.path, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+// restore loads the persisted index, and brings it up to date with the site, as restored from the AOF.
+// Pages that have not changed since the index was saved are not re-indexed.
+func (ix *SearchIndex) restore(site *Site) {
+	var saved searchFile
+	if ix.path != "" {
+		if data, err := ioutil.ReadFile(ix.path); err == nil {
+			if err := json.Unmarshal(data, &saved); err != nil {
+				echo(Log{"t": "search_restore", "path": ix.path, "error": err.Error()})
+			}
+		} else if !os.IsNotExist(err) {
+			echo(Log{"t": "search_restore", "path": ix.path, "error": err.Error()})
+		}
+	}
+
+	start := time.Now()
+	reused, indexed := 0, 0
+	for _, url := range site.urls() {
+		p := site.peek(url)
+		if p == nil {
+			continue
+		}
+		p.RLock()
+		// AOF timestamps have a resolution of a second, and changes made in the second the index was saved
+		// may not be in it, so only pages last changed in an earlier second are reused.
+		if doc, ok := saved.Docs[url]; ok && doc.Modified.Unix() == p.modified.Unix() && p.modified.Unix() < saved.Saved.Unix() {
+			ix.Lock()
+			ix.docs[url] = doc
+			for _, c := range doc.Cards {
+				ix.postCard(url, c.Terms)
+			}
+			ix.Unlock()
+			reused++
+		} else {
+			ix.update(url, p, nil)
+			indexed++
+		}
+		p.RUnlock()
+	}
+	echo(Log{"t": "search_restore", "reused": strconv.Itoa(reused), "indexed": strconv.Itoa(indexed), "elapsed": time.Since(start).String()})
+}
+
+// SearchHandler searches the text on all pages:
+// GET /_api/search?q=quarterly revenue&prefix=/sales&limit=20.
+// Pages containing every word in q are returned, those with the most occurrences first.
+// Callers see only the pages, and cards, they are allowed to read.
+type SearchHandler struct {
+	site *Site
+	auth *Auth
+}
+
+func newSearchHandler(site *Site, auth *Auth) *SearchHandler {
+	return &SearchHandler{site, auth}
+}
+
+func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	viewer, ok := h.auth.identify(r)
+	if !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if h.site.search == nil {
+		http.Error(w, "search is off", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultSearchLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if n > maxPageListLimit {
+			n = maxPageListLimit
+		}
+		limit = n
+	}
+	prefix := q.Get("prefix")
+	if prefix == "" {
+		prefix = "/"
+	}
+
+	allows := func(url string) bool { return h.site.acl.allows(url, viewer.username, viewer.roles) }
+	res := h.site.search.search(q.Get("q"), prefix, limit, viewer.roles, viewer.trusted, allows)
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(res)
+}
@@ -16,13 +16,14 @@ package wave
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/go-oidc"
@@ -38,17 +39,76 @@ const logo = `
 └─────────────────────────┘
 `
 
-// Log represents key-value data for a log message.
-type Log map[string]string
+// shutdownTimeout is how long in-flight requests are given to complete when the server stops.
+const shutdownTimeout = 10 * time.Second
 
-func echo(m Log) {
-	if j, err := json.Marshal(m); err == nil { // TODO speed up
-		log.Println("#", string(j))
+// Run runs the HTTP server, until conf.Stop, if set, is closed. Whatever Run starts, it stops before
+// returning, on failure too, so it can be run again in the same process, e.g. by tests.
+func Run(conf ServerConf) {
+	// The logger, tracer and clock are shared by the whole process; put back whatever was in use before.
+	defer func(l Logger, t Tracer, c Clock) { logger, tracer, clock = l, t, c }(logger, tracer, clock)
+	if conf.Logger != nil {
+		logger = conf.Logger
+	}
+	if conf.Tracer != nil {
+		tracer = conf.Tracer
+	}
+	if conf.Clock != nil {
+		clock = conf.Clock
+	}
+	if err := conf.Validate(); err != nil {
+		for _, e := range err.(ConfErrors) {
+			echo(Log{"t": "conf", "error": e})
+		}
+		return
+	}
+	defer echo(Log{"t": "stopped"}) // once everything else has stopped
+	for _, l := range conf.listeners() {
+		if l.Listener != nil {
+			defer l.Listener.Close()
+		}
+	}
+	if conf.OTLP.URL != "" {
+		otlp := newOTLPTracer(conf.OTLP)
+		go otlp.run()
+		prev := tracer
+		tracer = otlp
+		defer func() {
+			tracer = prev
+			otlp.flush()
+		}()
+	}
+	licensing = newLicensing(conf.Entitlements)
+	if errs := licensing.check(conf); len(errs) > 0 {
+		for _, e := range errs {
+			echo(Log{"t": "license", "error": e.Error()})
+		}
+		return
+	}
+	checks := conf.Validators
+	if conf.CardSchemas != "" {
+		schemas, err := loadCardSchemas(conf.CardSchemas)
+		if err != nil {
+			echo(Log{"t": "card_schemas", "path": conf.CardSchemas, "error": err.Error()})
+			return
+		}
+		checks = append(append([]CardValidator(nil), checks...), schemas...)
+	}
+	validators = newValidators(checks)
+	wireDefault = grammarVersion
+	if conf.WireVersion > 0 {
+		wireDefault = conf.WireVersion
+	}
+	conf, err := conf.withProfile()
+	if err != nil {
+		echo(Log{"t": "profile", "error": err.Error()})
+		return
+	}
+	if proxies, err = newTrustedProxies(conf.TrustedProxies); err != nil {
+		echo(Log{"t": "trusted_proxies", "error": err.Error()})
+		return
 	}
-}
 
-// Run runs the HTTP server.
-func Run(conf ServerConf) {
 	accessKeyHash, err := bcrypt.GenerateFromPassword([]byte(conf.AccessKeySecret), bcrypt.DefaultCost)
 	if err != nil {
 		echo(Log{"t": "users_init", "error": err.Error()})
@@ -57,25 +117,182 @@ func Run(conf ServerConf) {
 
 	// FIXME RBAC
 	users := map[string][]byte{conf.AccessKeyID: accessKeyHash}
+	if conf.Keychain != "" {
+		keys, err := loadKeychain(conf.Keychain)
+		if err != nil {
+			echo(Log{"t": "keychain", "error": err.Error()})
+			return
+		}
+		for id, hash := range keys {
+			users[id] = hash
+		}
+		if len(keys) > 0 {
+			echo(Log{"t": "keychain", "path": conf.Keychain, "keys": strconv.Itoa(len(keys))})
+		}
+	}
 
 	// FIXME SESSIONS
 	sessions := newOIDCSessions()
 
 	if len(conf.Compact) > 0 {
-		compactSite(conf.Compact)
+		path, done, err := fetchArchive(conf.Compact, conf.AOF.Archive, conf.DataDir)
+		if err != nil {
+			echo(Log{"t": "archive_fetch", "url": conf.Compact, "error": err.Error()})
+			return
+		}
+		defer done()
+		if err := CompactAOF(log.Writer(), path, conf.InitSkipErrors); err != nil {
+			echo(Log{"t": "compact", "error": err.Error()})
+		}
 		return
 	}
 
+	var ready int32
+
 	site := newSite()
+	site.undoDepth = max0(conf.Footprint.UndoDepth)
 	if len(conf.Init) > 0 {
-		initSite(site, conf.Init)
+		path, done, err := fetchArchive(conf.Init, conf.AOF.Archive, conf.DataDir)
+		if err != nil {
+			echo(Log{"t": "archive_fetch", "url": conf.Init, "error": err.Error()})
+			return
+		}
+		err = initSite(site, path, conf.InitSkipErrors)
+		done()
+		if err != nil {
+			echo(Log{"t": "init", "error": err.Error()})
+			return
+		}
+	}
+	gone := site.dropClientPages() // before syncing with peers, whose clients' pages are live
+	if err := site.acl.open(filepath.Join(conf.DataDir, "acl.json")); err != nil {
+		echo(Log{"t": "acl_load", "error": err.Error()})
+		return
+	}
+	if len(conf.Cluster.Peers) > 0 {
+		cluster = newCluster(conf.Cluster)
+		defer func() { cluster = nil }()
+		cluster.join(site)
 	}
+	if !conf.NoSearchIndex {
+		search := newSearchIndex(filepath.Join(conf.DataDir, "search.json"))
+		search.restore(site)
+		site.search = search
+		defer func() {
+			if err := search.save(); err != nil {
+				echo(Log{"t": "search_save", "error": err.Error()})
+			}
+		}()
+	}
+	if conf.AOF.Dir != "" {
+		a, err := openAOF(conf.AOF)
+		if err != nil {
+			echo(Log{"t": "aof", "error": err.Error()})
+			return
+		}
+		aof = a
+		defer func() {
+			aof = nil
+			a.close()
+		}()
+	} else {
+		log.Println(commentMarker, aofFormatPrefix+strconv.Itoa(aofFormat))
+	}
+	for _, url := range gone { // else replaying the log would bring them back
+		appendAOF(deleteMarker, url, emptyJSON)
+	}
+	site.annotations = newAnnotations(filepath.Join(conf.DataDir, "annotations.json"))
+	atomic.StoreInt32(&ready, 1)
 
-	broker := newBroker(site)
-	go broker.run()
+	notifier := newNotifier(filepath.Join(conf.DataDir, "subscriptions.json"), conf.SMTP)
+	if conf.Analytics.enabled() {
+		a := newAnalytics(filepath.Join(conf.DataDir, "analytics.json"), conf.Analytics)
+		analytics = a
+		defer func() {
+			analytics = nil
+			a.flush()
+		}()
+	}
+	if conf.Audit.enabled() {
+		a, err := openAuditLog(conf.Audit)
+		if err != nil {
+			echo(Log{"t": "audit", "error": err.Error()})
+			return
+		}
+		auditor = a
+		defer func() {
+			auditor = nil
+			a.close()
+		}()
+	}
+
+	webhooks := newWebhooks(filepath.Join(conf.DataDir, "webhooks.json"))
+	defer webhooks.close()
+	broker := newBroker(site, conf.Primary, notifier, webhooks, newJobs(filepath.Join(conf.DataDir, "jobs.json")), newSchedule(filepath.Join(conf.DataDir, "schedule.json")), conf.Backpressure, conf.Footprint, conf.Subscriptions, conf.Ordering)
+	if err := broker.approvals.open(filepath.Join(conf.DataDir, "approvals.json")); err != nil {
+		echo(Log{"t": "approvals_load", "error": err.Error()})
+		return
+	}
+	if conf.Record != "" {
+		r, err := newRecorder(conf.Record)
+		if err != nil {
+			echo(Log{"t": "record", "error": err.Error()})
+			return
+		}
+		recorder = r
+		defer func() {
+			recorder = nil
+			r.close()
+		}()
+	}
+	// Background work is spawned by the broker, so that stopping the broker waits for it to end, before
+	// the globals above are torn down.
+	broker.start()
+	defer broker.stop()
+	broker.spawn(func() { notifier.run(broker.quit) })
+	if a := analytics; a != nil {
+		broker.spawn(func() { a.run(broker.quit) })
+	}
+	broker.spawn(broker.reap)
+	broker.spawn(func() { broker.schedule.run(broker) })
+	if cluster != nil {
+		cluster.run(broker)
+	}
+	if conf.Mock {
+		broker.spawn(func() { newMock(broker).run(conf.MockRate) })
+	}
+	if conf.Replay != "" {
+		broker.spawn(func() { broker.replayRecording(conf.Replay, conf.ReplaySpeed) })
+	}
+	if conf.RemoteWrite.URL != "" {
+		rw := newRemoteWriter(conf.RemoteWrite, site)
+		broker.spawn(func() { rw.run(broker.quit) })
+	}
+	if conf.MaxCacheBytes > 0 {
+		site.spillTo(filepath.Join(conf.DataDir, "evicted"))
+		broker.spawn(func() { broker.trim(conf.MaxCacheBytes) })
+	}
+	defineJobs(broker, conf.DataDir, conf.AOF.Archive)
+	broker.publishJobs(broker.jobs.list())
+	admin := newAdmin(broker)
+	broker.spawn(admin.run)
+	broker.spawn(func() { broker.jobs.schedule("gc", time.Hour, broker.quit) })
+	if aof != nil && conf.AOF.Archive.URL != "" {
+		broker.spawn(func() { broker.jobs.schedule("archive", archiveEvery, broker.quit) })
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", newHealthHandler(broker, &ready, true))
+	mux.Handle("/readyz", newHealthHandler(broker, &ready, false))
 
 	if conf.Debug {
-		http.Handle("/_d/site", newDebugHandler(broker))
+		mux.Handle("/_d/site", newDebugHandler(broker))
+	}
+
+	if conf.MetricsListen != "" {
+		metrics := newMetricsServer(conf.MetricsListen, site)
+		go serveMetrics(metrics)
+		defer metrics.Close()
 	}
 
 	var oauth2Config oauth2.Config
@@ -84,7 +301,8 @@ func Run(conf ServerConf) {
 		defer cancel()
 		provider, err := oidc.NewProvider(ctx, conf.OIDCProviderURL)
 		if err != nil {
-			panic(err)
+			echo(Log{"t": "oidc", "url": conf.OIDCProviderURL, "error": err.Error()})
+			return
 		}
 
 		oauth2Config = oauth2.Config{
@@ -96,34 +314,130 @@ func Run(conf ServerConf) {
 			Scopes: []string{oidc.ScopeOpenID},
 		}
 
-		http.Handle("/_auth/init", newOIDCInitHandler(sessions, oauth2Config))
-		http.Handle("/_auth/callback", newOAuth2Handler(sessions, oauth2Config, conf.OIDCProviderURL))
-		http.Handle("/_logout", newOIDCLogoutHandler(sessions, conf.OIDCEndSessionURL))
+		mux.Handle("/_auth/init", newOIDCInitHandler(sessions, oauth2Config))
+		mux.Handle("/_auth/callback", newOAuth2Handler(sessions, oauth2Config, conf.OIDCProviderURL))
+		mux.Handle("/_logout", newOIDCLogoutHandler(sessions, conf.OIDCEndSessionURL))
 	}
 
 	// XXX wrap special _ routes in a separate handler
-	http.Handle("/_s", newSocketServer(broker, sessions))
+	cors := newCORS(conf.AllowedOrigins)
+	upgrader := newUpgrader(conf.Footprint.SocketBufferSize, conf.Compression.Deflate, cors.checkOrigin)
+	limiter := newRequestLimiter(conf.RateLimits)
+	sockets := newSocketServer(broker, sessions, conf.oidcEnabled(), oauth2Config, conf.KeepAlive, upgrader, limiter)
+	defer sockets.close() // before the broker stops
+	mux.Handle("/_s", sockets)
 	fileDir := filepath.Join(conf.DataDir, "f")
-	http.Handle("/_f", newFileStore(fileDir))                                                                  // XXX secure
-	http.Handle("/_f/", newFileServer(fileDir))                                                                // XXX secure
-	http.Handle("/_p", newProxy())                                                                             // XXX secure
-	http.Handle("/_c/", newCache("/_c/"))                                                                      // XXX secure
-	http.Handle("/_ide", http.StripPrefix("/_ide", http.FileServer(http.Dir(path.Join(conf.WebDir, "_ide"))))) // XXX secure
-	http.Handle("/", newWebServer(site, broker, users, conf.oidcEnabled(), sessions, oauth2Config, conf.WebDir))
+	mux.Handle("/_f", newFileStore(fileDir))                                                                      // XXX secure
+	mux.Handle("/_f/", newFileServer(fileDir))                                                                    // XXX secure
+	mux.Handle("/_p", newProxy())                                                                                 // XXX secure
+	mux.Handle("/_c/", newCache("/_c/"))                                                                          // XXX secure
+	mux.Handle("/_ide", http.StripPrefix("/_ide", newAssetServer(newAssetFS(joinAssetDir(conf.WebDir, "_ide"))))) // XXX secure
+	auth := newAuth(users, conf.oidcEnabled(), sessions, oauth2Config)
+	mux.Handle("/_subscriptions", newSubscriptionHandler(notifier, site, auth))
+	mux.Handle("/_webhooks", newWebhookHandler(webhooks, auth))
+	mux.Handle("/_schedule", newScheduleHandler(broker.schedule, auth))
+	mux.Handle("/_admin", newAdminHandler(admin, auth))
+	mux.Handle("/_admin/analytics", newAnalyticsHandler(site, auth))
+	mux.Handle("/_admin/audit", newAuditHandler(auth))
+	mux.Handle("/_annotations", newAnnotationHandler(broker, auth))
+	mux.Handle("/_commands", newCommandHandler(broker, auth))
+	mux.Handle("/_stream", newStreamHandler(broker, auth, limiter))
+	mux.Handle("/_publish", newPublishHandler(broker, auth, limiter, cors.checkOrigin))
+	mux.Handle("/_contract", newContractHandler())
+	mux.Handle("/_parse", newParseHandler(auth, limiter))
+	mux.Handle("/_api/pages", newPageListHandler(site, auth))
+	mux.Handle("/_api/cards", newCardListHandler(site, auth))
+	mux.Handle("/_api/batch", newBatchHandler(site, auth))
+	mux.Handle("/_api/search", newSearchHandler(site, auth))
+	mux.Handle("/_api/site", newSiteHandler(broker, auth))
+	mux.Handle("/_api/diff", newDiffHandler(site, auth))
+	mux.Handle("/_taps", newTapHandler(broker.taps, auth))
+	mux.Handle("/_peer", newPeerHandler(broker, auth))
+	var root http.Handler = newWebServer(site, broker, users, conf.oidcEnabled(), sessions, oauth2Config, conf.WebDir, conf.SPAFallback, limiter)
+	if conf.Compression.Gzip {
+		root = gzipped(root)
+	}
+	if conf.Dev {
+		root = noCache(root)
+		if isOriginURL(conf.WebDir) {
+			warn(Log{"t": "dev", "error": "cannot watch remote web assets for changes", "webroot": conf.WebDir})
+		} else {
+			broker.spawn(func() { broker.watchAssets(conf.WebDir) })
+		}
+	}
+	mux.Handle("/", root)
 
 	for _, line := range strings.Split(fmt.Sprintf(logo, conf.Version, conf.BuildDate), "\n") {
 		log.Println("#", line)
 	}
 
-	echo(Log{"t": "listen", "address": conf.Listen, "webroot": conf.WebDir})
+	if conf.OnReady != nil {
+		conf.OnReady(&LocalSite{broker})
+	}
 
-	if conf.CertFile != "" && conf.KeyFile != "" {
-		if err := http.ListenAndServeTLS(conf.Listen, conf.CertFile, conf.KeyFile, nil); err != nil {
-			echo(Log{"t": "listen_tls", "error": err.Error()})
-		}
+	listeners := conf.listeners()
+	servers := make([]*http.Server, len(listeners))
+	for i, l := range listeners {
+		servers[i] = &http.Server{Addr: l.Address, Handler: logRequests(cors.wrap(limiter.wrap(scopeTo(l.Serves, mux))))}
+	}
+	served := make(chan struct{})  // closed once the servers have stopped accepting requests
+	drained := make(chan struct{}) // closed once in-flight requests have completed
+	if conf.Stop != nil {
+		go func() {
+			defer close(drained)
+			shutdownOn(conf.Stop, served, servers...)
+		}()
 	} else {
-		if err := http.ListenAndServe(conf.Listen, nil); err != nil {
-			echo(Log{"t": "listen_no_tls", "error": err.Error()})
+		close(drained)
+	}
+
+	var wg sync.WaitGroup
+	for i, l := range listeners {
+		serves := l.Serves
+		if serves == "" {
+			serves = ServeAll
 		}
+		echo(Log{"t": "listen", "address": l.Address, "serves": serves, "webroot": conf.WebDir})
+		wg.Add(1)
+		go func(server *http.Server, l ListenConf) {
+			defer wg.Done()
+			if err := serve(server, l, conf.CertFile, conf.KeyFile); err != nil && err != http.ErrServerClosed {
+				t := "listen_no_tls"
+				if conf.CertFile != "" && conf.KeyFile != "" && !l.unix() {
+					t = "listen_tls"
+				}
+				echo(Log{"t": t, "address": l.Address, "error": err.Error()})
+				for _, s := range servers { // don't carry on with part of the interface missing
+					s.Close()
+				}
+			}
+		}(servers[i], l)
+	}
+	wg.Wait()
+	close(served)
+	<-drained // serving ends as soon as shutdown begins; don't tear down what in-flight requests use until they're done
+}
+
+// shutdownOn stops the servers once stop is closed, waiting for in-flight requests to complete.
+// Returns early if served is closed, since the servers have failed by then.
+func shutdownOn(stop, served <-chan struct{}, servers ...*http.Server) {
+	select {
+	case <-stop:
+	case <-served:
+		return
+	}
+	echo(Log{"t": "shutdown"})
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				echo(Log{"t": "shutdown", "address": server.Addr, "error": err.Error()})
+			}
+		}(server)
 	}
+	wg.Wait()
 }
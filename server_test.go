@@ -0,0 +1,144 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunCleansUpOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "approvals.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Run(ServerConf{
+		Listeners:       []ListenConf{{Address: l.Addr().String(), Listener: l}},
+		DataDir:         dir,
+		AccessKeyID:     "id",
+		AccessKeySecret: "secret",
+		AOF:             AOFConf{Dir: filepath.Join(dir, "aof"), Fsync: "never"},
+		Analytics:       AnalyticsConf{Privacy: AnalyticsCounts},
+		Record:          filepath.Join(dir, "recording.jsonl"),
+	}) // fails to load approvals, after opening the AOF and starting analytics
+
+	if aof != nil {
+		t.Error("AOF left open")
+	}
+	if analytics != nil {
+		t.Error("analytics left running")
+	}
+	if recorder != nil {
+		t.Error("recorder left open")
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Error("listener left open")
+	}
+}
+
+func TestRunDrainsRequests(t *testing.T) {
+	dir := t.TempDir()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entered, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		Run(ServerConf{
+			Listeners:       []ListenConf{{Address: l.Addr().String(), Listener: l}},
+			DataDir:         dir,
+			AccessKeyID:     "id",
+			AccessKeySecret: "secret",
+			AOF:             AOFConf{Dir: filepath.Join(dir, "aof"), Fsync: "never"},
+			Validators: []CardValidator{{Check: func(route, card string, data map[string]interface{}) error {
+				once.Do(func() { // hold the request up, until the server is stopping
+					close(entered)
+					<-release
+				})
+				return nil
+			}}},
+			Stop: stop,
+		})
+	}()
+
+	status := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPatch, "http://"+l.Addr().String()+"/drained", strings.NewReader(testPatch))
+		req.SetBasicAuth("id", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-entered
+	close(stop)
+	time.Sleep(100 * time.Millisecond) // shutdown has begun
+	close(release)
+	<-stopped
+
+	if s := <-status; s != http.StatusOK {
+		t.Fatalf("want the in-flight patch accepted, got status %d", s)
+	}
+	var logged bool
+	filepath.Walk(filepath.Join(dir, "aof"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			data, _ := ioutil.ReadFile(path)
+			logged = logged || bytes.Contains(data, []byte("/drained"))
+		}
+		return nil
+	})
+	if !logged {
+		t.Fatal("accepted patch missing from the AOF")
+	}
+}
+
+func TestRunRestoresGlobals(t *testing.T) {
+	prevLogger, prevTracer, prevClock := logger, tracer, clock
+	rec := &logRecorder{}
+	Run(ServerConf{
+		Listeners:       []ListenConf{{Address: "127.0.0.1:0"}},
+		DataDir:         t.TempDir(),
+		AccessKeyID:     "id",
+		AccessKeySecret: "secret",
+		Profile:         "unknown", // fails once the logger, tracer and clock are in place
+		Logger:          rec,
+		Tracer:          &struct{ noopTracer }{},
+		Clock:           NewManualClock(time.Unix(0, 0)),
+	})
+	if len(rec.logs) == 0 {
+		t.Fatal("configured logger not used")
+	}
+	if logger != prevLogger || tracer != prevTracer || clock != prevClock {
+		t.Fatal("logger, tracer or clock left in place")
+	}
+}
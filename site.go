@@ -17,32 +17,89 @@ package wave
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"sort"
 	"sync"
+	"time"
 )
 
 const (
 	keySeparator = " "
+	// draftPrefix is prepended to a page's url to obtain the url of its draft.
+	draftPrefix = "/_draft"
+	// draftRole is the role required to view drafts.
+	draftRole = "editor"
 )
 
 // Site represents the website, and holds a collection of pages.
 type Site struct {
 	sync.RWMutex
-	pages map[string]*Page // url => page
-	ns    *Namespace       // buffer type namespace
+	pages       map[string]*Page        // url => page
+	evicted     map[string]*EvictedPage // url => page spilled to disk to stay within the memory budget
+	spillDir    string                  // directory evicted pages are written to
+	ns          *Namespace              // buffer type namespace
+	acl         *ACL                    // access control rules
+	annotations *Annotations            // time range annotations
+	search      *SearchIndex            // full-text index of page contents; nil if off
+	undoDepth   int                     // past versions retained per page, for diffs; see Footprint
 }
 
 func newSite() *Site {
-	return &Site{pages: make(map[string]*Page), ns: newNamespace()}
+	site := &Site{pages: make(map[string]*Page), evicted: make(map[string]*EvictedPage), ns: newNamespace(), acl: newACL(), annotations: newAnnotations(""), undoDepth: defaultFootprint.UndoDepth}
+	site.acl.set(draftPrefix, nil, []string{draftRole}) // drafts are visible only to editors
+	site.acl.set(systemPrefix, nil, []string{systemRole})
+	site.acl.set(clientPrefix, nil, []string{systemRole}) // client pages are read by their clients over websockets
+	return site
+}
+
+func draftURL(url string) string {
+	return draftPrefix + url
+}
+
+// publish atomically replaces the contents of the page at url with a copy of its draft.
+func (site *Site) publish(url string, version int64) (*Page, bool) {
+	draft := site.at(draftURL(url))
+	if draft == nil {
+		return nil, false
+	}
+
+	draft.RLock()
+	d := draft.dump()
+	writers := make(map[string]CardWriter, len(draft.writers))
+	for k, w := range draft.writers {
+		writers[k] = w
+	}
+	draft.RUnlock()
+
+	p := loadPage(site.ns, d)
+	p.writers = writers
+	p.version = version
+	p.modified = clock.Now()
+	if prev := site.at(url); prev != nil {
+		p.undo = prev.replaced(version, site.undoDepth)
+	}
+
+	site.Lock()
+	site.forget(url)
+	site.pages[url] = p
+	site.Unlock()
+
+	return p, true
 }
 
 // at returns the page at url, else nil
 func (site *Site) at(url string) *Page {
 	site.RLock()
-	defer site.RUnlock()
-	if p, ok := site.pages[url]; ok {
+	p, ok := site.pages[url]
+	_, evicted := site.evicted[url]
+	site.RUnlock()
+	if ok {
+		p.access()
 		return p
 	}
+	if evicted {
+		return site.reload(url)
+	}
 	return nil
 }
 
@@ -65,35 +122,93 @@ func (site *Site) get(url string) *Page {
 func (site *Site) del(url string) {
 	site.Lock()
 	delete(site.pages, url)
+	site.forget(url)
 	site.Unlock()
+	if site.search != nil {
+		site.search.remove(url)
+	}
 }
 
-// set overwrites a page's content.
-func (site *Site) set(url string, data []byte) error {
+// forget discards the evicted copy of the page at url, if any. Must be called under lock.
+func (site *Site) forget(url string) {
+	if e, ok := site.evicted[url]; ok {
+		delete(site.evicted, url)
+		os.Remove(e.path)
+	}
+}
+
+// set overwrites a page's content, and sets the page's version.
+func (site *Site) set(url string, data []byte, version int64) error {
 	var ops OpsD
 	if err := json.Unmarshal(data, &ops); err != nil {
 		return fmt.Errorf("failed unmarshaling data: %v", err)
 	}
 	if ops.P != nil {
-		site.pages[url] = loadPage(site.ns, ops.P)
+		p := loadPage(site.ns, ops.P)
+		if ops.T > 0 {
+			p.ttl = time.Duration(ops.T) * time.Second
+		}
+		p.version = version
+		if prev := site.at(url); prev != nil && version > 0 {
+			p.undo = prev.replaced(version, site.undoDepth)
+		}
+		site.Lock()
+		site.forget(url)
+		site.pages[url] = p
+		site.Unlock()
 	}
 	return nil
 }
 
-// patch patches a page's content.
-func (site *Site) patch(url string, data []byte) error {
-	var ops OpsD
-	if err := json.Unmarshal(data, &ops); err != nil { // TODO speed up
-		return fmt.Errorf("failed unmarshaling data: %v", err)
+// patch patches a page's content, and sets the page's version.
+func (site *Site) patch(url string, data []byte, version int64) error {
+	ops, err := parsePatch(data)
+	if err != nil {
+		return err
 	}
-	site.exec(url, ops)
+	site.exec(url, ops, version)
 	return nil
 }
 
+// touch sets the last-modified time of the page at url, if any.
+func (site *Site) touch(url string, t time.Time) {
+	if p := site.at(url); p != nil && !t.IsZero() {
+		p.Lock()
+		p.modified = t
+		p.Unlock()
+		if site.search != nil {
+			site.search.stamp(url, t)
+		}
+	}
+}
+
+// has reports whether there is a page at url, in memory or evicted.
+func (site *Site) has(url string) bool {
+	site.RLock()
+	defer site.RUnlock()
+	_, ok := site.pages[url]
+	_, evicted := site.evicted[url]
+	return ok || evicted
+}
+
+// version returns the version of the page at url, or 0 if there is no such page.
+func (site *Site) version(url string) int64 {
+	p := site.at(url)
+	if p == nil {
+		return 0
+	}
+	p.RLock()
+	defer p.RUnlock()
+	return p.version
+}
+
 // exec applies changes to a page's content.
-func (site *Site) exec(url string, ops OpsD) {
+func (site *Site) exec(url string, ops OpsD, version int64) {
 	page := site.get(url)
 	page.Lock()
+	if version > 0 {
+		page.record(ops, version, site.undoDepth)
+	}
 	for _, op := range ops.D {
 		if len(op.K) > 0 {
 			if op.C != nil {
@@ -108,28 +223,48 @@ func (site *Site) exec(url string, ops OpsD) {
 				page.set(op.K, op.V)
 			}
 		} else { // drop page
+			undo := page.undo
 			site.del(url)
 			page.Unlock()
 			page = site.get(url)
 			page.Lock()
+			page.undo = undo
 		}
 	}
+	if ops.T > 0 {
+		page.ttl = time.Duration(ops.T) * time.Second
+	} else if ops.T < 0 {
+		page.ttl = 0
+	}
 	page.cache = nil // will be re-cached on next call to site.get(url)
+	page.version = version
+	page.modified = clock.Now()
+	page.restrict()
 	page.Unlock()
 }
 
+// urlsUnder returns a sorted slice of urls at or below prefix.
+func (site *Site) urlsUnder(prefix string) []string {
+	var urls []string
+	for _, url := range site.urls() {
+		if isPathPrefix(prefix, url) {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
 // urls returns a sorted slice of urls hosted by this site.
 func (site *Site) urls() []string {
 	site.RLock()
 	defer site.RUnlock()
 
-	pages := site.pages
-
-	urls := make([]string, len(pages))
-	i := 0
-	for url := range pages {
-		urls[i] = url
-		i++
+	urls := make([]string, 0, len(site.pages)+len(site.evicted))
+	for url := range site.pages {
+		urls = append(urls, url)
+	}
+	for url := range site.evicted {
+		urls = append(urls, url)
 	}
 
 	sort.Strings(urls)
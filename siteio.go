@@ -0,0 +1,256 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeNDJSON = "application/x-ndjson"
+	viaImport         = "import"
+)
+
+// SiteEntry represents one page in an NDJSON site export.
+type SiteEntry struct {
+	URL  string          `json:"url"`
+	Page json.RawMessage `json:"page"` // page, with its TTL, as accepted by import
+}
+
+// SiteImportError represents a page that could not be imported.
+type SiteImportError struct {
+	URL   string `json:"url,omitempty"`
+	Line  int    `json:"line,omitempty"` // NDJSON imports only
+	Error string `json:"error"`
+}
+
+// SiteImport represents the response to an import request.
+type SiteImport struct {
+	Imported int               `json:"imported"`
+	Errors   []SiteImportError `json:"errors,omitempty"`
+}
+
+// SiteHandler exports and imports whole sites, or the pages under a prefix, for moving dashboards between instances:
+// GET /_api/site?prefix=/foo exports the pages, with their cards and TTLs, as one JSON object keyed by url,
+// or, with ?format=ndjson (or Accept: application/x-ndjson), as one {"url":..,"page":..} object per line.
+// PUT /_api/site imports either format, replacing each page wholesale; ?prefix= imports only the pages under it.
+// Imported pages are logged, replicated and broadcast like any other change. Requires an access key.
+type SiteHandler struct {
+	broker *Broker
+	auth   *Auth
+}
+
+func newSiteHandler(broker *Broker, auth *Auth) *SiteHandler {
+	return &SiteHandler{broker, auth}
+}
+
+func (h *SiteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, ok := h.auth.trusted(r)
+	if !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		prefix = "/"
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ndjson := wantsNDJSON(r, r.Header.Get("Accept"))
+		if ndjson {
+			w.Header().Set("Content-Type", contentTypeNDJSON)
+		} else {
+			w.Header().Set("Content-Type", contentTypeJSON)
+		}
+		n, err := h.broker.exportSite(r.Context(), w, prefix, ndjson)
+		if err != nil { // headers are out; all we can do is cut the response short
+			echo(Log{"t": "site_export", "remote": getRemoteAddr(r), "prefix": prefix, "error": err.Error()})
+			return
+		}
+		echo(Log{"t": "site_export", "remote": getRemoteAddr(r), "prefix": prefix, "pages": strconv.Itoa(n)})
+	case http.MethodPut, http.MethodPost:
+		ctx := withWriter(withRemote(r.Context(), getRemoteAddr(r)), username, viaImport)
+		var resp SiteImport
+		if wantsNDJSON(r, r.Header.Get("Content-Type")) {
+			resp = h.broker.importNDJSON(ctx, r.Body, prefix)
+		} else {
+			resp = h.broker.importJSON(ctx, r.Body, prefix)
+		}
+		echo(Log{"t": "site_import", "remote": getRemoteAddr(r), "prefix": prefix, "pages": strconv.Itoa(resp.Imported), "errors": strconv.Itoa(len(resp.Errors))})
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(resp)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// wantsNDJSON reports whether a request asks for NDJSON, via ?format= or the given content type header.
+func wantsNDJSON(r *http.Request, header string) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "ndjson"
+	}
+	for _, t := range strings.Split(header, ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(t)); err == nil && mt == contentTypeNDJSON {
+			return true
+		}
+	}
+	return false
+}
+
+// exportSite writes the pages under prefix, excluding system pages, and returns how many were written.
+// Pages are written one at a time, so that large sites are never held in memory as a whole.
+func (b *Broker) exportSite(ctx context.Context, w io.Writer, prefix string, ndjson bool) (int, error) {
+	bw := bufio.NewWriter(w)
+	if !ndjson {
+		bw.WriteString("{")
+	}
+	n := 0
+	now := clock.Now()
+	for _, url := range b.site.snapshotURLs() {
+		if !isPathPrefix(prefix, url) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		page := b.site.peek(url)
+		if page == nil {
+			continue // deleted since listing
+		}
+		page.RLock()
+		expired := page.expired(now)
+		page.RUnlock()
+		if expired {
+			continue
+		}
+		data := page.snapshot()
+		if data == nil {
+			continue
+		}
+		key, _ := json.Marshal(url)
+		if ndjson {
+			line, err := json.Marshal(SiteEntry{url, data})
+			if err != nil {
+				return n, err
+			}
+			bw.Write(line)
+			bw.WriteString("\n")
+		} else {
+			if n > 0 {
+				bw.WriteString(",")
+			}
+			bw.Write(key)
+			bw.WriteString(":")
+			bw.Write(data)
+		}
+		n++
+	}
+	if !ndjson {
+		bw.WriteString("}\n")
+	}
+	return n, bw.Flush()
+}
+
+// importJSON imports pages from a JSON object keyed by url, as written by exportSite.
+func (b *Broker) importJSON(ctx context.Context, r io.Reader, prefix string) SiteImport {
+	var resp SiteImport
+	var pages map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&pages); err != nil {
+		resp.Errors = append(resp.Errors, SiteImportError{Error: err.Error()})
+		return resp
+	}
+	urls := make([]string, 0, len(pages))
+	for url := range pages {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	for _, url := range urls {
+		if !isPathPrefix(prefix, url) {
+			continue
+		}
+		if ctx.Err() != nil { // client went away; don't import the rest
+			break
+		}
+		if err := b.importPage(ctx, url, pages[url]); err != nil {
+			resp.Errors = append(resp.Errors, SiteImportError{URL: url, Error: err.Error()})
+		} else {
+			resp.Imported++
+		}
+	}
+	return resp
+}
+
+// importNDJSON imports pages from one SiteEntry per line, as written by exportSite.
+func (b *Broker) importNDJSON(ctx context.Context, r io.Reader, prefix string) SiteImport {
+	var resp SiteImport
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxStreamLine)
+	line := 0
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return resp
+		}
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e SiteEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			resp.Errors = append(resp.Errors, SiteImportError{Line: line, Error: err.Error()})
+			continue
+		}
+		if !isPathPrefix(prefix, e.URL) {
+			continue
+		}
+		if err := b.importPage(ctx, e.URL, e.Page); err != nil {
+			resp.Errors = append(resp.Errors, SiteImportError{URL: e.URL, Line: line, Error: err.Error()})
+		} else {
+			resp.Imported++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		resp.Errors = append(resp.Errors, SiteImportError{Line: line + 1, Error: err.Error()})
+	}
+	return resp
+}
+
+// importPage replaces the page at url with an exported copy.
+func (b *Broker) importPage(ctx context.Context, url string, data []byte) error {
+	if !strings.HasPrefix(url, "/") {
+		return fmt.Errorf("want absolute url, got %q", url)
+	}
+	if isPathPrefix(systemPrefix, url) {
+		return fmt.Errorf("cannot import system page %s", url)
+	}
+	var ops OpsD
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return fmt.Errorf("failed unmarshaling page: %v", err)
+	}
+	if ops.P == nil {
+		return fmt.Errorf("want page, got patch")
+	}
+	return b.replace(ctx, url, data)
+}
@@ -15,35 +15,141 @@
 package wave
 
 import (
+	"encoding/json"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/oauth2"
 )
 
 // SocketServer represents a websocket server.
 type SocketServer struct {
-	broker   *Broker
-	sessions *OIDCSessions
+	broker       *Broker
+	sessions     *OIDCSessions
+	oidcEnabled  bool
+	oauth2Config oauth2.Config
+	keepAlive    KeepAlive
+	upgrader     *websocket.Upgrader
+	limiter      *RequestLimiter
+	mu           sync.Mutex
+	clients      map[*Client]bool // connected clients
+	connected    sync.WaitGroup   // done when all clients are gone
 }
 
-func newSocketServer(broker *Broker, sessions *OIDCSessions) *SocketServer {
+func newSocketServer(broker *Broker, sessions *OIDCSessions, oidcEnabled bool, oauth2Config oauth2.Config, keepAlive KeepAlive, upgrader *websocket.Upgrader, limiter *RequestLimiter) *SocketServer {
 	return &SocketServer{
 		broker,
 		sessions,
+		oidcEnabled,
+		oauth2Config,
+		keepAlive.withDefaults(),
+		upgrader,
+		limiter,
+		sync.Mutex{},
+		make(map[*Client]bool),
+		sync.WaitGroup{},
+	}
+}
+
+// newUpgrader returns a websocket upgrader for UI clients, with read and write buffers of bufferSize bytes.
+func newUpgrader(bufferSize int, compress bool, checkOrigin func(*http.Request) bool) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    bufferSize,   // see Footprint
+		WriteBufferSize:   bufferSize,   // see Footprint
+		WriteBufferPool:   &sync.Pool{}, // held only while writing, rather than for the life of each connection
+		Subprotocols:      []string{msgpackProtocol},
+		EnableCompression: compress,
+		CheckOrigin:       checkOrigin,
 	}
 }
 
 func (s *SocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if s.oidcEnabled && !hasValidSession(r, s.oauth2Config, s.sessions) {
+		stats.authFailed()
+		echo(Log{"t": "socket_auth", "client": getRemoteAddr(r), "error": "no valid session"})
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	wire, err := wireVersionOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		echo(Log{"t": "socket_upgrade", "err": err.Error()})
 		return
 	}
-	username, subject, accessToken, refreshToken := getIdentity(r, s.sessions)
-	client := newClient(getRemoteAddr(r), username, subject, accessToken, refreshToken, s.broker, conn)
+	if primary := s.broker.getPrimary(); primary != "" {
+		redirect(conn, primary)
+		echo(Log{"t": "socket_redirect", "client": getRemoteAddr(r), "address": primary})
+		return
+	}
+	username, subject, roles, accessToken, refreshToken := getIdentity(r, s.sessions)
+	if err := licensing.connect(username); err != nil {
+		refuse(conn, err.Error())
+		echo(Log{"t": "socket_refused", "client": getRemoteAddr(r), "user": username, "error": err.Error()})
+		return
+	}
+	client := newClient(getRemoteAddr(r), username, subject, roles, accessToken, refreshToken, s.broker, s.limiter, conn, s.keepAlive, wire)
+	s.mu.Lock()
+	s.clients[client] = true
+	s.connected.Add(1)
+	s.mu.Unlock()
 	go client.flush()
-	go client.listen()
+	go func() {
+		client.listen()
+		s.mu.Lock()
+		delete(s.clients, client)
+		s.mu.Unlock()
+		s.connected.Done()
+	}()
+}
+
+// close disconnects all clients, and waits for them to go away. Unlike other requests, websocket
+// connections are not closed when the HTTP server shuts down.
+func (s *SocketServer) close() {
+	s.mu.Lock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+	s.connected.Wait()
 }
 
-func getIdentity(r *http.Request, sessions *OIDCSessions) (username, subject, accessToken, refreshToken string) {
+// refuse reports an error to a freshly connected client, and closes the connection.
+func refuse(conn *websocket.Conn, msg string) {
+	defer conn.Close()
+	data, err := json.Marshal(struct {
+		E string `json:"e"`
+	}{msg})
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "refused"))
+}
+
+// redirect instructs a freshly connected client to reconnect to addr, and closes the connection.
+func redirect(conn *websocket.Conn, addr string) {
+	defer conn.Close()
+	data, err := json.Marshal(OpsD{U: addr})
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "redirect"))
+}
+
+func getIdentity(r *http.Request, sessions *OIDCSessions) (username, subject string, roles []string, accessToken, refreshToken string) {
 	username = "default-user"
 	subject = "no-subject"
 	accessToken = ""
@@ -55,15 +161,12 @@ func getIdentity(r *http.Request, sessions *OIDCSessions) (username, subject, ac
 	}
 	sessionID := cookie.Value
 	session, ok := sessions.get(sessionID)
-	if !ok {
+	if !ok || session.token == nil {
 		return
 	}
-	return session.username, session.subject, session.token.AccessToken, session.token.RefreshToken
+	return session.username, session.subject, session.roles, session.token.AccessToken, session.token.RefreshToken
 }
 
 func getRemoteAddr(r *http.Request) string {
-	if addr := r.Header.Get("X-FORWARDED-FOR"); addr != "" { // forwarded via a proxy?
-		return addr
-	}
-	return r.RemoteAddr
+	return proxies.clientAddr(r)
 }
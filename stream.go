@@ -0,0 +1,123 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const maxStreamLine = 64 * 1024 * 1024 // longest accepted patch, in bytes
+
+// StreamPatch represents one line of a streaming publish request.
+type StreamPatch struct {
+	Route string          `json:"route"`
+	Data  json.RawMessage `json:"data"` // patch, as accepted by PATCH
+}
+
+// StreamError represents a line of a streaming publish request that could not be applied.
+type StreamError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// StreamResponse represents the response to a streaming publish request, sent when the request body ends.
+type StreamResponse struct {
+	Applied int           `json:"applied"`
+	Pending []string      `json:"pending,omitempty"` // IDs of patches queued for approval
+	Errors  []StreamError `json:"errors,omitempty"`
+}
+
+// StreamHandler accepts a long-lived request whose body is a stream of patches, one JSON object per line,
+// and applies each patch as soon as its line is received. This lets notebooks and scripts publish
+// incrementally over a single authenticated connection, without per-patch request overhead.
+type StreamHandler struct {
+	broker  *Broker
+	auth    *Auth
+	limiter *RequestLimiter
+}
+
+func newStreamHandler(broker *Broker, auth *Auth, limiter *RequestLimiter) *StreamHandler {
+	return &StreamHandler{broker, auth, limiter}
+}
+
+func (h *StreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := h.auth.trusted(r)
+	if !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	wire, err := wireVersionOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := withWriter(withRemote(extractTraceContext(r), getRemoteAddr(r)), username, "stream")
+	var resp StreamResponse
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxStreamLine)
+	line := 0
+	for scanner.Scan() {
+		if ctx.Err() != nil { // client went away; don't apply the rest of the stream
+			echo(Log{"t": "stream", "remote": getRemoteAddr(r), "lines": strconv.Itoa(line), "error": ctx.Err().Error()})
+			return
+		}
+		line++
+		b := scanner.Bytes()
+		if len(b) == 0 {
+			continue
+		}
+		var p StreamPatch
+		if err := json.Unmarshal(b, &p); err != nil {
+			resp.Errors = append(resp.Errors, StreamError{line, err.Error()})
+			continue
+		}
+		if p.Route == "" || len(p.Data) == 0 {
+			resp.Errors = append(resp.Errors, StreamError{line, "want route and data"})
+			continue
+		}
+		data, err := upgradePatch(p.Data, wire)
+		if err != nil {
+			resp.Errors = append(resp.Errors, StreamError{line, err.Error()})
+			continue
+		}
+		if ok, wait := h.limiter.allowKey(username); !ok {
+			resp.Errors = append(resp.Errors, StreamError{line, errRateLimited(wait).Error()})
+			continue
+		}
+		if id, err := h.broker.patchIf(ctx, p.Route, data, -1); err != nil {
+			resp.Errors = append(resp.Errors, StreamError{line, err.Error()})
+		} else if id != "" {
+			resp.Pending = append(resp.Pending, id)
+		} else {
+			resp.Applied++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		resp.Errors = append(resp.Errors, StreamError{line + 1, err.Error()})
+	}
+	echo(Log{"t": "stream", "remote": getRemoteAddr(r), "lines": strconv.Itoa(line), "applied": strconv.Itoa(resp.Applied)})
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(resp)
+}
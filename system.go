@@ -0,0 +1,185 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// systemPrefix is the url prefix of pages maintained by the server itself.
+	systemPrefix = "/_system"
+	// systemRole is the role required to view system pages.
+	systemRole = "admin"
+	// jobsURL is the url of the page that shows the status of background jobs.
+	jobsURL = systemPrefix + "/jobs"
+	// adminURL is the url of the page that shows the server's status to administrators.
+	adminURL = systemPrefix + "/admin"
+	// jobsShown is the number of jobs listed on the jobs page.
+	jobsShown = 25
+)
+
+// defineJobs registers the server's built-in jobs.
+func defineJobs(b *Broker, dataDir string, archive ArchiveConf) {
+	retry := Retry{Attempts: 3, Backoff: 10 * time.Second}
+	b.jobs.define("compact", retry, func(p Progress) error {
+		if err := b.compactTo(filepath.Join(dataDir, "compact", snapshotName("site", ".aof")), p); err != nil {
+			return err
+		}
+		return b.site.search.save()
+	})
+	b.jobs.define("export", retry, func(p Progress) error {
+		if err := b.exportTo(filepath.Join(dataDir, "exports", snapshotName("site", ".json")), p); err != nil {
+			return err
+		}
+		return b.site.search.save()
+	})
+	b.jobs.define("gc", Retry{}, func(p Progress) error {
+		return b.collect(p)
+	})
+	if aof != nil && archive.URL != "" {
+		a := newArchive(archive)
+		b.jobs.define("archive", retry, func(p Progress) error {
+			return b.archiveAOF(a, archive.Retention, p)
+		})
+	}
+	b.jobs.changed = b.publishJobs
+}
+
+func snapshotName(prefix, ext string) string {
+	return prefix + "-" + clock.Now().UTC().Format("20060102T150405") + ext
+}
+
+// compactTo writes the site's current contents to a file in AOF format, one compacted entry per page.
+// The file can be used in place of the server's log to restore the site.
+func (b *Broker) compactTo(path string, p Progress) error {
+	return writeSnapshot(path, func(f *os.File) error {
+		l := log.New(f, "", log.LstdFlags)
+		if err := writeAOFHeader(l, aofFormat); err != nil {
+			return err
+		}
+		b.writeCompacted(l, p)
+		return nil
+	})
+}
+
+func (b *Broker) writeCompacted(aof *log.Logger, p Progress) {
+	urls := b.site.snapshotURLs()
+	p.total(len(urls))
+	for _, url := range urls {
+		if page := b.site.peek(url); page != nil {
+			if data := page.snapshot(); data != nil {
+				aof.Println(compactMarker, url, string(data))
+			}
+		}
+		p.step(1)
+	}
+}
+
+// exportTo writes the site's current contents to a file as a JSON object, keyed by page url.
+func (b *Broker) exportTo(path string, p Progress) error {
+	return writeSnapshot(path, func(f *os.File) error {
+		urls := b.site.snapshotURLs()
+		p.total(len(urls))
+		pages := make(map[string]json.RawMessage, len(urls))
+		for _, url := range urls {
+			if page := b.site.peek(url); page != nil {
+				if data := page.marshal(); data != nil {
+					pages[url] = data
+				}
+			}
+			p.step(1)
+		}
+		return json.NewEncoder(f).Encode(pages)
+	})
+}
+
+// snapshotURLs returns the urls of pages to be included in snapshots; system pages are excluded.
+func (site *Site) snapshotURLs() []string {
+	var urls []string
+	for _, url := range site.urls() {
+		if !isPathPrefix(systemPrefix, url) {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// writeSnapshot writes a file via a temporary file, so that partially written snapshots are never visible.
+func writeSnapshot(path string, write func(*os.File) error) error {
+	if err := writeFileWith(path, write); err != nil {
+		return err
+	}
+	echo(Log{"t": "snapshot", "path": path})
+	return nil
+}
+
+// collect discards patch history retained for routes that no longer have any subscribers.
+func (b *Broker) collect(p Progress) error {
+	reply := make(chan int)
+	b.sweep <- reply
+	n := <-reply
+	p.total(n)
+	p.step(n)
+	return nil
+}
+
+// publishJobs refreshes the jobs page. Not written to the AOF; the page is rebuilt from job state on boot.
+func (b *Broker) publishJobs(jobs []Job) {
+	var sb strings.Builder
+	sb.WriteString("| Kind | State | Progress | Attempts | Started | Finished | Error |\n")
+	sb.WriteString("|---|---|---|---|---|---|---|\n")
+	for i, j := range jobs {
+		if i == jobsShown {
+			break
+		}
+		progress := strconv.Itoa(j.Done)
+		if j.Total > 0 {
+			progress = fmt.Sprintf("%d/%d", j.Done, j.Total)
+		}
+		finished := ""
+		if j.Finished != nil {
+			finished = j.Finished.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&sb, "| %s | %s | %s | %d | %s | %s | %s |\n",
+			j.Kind, j.State, progress, j.Attempts, j.Started.Format(time.RFC3339), finished, strings.ReplaceAll(j.Error, "|", "\\|"))
+	}
+	data, err := json.Marshal(OpsD{D: []OpD{{K: "jobs", D: map[string]interface{}{
+		"view":    "markdown",
+		"box":     "1 1 12 10",
+		"title":   "Jobs",
+		"content": sb.String(),
+	}}}})
+	if err != nil {
+		echo(Log{"t": "jobs_publish", "error": err.Error()})
+		return
+	}
+	b.pubMux.Lock()
+	defer b.pubMux.Unlock()
+	seq := nextSeq()
+	if err := b.site.patch(jobsURL, data, seq); err != nil {
+		echo(Log{"t": "jobs_publish", "error": err.Error()})
+		return
+	}
+	b.publish <- Pub{jobsURL, data, context.Background(), seq}
+}
@@ -0,0 +1,276 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	tapDuration    = time.Minute      // default capture duration
+	tapMaxDuration = 10 * time.Minute // longest allowed capture
+	tapLimit       = 1000             // default number of messages captured per tap
+	tapMaxLimit    = 10000            // most messages allowed per tap
+	redacted       = "[redacted]"
+)
+
+// sensitiveKeys are substrings of (lowercased) field and attribute names whose values are never logged by taps.
+var sensitiveKeys = []string{"password", "passwd", "secret", "token", "api_key", "apikey", "authorization", "cookie"}
+
+// Tap represents an admin-triggered capture of websocket messages exchanged with a client or on a page.
+// Captured messages are logged as "ws_trace" events, with sensitive fields redacted.
+type Tap struct {
+	ID       string    `json:"id"`
+	Route    string    `json:"route,omitempty"`  // capture messages for clients watching this route
+	Client   string    `json:"client,omitempty"` // capture messages for the client having this id, address or username
+	Sample   float64   `json:"sample"`           // fraction of messages captured, in (0, 1]
+	Limit    int       `json:"limit"`            // stop after capturing this many messages
+	Until    time.Time `json:"until"`            // stop capturing at this time
+	Captured int       `json:"captured"`         // number of messages captured so far
+}
+
+// TapRequest represents a request to start a tap.
+type TapRequest struct {
+	Route    string  `json:"route"`
+	Client   string  `json:"client"`
+	Duration float64 `json:"duration"` // seconds; defaults to a minute
+	Sample   float64 `json:"sample"`   // defaults to 1
+	Limit    int     `json:"limit"`    // defaults to 1000
+}
+
+// Taps holds active taps.
+type Taps struct {
+	sync.Mutex
+	n    int32 // number of active taps; read without locking to keep the no-tap path cheap
+	taps map[string]*Tap
+}
+
+func newTaps() *Taps {
+	return &Taps{taps: make(map[string]*Tap)}
+}
+
+// add starts a tap.
+func (ts *Taps) add(q TapRequest) *Tap {
+	d := time.Duration(q.Duration * float64(time.Second))
+	if d <= 0 {
+		d = tapDuration
+	} else if d > tapMaxDuration {
+		d = tapMaxDuration
+	}
+	if q.Sample <= 0 || q.Sample > 1 {
+		q.Sample = 1
+	}
+	if q.Limit <= 0 {
+		q.Limit = tapLimit
+	} else if q.Limit > tapMaxLimit {
+		q.Limit = tapMaxLimit
+	}
+	t := &Tap{uuid.New().String(), q.Route, q.Client, q.Sample, q.Limit, clock.Now().Add(d), 0}
+	ts.Lock()
+	ts.taps[t.ID] = t
+	atomic.StoreInt32(&ts.n, int32(len(ts.taps)))
+	ts.Unlock()
+	echo(Log{"t": "tap_start", "id": t.ID, "route": t.Route, "client": t.Client, "until": t.Until.Format(time.RFC3339)})
+	return t
+}
+
+// remove stops a tap, and reports whether it was active.
+func (ts *Taps) remove(id string) bool {
+	ts.Lock()
+	defer ts.Unlock()
+	return ts.drop(id, "stopped")
+}
+
+// drop must be called under lock.
+func (ts *Taps) drop(id, reason string) bool {
+	t, ok := ts.taps[id]
+	if !ok {
+		return false
+	}
+	delete(ts.taps, id)
+	atomic.StoreInt32(&ts.n, int32(len(ts.taps)))
+	echo(Log{"t": "tap_stop", "id": id, "reason": reason, "captured": strconv.Itoa(t.Captured)})
+	return true
+}
+
+// list returns active taps.
+func (ts *Taps) list() []Tap {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.expire(clock.Now())
+	taps := make([]Tap, 0, len(ts.taps))
+	for _, t := range ts.taps {
+		taps = append(taps, *t)
+	}
+	return taps
+}
+
+// expire must be called under lock.
+func (ts *Taps) expire(now time.Time) {
+	for id, t := range ts.taps {
+		if now.After(t.Until) {
+			ts.drop(id, "expired")
+		}
+	}
+}
+
+// capture logs a message sent to (dir "out") or received from (dir "in") a client, if any tap wants it.
+// route is the message's address for inbound messages, and empty for outbound messages.
+func (ts *Taps) capture(c *Client, dir, route string, data []byte) {
+	if atomic.LoadInt32(&ts.n) == 0 {
+		return
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	ts.expire(clock.Now())
+	for id, t := range ts.taps {
+		if !t.matches(c, route) || (t.Sample < 1 && rand.Float64() >= t.Sample) {
+			continue
+		}
+		echo(Log{"t": "ws_trace", "tap": id, "dir": dir, "client": c.addr, "user": c.username, "route": route, "data": string(redact(data))})
+		if t.Captured++; t.Captured >= t.Limit {
+			ts.drop(id, "limit")
+		}
+	}
+}
+
+func (t *Tap) matches(c *Client, route string) bool {
+	if t.Client != "" && t.Client != c.id && t.Client != c.addr && t.Client != c.username {
+		return false
+	}
+	if t.Route == "" {
+		return true
+	}
+	if route != "" {
+		return route == t.Route
+	}
+	for _, r := range c.routes {
+		if r == t.Route {
+			return true
+		}
+	}
+	return false
+}
+
+// redact blanks out the values of sensitive fields and attributes in a message.
+// Malformed JSON is redacted entirely; other payloads (hashes, card names) are left as-is.
+func redact(data []byte) []byte {
+	if len(data) == 0 || (data[0] != '{' && data[0] != '[') {
+		return data
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return []byte(redacted)
+	}
+	v = redactValue(v)
+	b, err := json.Marshal(v)
+	if err != nil {
+		return []byte(redacted)
+	}
+	return b
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		// Patch ops carry attribute names in keys: {"k": "card attr", "v": value}.
+		if k, ok := v["k"].(string); ok && isSensitive(k) {
+			if _, ok := v["v"]; ok {
+				v["v"] = redacted
+			}
+		}
+		for k, x := range v {
+			if isSensitive(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactValue(x)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, x := range v {
+			v[i] = redactValue(x)
+		}
+		return v
+	}
+	return v
+}
+
+func isSensitive(k string) bool {
+	k = strings.ToLower(k)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// TapHandler starts (POST), lists (GET) and stops (DELETE ?id=) taps.
+type TapHandler struct {
+	taps *Taps
+	auth *Auth
+}
+
+func newTapHandler(taps *Taps, auth *Auth) *TapHandler {
+	return &TapHandler{taps, auth}
+}
+
+func (h *TapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth.trusted(r); !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(h.taps.list())
+	case http.MethodPost:
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+		if err != nil {
+			if len(b) >= maxMessageSize {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		var q TapRequest
+		if err := json.Unmarshal(b, &q); err != nil || (q.Route == "" && q.Client == "") {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(h.taps.add(q))
+	case http.MethodDelete:
+		if !h.taps.remove(r.URL.Query().Get("id")) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
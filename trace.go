@@ -0,0 +1,145 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Span represents a unit of traced work.
+type Span interface {
+	// SetAttr annotates the span.
+	SetAttr(k, v string)
+	// End completes the span.
+	End()
+}
+
+// Tracer starts spans. Implementations must be safe for concurrent use.
+// To export spans to an OpenTelemetry collector, set ServerConf.OTLP. To hand them to an OTel SDK instead,
+// implement Tracer using an OTel tracer, reading the producer's trace context from the parent context
+// using TraceContextFrom(), and inject it via ServerConf.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// TraceContext represents W3C trace context (https://www.w3.org/TR/trace-context/).
+type TraceContext struct {
+	TraceID string // 32 hex chars
+	SpanID  string // 16 hex chars
+	Flags   string // 2 hex chars
+}
+
+type traceContextKey struct{}
+
+// TraceContextFrom returns the trace context carried by ctx, if any.
+func TraceContextFrom(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
+
+// WithTraceContext returns a copy of ctx carrying tc.
+func WithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// extractTraceContext returns the request's context, annotated with the producer's
+// trace context from the "traceparent" header, if present and well-formed.
+func extractTraceContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	// version-traceid-spanid-flags
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	return WithTraceContext(ctx, TraceContext{parts[1], parts[2], parts[3]})
+}
+
+var tracer Tracer = noopTracer{}
+
+// trace starts a span using the configured tracer.
+func trace(ctx context.Context, name string) (context.Context, Span) {
+	return tracer.Start(ctx, name)
+}
+
+type noopTracer struct{}
+type noopSpan struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+func (noopSpan) SetAttr(string, string) {}
+func (noopSpan) End()                   {}
+
+// LogTracer is a Tracer that logs completed spans at debug level.
+type LogTracer struct{}
+
+// LogSpan represents a span recorded by LogTracer.
+type LogSpan struct {
+	name   string
+	tc     TraceContext
+	parent string
+	start  time.Time
+	attrs  Log
+}
+
+// Start implements Tracer.
+func (LogTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, tc, parent := childTraceContext(ctx)
+	return ctx, &LogSpan{name, tc, parent, time.Now(), Log{}}
+}
+
+// childTraceContext returns a copy of ctx carrying a new span's trace context, continuing the trace ctx carries,
+// if any, and the ID of the span's parent, if any.
+func childTraceContext(ctx context.Context) (context.Context, TraceContext, string) {
+	tc, ok := TraceContextFrom(ctx)
+	parent := tc.SpanID
+	if !ok {
+		tc = TraceContext{randomHex(16), "", "01"}
+	}
+	tc.SpanID = randomHex(8)
+	return WithTraceContext(ctx, tc), tc, parent
+}
+
+// SetAttr implements Span.
+func (s *LogSpan) SetAttr(k, v string) {
+	s.attrs[k] = v
+}
+
+// End implements Span.
+func (s *LogSpan) End() {
+	m := s.attrs
+	m["t"] = "span"
+	m["name"] = s.name
+	m["trace_id"] = s.tc.TraceID
+	m["span_id"] = s.tc.SpanID
+	if s.parent != "" {
+		m["parent_id"] = s.parent
+	}
+	m["elapsed"] = time.Since(s.start).String()
+	debug(m)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return strings.Repeat("0", 2*n)
+	}
+	return hex.EncodeToString(b)
+}
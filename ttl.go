@@ -0,0 +1,89 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const reapEvery = 10 * time.Second // how often to look for expired pages
+
+// expired reports whether the page has not been changed for longer than its TTL, as of now.
+// Must be called under lock.
+func (p *Page) expired(now time.Time) bool {
+	return p.ttl > 0 && now.Sub(p.modified) >= p.ttl
+}
+
+// snapshot marshals the page along with its TTL, for compaction.
+func (p *Page) snapshot() []byte {
+	p.RLock()
+	ttl := p.ttl
+	p.RUnlock()
+	if ttl == 0 {
+		return p.marshal()
+	}
+
+	p.RLock()
+	d := p.dump()
+	p.RUnlock()
+
+	data, err := json.Marshal(OpsD{P: d, T: int(ttl / time.Second)})
+	if err != nil {
+		echo(Log{"t": "page_marshal", "error": err.Error()})
+		return nil
+	}
+	return data
+}
+
+// expired returns the urls of pages that have expired as of now.
+func (site *Site) expired(now time.Time) []string {
+	var urls []string
+	for _, url := range site.urls() {
+		if p := site.resident(url); p != nil {
+			p.RLock()
+			if p.expired(now) {
+				urls = append(urls, url)
+			}
+			p.RUnlock()
+		}
+	}
+	site.RLock()
+	for url, e := range site.evicted {
+		if e.ttl > 0 && now.Sub(e.modified) >= e.ttl {
+			urls = append(urls, url)
+		}
+	}
+	site.RUnlock()
+	return urls
+}
+
+// reap periodically deletes expired pages.
+func (b *Broker) reap() {
+	ticker := clock.NewTicker(reapEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-b.quit:
+			return
+		}
+		for _, url := range b.site.expired(clock.Now()) {
+			if b.deletePageIf(url, func(p *Page) bool { return p.expired(clock.Now()) }) {
+				echo(Log{"t": "page_expire", "route": url})
+			}
+		}
+	}
+}
@@ -12,13 +12,14 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-import { Spinner, SpinnerSize } from '@fluentui/react'
+import { MessageBar, Spinner, SpinnerSize } from '@fluentui/react'
 import React from 'react'
 import { stylesheet } from 'typestyle'
 import { PageLayout } from './page'
-import { bond, box, connect, on, Page, qd, S, SockEvent, SockEventType, SockMessageType } from './qd'
+import { bond, box, CommandD, connect, on, Page, qd, S, SockEvent, SockEventType, SockMessageType } from './qd'
 import { clas, getTheme, pc } from './theme'
 import Dialog from './dialog'
+import { toMessageBarType } from './message_bar'
 
 const
   theme = getTheme(),
@@ -48,6 +49,11 @@ const
     busyOverlay: {
       display: 'block',
     },
+    toast: {
+      position: 'fixed',
+      top: 0, left: 0, right: 0,
+      zIndex: 1,
+    },
   })
 
 
@@ -75,8 +81,11 @@ const
     return { render, busyB, spinB }
   }),
   App = bond(() => {
+    let
+      toastTimeout = 0
     const
       contentB = box<{ page?: Page, error?: S }>({}),
+      toastB = box<CommandD | null>(null),
       onSocket = (e: SockEvent) => {
         switch (e.t) {
           case SockEventType.Data:
@@ -88,6 +97,11 @@ const
           case SockEventType.Reset:
             window.location.reload()
             break
+          case SockEventType.Toast:
+            window.clearTimeout(toastTimeout)
+            toastB(e.toast)
+            toastTimeout = window.setTimeout(() => toastB(null), (e.toast.timeout || 5) * 1000)
+            break
         }
       },
       onHashChanged = () => {
@@ -102,7 +116,7 @@ const
         window.addEventListener('hashchange', onHashChanged)
       },
       render = () => {
-        const { page, error } = contentB()
+        const { page, error } = contentB(), toast = toastB()
         // TODO prettier error section
         if (error) {
           const errorMessage = error === 'not_found'
@@ -115,12 +129,18 @@ const
         return (
           <div className={css.app}>
             <PageLayout key={page.key} page={page} />
+            {toast && (
+              <MessageBar className={css.toast} messageBarType={toMessageBarType(toast.type)} onDismiss={() => toastB(null)}>
+                {toast.text}
+              </MessageBar>
+            )}
             <BusyOverlay />
             <Dialog />
           </div>
         )
       },
       dispose = () => {
+        window.clearTimeout(toastTimeout)
         window.removeEventListener('hashchange', onHashChanged)
       }
 
@@ -35,7 +35,7 @@ export interface MessageBar {
   visible?: B
 }
 
-const
+export const
   toMessageBarType = (t?: S): Fluent.MessageBarType => {
     switch (t) {
       case 'error': return Fluent.MessageBarType.error
@@ -45,9 +45,7 @@ const
       case 'blocked': return Fluent.MessageBarType.blocked
       default: return Fluent.MessageBarType.info
     }
-  }
-
-export const
+  },
   XMessageBar = ({ model: m }: { model: MessageBar }) => (
     m.text?.length
       ? (
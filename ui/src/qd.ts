@@ -207,6 +207,18 @@ interface OpsD {
   d?: OpD[] // deltas
   e?: S // error
   r?: U // reset
+  u?: S // redirect
+  s?: U // sequence number
+  l?: U // reload
+  x?: CommandD // command
+}
+/** An action pushed by the server, outside of any page. */
+export interface CommandD {
+  action: 'navigate' | 'clear_cache' | 'toast'
+  route?: S // navigate: path, and optional #hash
+  text?: S // toast
+  type?: 'info' | 'success' | 'warning' | 'error' // toast
+  timeout?: U // toast, in seconds
 }
 interface OpD {
   k?: S
@@ -798,15 +810,16 @@ on(qd.refreshRateB, r => {
   if (sock) sock.close()
 })
 
-export enum SockEventType { Message, Data, Reset }
-export type SockEvent = SockMessage | SockData | SockReload
+export enum SockEventType { Message, Data, Reset, Toast }
+export type SockEvent = SockMessage | SockData | SockReload | SockToast
 export interface SockData { t: SockEventType.Data, page: Page }
 export enum SockMessageType { Info, Warn, Err }
 export interface SockMessage { t: SockEventType.Message, type: SockMessageType, message: S }
 export interface SockReload { t: SockEventType.Reset }
+export interface SockToast { t: SockEventType.Toast, toast: CommandD }
 type SockHandler = (e: SockEvent) => void
 
-let backoff = 1, currentPage: Page | null = null
+let backoff = 1, currentPage: Page | null = null, lastSeq = 0
 const
   toSocketAddress = (path: S): S => {
     const
@@ -814,6 +827,12 @@ const
       p = l.protocol === 'https:' ? 'wss' : 'ws'
     return p + "://" + l.host + path
   },
+  clearCaches = (): Promise<any> => {
+    currentPage = null
+    lastSeq = 0
+    if (!('caches' in window)) return Promise.resolve()
+    return caches.keys().then(keys => Promise.all(keys.map(k => caches.delete(k))))
+  },
   reconnect = (address: S, handle: SockHandler) => {
     const retry = () => reconnect(address, handle)
     const sock = new WebSocket(address)
@@ -821,8 +840,11 @@ const
       qd.socket = sock
       handle({ t: SockEventType.Message, type: SockMessageType.Info, message: 'Connected' })
       backoff = 1
-      const hash = window.location.hash
-      sock.send(`+ ${qd.path} ${hash.charAt(0) === '#' ? hash.substr(1) : hash}`) // protocol: t<sep>addr<sep>data
+      const
+        hash = window.location.hash,
+        h = hash.charAt(0) === '#' ? hash.substr(1) : hash
+      // protocol: t<sep>addr<sep>data; on reconnect, resume from the last-seen sequence number to receive missed patches.
+      sock.send(lastSeq && currentPage ? `^ ${qd.path} ${lastSeq} ${h}` : `+ ${qd.path} ${h}`)
     }
     sock.onclose = function () {
       const refreshRate = qd.refreshRateB()
@@ -843,6 +865,7 @@ const
       for (const line of e.data.split('\n')) {
         try {
           const msg = JSON.parse(line) as OpsD
+          if (msg.s) lastSeq = msg.s
           if (msg.d) {
             const page = exec(currentPage || newPage(), msg.d)
             if (currentPage !== page) {
@@ -856,6 +879,39 @@ const
             handle({ t: SockEventType.Message, type: SockMessageType.Err, message: msg.e })
           } else if (msg.r) {
             handle({ t: SockEventType.Reset })
+          } else if (msg.l) {
+            // Dev mode: web assets changed.
+            window.location.reload()
+            return
+          } else if (msg.u) {
+            // Failover: the server we connected to is a standby; reconnect to the primary.
+            sock.onclose = null
+            sock.close()
+            reconnect(msg.u, handle)
+            return
+          } else if (msg.x) {
+            const x = msg.x
+            switch (x.action) {
+              case 'navigate': {
+                const u = new URL(x.route || '/', window.location.origin)
+                if (u.origin !== window.location.origin) return
+                if (u.pathname === qd.path) {
+                  // Same page: switch views through the hash router, without reloading.
+                  window.location.hash = u.hash
+                  break
+                }
+                window.location.assign(u.pathname + u.search + u.hash)
+                return
+              }
+              case 'clear_cache':
+                sock.onclose = null
+                sock.close()
+                clearCaches().then(() => window.location.reload())
+                return
+              case 'toast':
+                handle({ t: SockEventType.Toast, toast: x })
+                break
+            }
           }
         } catch (err) {
           console.error(err)
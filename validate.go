@@ -0,0 +1,230 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CardValidator checks cards being created or changed by a patch, before the patch is applied.
+// Check is called with each affected card's data as it would be after the patch; buffers appear as their
+// marshaled form (BufD). Returning an error rejects the whole patch.
+type CardValidator struct {
+	Prefix string // routes at or below this; all routes if empty
+	View   string // cards of this type (their view attribute); all cards if empty
+	Check  func(route, card string, data map[string]interface{}) error
+}
+
+// CardSchema declares the attributes a card must have, for validating patches without writing code.
+type CardSchema struct {
+	Prefix   string            `json:"prefix,omitempty"`
+	View     string            `json:"view,omitempty"`
+	Required []string          `json:"required,omitempty"` // attributes that must be set
+	Types    map[string]string `json:"types,omitempty"`    // attribute => type, or types separated by "|"
+}
+
+// schemaTypes lists the types a CardSchema can require of an attribute.
+var schemaTypes = []string{"string", "number", "boolean", "object", "array", "buffer"}
+
+// ValidationError reports a patch rejected by a CardValidator.
+type ValidationError struct {
+	Route  string `json:"route"`
+	Card   string `json:"card"`
+	Reason string `json:"error"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid card %s at %s: %s", e.Card, e.Route, e.Reason)
+}
+
+// rejectInvalid responds to a request whose patch failed validation, if err is a ValidationError.
+func rejectInvalid(w http.ResponseWriter, err error) bool {
+	if e, ok := err.(*ValidationError); ok {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(e)
+		return true
+	}
+	return false
+}
+
+// loadCardSchemas reads a JSON list of CardSchema, and converts them to validators.
+func loadCardSchemas(path string) ([]CardValidator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schemas []CardSchema
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return nil, fmt.Errorf("failed unmarshaling card schemas: %v", err)
+	}
+	vs := make([]CardValidator, len(schemas))
+	for i, s := range schemas {
+		check, err := s.compile()
+		if err != nil {
+			return nil, fmt.Errorf("card schema %d: %v", i, err)
+		}
+		vs[i] = CardValidator{s.Prefix, s.View, check}
+	}
+	return vs, nil
+}
+
+func (s CardSchema) compile() (func(route, card string, data map[string]interface{}) error, error) {
+	types := make(map[string][]string)
+	names := make([]string, 0, len(s.Types))
+	for attr, t := range s.Types {
+		for _, x := range strings.Split(t, "|") {
+			if !containsString(schemaTypes, x) {
+				return nil, fmt.Errorf("unknown type %q for %s: want one of %s", x, attr, strings.Join(schemaTypes, ", "))
+			}
+		}
+		types[attr] = strings.Split(t, "|")
+		names = append(names, attr)
+	}
+	sort.Strings(names)
+	return func(route, card string, data map[string]interface{}) error {
+		for _, attr := range s.Required {
+			if _, ok := data[attr]; !ok {
+				return fmt.Errorf("missing required attribute %s", attr)
+			}
+		}
+		for _, attr := range names {
+			v, ok := data[attr]
+			if !ok {
+				continue
+			}
+			if t := typeOf(v); !containsString(types[attr], t) {
+				return fmt.Errorf("attribute %s must be %s, got %s", attr, strings.Join(types[attr], " or "), t)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// typeOf names the schema type of a card attribute.
+func typeOf(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case BufD:
+		return "buffer"
+	case nil:
+		return "null"
+	}
+	return "object"
+}
+
+func containsString(xs []string, x string) bool {
+	for _, y := range xs {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
+
+// Validators holds the card validators registered with the server.
+type Validators struct {
+	list []CardValidator
+}
+
+var validators = newValidators(nil)
+
+func newValidators(list []CardValidator) *Validators {
+	return &Validators{list}
+}
+
+// check rejects a patch to route if any card it creates or changes fails validation.
+// The patch is applied to a scratch copy of the affected cards; the page itself is left untouched.
+func (vs *Validators) check(site *Site, route string, ops OpsD) error {
+	var applicable []CardValidator
+	for _, v := range vs.list {
+		if v.Prefix == "" || isPathPrefix(v.Prefix, route) {
+			applicable = append(applicable, v)
+		}
+	}
+	if len(applicable) == 0 {
+		return nil
+	}
+
+	touched := make(map[string]bool)
+	for _, op := range ops.D {
+		if len(op.K) > 0 {
+			touched[strings.SplitN(op.K, keySeparator, 2)[0]] = true
+		}
+	}
+	if len(touched) == 0 {
+		return nil
+	}
+
+	cards := make(map[string]CardD)
+	if p := site.peek(route); p != nil {
+		p.RLock()
+		for name := range touched {
+			if c, ok := p.cards[name]; ok {
+				cards[name] = c.dump()
+			}
+		}
+		p.RUnlock()
+	}
+	scratch := newSite()
+	scratch.pages[route] = loadPage(scratch.ns, &PageD{cards})
+	scratch.exec(route, ops, 0)
+	page := scratch.at(route)
+
+	names := make([]string, 0, len(touched))
+	for name := range touched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c, ok := page.cards[name]
+		if !ok { // deleted
+			continue
+		}
+		d := c.dump()
+		data := make(map[string]interface{}, len(d.D))
+		for k, v := range d.D {
+			if strings.HasPrefix(k, dataPrefix) {
+				if i, ok := v.(int); ok && i < len(d.B) {
+					data[strings.TrimPrefix(k, dataPrefix)] = d.B[i]
+					continue
+				}
+			}
+			data[k] = v
+		}
+		view, _ := data["view"].(string)
+		for _, v := range applicable {
+			if v.View != "" && v.View != view {
+				continue
+			}
+			if err := v.Check(route, name, data); err != nil {
+				return &ValidationError{route, name, err.Error()}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// rolesAttr is the card attribute listing the roles required to view a card.
+// A card without this attribute is visible to everyone.
+const rolesAttr = "_roles"
+
+// cardRoles returns the roles required to view a card, if any.
+func cardRoles(c *Card) []string {
+	xs, ok := c.data[rolesAttr].([]interface{})
+	if !ok {
+		return nil
+	}
+	roles := make([]string, 0, len(xs))
+	for _, x := range xs {
+		if s, ok := x.(string); ok {
+			roles = append(roles, s)
+		}
+	}
+	return roles
+}
+
+func hasAnyRole(required, roles []string) bool {
+	for _, r := range required {
+		for _, role := range roles {
+			if r == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restrict recomputes the set of role-restricted cards. Must be called under the page's write-lock.
+func (p *Page) restrict() {
+	var restricted map[string][]string
+	for k, c := range p.cards {
+		if roles := cardRoles(c); roles != nil {
+			if restricted == nil {
+				restricted = make(map[string][]string)
+			}
+			restricted[k] = roles
+		}
+	}
+	p.restricted = restricted
+}
+
+// hidden returns the names of cards that cannot be viewed by someone having the given roles.
+func (p *Page) hidden(roles []string) map[string]bool {
+	p.RLock()
+	defer p.RUnlock()
+	var hidden map[string]bool
+	for k, required := range p.restricted {
+		if !hasAnyRole(required, roles) {
+			if hidden == nil {
+				hidden = make(map[string]bool)
+			}
+			hidden[k] = true
+		}
+	}
+	return hidden
+}
+
+// marshalFor marshals the page as seen by someone having the given roles.
+func (p *Page) marshalFor(roles []string) []byte {
+	hidden := p.hidden(roles)
+	if len(hidden) == 0 {
+		return p.marshal()
+	}
+
+	p.RLock()
+	d := p.dump()
+	p.RUnlock()
+
+	for k := range hidden {
+		delete(d.C, k)
+	}
+	data, err := json.Marshal(OpsD{P: d})
+	if err != nil {
+		echo(Log{"t": "page_marshal", "error": err.Error()})
+		return nil
+	}
+	return data
+}
+
+// filterFor rewrites a broadcast patch as seen by someone having the given roles:
+// changes to hidden cards are replaced by card removals, and cards that just became
+// visible are sent in full.
+func (p *Page) filterFor(data []byte, roles []string) []byte {
+	if !p.filters(data) {
+		return data
+	}
+	return p.filter(data, roles)
+}
+
+// filters reports whether a broadcast patch may look different to viewers having different roles.
+func (p *Page) filters(data []byte) bool {
+	p.RLock()
+	restricted := len(p.restricted) > 0
+	p.RUnlock()
+	return restricted || bytes.Contains(data, []byte(rolesAttr))
+}
+
+// filter is filterFor, for patches known to need filtering.
+func (p *Page) filter(data []byte, roles []string) []byte {
+	var ops OpsD
+	if err := json.Unmarshal(data, &ops); err != nil || (len(ops.D) == 0 && ops.P == nil && len(ops.A) == 0) {
+		return data
+	}
+
+	hidden := p.hidden(roles)
+	changed := false
+	if ops.P != nil { // whole page
+		for k := range hidden {
+			if _, ok := ops.P.C[k]; ok {
+				delete(ops.P.C, k)
+				changed = true
+			}
+		}
+	}
+	if len(ops.A) > 0 { // annotations on hidden cards
+		xs := ops.A[:0]
+		for _, x := range ops.A {
+			if hidden[x.Card] {
+				changed = true
+				continue
+			}
+			xs = append(xs, x)
+		}
+		ops.A = xs
+	}
+	for i, op := range ops.D {
+		ks := strings.SplitN(op.K, keySeparator, 2)
+		k := ks[0]
+		if len(k) == 0 {
+			continue
+		}
+		if hidden[k] {
+			ops.D[i] = OpD{K: k}
+			changed = true
+		} else if len(ks) == 2 && ks[1] == rolesAttr {
+			p.RLock()
+			card, ok := p.cards[k]
+			var d CardD
+			if ok {
+				d = card.dump()
+			}
+			p.RUnlock()
+			if ok {
+				ops.D[i] = OpD{K: k, D: d.D, B: d.B}
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return data
+	}
+
+	filtered, err := json.Marshal(ops)
+	if err != nil {
+		echo(Log{"t": "page_filter", "error": err.Error()})
+		return data
+	}
+	return filtered
+}
@@ -0,0 +1,210 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wavetest runs a Wave server inside a test process, for end-to-end tests, much as net/http/httptest
+// does for HTTP handlers:
+//
+//	s := wavetest.StartServer(t)
+//	ws := s.Connect()
+//	ws.Watch("/demo")
+//	ops := ws.Next()
+package wavetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/h2oai/wave"
+	"github.com/h2oai/wave/client"
+)
+
+const (
+	testAccessKeyID     = "test-access-key-id"
+	testAccessKeySecret = "test-access-key-secret"
+	testServerTimeout   = 10 * time.Second // allowed to start the server, and to wait for a websocket message
+)
+
+// servers counts running test servers. Servers share process-wide state, e.g. the AOF and logger,
+// so at most one can run at a time.
+var servers int32
+
+// Server is a server started by StartServer for an end-to-end test.
+type Server struct {
+	Address         string          // base URL, e.g. http://127.0.0.1:41235
+	AccessKeyID     string          // access key accepted by the server
+	AccessKeySecret string          // secret of the access key
+	DataDir         string          // site data, including the AOF; removed when the test ends
+	Site            *wave.LocalSite // direct access to pages, bypassing HTTP
+	Client          *client.Client  // publishes pages over HTTP, with the server's access key
+	t               testing.TB
+}
+
+// StartServer starts a server, with the full stack, for the duration of a test: pages are logged to an AOF
+// in a temporary directory, and served on a random port of the loopback interface, with test credentials.
+// The server is stopped, and its data removed, when the test ends.
+//
+// The server's subsystems share process-wide state, so only one test server can run at a time: tests that
+// start one must not run in parallel, and the test fails if another test server is already running.
+func StartServer(t testing.TB) *Server {
+	t.Helper()
+	if !atomic.CompareAndSwapInt32(&servers, 0, 1) {
+		t.Fatal("wavetest: another test server is running; tests that start test servers cannot run in parallel")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0") // handed to the server, so the port can't be taken in the meantime
+	if err != nil {
+		atomic.StoreInt32(&servers, 0)
+		t.Fatalf("wavetest: test server: %v", err)
+	}
+	addr := l.Addr().String()
+	dir := t.TempDir()
+	ready := make(chan *wave.LocalSite, 1)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	conf := wave.ServerConf{
+		Listeners:       []wave.ListenConf{{Address: addr, Listener: l}},
+		WebDir:          filepath.Join(dir, "www"),
+		DataDir:         dir,
+		AccessKeyID:     testAccessKeyID,
+		AccessKeySecret: testAccessKeySecret,
+		AOF:             wave.AOFConf{Dir: filepath.Join(dir, "aof"), Fsync: "never"},
+		Stop:            stop,
+		OnReady:         func(site *wave.LocalSite) { ready <- site },
+	}
+	go func() {
+		wave.Run(conf)
+		close(stopped)
+	}()
+	t.Cleanup(func() { // before the temporary directory is removed
+		close(stop)
+		<-stopped
+		atomic.StoreInt32(&servers, 0)
+	})
+
+	s := &Server{
+		Address:         "http://" + addr,
+		AccessKeyID:     testAccessKeyID,
+		AccessKeySecret: testAccessKeySecret,
+		DataDir:         dir,
+		Client:          client.New(client.Config{Address: "http://" + addr, AccessKeyID: testAccessKeyID, AccessKeySecret: testAccessKeySecret}),
+		t:               t,
+	}
+	select {
+	case s.Site = <-ready:
+	case <-stopped:
+		t.Fatal("wavetest: test server failed to start; see the server's log")
+	case <-time.After(testServerTimeout):
+		t.Fatal("wavetest: test server did not start in time")
+	}
+	if err := s.await(); err != nil {
+		t.Fatalf("wavetest: test server: %v", err)
+	}
+	return s
+}
+
+// await waits for the server to accept requests.
+func (s *Server) await() error {
+	deadline := time.Now().Add(testServerTimeout)
+	for {
+		resp, err := http.Get(s.Address + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("readyz: %s", resp.Status)
+			}
+			return fmt.Errorf("not ready in time: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Socket is a websocket connection to a test server, as made by a browser.
+type Socket struct {
+	conn    *websocket.Conn
+	pending []wave.OpsD // received, but not yet returned by Next
+	t       testing.TB
+}
+
+// Connect opens a websocket connection to the server, closed when the test ends.
+func (s *Server) Connect() *Socket {
+	s.t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+s.Address[len("http"):]+"/_s", nil)
+	if err != nil {
+		s.t.Fatalf("wavetest: test socket: %v", err)
+	}
+	ws := &Socket{conn: conn, t: s.t}
+	s.t.Cleanup(ws.Close)
+	return ws
+}
+
+// Watch subscribes to the page at route. The page, or an error, is the next message received.
+func (ws *Socket) Watch(route string) {
+	ws.t.Helper()
+	ws.send("+ " + route + " ")
+}
+
+// Patch changes the page at route, as a browser would.
+func (ws *Socket) Patch(route, data string) {
+	ws.t.Helper()
+	ws.send("* " + route + " " + data)
+}
+
+func (ws *Socket) send(msg string) {
+	ws.t.Helper()
+	if err := ws.conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		ws.t.Fatalf("wavetest: test socket: %v", err)
+	}
+}
+
+// Next returns the next message received: a page, or a patch to it. The test fails if none arrives in time.
+func (ws *Socket) Next() wave.OpsD {
+	ws.t.Helper()
+	for len(ws.pending) == 0 {
+		ws.conn.SetReadDeadline(time.Now().Add(testServerTimeout))
+		_, b, err := ws.conn.ReadMessage()
+		if err != nil {
+			ws.t.Fatalf("wavetest: test socket: %v", err)
+		}
+		for _, line := range bytes.Split(b, []byte("\n")) { // messages may carry several patches, one per line
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var ops wave.OpsD
+			if err := json.Unmarshal(line, &ops); err != nil {
+				ws.t.Fatalf("wavetest: test socket: bad message %q: %v", line, err)
+			}
+			ws.pending = append(ws.pending, ops)
+		}
+	}
+	ops := ws.pending[0]
+	ws.pending = ws.pending[1:]
+	return ops
+}
+
+// Close closes the connection.
+func (ws *Socket) Close() {
+	ws.conn.Close()
+}
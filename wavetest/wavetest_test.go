@@ -0,0 +1,133 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wavetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	s := StartServer(t)
+	ws := s.Connect()
+	ws.Watch("/demo")
+	if ops := ws.Next(); ops.P != nil {
+		t.Fatalf("want no page before publishing, got %+v", ops.P)
+	}
+
+	p := s.Client.Page("/demo")
+	p.Set("hello", map[string]interface{}{"view": "markdown", "box": "1 1 2 2", "title": "Hello", "content": "World"})
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	ops := ws.Next()
+	if len(ops.D) != 1 || ops.D[0].K != "hello" {
+		t.Fatalf("want the new card, got %+v", ops)
+	}
+
+	ws.Patch("/demo", `{"d":[{"k":"hello content","v":"Everyone"}]}`)
+	ws.Next() // the socket's change, echoed
+	cards, err := p.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cardContent(cards, "hello"); got != "Everyone" {
+		t.Fatalf("want the socket's change applied, got content %q in %+v", got, cards)
+	}
+
+	if _, err := s.Site.Patch(context.Background(), "/demo", []byte(`{"d":[{"k":"hello"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	ws.Next()
+	if cards, err := p.Load(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := cards["hello"]; ok {
+		t.Fatalf("want the card removed, got %+v", cards)
+	}
+}
+
+// cardContent returns the content of a card, as loaded by client.Page.Load.
+func cardContent(cards map[string]interface{}, name string) string {
+	card, _ := cards[name].(map[string]interface{})
+	d, _ := card["d"].(map[string]interface{})
+	content, _ := d["content"].(string)
+	return content
+}
+
+func TestServerRestart(t *testing.T) {
+	for i := 0; i < 2; i++ { // stopped servers leave nothing behind that trips up the next one
+		t.Run(fmt.Sprintf("run%d", i), func(t *testing.T) {
+			s := StartServer(t)
+			p := s.Client.Page("/demo")
+			p.Set("hello", map[string]interface{}{"view": "markdown", "box": "1 1 2 2", "content": "World"})
+			if err := p.Save(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPatchTooLarge(t *testing.T) {
+	s := StartServer(t)
+	body := append([]byte(`{"d":[{"k":"big","d":{"view":"markdown","content":"`), bytes.Repeat([]byte("x"), 16*1024*1024)...)
+	body = append(body, `"}}]}`...)
+	req, err := http.NewRequest(http.MethodPatch, s.Address+"/big", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(s.AccessKeyID, s.AccessKeySecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("want %d, got %s", http.StatusRequestEntityTooLarge, resp.Status)
+	}
+	if _, _, ok := s.Site.Read("/big"); ok {
+		t.Fatal("oversized patch applied")
+	}
+}
+
+func TestServerOneAtATime(t *testing.T) {
+	StartServer(t)
+	ft := &fatalRecorder{TB: t}
+	func() {
+		defer func() { recover() }() // the recorder panics to stop StartServer, as Fatal would
+		StartServer(ft)
+	}()
+	if !ft.failed {
+		t.Fatal("want a second test server refused")
+	}
+}
+
+// fatalRecorder records a call to Fatal or Fatalf, instead of failing the test.
+type fatalRecorder struct {
+	testing.TB
+	failed bool
+}
+
+func (r *fatalRecorder) Fatal(args ...interface{}) {
+	r.failed = true
+	panic(r)
+}
+
+func (r *fatalRecorder) Fatalf(format string, args ...interface{}) {
+	r.failed = true
+	panic(r)
+}
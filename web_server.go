@@ -21,6 +21,9 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2"
@@ -28,14 +31,19 @@ import (
 
 // WebServer represents a web server (d'oh).
 type WebServer struct {
-	site   *Site
-	broker *Broker
-	fs     http.Handler
-	users  map[string][]byte
+	site         *Site
+	broker       *Broker
+	fs           http.Handler
+	users        map[string][]byte
+	oidcEnabled  bool
+	sessions     *OIDCSessions
+	oauth2Config oauth2.Config
+	limiter      *RequestLimiter
 }
 
 const (
 	contentTypeJSON = "application/json"
+	maxPatchSize    = 16 * 1024 * 1024 // bytes, in a PATCH request body
 )
 
 func newWebServer(
@@ -46,43 +54,96 @@ func newWebServer(
 	sessions *OIDCSessions,
 	oauth2Config oauth2.Config,
 	www string,
+	spa SPAFallback,
+	limiter *RequestLimiter,
 ) *WebServer {
-	fs := fallback("/", http.FileServer(http.Dir(www)))
+	fs := fallback("/", spa, newAssetServer(newAssetFS(www)))
 	if oidcEnabled {
 		fs = checkSession(oauth2Config, sessions, fs)
 	}
-	return &WebServer{site, broker, fs, users}
+	return &WebServer{site, broker, fs, users, oidcEnabled, sessions, oauth2Config, limiter}
 }
 
-func (s *WebServer) authenticate(username, password string) bool {
-	hash, ok := s.users[username]
+// authenticate reports whether the request carries valid access key credentials, and returns the key's ID.
+func (s *WebServer) authenticate(r *http.Request) (string, bool) {
+	username, password, ok := r.BasicAuth()
 	if !ok {
-		return false
+		return "", false
+	}
+	hash, ok := s.users[username]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
 	}
-	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
-	return err == nil
+	noteKey(r, username)
+	return username, true
 }
 
 func (s *WebServer) guard(w http.ResponseWriter, r *http.Request) bool {
-	username, password, ok := r.BasicAuth()
-	if !ok || !s.authenticate(username, password) {
+	if _, ok := s.authenticate(r); !ok {
+		stats.authFailed()
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return false
 	}
 	return true
 }
 
+// guardWrite is like guard, and also applies the write rate limit: to the access key once verified,
+// else to the client's IP address.
+func (s *WebServer) guardWrite(w http.ResponseWriter, r *http.Request) bool {
+	username, ok := s.authenticate(r)
+	if !ok {
+		if s.limiter.allowWrite(w, r, "") {
+			stats.authFailed()
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		}
+		return false
+	}
+	return s.limiter.allowWrite(w, r, username)
+}
+
+// Viewer represents the identity of someone reading pages over HTTP.
+type Viewer struct {
+	username string
+	roles    []string
+	trusted  bool // authenticated using an access key; sees everything
+}
+
+// guardRead permits reads from browsers holding a valid OIDC session, or from clients using basic auth.
+// Browser reads are additionally subject to the page's access control rules.
+func (s *WebServer) guardRead(w http.ResponseWriter, r *http.Request) (Viewer, bool) {
+	if username, ok := s.authenticate(r); ok {
+		return Viewer{username: username, trusted: true}, true
+	}
+	if s.oidcEnabled && !hasValidSession(r, s.oauth2Config, s.sessions) {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return Viewer{}, false
+	}
+	username, _, roles, _, _ := getIdentity(r, s.sessions)
+	if !s.site.acl.allows(r.URL.Path, username, roles) {
+		stats.authFailed()
+		echo(Log{"t": "page_forbidden", "url": r.URL.Path, "user": username})
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return Viewer{}, false
+	}
+	return Viewer{username: username, roles: roles}, true
+}
+
 func (s *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPatch: // writes
-		if !s.guard(w, r) {
+		if !s.guardWrite(w, r) {
 			return
 		}
 		s.patch(w, r)
 	case http.MethodGet: // reads
 		switch r.Header.Get("Content-Type") {
 		case contentTypeJSON: // data
-			s.get(w, r)
+			viewer, ok := s.guardRead(w, r)
+			if !ok {
+				return
+			}
+			s.get(w, r, viewer)
 		default: // template
 			s.fs.ServeHTTP(w, r)
 		}
@@ -98,30 +159,231 @@ func (s *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *WebServer) patch(w http.ResponseWriter, r *http.Request) {
-	data, err := ioutil.ReadAll(r.Body) // XXX add limit
+	username, _, _ := r.BasicAuth()
+	ctx, span := trace(withWriter(withRemote(extractTraceContext(r), getRemoteAddr(r)), username, "http"), "http_patch")
+	span.SetAttr("route", r.URL.Path)
+	defer span.End()
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchSize))
 	if err != nil {
+		if len(data) >= maxPatchSize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
 		echo(Log{"t": "read patch request body", "error": err.Error()})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	s.broker.patch(r.URL.Path, data)
+	if r.Header.Get("Content-Type") == contentTypeMsgpack {
+		if data, err = msgpackToJSON(data); err != nil {
+			echo(Log{"t": "patch", "url": r.URL.Path, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	wire, err := wireVersionOf(r)
+	if err == nil {
+		data, err = upgradePatch(data, wire)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var revertAfter time.Duration
+	if v := r.URL.Query().Get("revert_after"); v != "" {
+		if revertAfter, err = parseRevertAfter(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("apply_at"); v != "" {
+		s.schedulePatch(w, r, username, data, v, revertAfter)
+		return
+	}
+	var revert *Revert
+	if revertAfter > 0 {
+		ctx, revert = withRevert(ctx, revertAfter)
+	}
+	want := int64(-1)
+	if v := r.Header.Get("If-Match"); v != "" {
+		if want, err = parseVersion(v); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	id, err := s.broker.patchIf(ctx, r.URL.Path, data, want)
+	if ctx.Err() != nil { // client went away; nobody is listening for the response
+		echo(Log{"t": "patch", "url": r.URL.Path, "error": ctx.Err().Error()})
+		return
+	}
+	if err == errVersionMismatch {
+		w.Header().Set("ETag", formatVersion(s.site.version(r.URL.Path)))
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+	if refuseRequest(w, err) || rejectInvalid(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if id != "" {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(PendingResponse{id})
+		return
+	}
+	w.Header().Set("ETag", formatVersion(s.site.version(r.URL.Path)))
+	respondReverted(w, revert)
+}
+
+// respondApprovalError reports why a pending patch could not be approved or rejected.
+func respondApprovalError(w http.ResponseWriter, err error) {
+	if err == errNotPending {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if _, ok := err.(approvalsSaveError); ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if refuseRequest(w, err) || rejectInvalid(w, err) {
+		return
+	}
+	http.Error(w, err.Error(), http.StatusConflict) // e.g. the page changed such that the patch no longer applies
+}
+
+// respondReverted tells the writer of a patch to be undone later when that will happen.
+func respondReverted(w http.ResponseWriter, revert *Revert) {
+	if revert == nil || revert.Patch == nil {
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(RevertResponse{revert.Patch.ID, revert.Patch.ApplyAt})
+}
+
+// schedulePatch holds a patch until the time given by ?apply_at=, or applies it right away if that time has passed.
+// If revertAfter is positive, the patch is undone that long after it is applied.
+func (s *WebServer) schedulePatch(w http.ResponseWriter, r *http.Request, username string, data []byte, applyAt string, revertAfter time.Duration) {
+	at, err := time.Parse(time.RFC3339, applyAt)
+	if err != nil {
+		http.Error(w, "invalid apply_at: want RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("If-Match") != "" {
+		http.Error(w, "If-Match cannot be combined with apply_at", http.StatusBadRequest)
+		return
+	}
+	ops, err := parsePatch(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validators.check(s.site, r.URL.Path, ops); rejectInvalid(w, err) { // checked again when applied
+		return
+	}
+	if !at.After(clock.Now()) {
+		ctx := withWriter(withRemote(r.Context(), getRemoteAddr(r)), username, "http")
+		var revert *Revert
+		if revertAfter > 0 {
+			ctx, revert = withRevert(ctx, revertAfter)
+		}
+		if _, err := s.broker.patchIf(ctx, r.URL.Path, data, -1); err != nil {
+			if !refuseRequest(w, err) && !rejectInvalid(w, err) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		w.Header().Set("ETag", formatVersion(s.site.version(r.URL.Path)))
+		respondReverted(w, revert)
+		return
+	}
+	if revertAfter > 0 && s.broker.approvals.requires(r.URL.Path) {
+		http.Error(w, errRevertApproval.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := s.broker.schedule.add(r.URL.Path, data, at, username, revertAfter)
+	if err != nil {
+		echo(Log{"t": "patch_schedule", "route": r.URL.Path, "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	echo(Log{"t": "patch_schedule", "route": p.Route, "id": p.ID, "apply_at": p.ApplyAt.Format(time.RFC3339)})
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ScheduledResponse{p.ID, p.ApplyAt})
 }
 
-func (s *WebServer) get(w http.ResponseWriter, r *http.Request) {
+// formatVersion formats a page version as an entity tag.
+func formatVersion(v int64) string {
+	return `"` + strconv.FormatInt(v, 10) + `"`
+}
+
+// parseVersion parses a page version from an entity tag; quotes are optional.
+func parseVersion(s string) (int64, error) {
+	return strconv.ParseInt(strings.Trim(strings.TrimSpace(s), `"`), 10, 64)
+}
+
+func (s *WebServer) get(w http.ResponseWriter, r *http.Request, viewer Viewer) {
 	url := r.URL.Path
+	wire, err := wireVersionOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	page := s.site.at(url)
 	if page == nil {
 		echo(Log{"t": "page_not_found", "url": url})
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
+	etag := formatVersion(s.site.version(url))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-	data := page.marshal()
+	var data []byte
+	if name := r.URL.Query().Get("card"); name != "" { // single card
+		ok := false
+		if viewer.trusted || !page.hidden(viewer.roles)[name] {
+			data, ok = page.marshalCard(name)
+		}
+		if !ok {
+			echo(Log{"t": "card_not_found", "url": url, "card": name})
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+	} else if viewer.trusted {
+		data = page.marshal()
+	} else {
+		data = page.marshalFor(viewer.roles)
+	}
 	if data == nil {
 		echo(Log{"t": "cache_miss", "url": url})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	if r.URL.Query().Get("card") == "" { // a whole page is a message; a card is not
+		if data, err = downgradeMsg(data, wire); err != nil {
+			echo(Log{"t": "page_encode", "url": url, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	if r.Header.Get("Accept") == contentTypeMsgpack {
+		b, err := jsonToMsgpack(data)
+		if err != nil {
+			echo(Log{"t": "page_encode", "url": url, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeMsgpack)
+		w.Write(b)
+		return
+	}
 	w.Header().Set("Content-Type", contentTypeJSON)
 	w.Write(data)
 }
@@ -142,11 +404,121 @@ func (s *WebServer) post(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if req.RegisterApp != nil {
+			if refuseRequest(w, licensing.allows(FeatureApps)) {
+				return
+			}
 			q := req.RegisterApp
 			s.broker.addApp(q.Mode, q.Route, q.Address)
+			auditRequest(r, AuditRegister, q.Route, int64(len(b)))
 		} else if req.UnregisterApp != nil {
 			q := req.UnregisterApp
 			s.broker.dropApp(q.Route)
+		} else if req.SetACL != nil {
+			q := req.SetACL
+			if err := s.site.acl.put(*q); err != nil {
+				echo(Log{"t": "acl_set", "route": q.Route, "error": err.Error()})
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if cluster != nil {
+				username, _, _ := r.BasicAuth()
+				if data, err := json.Marshal(q); err == nil {
+					cluster.forward(withWriter(r.Context(), username, "http"), aclMarker, q.Route, data)
+				}
+			}
+			echo(Log{"t": "acl_set", "route": q.Route})
+		} else if req.SetApproval != nil {
+			q := req.SetApproval
+			if err := s.broker.approvals.protect(q.Route, q.Required); err != nil {
+				echo(Log{"t": "approval_set", "route": q.Route, "error": err.Error()})
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			echo(Log{"t": "approval_set", "route": q.Route})
+		} else if req.ListPending != nil {
+			w.Header().Set("Content-Type", contentTypeJSON)
+			json.NewEncoder(w).Encode(s.broker.approvals.list())
+		} else if req.ApprovePatch != nil {
+			if err := s.broker.approve(req.ApprovePatch.ID); err != nil {
+				respondApprovalError(w, err)
+			}
+		} else if req.RejectPatch != nil {
+			if err := s.broker.reject(req.RejectPatch.ID); err != nil {
+				respondApprovalError(w, err)
+			}
+		} else if req.PublishDraft != nil {
+			username, _, _ := r.BasicAuth()
+			ctx := withWriter(withRemote(r.Context(), getRemoteAddr(r)), username, "http")
+			id, err := s.broker.publishDraft(ctx, req.PublishDraft.Route)
+			if err == errNoDraft {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			if refuseRequest(w, err) || rejectInvalid(w, err) {
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if id != "" { // audited once approved
+				w.Header().Set("Content-Type", contentTypeJSON)
+				w.WriteHeader(http.StatusAccepted)
+				json.NewEncoder(w).Encode(PendingResponse{id})
+				return
+			}
+			auditRequest(r, AuditReplace, req.PublishDraft.Route, 0)
+		} else if req.DeletePages != nil {
+			prefix := req.DeletePages.Prefix
+			if prefix == "" {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			username, _, _ := r.BasicAuth()
+			ctx := withWriter(withRemote(context.Background(), getRemoteAddr(r)), username, "http") // outlives the request
+			id := s.broker.jobs.start("delete_pages", func(p Progress) error {
+				return s.broker.deletePages(ctx, prefix, p)
+			})
+			w.Header().Set("Content-Type", contentTypeJSON)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(JobResponse{id})
+		} else if req.GetJob != nil {
+			job, ok := s.broker.jobs.get(req.GetJob.ID)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", contentTypeJSON)
+			json.NewEncoder(w).Encode(job)
+		} else if req.ListJobs != nil {
+			w.Header().Set("Content-Type", contentTypeJSON)
+			json.NewEncoder(w).Encode(s.broker.jobs.list())
+		} else if req.StartJob != nil {
+			id, err := s.broker.jobs.run(req.StartJob.Kind)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", contentTypeJSON)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(JobResponse{id})
+		} else if req.ImportGrafana != nil {
+			q := req.ImportGrafana
+			if q.Route == "" || len(q.Dashboard) == 0 {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			resp, err := s.broker.importGrafana(q.Route, q.Dashboard, q.Prometheus)
+			if err != nil {
+				echo(Log{"t": "grafana_import", "route": q.Route, "error": err.Error()})
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", contentTypeJSON)
+			json.NewEncoder(w).Encode(resp)
+		} else if req.SetPrimary != nil {
+			q := req.SetPrimary
+			s.broker.setPrimary(q.Address)
 		}
 	default:
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -160,54 +532,42 @@ func checkSession(oauth2Config oauth2.Config, sessions *OIDCSessions, h http.Han
 			return
 		}
 
-		u, _ := url.Parse("/_login")
-		q := u.Query()
-		q.Set("next", r.URL.Path)
-		u.RawQuery = q.Encode()
-
-		cookie, err := r.Cookie(oidcSessionKey)
-		if err != nil {
-			http.Redirect(w, r, u.String(), http.StatusFound)
-			return
-		}
-		sessionID := cookie.Value
-		session, ok := sessions.get(sessionID)
-		if !ok {
-			http.Redirect(w, r, u.String(), http.StatusFound)
-			return
-		}
-
-		t, err := ensureValidOidcToken(r.Context(), oauth2Config, session.token)
-		if err != nil {
-			echo(Log{"t": "access_token_refresh", "error": err.Error()})
+		if !hasValidSession(r, oauth2Config, sessions) {
+			u, _ := url.Parse("/_login")
+			q := u.Query()
+			q.Set("next", r.URL.Path)
+			u.RawQuery = q.Encode()
 			http.Redirect(w, r, u.String(), http.StatusFound)
 			return
 		}
-		if session.token != t {
-			session.token = t
-			sessions.set(sessionID, session)
-		}
 
 		h.ServeHTTP(w, r)
 	})
 }
 
-func fallback(prefix string, h http.Handler) http.Handler {
-	// copy of http.StripPrefix
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// if the url has an extension, serve the file
-		if len(path.Ext(r.URL.Path)) > 0 {
-			h.ServeHTTP(w, r)
-			return
-		}
-		// rewrite
-		r2 := new(http.Request)
-		*r2 = *r
-		r2.URL = new(url.URL)
-		*r2.URL = *r.URL
-		r2.URL.Path = prefix
-		h.ServeHTTP(w, r2)
-	})
+// hasValidSession reports whether the request carries a known OIDC session cookie,
+// refreshing the session's access token if required.
+func hasValidSession(r *http.Request, oauth2Config oauth2.Config, sessions *OIDCSessions) bool {
+	cookie, err := r.Cookie(oidcSessionKey)
+	if err != nil {
+		return false
+	}
+	sessionID := cookie.Value
+	session, ok := sessions.get(sessionID)
+	if !ok || session.token == nil {
+		return false
+	}
+
+	t, err := ensureValidOidcToken(r.Context(), oauth2Config, session.token)
+	if err != nil {
+		echo(Log{"t": "access_token_refresh", "error": err.Error()})
+		return false
+	}
+	if session.token != t {
+		session.token = t
+		sessions.set(sessionID, session)
+	}
+	return true
 }
 
 func ensureValidOidcToken(c context.Context, cfg oauth2.Config, t *oauth2.Token) (*oauth2.Token, error) {
@@ -0,0 +1,380 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook events.
+const (
+	patchEvent  = "patch"
+	deleteEvent = "delete"
+)
+
+const webhookQueueSize = 1024 // events buffered per webhook before dropping
+
+var webhookRetry = Retry{Attempts: 5, Backoff: time.Second}
+
+// Webhook represents a callback URL that receives a POST whenever a page at or below Prefix is patched or deleted.
+// Batching webhooks act as virtual subscribers for serverless consumers, which receive changes collected over
+// a window in one POST instead of holding a socket open.
+type Webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Prefix  string    `json:"prefix"`              // "/" = all pages
+	Secret  string    `json:"secret,omitempty"`    // if set, deliveries are signed using HMAC-SHA256; never listed
+	Batch   int       `json:"batch,omitempty"`     // if set, POST up to this many events at a time as a WebhookBatch
+	Window  int       `json:"window_ms,omitempty"` // time to collect a batch after its first event, in milliseconds
+	Created time.Time `json:"created"`
+}
+
+// WebhookEvent represents the body of a webhook delivery.
+type WebhookEvent struct {
+	ID      string          `json:"id"`
+	Event   string          `json:"event"` // "patch" or "delete"
+	Route   string          `json:"route"`
+	Version int64           `json:"version"`
+	Data    json.RawMessage `json:"data,omitempty"` // the patch, as applied
+	Time    time.Time       `json:"time"`
+}
+
+// WebhookBatch represents the body of a batching webhook's delivery. Events are in the order they occurred.
+type WebhookBatch struct {
+	ID     string         `json:"id"`
+	Events []WebhookEvent `json:"events"`
+}
+
+const (
+	batchEvent          = "batch"
+	maxWebhookBatch     = 1000
+	defaultWebhookDelay = 1000 // ms
+)
+
+type hook struct {
+	Webhook
+	queue chan WebhookEvent
+	quit  chan struct{}
+}
+
+// Webhooks delivers page change events to registered webhooks, retrying failed deliveries.
+// Webhooks are persisted as JSON to a file in the data directory.
+type Webhooks struct {
+	sync.RWMutex
+	path   string
+	client *http.Client
+	hooks  map[string]*hook // id => webhook
+	active sync.WaitGroup   // delivery goroutines
+}
+
+func newWebhooks(path string) *Webhooks {
+	ws := &Webhooks{path: path, client: &http.Client{Timeout: 10 * time.Second}, hooks: make(map[string]*hook)}
+	if err := ws.load(); err != nil {
+		echo(Log{"t": "webhooks_load", "path": path, "error": err.Error()})
+	}
+	return ws
+}
+
+func (ws *Webhooks) load() error {
+	data, err := ioutil.ReadFile(ws.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var hooks []Webhook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		ws.start(h)
+	}
+	return nil
+}
+
+// save persists webhooks. Must be called under lock.
+func (ws *Webhooks) save() error {
+	hooks := make([]Webhook, 0, len(ws.hooks))
+	for _, h := range ws.hooks {
+		hooks = append(hooks, h.Webhook)
+	}
+	data, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(ws.path, data)
+}
+
+// start registers a webhook and starts delivering to it. Must be called under lock.
+func (ws *Webhooks) start(w Webhook) {
+	h := &hook{w, make(chan WebhookEvent, webhookQueueSize), make(chan struct{})}
+	ws.hooks[w.ID] = h
+	ws.active.Add(1)
+	go func() {
+		defer ws.active.Done()
+		ws.deliver(h)
+	}()
+}
+
+func (ws *Webhooks) add(w Webhook) (Webhook, error) {
+	if !strings.HasPrefix(w.URL, "http://") && !strings.HasPrefix(w.URL, "https://") {
+		return w, errors.New("want http(s) webhook URL")
+	}
+	if w.Prefix == "" {
+		w.Prefix = "/"
+	}
+	if !strings.HasPrefix(w.Prefix, "/") {
+		return w, errors.New("want prefix starting with /")
+	}
+	if w.Batch < 0 || w.Batch > maxWebhookBatch || w.Window < 0 {
+		return w, fmt.Errorf("want batch between 0 and %d, and non-negative window", maxWebhookBatch)
+	}
+	if w.Batch > 0 && w.Window == 0 {
+		w.Window = defaultWebhookDelay
+	}
+	w.ID, w.Created = uuid.New().String(), clock.Now()
+	ws.Lock()
+	defer ws.Unlock()
+	ws.start(w)
+	return w, ws.save()
+}
+
+func (ws *Webhooks) remove(id string) (bool, error) {
+	ws.Lock()
+	defer ws.Unlock()
+	h, ok := ws.hooks[id]
+	if !ok {
+		return false, nil
+	}
+	delete(ws.hooks, id)
+	close(h.quit)
+	return true, ws.save()
+}
+
+// close stops delivering to all webhooks, and waits for deliveries in progress. Undelivered events are discarded.
+func (ws *Webhooks) close() {
+	ws.Lock()
+	for id, h := range ws.hooks {
+		delete(ws.hooks, id)
+		close(h.quit)
+	}
+	ws.Unlock()
+	ws.active.Wait()
+}
+
+// list returns all webhooks, without their secrets.
+func (ws *Webhooks) list() []Webhook {
+	ws.RLock()
+	defer ws.RUnlock()
+	hooks := make([]Webhook, 0, len(ws.hooks))
+	for _, h := range ws.hooks {
+		w := h.Webhook
+		w.Secret = ""
+		hooks = append(hooks, w)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].Created.Before(hooks[j].Created) })
+	return hooks
+}
+
+// fire queues an event for every webhook matching route. System pages, and changes replicated from peers
+// (which fire on the server they were made on), do not fire webhooks.
+func (ws *Webhooks) fire(ctx context.Context, event, route string, data []byte, version int64) {
+	if writerFrom(ctx).Via == viaPeer || isPathPrefix(systemPrefix, route) {
+		return
+	}
+	ws.RLock()
+	defer ws.RUnlock()
+	if len(ws.hooks) == 0 {
+		return
+	}
+	e := WebhookEvent{uuid.New().String(), event, route, version, data, clock.Now()}
+	for _, h := range ws.hooks {
+		if !isPathPrefix(h.Prefix, route) {
+			continue
+		}
+		select {
+		case h.queue <- e:
+		default:
+			stats.webhookDropped()
+			echo(Log{"t": "webhook_drop", "webhook": h.ID, "route": route})
+		}
+	}
+}
+
+// onChange fires webhooks for a page change published on the broker's bus.
+func (ws *Webhooks) onChange(e Event) {
+	event := patchEvent
+	if e.Change == changeDelete {
+		event = deleteEvent
+	}
+	ws.fire(e.Ctx, event, e.Route, e.Data, e.Version)
+}
+
+// deliver sends queued events to a webhook, in order, until the webhook is removed.
+func (ws *Webhooks) deliver(h *hook) {
+	for {
+		select {
+		case <-h.quit:
+			return
+		case e := <-h.queue:
+			if h.Batch == 0 {
+				ws.send(h, e.Event, e.ID, e)
+				continue
+			}
+			batch := ws.collect(h, e)
+			ws.send(h, batchEvent, batch.ID, batch)
+		}
+	}
+}
+
+// collect gathers events following e into a batch, until the batch is full or the webhook's window has passed.
+func (ws *Webhooks) collect(h *hook, e WebhookEvent) WebhookBatch {
+	events := []WebhookEvent{e}
+	window := clock.After(time.Duration(h.Window) * time.Millisecond)
+	for len(events) < h.Batch {
+		select {
+		case e := <-h.queue:
+			events = append(events, e)
+		case <-window:
+			return WebhookBatch{uuid.New().String(), events}
+		case <-h.quit:
+			return WebhookBatch{uuid.New().String(), events}
+		}
+	}
+	return WebhookBatch{uuid.New().String(), events}
+}
+
+// send POSTs a delivery to a webhook, retrying with exponential backoff. The delivery is discarded after the last attempt.
+func (ws *Webhooks) send(h *hook, event, id string, delivery interface{}) {
+	body, err := json.Marshal(delivery)
+	if err != nil {
+		return
+	}
+	backoff := webhookRetry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := ws.post(h.Webhook, event, id, body)
+		if err == nil {
+			stats.webhookDelivered()
+			return
+		}
+		stats.webhookFailed()
+		echo(Log{"t": "webhook_send", "webhook": h.ID, "delivery": id, "attempt": fmt.Sprint(attempt), "error": err.Error()})
+		if attempt >= webhookRetry.Attempts {
+			return
+		}
+		select {
+		case <-h.quit:
+			return
+		case <-clock.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (ws *Webhooks) post(w Webhook, event, id string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	req.Header.Set("X-Wave-Event", event)
+	req.Header.Set("X-Wave-Delivery", id)
+	if w.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Wave-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// WebhookHandler serves the webhook registration API for administrators:
+// GET lists, POST adds, and DELETE ?id= removes webhooks.
+type WebhookHandler struct {
+	webhooks *Webhooks
+	auth     *Auth
+}
+
+func newWebhookHandler(webhooks *Webhooks, auth *Auth) *WebhookHandler {
+	return &WebhookHandler{webhooks, auth}
+}
+
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth.trusted(r); !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(h.webhooks.list())
+	case http.MethodPost:
+		if refuseRequest(w, licensing.allows(FeatureWebhooks)) {
+			return
+		}
+		var q Webhook
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		hook, err := h.webhooks.add(q)
+		if err != nil {
+			echo(Log{"t": "webhook_add", "url": q.URL, "error": err.Error()})
+			http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(http.StatusBadRequest), err), http.StatusBadRequest)
+			return
+		}
+		hook.Secret = ""
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(hook)
+	case http.MethodDelete:
+		ok, err := h.webhooks.remove(r.URL.Query().Get("id"))
+		if err != nil {
+			echo(Log{"t": "webhook_remove", "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
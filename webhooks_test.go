@@ -0,0 +1,77 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	type delivery struct {
+		event, id, signature string
+		body                 []byte
+	}
+	got := make(chan delivery, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got <- delivery{r.Header.Get("X-Wave-Event"), r.Header.Get("X-Wave-Delivery"), r.Header.Get("X-Wave-Signature"), body}
+	}))
+	defer srv.Close()
+
+	ws := newWebhooks(filepath.Join(t.TempDir(), "webhooks.json"))
+	for _, c := range []struct {
+		name      string
+		secret    string
+		body      string
+		signature string
+	}{
+		{"unsigned", "", `{"id":"x"}`, ""},
+		// RFC 4231, test case 2
+		{"signed", "Jefe", "what do ya want for nothing?", "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"empty body", "key", "", "sha256=5d5d139563c95b5967b9bd9a8c9b233a9dedb45072794cd232dc1b74832607d0"},
+	} {
+		if err := ws.post(Webhook{URL: srv.URL, Secret: c.secret}, patchEvent, "d1", []byte(c.body)); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		d := <-got
+		if d.signature != c.signature {
+			t.Errorf("%s: signature = %q, want %q", c.name, d.signature, c.signature)
+		}
+		if string(d.body) != c.body || d.event != patchEvent || d.id != "d1" {
+			t.Errorf("%s: got event %q, delivery %q, body %q", c.name, d.event, d.id, d.body)
+		}
+	}
+}
+
+func TestWebhookSecretNotListed(t *testing.T) {
+	ws := newWebhooks(filepath.Join(t.TempDir(), "webhooks.json"))
+	defer ws.close()
+	w, err := ws.add(Webhook{URL: "https://hooks.example.com/x", Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Secret != "s3cret" {
+		t.Fatalf("secret not kept: %q", w.Secret)
+	}
+	for _, w := range ws.list() {
+		if w.Secret != "" {
+			t.Errorf("listed secret %q", w.Secret)
+		}
+	}
+}
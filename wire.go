@@ -0,0 +1,122 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Publishers and UIs written against an older wire grammar keep working during a migration: they declare the
+// version they speak, and the server converts their patches up to the current grammar on the way in, and
+// the messages it sends them down to their grammar on the way out. Pages are only ever held, logged and
+// replicated in the current grammar.
+//
+// To change the grammar, bump grammarVersion, and add a migration from the previous version to wireMigrations.
+
+const (
+	wireOldest        = 1                   // oldest wire grammar version still understood
+	wireVersionHeader = "Wave-Wire-Version" // declares the wire version of an HTTP request
+	wireVersionParam  = "wire"              // declares the wire version of a websocket connection, e.g. /_s?wire=1
+)
+
+// wireDefault is the wire version assumed for publishers and UIs that do not declare one.
+var wireDefault = grammarVersion
+
+// wireMigration converts between a wire grammar version and the next.
+type wireMigration struct {
+	up   func(patch []byte) ([]byte, error) // patch from an older publisher => patch in the next version
+	down func(msg []byte) ([]byte, error)   // message in the next version => message for an older UI
+}
+
+// wireMigrations[v-wireOldest] converts between version v and v+1.
+var wireMigrations = []wireMigration{
+	{up: unchanged, down: dropTTL}, // 1 => 2: patches gained "t" (TTL), which version 1 UIs don't understand
+}
+
+// unchanged is the conversion of patches that are valid as they are in the next version.
+func unchanged(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// dropTTL removes a patch's or message's TTL, if any.
+func dropTTL(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte(`"t"`)) {
+		return data, nil
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if _, ok := m["t"]; !ok {
+		return data, nil // "t" is a key or value further in
+	}
+	delete(m, "t")
+	return json.Marshal(m)
+}
+
+// parseWireVersion parses a declared wire version; empty is wireDefault.
+func parseWireVersion(s string) (int, error) {
+	if s == "" {
+		return wireDefault, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < wireOldest || v > grammarVersion {
+		return 0, fmt.Errorf("wire version: want %d to %d, got %q", wireOldest, grammarVersion, s)
+	}
+	return v, nil
+}
+
+// wireVersionOf returns the wire version declared by a request, in its Wave-Wire-Version header or wire query parameter.
+func wireVersionOf(r *http.Request) (int, error) {
+	s := r.Header.Get(wireVersionHeader)
+	if s == "" {
+		s = r.URL.Query().Get(wireVersionParam)
+	}
+	return parseWireVersion(s)
+}
+
+// upgradePatch converts a patch written against wire version v to the current version.
+func upgradePatch(patch []byte, v int) ([]byte, error) {
+	if v >= grammarVersion {
+		return patch, nil
+	}
+	for ; v < grammarVersion; v++ {
+		var err error
+		if patch, err = wireMigrations[v-wireOldest].up(patch); err != nil {
+			return nil, fmt.Errorf("patch: upgrading from wire version %d failed: %v", v, err)
+		}
+	}
+	stats.wireConverted()
+	return patch, nil
+}
+
+// downgradeMsg converts a message in the current wire version to version v.
+func downgradeMsg(msg []byte, v int) ([]byte, error) {
+	if v >= grammarVersion {
+		return msg, nil
+	}
+	for w := grammarVersion; w > v; w-- {
+		var err error
+		if msg, err = wireMigrations[w-1-wireOldest].down(msg); err != nil {
+			return nil, fmt.Errorf("downgrading to wire version %d failed: %v", w-1, err)
+		}
+	}
+	stats.wireConverted()
+	return msg, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import "testing"
+
+func TestWireMigration(t *testing.T) {
+	const withTTL = `{"d":[{"k":"status","d":{"view":"markdown","content":"up"}}],"t":60}`
+	up, err := upgradePatch([]byte(withTTL), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(up) != withTTL {
+		t.Fatalf("upgrade: want the patch as is, got %s", up)
+	}
+	down, err := downgradeMsg([]byte(withTTL), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"d":[{"k":"status","d":{"view":"markdown","content":"up"}}]}`; string(down) != want {
+		t.Fatalf("downgrade: want %s, got %s", want, down)
+	}
+	if same, _ := downgradeMsg([]byte(withTTL), grammarVersion); string(same) != withTTL {
+		t.Fatalf("current version: want the message as is, got %s", same)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CardWriter identifies who last modified a card, and when.
+type CardWriter struct {
+	By  string    `json:"by,omitempty"` // access key ID or username; empty for changes made by the server itself
+	Via string    `json:"via"`          // http, stream, socket, approval or system
+	At  time.Time `json:"at"`
+}
+
+type writerKey struct{}
+
+// withWriter returns a copy of ctx identifying the publisher of the changes made under it.
+func withWriter(ctx context.Context, by, via string) context.Context {
+	return context.WithValue(ctx, writerKey{}, CardWriter{By: by, Via: via})
+}
+
+// writerFrom returns the publisher identified by ctx, or the server itself.
+func writerFrom(ctx context.Context) CardWriter {
+	if w, ok := ctx.Value(writerKey{}).(CardWriter); ok {
+		return w
+	}
+	return CardWriter{Via: "system"}
+}
+
+// attribute records w as the last writer of the cards changed by ops on the page at url.
+// Attribution is not recorded in the AOF: it is spilled along with evicted pages, but does not survive restarts.
+func (site *Site) attribute(url string, ops OpsD, w CardWriter) {
+	p := site.resident(url)
+	if p == nil {
+		return
+	}
+	w.At = clock.Now()
+	p.Lock()
+	defer p.Unlock()
+	for _, op := range ops.D {
+		if len(op.K) == 0 { // drop page
+			p.writers = nil
+			continue
+		}
+		ks := strings.SplitN(op.K, keySeparator, 2)
+		if _, ok := p.cards[ks[0]]; !ok { // card deleted
+			delete(p.writers, ks[0])
+			continue
+		}
+		if p.writers == nil {
+			p.writers = make(map[string]CardWriter)
+		}
+		p.writers[ks[0]] = w
+	}
+}
+
+// CardInfo represents a card's metadata.
+type CardInfo struct {
+	Name   string      `json:"name"`
+	Writer *CardWriter `json:"writer,omitempty"` // unknown if the card was last changed before the server started
+}
+
+// CardList represents the cards on a page.
+type CardList struct {
+	URL   string     `json:"url"`
+	Cards []CardInfo `json:"cards"`
+}
+
+// CardListHandler lists the cards on a page, along with who last modified each card: GET /_api/cards?url=/foo.
+// Callers see only the cards they are allowed to read.
+type CardListHandler struct {
+	site *Site
+	auth *Auth
+}
+
+func newCardListHandler(site *Site, auth *Auth) *CardListHandler {
+	return &CardListHandler{site, auth}
+}
+
+func (h *CardListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	viewer, ok := h.auth.identify(r)
+	if !ok {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if !viewer.trusted && !h.site.acl.allows(url, viewer.username, viewer.roles) {
+		stats.authFailed()
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	page := h.site.at(url)
+	if page == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	var hidden map[string]bool
+	if !viewer.trusted {
+		hidden = page.hidden(viewer.roles)
+	}
+
+	list := CardList{URL: url, Cards: []CardInfo{}}
+	page.RLock()
+	for name := range page.cards {
+		if hidden[name] {
+			continue
+		}
+		info := CardInfo{Name: name}
+		if w, ok := page.writers[name]; ok {
+			info.Writer = &w
+		}
+		list.Cards = append(list.Cards, info)
+	}
+	page.RUnlock()
+	sort.Slice(list.Cards, func(i, j int) bool { return list.Cards[i].Name < list.Cards[j].Name })
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(list)
+}